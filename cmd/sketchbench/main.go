@@ -0,0 +1,227 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+// Command sketchbench helps choosing a sketch configuration for a given
+// workload. It adds the values of the provided data files to sketches that use
+// various combinations of index mappings and stores, and reports, for each of
+// them, the insertion time, the memory size, the encoded size and the maximum
+// relative error on a set of quantiles.
+//
+// Data files hold one value per line; blank lines and lines starting with '#'
+// are ignored. Values of all files are added to the same sketches.
+//
+// Usage:
+//
+//	sketchbench [-accuracy 0.01] [-maxbins 2048] [-quantiles 0.5,0.9,0.99] file...
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DataDog/sketches-go/dataset"
+	"github.com/DataDog/sketches-go/ddsketch"
+	"github.com/DataDog/sketches-go/ddsketch/mapping"
+	"github.com/DataDog/sketches-go/ddsketch/store"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "sketchbench:", err)
+		os.Exit(1)
+	}
+}
+
+type namedMapping struct {
+	name       string
+	newMapping func(relativeAccuracy float64) (mapping.IndexMapping, error)
+}
+
+type namedStore struct {
+	name     string
+	newStore func(maxNumBins int) store.Store
+}
+
+var (
+	mappings = []namedMapping{
+		{"logarithmic", func(relativeAccuracy float64) (mapping.IndexMapping, error) {
+			return mapping.NewLogarithmicMapping(relativeAccuracy)
+		}},
+		{"linearly_interpolated", func(relativeAccuracy float64) (mapping.IndexMapping, error) {
+			return mapping.NewLinearlyInterpolatedMapping(relativeAccuracy)
+		}},
+		{"cubically_interpolated", func(relativeAccuracy float64) (mapping.IndexMapping, error) {
+			return mapping.NewCubicallyInterpolatedMapping(relativeAccuracy)
+		}},
+		{"lookup_table", func(relativeAccuracy float64) (mapping.IndexMapping, error) {
+			return mapping.NewLookupTableMapping(relativeAccuracy)
+		}},
+		{"bit_shift", func(relativeAccuracy float64) (mapping.IndexMapping, error) {
+			return mapping.NewBitShiftMapping(relativeAccuracy)
+		}},
+	}
+	stores = []namedStore{
+		{"dense", func(int) store.Store { return store.NewDenseStore() }},
+		{"sparse", func(int) store.Store { return store.NewSparseStore() }},
+		{"buffered_paginated", func(int) store.Store { return store.NewBufferedPaginatedStore() }},
+		{"unbuffered_paginated", func(int) store.Store { return store.NewUnbufferedPaginatedStore() }},
+		{"integer_dense", func(int) store.Store { return store.NewIntegerDenseStore() }},
+		{"dense_f32", func(int) store.Store { return store.NewDenseStoreF32() }},
+		{"adaptive", func(int) store.Store { return store.NewAdaptiveStore() }},
+		{"collapsing_lowest", func(maxNumBins int) store.Store { return store.NewCollapsingLowestDenseStore(maxNumBins) }},
+		{"collapsing_highest", func(maxNumBins int) store.Store { return store.NewCollapsingHighestDenseStore(maxNumBins) }},
+	}
+)
+
+// result holds the measurements of a sketch configuration.
+type result struct {
+	mapping          string
+	store            string
+	addDuration      time.Duration // per value
+	memorySize       int
+	encodedSize      int
+	maxRelativeError float64
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("sketchbench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	relativeAccuracy := flags.Float64("accuracy", 0.01, "relative accuracy of the index mappings")
+	maxNumBins := flags.Int("maxbins", 2048, "maximum number of bins of the collapsing stores")
+	quantilesFlag := flags.String("quantiles", "0,0.5,0.75,0.9,0.95,0.99,0.999,1", "comma-separated quantiles used to measure the relative error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no data file provided")
+	}
+	quantiles, err := parseQuantiles(*quantilesFlag)
+	if err != nil {
+		return err
+	}
+	data := dataset.NewDataset()
+	for _, path := range flags.Args() {
+		if err := readValues(path, data); err != nil {
+			return err
+		}
+	}
+	if data.Count == 0 {
+		return errors.New("no value found in the data files")
+	}
+
+	results, err := benchmark(data, *relativeAccuracy, *maxNumBins, quantiles)
+	if err != nil {
+		return err
+	}
+	return printResults(stdout, results)
+}
+
+func parseQuantiles(s string) ([]float64, error) {
+	var quantiles []float64
+	for _, field := range strings.Split(s, ",") {
+		q, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || q < 0 || q > 1 {
+			return nil, fmt.Errorf("invalid quantile: %q", field)
+		}
+		quantiles = append(quantiles, q)
+	}
+	return quantiles, nil
+}
+
+// readValues adds to data the values of the file at the provided path.
+func readValues(path string, data *dataset.Dataset) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		value, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid value: %q", path, lineNumber, line)
+		}
+		data.Add(value)
+	}
+	return scanner.Err()
+}
+
+// benchmark measures every combination of index mappings and stores on the
+// values of data.
+func benchmark(data *dataset.Dataset, relativeAccuracy float64, maxNumBins int, quantiles []float64) ([]result, error) {
+	var results []result
+	for _, m := range mappings {
+		indexMapping, err := m.newMapping(relativeAccuracy)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stores {
+			sketch := ddsketch.NewDDSketch(indexMapping, s.newStore(maxNumBins), s.newStore(maxNumBins))
+			start := time.Now()
+			if err := sketch.AddValues(data.Values); err != nil {
+				return nil, fmt.Errorf("%s/%s: %v", m.name, s.name, err)
+			}
+			addDuration := time.Since(start) / time.Duration(len(data.Values))
+			var encoded []byte
+			sketch.Encode(&encoded, false)
+			maxRelativeError, err := maxRelativeError(sketch, data, quantiles)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, result{
+				mapping:          m.name,
+				store:            s.name,
+				addDuration:      addDuration,
+				memorySize:       sketch.MemorySize(),
+				encodedSize:      len(encoded),
+				maxRelativeError: maxRelativeError,
+			})
+		}
+	}
+	return results, nil
+}
+
+// maxRelativeError returns the maximum, over the provided quantiles, of the
+// relative distance between the quantile that the sketch estimates and the
+// range of the values of data that are exact quantiles.
+func maxRelativeError(sketch *ddsketch.DDSketch, data *dataset.Dataset, quantiles []float64) (float64, error) {
+	maxError := float64(0)
+	for _, q := range quantiles {
+		value, err := sketch.GetValueAtQuantile(q)
+		if err != nil {
+			return math.NaN(), err
+		}
+		lower, upper := data.LowerQuantile(q), data.UpperQuantile(q)
+		if value < lower {
+			maxError = math.Max(maxError, (lower-value)/math.Abs(lower))
+		} else if value > upper {
+			maxError = math.Max(maxError, (value-upper)/math.Abs(upper))
+		}
+	}
+	return maxError, nil
+}
+
+func printResults(w io.Writer, results []result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "mapping\tstore\tadd (ns/value)\tmemory (B)\tencoded (B)\tmax rel. error\t")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%.4g\t\n", r.mapping, r.store, r.addDuration.Nanoseconds(), r.memorySize, r.encodedSize, r.maxRelativeError)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,63 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/sketches-go/dataset"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("# latencies\n1\n2.5\n\n-3\n1e3\n0\n"), 0o600))
+	var stdout, stderr bytes.Buffer
+	assert.NoError(t, run([]string{"-accuracy", "0.02", path}, &stdout, &stderr))
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	assert.Len(t, lines, 1+len(mappings)*len(stores))
+	assert.Contains(t, lines[1], "logarithmic")
+	assert.Contains(t, lines[1], "dense")
+}
+
+func TestRunErrors(t *testing.T) {
+	dir := t.TempDir()
+	invalid := filepath.Join(dir, "invalid.txt")
+	assert.NoError(t, os.WriteFile(invalid, []byte("1\nfoo\n"), 0o600))
+	empty := filepath.Join(dir, "empty.txt")
+	assert.NoError(t, os.WriteFile(empty, nil, 0o600))
+	valid := filepath.Join(dir, "valid.txt")
+	assert.NoError(t, os.WriteFile(valid, []byte("1\n"), 0o600))
+	for _, args := range [][]string{
+		{},
+		{invalid},
+		{empty},
+		{filepath.Join(dir, "missing.txt")},
+		{"-quantiles", "0.5,2", valid},
+		{"-accuracy", "0", valid},
+	} {
+		var stdout, stderr bytes.Buffer
+		assert.Error(t, run(args, &stdout, &stderr), args)
+	}
+}
+
+func TestMaxRelativeError(t *testing.T) {
+	data := dataset.NewDataset()
+	for i := 1; i <= 1000; i++ {
+		data.Add(float64(i))
+	}
+	results, err := benchmark(data, 0.01, 2048, []float64{0, 0.5, 0.99, 1})
+	assert.NoError(t, err)
+	for _, r := range results {
+		assert.LessOrEqual(t, r.maxRelativeError, 0.01+1e-9, r.mapping+"/"+r.store)
+		assert.Greater(t, r.memorySize, 0)
+		assert.Greater(t, r.encodedSize, 0)
+	}
+}
@@ -0,0 +1,96 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+// Package aggregator decodes and merges encoded sketches concurrently, which is
+// the fan-in topology of backends that aggregate the sketches that many
+// clients send.
+package aggregator
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/DataDog/sketches-go/ddsketch"
+)
+
+// Aggregate decodes the encoded sketches that it receives from payloads and
+// merges them into target, until payloads is closed. Payloads are decoded by
+// numWorkers goroutines, each merging them into its own partial sketch, and
+// the partial sketches are merged into target once payloads is closed, so that
+// target is not accessed concurrently. Partial sketches use the same index
+// mapping and the same types of stores as target. Payloads that omit the index
+// mapping are assumed to use the one of target.
+// Payloads that cannot be decoded or that use an index mapping that differs
+// from the one of target are skipped and the other payloads are still merged,
+// so that senders are never blocked. In that case, a non-nil error that wraps
+// the first decoding error is returned.
+func Aggregate(target *ddsketch.DDSketch, payloads <-chan []byte, numWorkers int) error {
+	if numWorkers <= 0 {
+		return errors.New("the number of workers must be positive")
+	}
+	workers := make([]*worker, numWorkers)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = newWorker(target)
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			w.run(target, payloads)
+		}(workers[i])
+	}
+	wg.Wait()
+
+	numFailed := 0
+	var firstErr error
+	for _, w := range workers {
+		if err := target.MergeWith(w.partial); err != nil {
+			return err
+		}
+		numFailed += w.numFailed
+		if firstErr == nil {
+			firstErr = w.firstErr
+		}
+	}
+	if numFailed > 0 {
+		return fmt.Errorf("%d payloads could not be aggregated: %w", numFailed, firstErr)
+	}
+	return nil
+}
+
+// worker merges the payloads that it decodes into its partial sketch.
+type worker struct {
+	partial   *ddsketch.DDSketch
+	decoded   *ddsketch.DDSketch
+	numFailed int
+	firstErr  error
+}
+
+func newWorker(target *ddsketch.DDSketch) *worker {
+	partial := target.Copy()
+	partial.Clear()
+	return &worker{
+		partial: partial,
+		decoded: partial.Copy(),
+	}
+}
+
+func (w *worker) run(target *ddsketch.DDSketch, payloads <-chan []byte) {
+	for payload := range payloads {
+		// Payloads are decoded separately so that those that cannot be
+		// decoded do not leave partially merged content.
+		w.decoded.IndexMapping = target.IndexMapping
+		err := w.decoded.DecodeInto(payload)
+		if err == nil {
+			err = w.partial.MergeWith(w.decoded)
+		}
+		if err != nil {
+			w.numFailed++
+			if w.firstErr == nil {
+				w.firstErr = err
+			}
+		}
+	}
+}
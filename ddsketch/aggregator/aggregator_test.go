@@ -0,0 +1,65 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package aggregator
+
+import (
+	"testing"
+
+	"github.com/DataDog/sketches-go/dataset"
+	"github.com/DataDog/sketches-go/ddsketch"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregate(t *testing.T) {
+	target, _ := ddsketch.NewDefaultDDSketch(0.01)
+	assert.Nil(t, target.Add(1))
+	expected := target.Copy()
+
+	generator := dataset.NewNormal(0, 10)
+	var payloads [][]byte
+	for i := 0; i < 100; i++ {
+		sketch, _ := ddsketch.NewDefaultDDSketch(0.01)
+		for j := 0; j < 100; j++ {
+			assert.Nil(t, sketch.Add(generator.Generate()))
+		}
+		assert.Nil(t, expected.MergeWith(sketch))
+		var b []byte
+		sketch.Encode(&b, i%2 == 0)
+		payloads = append(payloads, b)
+	}
+
+	ch := make(chan []byte)
+	go func() {
+		for _, payload := range payloads {
+			ch <- payload
+		}
+		close(ch)
+	}()
+	assert.Nil(t, Aggregate(target, ch, 4))
+	assert.True(t, expected.ApproxEquals(target, 1e-9))
+}
+
+func TestAggregateInvalidPayloads(t *testing.T) {
+	target, _ := ddsketch.NewDefaultDDSketch(0.01)
+	valid, _ := ddsketch.NewDefaultDDSketch(0.01)
+	assert.Nil(t, valid.Add(1))
+	otherMapping, _ := ddsketch.NewDefaultDDSketch(0.02)
+	assert.Nil(t, otherMapping.Add(1))
+	var b, bOtherMapping []byte
+	valid.Encode(&b, false)
+	otherMapping.Encode(&bOtherMapping, false)
+
+	ch := make(chan []byte, 4)
+	ch <- b
+	ch <- b[:len(b)-1]
+	ch <- bOtherMapping
+	ch <- b
+	close(ch)
+	assert.NotNil(t, Aggregate(target, ch, 2))
+	assert.Equal(t, float64(2), target.GetCount())
+
+	assert.NotNil(t, Aggregate(target, ch, 0))
+}
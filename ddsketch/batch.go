@@ -0,0 +1,162 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"errors"
+	"io"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/mapping"
+	"github.com/DataDog/sketches-go/ddsketch/store"
+)
+
+// A batch is a sequence of sketches that are serialized with the custom
+// encoding (see Encode) into a single payload, which is laid out as follows:
+//   - a byte that is 1 if all the sketches share the same index mapping and 0
+//     otherwise,
+//   - if the index mapping is shared, its encoding, once only,
+//   - the number of sketches, as a varuint,
+//   - for each sketch, the length of its encoding, as a varuint, followed by
+//     its encoding, which omits the index mapping if it is shared.
+// The length prefixes allow skipping sketches without decoding them.
+
+const (
+	batchIndependentIndexMappings byte = 0
+	batchSharedIndexMapping       byte = 1
+)
+
+var errInvalidBatch = errors.New("invalid batch")
+
+// EncodeBatch serializes sketches into a single payload that can be decoded
+// with DecodeBatch or NewBatchDecoder.
+func EncodeBatch(sketches []*DDSketch) []byte {
+	sharedIndexMapping := len(sketches) > 0
+	for _, sketch := range sketches {
+		if !sketch.IndexMapping.Equals(sketches[0].IndexMapping) {
+			sharedIndexMapping = false
+			break
+		}
+	}
+
+	var b []byte
+	if sharedIndexMapping {
+		b = append(b, batchSharedIndexMapping)
+		sketches[0].IndexMapping.Encode(&b)
+	} else {
+		b = append(b, batchIndependentIndexMappings)
+	}
+	enc.EncodeUvarint64(&b, uint64(len(sketches)))
+	var encoded []byte
+	for _, sketch := range sketches {
+		encoded = encoded[:0]
+		sketch.Encode(&encoded, sharedIndexMapping)
+		enc.EncodeUvarint64(&b, uint64(len(encoded)))
+		b = append(b, encoded...)
+	}
+	return b
+}
+
+// DecodeBatch deserializes all the sketches of a payload that has been encoded
+// with EncodeBatch. Stores are built using storeProvider.
+func DecodeBatch(b []byte, storeProvider store.Provider) ([]*DDSketch, error) {
+	decoder, err := NewBatchDecoder(b)
+	if err != nil {
+		return nil, err
+	}
+	sketches := make([]*DDSketch, 0, decoder.Remaining())
+	for decoder.Remaining() > 0 {
+		sketch, err := decoder.Next(storeProvider)
+		if err != nil {
+			return nil, err
+		}
+		sketches = append(sketches, sketch)
+	}
+	return sketches, nil
+}
+
+// BatchDecoder sequentially decodes or skips the sketches of a payload that
+// has been encoded with EncodeBatch.
+type BatchDecoder struct {
+	b            []byte
+	indexMapping mapping.IndexMapping
+	remaining    int
+}
+
+// NewBatchDecoder decodes the header of the payload and returns a decoder that
+// is positioned on its first sketch.
+func NewBatchDecoder(b []byte) (*BatchDecoder, error) {
+	if len(b) == 0 {
+		return nil, io.EOF
+	}
+	d := &BatchDecoder{b: b[1:]}
+	switch b[0] {
+	case batchIndependentIndexMappings:
+	case batchSharedIndexMapping:
+		flag, err := enc.DecodeFlag(&d.b)
+		if err != nil {
+			return nil, err
+		}
+		if flag.Type() != enc.FlagTypeIndexMapping {
+			return nil, errInvalidBatch
+		}
+		if d.indexMapping, err = mapping.Decode(&d.b, flag); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errInvalidBatch
+	}
+	numSketches, err := enc.DecodeUvarint64(&d.b)
+	if err != nil {
+		return nil, err
+	}
+	// Every sketch is prefixed with its length, which takes at least one byte.
+	if numSketches > uint64(len(d.b)) {
+		return nil, errInvalidBatch
+	}
+	d.remaining = int(numSketches)
+	return d, nil
+}
+
+// Remaining returns the number of sketches that are left to be decoded or
+// skipped.
+func (d *BatchDecoder) Remaining() int {
+	return d.remaining
+}
+
+// Next decodes the next sketch of the payload. Stores are built using
+// storeProvider.
+func (d *BatchDecoder) Next(storeProvider store.Provider) (*DDSketch, error) {
+	encoded, err := d.next()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeDDSketch(encoded, storeProvider, d.indexMapping)
+}
+
+// Skip moves to the next sketch of the payload without decoding the current
+// one.
+func (d *BatchDecoder) Skip() error {
+	_, err := d.next()
+	return err
+}
+
+func (d *BatchDecoder) next() ([]byte, error) {
+	if d.remaining == 0 {
+		return nil, io.EOF
+	}
+	length, err := enc.DecodeUvarint64(&d.b)
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(d.b)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	encoded := d.b[:length]
+	d.b = d.b[length:]
+	d.remaining--
+	return encoded, nil
+}
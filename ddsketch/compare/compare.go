@@ -0,0 +1,107 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+// Package compare provides measures of the distance between the distributions
+// that sketches encode, for instance, to detect regressions between the
+// latencies of a canary and those of a baseline.
+package compare
+
+import (
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/DataDog/sketches-go/ddsketch"
+	"github.com/DataDog/sketches-go/ddsketch/store"
+)
+
+var errEmptySketch = errors.New("no such element exists")
+
+// KolmogorovSmirnov returns the Kolmogorov-Smirnov statistic of the
+// distributions that the sketches encode, that is, the maximum absolute
+// difference between their cumulative distribution functions. It is between 0
+// and 1. Return a non-nil error if either sketch is empty.
+func KolmogorovSmirnov(s1, s2 *ddsketch.DDSketch) (float64, error) {
+	distance := float64(0)
+	err := forEachStep(s1, s2, func(value, nextValue, cdf1, cdf2 float64) {
+		distance = math.Max(distance, math.Abs(cdf1-cdf2))
+	})
+	return distance, err
+}
+
+// Wasserstein returns the first Wasserstein distance, also known as the earth
+// mover's distance, between the distributions that the sketches encode, that
+// is, the integral of the absolute difference between their cumulative
+// distribution functions. It is in the unit of the values that have been added
+// to the sketches. Return a non-nil error if either sketch is empty.
+func Wasserstein(s1, s2 *ddsketch.DDSketch) (float64, error) {
+	distance := float64(0)
+	err := forEachStep(s1, s2, func(value, nextValue, cdf1, cdf2 float64) {
+		distance += math.Abs(cdf1-cdf2) * (nextValue - value)
+	})
+	return distance, err
+}
+
+type bin struct {
+	value float64
+	count float64
+}
+
+// forEachStep aligns the bins of both sketches and calls f with the cumulative
+// distribution functions of the sketches at every value of the aligned bins,
+// by increasing order, as well as the following value (or the same value for
+// the last bin). If the sketches do not use the same index mapping, the bins
+// of s2 are converted to the index mapping of s1.
+func forEachStep(s1, s2 *ddsketch.DDSketch, f func(value, nextValue, cdf1, cdf2 float64)) error {
+	if s1.IsEmpty() || s2.IsEmpty() {
+		return errEmptySketch
+	}
+	if !s1.IndexMapping.Equals(s2.IndexMapping) {
+		s2 = s2.ChangeMapping(s1.IndexMapping, store.NewDenseStore(), store.NewDenseStore(), 1)
+	}
+	bins1, count1 := sortedBins(s1)
+	bins2, count2 := sortedBins(s2)
+
+	var i1, i2 int
+	var cumulativeCount1, cumulativeCount2 float64
+	for i1 < len(bins1) || i2 < len(bins2) {
+		value := math.Inf(1)
+		if i1 < len(bins1) {
+			value = bins1[i1].value
+		}
+		if i2 < len(bins2) {
+			value = math.Min(value, bins2[i2].value)
+		}
+		if i1 < len(bins1) && bins1[i1].value == value {
+			cumulativeCount1 += bins1[i1].count
+			i1++
+		}
+		if i2 < len(bins2) && bins2[i2].value == value {
+			cumulativeCount2 += bins2[i2].count
+			i2++
+		}
+		nextValue := value
+		if i1 < len(bins1) {
+			nextValue = bins1[i1].value
+		}
+		if i2 < len(bins2) && (i1 >= len(bins1) || bins2[i2].value < nextValue) {
+			nextValue = bins2[i2].value
+		}
+		f(value, nextValue, cumulativeCount1/count1, cumulativeCount2/count2)
+	}
+	return nil
+}
+
+func sortedBins(s *ddsketch.DDSketch) ([]bin, float64) {
+	var bins []bin
+	count := float64(0)
+	s.ForEach(func(value, c float64) (stop bool) {
+		bins = append(bins, bin{value: value, count: c})
+		count += c
+		return false
+	})
+	sort.Slice(bins, func(i, j int) bool { return bins[i].value < bins[j].value })
+	return bins, count
+}
@@ -0,0 +1,97 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package compare
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/DataDog/sketches-go/ddsketch"
+	"github.com/stretchr/testify/assert"
+)
+
+const relativeAccuracy = 0.01
+
+func newSketch(t *testing.T, relativeAccuracy float64, values ...float64) *ddsketch.DDSketch {
+	sketch, err := ddsketch.NewDefaultDDSketch(relativeAccuracy)
+	assert.NoError(t, err)
+	assert.NoError(t, sketch.AddValues(values))
+	return sketch
+}
+
+func normal(random *rand.Rand, n int, mean, stddev float64) []float64 {
+	values := make([]float64, n)
+	for i := range values {
+		values[i] = random.NormFloat64()*stddev + mean
+	}
+	return values
+}
+
+func TestEmpty(t *testing.T) {
+	empty := newSketch(t, relativeAccuracy)
+	nonEmpty := newSketch(t, relativeAccuracy, 1)
+	for _, sketches := range [][2]*ddsketch.DDSketch{{empty, empty}, {empty, nonEmpty}, {nonEmpty, empty}} {
+		_, err := KolmogorovSmirnov(sketches[0], sketches[1])
+		assert.Error(t, err)
+		_, err = Wasserstein(sketches[0], sketches[1])
+		assert.Error(t, err)
+	}
+}
+
+func TestIdentical(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+	sketch := newSketch(t, relativeAccuracy, normal(random, 10000, 0, 10)...)
+	ks, err := KolmogorovSmirnov(sketch, sketch.Copy())
+	assert.NoError(t, err)
+	assert.Zero(t, ks)
+	w, err := Wasserstein(sketch, sketch.Copy())
+	assert.NoError(t, err)
+	assert.Zero(t, w)
+}
+
+func TestConstants(t *testing.T) {
+	s1 := newSketch(t, relativeAccuracy, 10, 10)
+	s2 := newSketch(t, relativeAccuracy, 20)
+	ks, err := KolmogorovSmirnov(s1, s2)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), ks)
+	w, err := Wasserstein(s1, s2)
+	assert.NoError(t, err)
+	assert.InEpsilon(t, 10, w, 3*relativeAccuracy)
+
+	s2 = newSketch(t, relativeAccuracy, 10, 20)
+	ks, err = KolmogorovSmirnov(s1, s2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, ks)
+	w, err = Wasserstein(s2, s1)
+	assert.NoError(t, err)
+	assert.InEpsilon(t, 5, w, 3*relativeAccuracy)
+}
+
+func TestShiftedNormal(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+	s1 := newSketch(t, relativeAccuracy, normal(random, 100000, 50, 10)...)
+	s2 := newSketch(t, relativeAccuracy, normal(random, 100000, 55, 10)...)
+	ks, err := KolmogorovSmirnov(s1, s2)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.197, ks, 0.02)
+	w, err := Wasserstein(s1, s2)
+	assert.NoError(t, err)
+	assert.InDelta(t, 5, w, 0.5)
+}
+
+func TestDifferentMappings(t *testing.T) {
+	random := rand.New(rand.NewSource(42))
+	values := normal(random, 10000, 50, 10)
+	s1 := newSketch(t, relativeAccuracy, values...)
+	s2 := newSketch(t, 0.02, values...)
+	ks, err := KolmogorovSmirnov(s1, s2)
+	assert.NoError(t, err)
+	assert.Less(t, ks, 0.05)
+	w, err := Wasserstein(s1, s2)
+	assert.NoError(t, err)
+	assert.Less(t, w, 0.5)
+}
@@ -7,14 +7,23 @@ package ddsketch
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"unsafe"
 
 	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/internal/emptystore"
 	"github.com/DataDog/sketches-go/ddsketch/mapping"
 	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
 	"github.com/DataDog/sketches-go/ddsketch/stat"
 	"github.com/DataDog/sketches-go/ddsketch/store"
+	"google.golang.org/protobuf/proto"
 )
 
 var (
@@ -24,31 +33,77 @@ var (
 	ErrNegativeCount      = errors.New("count cannot be negative")
 	errEmptySketch        = errors.New("no such element exists")
 	errUnknownFlag        = errors.New("unknown encoding flag")
+	errDecreasedCount     = errors.New("bin counts cannot decrease since the checkpoint")
+	errIndexOutOfRange    = errors.New("bin index out of the range of the index mapping")
+
+	// ErrUnsupportedVersion is returned when decoding a payload whose encoding
+	// format version is more recent than the ones that this package supports.
+	ErrUnsupportedVersion = errors.New("unsupported encoding version")
 )
 
-// Unexported to prevent usage and avoid the cost of dynamic dispatch
-type quantileSketch interface {
+// QuantileSketch is the interface that is common to the sketches of this
+// package, DDSketch and DDSketchWithExactSummaryStatistics. It allows writing
+// code that does not depend on the type of sketch. When the type is known,
+// calling the methods of the concrete type directly avoids the cost of dynamic
+// dispatch.
+type QuantileSketch interface {
 	RelativeAccuracy() float64
 	IsEmpty() bool
 	GetCount() float64
+	GetValueAtQuantile(quantile float64) (float64, error)
+	GetValuesAtQuantiles(quantiles []float64) ([]float64, error)
+	Add(value float64) error
+	AddWithCount(value, count float64) error
+	// MergeWithSketch merges the content of the other sketch in this sketch.
+	// It returns an error if the sketches cannot be merged, for instance, if
+	// they do not use the same index mapping.
+	MergeWithSketch(other QuantileSketch) error
+	Clear()
+	Encode(b *[]byte, omitIndexMapping bool)
+	DecodeAndMergeWith(b []byte) error
+}
+
+var _ QuantileSketch = (*DDSketch)(nil)
+var _ QuantileSketch = (*DDSketchWithExactSummaryStatistics)(nil)
+
+// Unexported to prevent usage and avoid the cost of dynamic dispatch
+type quantileSketch interface {
+	QuantileSketch
 	GetZeroCount() float64
 	GetSum() float64
 	GetPositiveValueStore() store.Store
 	GetNegativeValueStore() store.Store
 	GetMinValue() (float64, error)
 	GetMaxValue() (float64, error)
-	GetValueAtQuantile(quantile float64) (float64, error)
-	GetValuesAtQuantiles(quantiles []float64) ([]float64, error)
+	GetMode() (float64, error)
+	MemorySize() int
+	ClearRetainingCapacity()
+	GetValueAtQuantileWithBounds(quantile float64) (value, lower, upper float64, err error)
+	GetValuesAtQuantilesWithBounds(quantiles []float64) (values, lowers, uppers []float64, err error)
+	GetRankOfValue(value float64) (float64, error)
+	GetCountBetween(lower, upper float64) float64
+	GetCountAtValue(value float64) float64
+	GetTrimmedMean(lowerQuantile, upperQuantile float64) (float64, error)
+	ToHistogram(boundaries []float64) []float64
+	ToCentroids() []Centroid
 	ForEach(f func(value, count float64) (stop bool))
-	Add(value float64) error
-	AddWithCount(value, count float64) error
+	AddValues(values []float64) error
+	AddWithCounts(values, counts []float64) error
+	RemoveWithCount(value, count float64) error
+	AddHDRBuckets(buckets []HDRBucket) error
+	AddCentroids(centroids []Centroid) error
+	Sample(n int, r *rand.Rand) []float64
+	EncodeTo(w io.Writer, omitIndexMapping bool) error
+	EncodeWithVersion(b *[]byte, omitIndexMapping bool)
+	EncodeWithType(b *[]byte)
+	MarshalProto() ([]byte, error)
+	UnmarshalProto(data []byte) error
 	// MergeWith
 	// ChangeMapping
 	Reweight(factor float64) error
-	Clear()
+	Rescale(factor float64) error
 	// Copy
-	Encode(b *[]byte, omitIndexMapping bool)
-	DecodeAndMergeWith(b []byte) error
+	// CopyTo
 }
 
 var _ quantileSketch = (*DDSketch)(nil)
@@ -59,12 +114,52 @@ type DDSketch struct {
 	positiveValueStore store.Store
 	negativeValueStore store.Store
 	zeroCount          float64
+	maxNumBins         int
+
+	quantileInterpolation QuantileInterpolation
+	clampOutOfRange       bool
+	clampedCount          float64
+
+	// smallIntIndexes is lazily set by AddInt.
+	smallIntIndexes smallIntIndexes
 }
 
+// QuantileInterpolation defines how the value at a quantile is derived from the
+// bin that the quantile falls in (see SetQuantileInterpolation).
+type QuantileInterpolation int
+
+const (
+	// QuantileInterpolationMidpoint returns the value that the index mapping
+	// maps the bin to, which is the one that minimizes the relative error. It
+	// is the geometric midpoint of the bin with the logarithmic mapping. This
+	// is the default.
+	QuantileInterpolationMidpoint QuantileInterpolation = iota
+	// QuantileInterpolationLowerBound returns the lowest value that the bin
+	// may hold.
+	QuantileInterpolationLowerBound
+	// QuantileInterpolationUpperBound returns the highest value that the bin
+	// may hold.
+	QuantileInterpolationUpperBound
+	// QuantileInterpolationLinear linearly interpolates between the values
+	// of the bins of the two ranks that surround the rank of the quantile, so
+	// that the values at quantiles vary continuously when quantiles fall
+	// between neighboring bins.
+	QuantileInterpolationLinear
+)
+
 func NewDDSketchFromStoreProvider(indexMapping mapping.IndexMapping, storeProvider store.Provider) *DDSketch {
 	return NewDDSketch(indexMapping, storeProvider(), storeProvider())
 }
 
+// NewDDSketchWithPool returns a sketch whose stores allocate their pages from
+// pool (see store.PoolProvider). High-cardinality aggregators can build all
+// the sketches of an aggregation window with the same store.ArenaPool and
+// release their pages all at once by resetting the pool at the end of the
+// window, instead of leaving them to the garbage collector.
+func NewDDSketchWithPool(indexMapping mapping.IndexMapping, pool store.PagePool) *DDSketch {
+	return NewDDSketchFromStoreProvider(indexMapping, store.PoolProvider(pool))
+}
+
 func NewDDSketch(indexMapping mapping.IndexMapping, positiveValueStore store.Store, negativeValueStore store.Store) *DDSketch {
 	return &DDSketch{
 		IndexMapping:       indexMapping,
@@ -103,6 +198,19 @@ func LogCollapsingLowestDenseDDSketch(relativeAccuracy float64, maxNumBins int)
 	return NewDDSketch(indexMapping, store.NewCollapsingLowestDenseStore(maxNumBins), store.NewCollapsingLowestDenseStore(maxNumBins)), nil
 }
 
+// Constructs an instance of DDSketch that offers constant-time insertion and whose size grows until the
+// maximum number of bins is reached, at which point bins with lowest indices are collapsed. Unlike with
+// LogCollapsingLowestDenseDDSketch, the maximum number of bins applies to the positive and negative value
+// stores combined (see SetMaxNumBins), which avoids wasting memory space when values are mostly of one sign.
+func LogCollapsingLowestDenseDDSketchWithGlobalMaxNumBins(relativeAccuracy float64, maxNumBins int) (*DDSketch, error) {
+	sketch, err := LogUnboundedDenseDDSketch(relativeAccuracy)
+	if err != nil {
+		return nil, err
+	}
+	sketch.SetMaxNumBins(maxNumBins)
+	return sketch, nil
+}
+
 // Constructs an instance of DDSketch that offers constant-time insertion and whose size grows until the
 // maximum number of bins is reached, at which point bins with highest indices are collapsed, which causes the
 // relative accuracy guarantee to be lost on highest quantiles if values are all positive, or the lowest and
@@ -115,6 +223,17 @@ func LogCollapsingHighestDenseDDSketch(relativeAccuracy float64, maxNumBins int)
 	return NewDDSketch(indexMapping, store.NewCollapsingHighestDenseStore(maxNumBins), store.NewCollapsingHighestDenseStore(maxNumBins)), nil
 }
 
+// Constructs an instance of DDSketch whose stores are BufferedPaginatedStores, which grow indefinitely
+// to accommodate for the range of input values but are memory-efficient when values are sparse or
+// when few values have been added.
+func LogBufferedPaginatedDDSketch(relativeAccuracy float64) (*DDSketch, error) {
+	indexMapping, err := mapping.NewLogarithmicMapping(relativeAccuracy)
+	if err != nil {
+		return nil, err
+	}
+	return NewDDSketchFromStoreProvider(indexMapping, store.BufferedPaginatedStoreConstructor), nil
+}
+
 // Adds a value to the sketch.
 func (s *DDSketch) Add(value float64) error {
 	return s.AddWithCount(value, float64(1))
@@ -128,18 +247,240 @@ func (s *DDSketch) AddWithCount(value, count float64) error {
 
 	if value > s.MinIndexableValue() {
 		if value > s.MaxIndexableValue() {
-			return ErrUntrackableTooHigh
+			if !s.clampOutOfRange {
+				return ErrUntrackableTooHigh
+			}
+			value = s.MaxIndexableValue()
+			s.clampedCount += count
 		}
 		s.positiveValueStore.AddWithCount(s.Index(value), count)
 	} else if value < -s.MinIndexableValue() {
 		if value < -s.MaxIndexableValue() {
-			return ErrUntrackableTooLow
+			if !s.clampOutOfRange {
+				return ErrUntrackableTooLow
+			}
+			value = -s.MaxIndexableValue()
+			s.clampedCount += count
 		}
 		s.negativeValueStore.AddWithCount(s.Index(-value), count)
 	} else if math.IsNaN(value) {
 		return ErrUntrackableNaN
 	} else {
 		s.zeroCount += count
+		return nil
+	}
+	s.enforceMaxNumBins()
+	return s.takeStoreError()
+}
+
+// numSmallInts is the number of integers, starting from 0, whose indexes are
+// cached by AddInt.
+const numSmallInts = 1024
+
+// smallIntIndexes refers to the indexes that a mapping assigns to small
+// integers.
+type smallIntIndexes struct {
+	// mapping is of a comparable type, so that comparing it with the mapping
+	// of the sketch does not panic.
+	mapping mapping.IndexMapping
+	indexes *[numSmallInts]int32
+}
+
+// smallIntIndexesKey identifies the mappings that assign the same indexes to
+// small integers.
+type smallIntIndexesKey struct {
+	mappingType reflect.Type
+	encoding    string
+}
+
+// sharedSmallIntIndexes maps smallIntIndexesKeys to the indexes that the
+// mappings assign to small integers, so that they are computed once and
+// shared by all the sketches whose mappings are equal. Its size is bounded by
+// the number of distinct mappings.
+var sharedSmallIntIndexes sync.Map
+
+// AddInt adds an integer value to the sketch. It is equivalent to Add, but it
+// is faster for the small integers (lower than 1024 in absolute value) that
+// are common when tracking latencies in microseconds or nanoseconds, as the
+// indexes of their bins are cached rather than computed.
+func (s *DDSketch) AddInt(value int64) error {
+	if value > 0 && value < numSmallInts && s.hasSmallIntIndexes() {
+		s.positiveValueStore.Add(int(s.smallIntIndexes.indexes[value]))
+	} else if value < 0 && value > -numSmallInts && s.hasSmallIntIndexes() {
+		s.negativeValueStore.Add(int(s.smallIntIndexes.indexes[-value]))
+	} else {
+		return s.AddWithCount(float64(value), 1)
+	}
+	s.enforceMaxNumBins()
+	return s.takeStoreError()
+}
+
+// hasSmallIntIndexes makes sure that the indexes of the small integers are
+// cached for the current mapping of the sketch, which can be reassigned, and
+// returns whether they can be used.
+func (s *DDSketch) hasSmallIntIndexes() bool {
+	if s.smallIntIndexes.indexes != nil && s.smallIntIndexes.mapping == s.IndexMapping {
+		return true
+	}
+	mappingType := reflect.TypeOf(s.IndexMapping)
+	if mappingType == nil || !mappingType.Comparable() {
+		return false
+	}
+	if !(1 > s.MinIndexableValue()) || !(numSmallInts <= s.MaxIndexableValue()) {
+		// Not expected with the mappings of this module.
+		return false
+	}
+	var encoding []byte
+	s.IndexMapping.Encode(&encoding)
+	key := smallIntIndexesKey{mappingType: mappingType, encoding: string(encoding)}
+	indexes, ok := sharedSmallIntIndexes.Load(key)
+	if !ok {
+		computed := new([numSmallInts]int32)
+		for i := 1; i < numSmallInts; i++ {
+			computed[i] = int32(s.Index(float64(i)))
+		}
+		indexes, _ = sharedSmallIntIndexes.LoadOrStore(key, computed)
+	}
+	s.smallIntIndexes = smallIntIndexes{mapping: s.IndexMapping, indexes: indexes.(*[numSmallInts]int32)}
+	return true
+}
+
+// RemoveWithCount subtracts count from the count of the bin that value falls
+// into, clamping it at zero. It allows retracting values that have previously
+// been added to the sketch, for instance, in sliding-window schemes. Removing
+// values that have not been added to the sketch affects the count of other
+// values of the same bin and does not allow restoring the sketch by adding
+// them back. If out-of-range values are clamped (see SetClampOutOfRange), they
+// are removed from the extreme bins, but ClampedCount is left unchanged.
+// Return a non-nil error if count is negative, NaN or infinite.
+func (s *DDSketch) RemoveWithCount(value, count float64) error {
+	if count < 0 {
+		return ErrNegativeCount
+	}
+	if math.IsNaN(count) || math.IsInf(count, 1) {
+		return store.ErrInvalidBinCount
+	}
+
+	if value > s.MinIndexableValue() {
+		if value > s.MaxIndexableValue() {
+			if !s.clampOutOfRange {
+				return ErrUntrackableTooHigh
+			}
+			value = s.MaxIndexableValue()
+		}
+		s.positiveValueStore.SubtractWithCount(s.Index(value), count)
+	} else if value < -s.MinIndexableValue() {
+		if value < -s.MaxIndexableValue() {
+			if !s.clampOutOfRange {
+				return ErrUntrackableTooLow
+			}
+			value = -s.MaxIndexableValue()
+		}
+		s.negativeValueStore.SubtractWithCount(s.Index(-value), count)
+	} else if math.IsNaN(value) {
+		return ErrUntrackableNaN
+	} else {
+		s.zeroCount = math.Max(s.zeroCount-count, 0)
+	}
+	return nil
+}
+
+// AddValues adds multiple values to the sketch. It is equivalent to calling Add
+// on each value, but it is faster as values are checked ahead of insertion. If
+// any of the values cannot be tracked, none of the values are added to the
+// sketch and a non-nil error is returned. If the stores of the sketch have a
+// memory limit (see store.NewBoundedStore), the values that would exceed it are
+// dropped and a *store.MemoryLimitError is returned.
+func (s *DDSketch) AddValues(values []float64) error {
+	if err := s.checkTrackable(values); err != nil {
+		return err
+	}
+	minIndexableValue, maxIndexableValue := s.MinIndexableValue(), s.MaxIndexableValue()
+	for _, value := range values {
+		if value > minIndexableValue {
+			if value > maxIndexableValue {
+				value = maxIndexableValue
+				s.clampedCount++
+			}
+			s.positiveValueStore.Add(s.Index(value))
+		} else if value < -minIndexableValue {
+			if value < -maxIndexableValue {
+				value = -maxIndexableValue
+				s.clampedCount++
+			}
+			s.negativeValueStore.Add(s.Index(-value))
+		} else {
+			s.zeroCount++
+		}
+	}
+	s.enforceMaxNumBins()
+	return s.takeStoreError()
+}
+
+// AddWithCounts adds multiple values to the sketch, each with the count at the
+// same position in counts. It is equivalent to calling AddWithCount on each
+// value, but it is faster as values and counts are checked ahead of insertion.
+// If any of the values cannot be tracked or any of the counts is negative, none
+// of the values are added to the sketch and a non-nil error is returned.
+// Values that would exceed the memory limit of the stores of the sketch, if
+// any, are dropped, as with AddValues.
+func (s *DDSketch) AddWithCounts(values, counts []float64) error {
+	if err := s.checkTrackableWithCounts(values, counts); err != nil {
+		return err
+	}
+	minIndexableValue, maxIndexableValue := s.MinIndexableValue(), s.MaxIndexableValue()
+	for i, value := range values {
+		count := counts[i]
+		if value > minIndexableValue {
+			if value > maxIndexableValue {
+				value = maxIndexableValue
+				s.clampedCount += count
+			}
+			s.positiveValueStore.AddWithCount(s.Index(value), count)
+		} else if value < -minIndexableValue {
+			if value < -maxIndexableValue {
+				value = -maxIndexableValue
+				s.clampedCount += count
+			}
+			s.negativeValueStore.AddWithCount(s.Index(-value), count)
+		} else {
+			s.zeroCount += count
+		}
+	}
+	s.enforceMaxNumBins()
+	return s.takeStoreError()
+}
+
+// checkTrackableWithCounts returns a non-nil error if values and counts do not
+// have the same length, if any of the counts is negative, or if any of the
+// values cannot be tracked by the sketch.
+func (s *DDSketch) checkTrackableWithCounts(values, counts []float64) error {
+	if len(values) != len(counts) {
+		return errors.New("values and counts must have the same length")
+	}
+	for _, count := range counts {
+		if count < 0 {
+			return ErrNegativeCount
+		}
+	}
+	return s.checkTrackable(values)
+}
+
+// checkTrackable returns a non-nil error if any of the values cannot be tracked
+// by the sketch.
+func (s *DDSketch) checkTrackable(values []float64) error {
+	maxIndexableValue := s.MaxIndexableValue()
+	if s.clampOutOfRange {
+		maxIndexableValue = math.Inf(1)
+	}
+	for _, value := range values {
+		if value > maxIndexableValue {
+			return ErrUntrackableTooHigh
+		} else if value < -maxIndexableValue {
+			return ErrUntrackableTooLow
+		} else if math.IsNaN(value) {
+			return ErrUntrackableNaN
+		}
 	}
 	return nil
 }
@@ -151,7 +492,261 @@ func (s *DDSketch) Copy() *DDSketch {
 		positiveValueStore: s.positiveValueStore.Copy(),
 		negativeValueStore: s.negativeValueStore.Copy(),
 		zeroCount:          s.zeroCount,
+		maxNumBins:         s.maxNumBins,
+
+		quantileInterpolation: s.quantileInterpolation,
+		clampOutOfRange:       s.clampOutOfRange,
+		clampedCount:          s.clampedCount,
+		smallIntIndexes:       s.smallIntIndexes,
+	}
+}
+
+// CopyTo overwrites the content of dst with the content of this sketch, so that
+// dst becomes a (deep) copy of it. Unlike Copy, it reuses the stores of dst and
+// the memory that they have allocated (see store.Store.CopyTo), which avoids
+// allocating when a sketch is repeatedly copied, for instance, at every flush.
+// If the stores of dst are of types that differ from those of this sketch,
+// they keep their types and may collapse bins.
+func (s *DDSketch) CopyTo(dst *DDSketch) {
+	if s == dst {
+		return
 	}
+	dst.IndexMapping = s.IndexMapping
+	dst.positiveValueStore = copyStoreTo(s.positiveValueStore, dst.positiveValueStore)
+	dst.negativeValueStore = copyStoreTo(s.negativeValueStore, dst.negativeValueStore)
+	dst.zeroCount = s.zeroCount
+	dst.maxNumBins = s.maxNumBins
+	dst.quantileInterpolation = s.quantileInterpolation
+	dst.clampOutOfRange = s.clampOutOfRange
+	dst.clampedCount = s.clampedCount
+	dst.smallIntIndexes = s.smallIntIndexes
+}
+
+func copyStoreTo(s, dst store.Store) store.Store {
+	if dst == nil {
+		return s.Copy()
+	}
+	s.CopyTo(dst)
+	return dst
+}
+
+// SetMaxNumBins sets the maximum number of bins that the positive and negative
+// value stores can span combined, or removes the limit if maxNumBins is not
+// positive. The number of bins that a store spans is the difference between
+// its maximum and minimum indexes, plus one. Whenever an operation makes the
+// sketch exceed the limit, the bins of lowest indexes, which are those of the
+// values that are the closest to zero, are collapsed, regardless of their
+// sign, which causes the relative accuracy guarantee to be lost for those
+// values. The limit is checked after every operation that adds values to the
+// sketch, which is fast with dense stores.
+// If both stores are non-empty, the limit cannot be lower than 2.
+func (s *DDSketch) SetMaxNumBins(maxNumBins int) {
+	if maxNumBins < 0 {
+		maxNumBins = 0
+	}
+	s.maxNumBins = maxNumBins
+	s.enforceMaxNumBins()
+}
+
+// MaxNumBins returns the maximum number of bins that the positive and negative
+// value stores can span combined, or 0 if there is no such limit (see
+// SetMaxNumBins).
+func (s *DDSketch) MaxNumBins() int {
+	return s.maxNumBins
+}
+
+// SetQuantileInterpolation sets how the value at a quantile is derived from the
+// bin that the quantile falls in, which affects GetValueAtQuantile and the
+// functions that build on it. Different systems may follow different
+// conventions, but the relative accuracy guarantee only applies with
+// QuantileInterpolationMidpoint, which is the default.
+func (s *DDSketch) SetQuantileInterpolation(interpolation QuantileInterpolation) {
+	s.quantileInterpolation = interpolation
+}
+
+// QuantileInterpolation returns how the value at a quantile is derived from the
+// bin that the quantile falls in (see SetQuantileInterpolation).
+func (s *DDSketch) QuantileInterpolation() QuantileInterpolation {
+	return s.quantileInterpolation
+}
+
+// SetClampOutOfRange sets whether values that are too high or too low to be
+// tracked by the sketch are clamped to MaxIndexableValue and its opposite
+// respectively, and counted in the extreme bins, rather than rejected with
+// ErrUntrackableTooHigh or ErrUntrackableTooLow. This avoids dropping samples
+// at the cost of the accuracy of the extreme quantiles; ClampedCount returns
+// how many values have been clamped. NaN values are still rejected.
+func (s *DDSketch) SetClampOutOfRange(clamp bool) {
+	s.clampOutOfRange = clamp
+}
+
+// ClampOutOfRange returns whether out-of-range values are clamped (see
+// SetClampOutOfRange).
+func (s *DDSketch) ClampOutOfRange() bool {
+	return s.clampOutOfRange
+}
+
+// ClampedCount returns the total count of the values that have been clamped
+// when added to the sketch, including those of the sketches that have been
+// merged into it, since it was created or last cleared. It is not encoded.
+func (s *DDSketch) ClampedCount() float64 {
+	return s.clampedCount
+}
+
+// clampValue returns the value that the sketch tracks when value is added.
+func (s *DDSketch) clampValue(value float64) float64 {
+	if s.clampOutOfRange {
+		if value > s.MaxIndexableValue() {
+			return s.MaxIndexableValue()
+		} else if value < -s.MaxIndexableValue() {
+			return -s.MaxIndexableValue()
+		}
+	}
+	return value
+}
+
+// takeStoreError returns the error of the stores of the sketch that reject
+// additions beyond a memory limit (see store.NewBoundedStore), if any of them
+// has rejected additions since the last call, and nil otherwise. It is called
+// on every addition, so that it does not allocate unless there is an error.
+func (s *DDSketch) takeStoreError() error {
+	positiveErr := takeStoreError(s.positiveValueStore)
+	negativeErr := takeStoreError(s.negativeValueStore)
+	if positiveErr == nil {
+		return negativeErr
+	}
+	if negativeErr == nil {
+		return positiveErr
+	}
+	return combineStoreErrors(positiveErr, negativeErr)
+}
+
+// combineStoreErrors returns the first non-nil error, or a *store.MemoryLimitError
+// whose rejected count is the total of the ones of errs if they are all
+// *store.MemoryLimitError or nil.
+func combineStoreErrors(errs ...error) error {
+	var combined *store.MemoryLimitError
+	for _, err := range errs {
+		var limitErr *store.MemoryLimitError
+		if err == nil {
+			continue
+		} else if !errors.As(err, &limitErr) {
+			return err
+		} else if combined == nil {
+			combined = &store.MemoryLimitError{MaxBytes: limitErr.MaxBytes, RejectedCount: limitErr.RejectedCount}
+		} else {
+			combined.RejectedCount += limitErr.RejectedCount
+		}
+	}
+	if combined == nil {
+		return nil
+	}
+	return combined
+}
+
+// hasBoundedStores returns whether any of the stores of the sketch rejects
+// additions beyond a memory limit (see store.NewBoundedStore).
+func (s *DDSketch) hasBoundedStores() bool {
+	_, positiveBounded := s.positiveValueStore.(*store.BoundedStore)
+	_, negativeBounded := s.negativeValueStore.(*store.BoundedStore)
+	return positiveBounded || negativeBounded
+}
+
+func takeStoreError(st store.Store) error {
+	if bounded, ok := st.(*store.BoundedStore); ok {
+		return bounded.TakeError()
+	}
+	return nil
+}
+
+// enforceMaxNumBins collapses the bins of lowest indexes of the stores until
+// they span at most maxNumBins bins combined.
+func (s *DDSketch) enforceMaxNumBins() {
+	if s.maxNumBins <= 0 {
+		return
+	}
+	for {
+		positiveMinIndex, positiveMaxIndex, positiveErr := storeIndexRange(s.positiveValueStore)
+		negativeMinIndex, negativeMaxIndex, negativeErr := storeIndexRange(s.negativeValueStore)
+		excess := -s.maxNumBins
+		if positiveErr == nil {
+			excess += positiveMaxIndex - positiveMinIndex + 1
+		}
+		if negativeErr == nil {
+			excess += negativeMaxIndex - negativeMinIndex + 1
+		}
+		if excess <= 0 {
+			return
+		}
+		// Collapse the store whose minimum index is the lowest, among those that
+		// have more than one bin, but not beyond the minimum index of the other
+		// store.
+		st, minIndex, maxIndex := s.positiveValueStore, positiveMinIndex, positiveMaxIndex
+		otherMinIndex, otherErr := negativeMinIndex, negativeErr
+		if positiveErr != nil || positiveMinIndex == positiveMaxIndex ||
+			(negativeErr == nil && negativeMinIndex < negativeMaxIndex && negativeMinIndex < positiveMinIndex) {
+			st, minIndex, maxIndex = s.negativeValueStore, negativeMinIndex, negativeMaxIndex
+			otherMinIndex, otherErr = positiveMinIndex, positiveErr
+		}
+		if minIndex == maxIndex {
+			// Both stores have a single bin.
+			return
+		}
+		numCollapsed := maxIndex - minIndex
+		if excess < numCollapsed {
+			numCollapsed = excess
+		}
+		if otherErr == nil && otherMinIndex > minIndex && otherMinIndex-minIndex < numCollapsed {
+			numCollapsed = otherMinIndex - minIndex
+		}
+		collapseLowest(st, minIndex+numCollapsed)
+	}
+}
+
+func storeIndexRange(s store.Store) (minIndex, maxIndex int, err error) {
+	if minIndex, err = s.MinIndex(); err != nil {
+		return 0, 0, err
+	}
+	maxIndex, err = s.MaxIndex()
+	return minIndex, maxIndex, err
+}
+
+// collapseLowest moves the counts of the bins whose indexes are lower than
+// newMinIndex to the bin of index newMinIndex.
+func collapseLowest(s store.Store, newMinIndex int) {
+	var indexes []int
+	var counts []float64
+	s.ForEach(func(index int, count float64) (stop bool) {
+		if index < newMinIndex {
+			indexes = append(indexes, index)
+			counts = append(counts, count)
+		}
+		return false
+	})
+	for i, index := range indexes {
+		s.SubtractWithCount(index, counts[i])
+		s.AddWithCount(newMinIndex, counts[i])
+	}
+}
+
+// Equals returns whether the other sketch uses the same index mapping and has
+// the same bin counts as this sketch, regardless of the type of their stores.
+func (s *DDSketch) Equals(other *DDSketch) bool {
+	return s.ApproxEquals(other, 0)
+}
+
+// ApproxEquals returns whether the other sketch uses the same index mapping as
+// this sketch and whether the absolute differences between their bin counts,
+// including the zero counts, are at most tolerance.
+func (s *DDSketch) ApproxEquals(other *DDSketch, tolerance float64) bool {
+	return s.IndexMapping.Equals(other.IndexMapping) &&
+		approxEqual(s.zeroCount, other.zeroCount, tolerance) &&
+		store.ApproxEquivalent(s.positiveValueStore, other.positiveValueStore, tolerance) &&
+		store.ApproxEquivalent(s.negativeValueStore, other.negativeValueStore, tolerance)
+}
+
+func approxEqual(a, b, tolerance float64) bool {
+	return a == b || math.Abs(a-b) <= tolerance
 }
 
 // Clear empties the sketch while allowing reusing already allocated memory.
@@ -159,6 +754,18 @@ func (s *DDSketch) Clear() {
 	s.positiveValueStore.Clear()
 	s.negativeValueStore.Clear()
 	s.zeroCount = 0
+	s.clampedCount = 0
+}
+
+// ClearRetainingCapacity empties the sketch while keeping the memory that its
+// stores have allocated (see store.Store.ClearRetainingCapacity). This is
+// useful when the same sketch is reused to track data that is similarly
+// distributed, for instance, at every flush interval.
+func (s *DDSketch) ClearRetainingCapacity() {
+	s.positiveValueStore.ClearRetainingCapacity()
+	s.negativeValueStore.ClearRetainingCapacity()
+	s.zeroCount = 0
+	s.clampedCount = 0
 }
 
 // Return the value at the specified quantile. Return a non-nil error if the quantile is invalid
@@ -180,13 +787,47 @@ func (s *DDSketch) GetValueAtQuantile(quantile float64) (float64, error) {
 	// compiler.
 	rank := float64(quantile * (count - 1))
 
+	if s.quantileInterpolation == QuantileInterpolationLinear {
+		lowerRank := math.Floor(rank)
+		lowerValue := s.valueAtRank(lowerRank, QuantileInterpolationMidpoint)
+		if lowerRank == rank {
+			return lowerValue, nil
+		}
+		upperValue := s.valueAtRank(math.Min(lowerRank+1, count-1), QuantileInterpolationMidpoint)
+		return lowerValue + (rank-lowerRank)*(upperValue-lowerValue), nil
+	}
+	return s.valueAtRank(rank, s.quantileInterpolation), nil
+}
+
+// valueAtRank returns the value of the bin that holds the provided rank,
+// derived from the bin as specified by interpolation, which cannot be
+// QuantileInterpolationLinear.
+func (s *DDSketch) valueAtRank(rank float64, interpolation QuantileInterpolation) float64 {
 	negativeValueCount := s.negativeValueStore.TotalCount()
 	if rank < negativeValueCount {
-		return -s.Value(s.negativeValueStore.KeyAtRank(negativeValueCount - 1 - rank)), nil
+		// The lowest negative values have the highest absolute values.
+		switch interpolation {
+		case QuantileInterpolationLowerBound:
+			interpolation = QuantileInterpolationUpperBound
+		case QuantileInterpolationUpperBound:
+			interpolation = QuantileInterpolationLowerBound
+		}
+		return -s.binValue(s.negativeValueStore.KeyAtRank(negativeValueCount-1-rank), interpolation)
 	} else if rank < s.zeroCount+negativeValueCount {
-		return 0, nil
+		return 0
 	} else {
-		return s.Value(s.positiveValueStore.KeyAtRank(rank - s.zeroCount - negativeValueCount)), nil
+		return s.binValue(s.positiveValueStore.KeyAtRank(rank-s.zeroCount-negativeValueCount), interpolation)
+	}
+}
+
+func (s *DDSketch) binValue(index int, interpolation QuantileInterpolation) float64 {
+	switch interpolation {
+	case QuantileInterpolationLowerBound:
+		return s.LowerBound(index)
+	case QuantileInterpolationUpperBound:
+		return s.UpperBound(index)
+	default:
+		return s.Value(index)
 	}
 }
 
@@ -204,6 +845,293 @@ func (s *DDSketch) GetValuesAtQuantiles(quantiles []float64) ([]float64, error)
 	return values, nil
 }
 
+// GetValueAtQuantileWithBounds returns the value at the specified quantile,
+// as GetValueAtQuantile does, as well as the bounds of the range of values
+// that the actual quantile is guaranteed to fall in. Unless bins have been
+// collapsed, the relative distance between the value and any of the bounds is
+// within the relative accuracy of the sketch. If the quantile falls in a bin
+// that holds the counts of collapsed bins, the relative accuracy guarantee is
+// void and the bounds extend to zero or infinity, depending on which bins
+// were collapsed. Return a non-nil error if the quantile is invalid or if the
+// sketch is empty.
+func (s *DDSketch) GetValueAtQuantileWithBounds(quantile float64) (value, lower, upper float64, err error) {
+	if quantile < 0 || quantile > 1 {
+		return math.NaN(), math.NaN(), math.NaN(), errors.New("The quantile must be between 0 and 1.")
+	}
+
+	count := s.GetCount()
+	if count == 0 {
+		return math.NaN(), math.NaN(), math.NaN(), errEmptySketch
+	}
+
+	// See GetValueAtQuantile.
+	rank := float64(quantile * (count - 1))
+
+	negativeValueCount := s.negativeValueStore.TotalCount()
+	if rank < negativeValueCount {
+		index := s.negativeValueStore.KeyAtRank(negativeValueCount - 1 - rank)
+		lower, upper = s.binBounds(s.negativeValueStore, index)
+		lower, upper = -upper, -lower
+	} else if rank < s.zeroCount+negativeValueCount {
+		lower, upper = -s.MinIndexableValue(), s.MinIndexableValue()
+	} else {
+		index := s.positiveValueStore.KeyAtRank(rank - s.zeroCount - negativeValueCount)
+		lower, upper = s.binBounds(s.positiveValueStore, index)
+	}
+	// The value only falls outside the bounds with linear interpolation.
+	value, _ = s.GetValueAtQuantile(quantile)
+	return math.Max(lower, math.Min(value, upper)), lower, upper, nil
+}
+
+// GetValuesAtQuantilesWithBounds returns the values at the respective specified
+// quantiles, as well as the bounds of the ranges that the actual quantiles fall
+// in (see GetValueAtQuantileWithBounds). Return a non-nil error if any of the
+// quantiles is invalid or if the sketch is empty.
+func (s *DDSketch) GetValuesAtQuantilesWithBounds(quantiles []float64) (values, lowers, uppers []float64, err error) {
+	return valuesAtQuantilesWithBounds(s.GetValueAtQuantileWithBounds, quantiles)
+}
+
+func valuesAtQuantilesWithBounds(valueAtQuantileWithBounds func(quantile float64) (value, lower, upper float64, err error), quantiles []float64) (values, lowers, uppers []float64, err error) {
+	values = make([]float64, len(quantiles))
+	lowers = make([]float64, len(quantiles))
+	uppers = make([]float64, len(quantiles))
+	for i, q := range quantiles {
+		if values[i], lowers[i], uppers[i], err = valueAtQuantileWithBounds(q); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return values, lowers, uppers, nil
+}
+
+// binBounds returns the range of the absolute values that the bin of the
+// specified index of the provided store may hold, taking collapsing into
+// account.
+func (s *DDSketch) binBounds(st store.Store, index int) (lower, upper float64) {
+	lower, upper = s.LowerBound(index), s.UpperBound(index)
+	switch c := st.(type) {
+	case *store.CollapsingLowestDenseStore:
+		if minIndex, err := c.MinIndex(); err == nil && c.IsCollapsed() && index == minIndex {
+			lower = 0
+		}
+	case *store.CollapsingHighestDenseStore:
+		if maxIndex, err := c.MaxIndex(); err == nil && c.IsCollapsed() && index == maxIndex {
+			upper = math.Inf(1)
+		}
+	}
+	return lower, upper
+}
+
+// GetRankOfValue returns the approximate fraction of the values that have been
+// added to this sketch that are less than or equal to the provided value. It is
+// the inverse of GetValueAtQuantile: values that are mapped to the same bin as
+// the provided value are all considered to be less than or equal to it. Return
+// a non-nil error if the value is NaN or if the sketch is empty.
+func (s *DDSketch) GetRankOfValue(value float64) (float64, error) {
+	if math.IsNaN(value) {
+		return math.NaN(), ErrUntrackableNaN
+	}
+
+	count := s.GetCount()
+	if count == 0 {
+		return math.NaN(), errEmptySketch
+	}
+
+	negativeValueCount := s.negativeValueStore.TotalCount()
+	var cumulCount float64
+	if value > s.MinIndexableValue() {
+		cumulCount = negativeValueCount + s.zeroCount
+		if value > s.MaxIndexableValue() {
+			cumulCount += s.positiveValueStore.TotalCount()
+		} else {
+			index := s.Index(value)
+			cumulCount += storeCountWhere(s.positiveValueStore, func(i int) bool { return i <= index })
+		}
+	} else if value < -s.MinIndexableValue() {
+		if value >= -s.MaxIndexableValue() {
+			index := s.Index(-value)
+			cumulCount = storeCountWhere(s.negativeValueStore, func(i int) bool { return i >= index })
+		}
+	} else {
+		// The value is mapped to the zero bin, whatever its sign.
+		cumulCount = negativeValueCount + s.zeroCount
+	}
+	return math.Min(cumulCount/count, 1), nil
+}
+
+// GetCountBetween returns the sum of the counts of the bins whose mapped values
+// (the values returned by ForEach) are greater than or equal to lower and
+// strictly less than upper. Values that have been mapped to the zero bin are
+// counted if and only if 0 is in [lower, upper).
+func (s *DDSketch) GetCountBetween(lower, upper float64) (count float64) {
+	if !(lower < upper) {
+		return 0
+	}
+	if lower <= 0 && 0 < upper {
+		count += s.zeroCount
+	}
+	if upper > 0 {
+		count += storeCountWhere(s.positiveValueStore, func(index int) bool {
+			value := s.Value(index)
+			return lower <= value && value < upper
+		})
+	}
+	if lower < 0 {
+		count += storeCountWhere(s.negativeValueStore, func(index int) bool {
+			value := -s.Value(index)
+			return lower <= value && value < upper
+		})
+	}
+	return count
+}
+
+// GetCountAtValue returns the count of the bin that the provided value is
+// mapped to, that is, the count of the values that have been added to the
+// sketch and that cannot be distinguished from it. Values that are mapped to
+// the zero bin share its count. Return 0 if the value is NaN or is not
+// trackable by the sketch.
+func (s *DDSketch) GetCountAtValue(value float64) float64 {
+	if value > s.MinIndexableValue() {
+		if value > s.MaxIndexableValue() {
+			return 0
+		}
+		return s.positiveValueStore.GetCountAtIndex(s.Index(value))
+	} else if value < -s.MinIndexableValue() {
+		if value < -s.MaxIndexableValue() {
+			return 0
+		}
+		return s.negativeValueStore.GetCountAtIndex(s.Index(-value))
+	} else if math.IsNaN(value) {
+		return 0
+	}
+	return s.zeroCount
+}
+
+// ToHistogram redistributes the counts of the bins of the sketch into the
+// buckets delimited by the provided boundaries, which must be sorted in
+// increasing order. It returns len(boundaries)+1 counts: the i-th bucket
+// counts the values in [boundaries[i-1], boundaries[i]), the first bucket
+// counting the values lower than boundaries[0] and the last bucket counting
+// the values greater than or equal to boundaries[len(boundaries)-1]. The count
+// of a bin that overlaps multiple buckets is split among them proportionally to
+// the size of the overlaps, assuming values are uniformly distributed within
+// the bin. Values of the zero bin are counted as being equal to 0.
+func (s *DDSketch) ToHistogram(boundaries []float64) []float64 {
+	histogram := make([]float64, len(boundaries)+1)
+	if s.zeroCount != 0 {
+		histogram[bucketIndex(boundaries, 0)] += s.zeroCount
+	}
+	s.positiveValueStore.ForEach(func(index int, count float64) (stop bool) {
+		distribute(histogram, boundaries, s.LowerBound(index), s.UpperBound(index), count)
+		return false
+	})
+	s.negativeValueStore.ForEach(func(index int, count float64) (stop bool) {
+		distribute(histogram, boundaries, -s.UpperBound(index), -s.LowerBound(index), count)
+		return false
+	})
+	return histogram
+}
+
+// bucketIndex returns the index of the bucket of the histogram delimited by
+// boundaries that the value belongs to.
+func bucketIndex(boundaries []float64, value float64) int {
+	return sort.Search(len(boundaries), func(i int) bool { return boundaries[i] > value })
+}
+
+// distribute adds count to the buckets of the histogram that overlap with
+// [lower, upper), proportionally to the size of the overlaps. If the range is
+// unbounded, which is the case of the bins of the highest indexes, the overlaps
+// with the buckets of finite sizes are negligible, and count is added to the
+// bucket that the finite values closest to its infinite end belong to.
+func distribute(histogram, boundaries []float64, lower, upper, count float64) {
+	if math.IsInf(upper, 1) {
+		histogram[bucketIndex(boundaries, math.MaxFloat64)] += count
+		return
+	}
+	if math.IsInf(lower, -1) {
+		histogram[bucketIndex(boundaries, -math.MaxFloat64)] += count
+		return
+	}
+	lowerBucketIndex := bucketIndex(boundaries, lower)
+	upperBucketIndex := bucketIndex(boundaries, upper)
+	if lowerBucketIndex == upperBucketIndex {
+		histogram[lowerBucketIndex] += count
+		return
+	}
+	for i := lowerBucketIndex; i <= upperBucketIndex; i++ {
+		from := lower
+		if i > lowerBucketIndex {
+			from = boundaries[i-1]
+		}
+		to := upper
+		if i < upperBucketIndex {
+			to = boundaries[i]
+		}
+		histogram[i] += count * (to - from) / (upper - lower)
+	}
+}
+
+// SplitAtValue partitions the content of the sketch into two new sketches that
+// use the same index mapping and the same types of stores as this sketch: below
+// encodes the values that are strictly less than v and above encodes the values
+// that are greater than or equal to v. The count of the bin that v falls into
+// is split between them proportionally to the size of the parts of the bin
+// that are on each side of v, like with ToHistogram. Values of the zero bin are
+// counted as being equal to 0. Return a non-nil error if v is NaN.
+func (s *DDSketch) SplitAtValue(v float64) (below, above *DDSketch, err error) {
+	if math.IsNaN(v) {
+		return nil, nil, ErrUntrackableNaN
+	}
+	below, above = s.Copy(), s.Copy()
+	boundaries := []float64{v}
+	split := func(belowStore, aboveStore store.Store, index int, lower, upper, count float64) {
+		var histogram [2]float64
+		distribute(histogram[:], boundaries, lower, upper, count)
+		if histogram[1] > 0 {
+			belowStore.SubtractWithCount(index, histogram[1])
+		}
+		if histogram[0] > 0 {
+			aboveStore.SubtractWithCount(index, histogram[0])
+		}
+	}
+	s.positiveValueStore.ForEach(func(index int, count float64) (stop bool) {
+		split(below.positiveValueStore, above.positiveValueStore, index, s.LowerBound(index), s.UpperBound(index), count)
+		return false
+	})
+	s.negativeValueStore.ForEach(func(index int, count float64) (stop bool) {
+		split(below.negativeValueStore, above.negativeValueStore, index, -s.UpperBound(index), -s.LowerBound(index), count)
+		return false
+	})
+	if 0 < v {
+		above.zeroCount = 0
+	} else {
+		below.zeroCount = 0
+	}
+	return below, above, nil
+}
+
+// SplitAtQuantile partitions the content of the sketch at the value at the
+// specified quantile (see SplitAtValue). Return a non-nil error if the quantile
+// is invalid or if the sketch is empty.
+func (s *DDSketch) SplitAtQuantile(quantile float64) (below, above *DDSketch, err error) {
+	value, err := s.GetValueAtQuantile(quantile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.SplitAtValue(value)
+}
+
+// storeCountWhere returns the sum of the counts of the bins of the store whose
+// indexes verify the predicate.
+func storeCountWhere(s store.Store, predicate func(index int) bool) (count float64) {
+	s.ForEach(func(index int, c float64) (stop bool) {
+		if predicate(index) {
+			count += c
+		}
+		return false
+	})
+	return count
+}
+
 // Return the total number of values that have been added to this sketch.
 func (s *DDSketch) GetCount() float64 {
 	return s.zeroCount + s.positiveValueStore.TotalCount() + s.negativeValueStore.TotalCount()
@@ -216,11 +1144,54 @@ func (s *DDSketch) GetZeroCount() float64 {
 	return s.zeroCount
 }
 
+// GetCollapsedCount returns the number of values that the stores of this
+// sketch hold in bins other than their own because bins have been collapsed
+// (see store.CollapsingLowestDenseStore.CollapsedCount), which only happens
+// with stores that cap their number of bins. If it is non-zero, the relative
+// accuracy guarantee does not hold for the quantiles that fall on the
+// collapsed bins, at the tails of the distribution that are collapsed.
+func (s *DDSketch) GetCollapsedCount() float64 {
+	return collapsedCount(s.positiveValueStore) + collapsedCount(s.negativeValueStore)
+}
+
+func collapsedCount(st store.Store) float64 {
+	if c, ok := st.(interface{ CollapsedCount() float64 }); ok {
+		return c.CollapsedCount()
+	}
+	return 0
+}
+
 // Return true iff no value has been added to this sketch.
 func (s *DDSketch) IsEmpty() bool {
 	return s.zeroCount == 0 && s.positiveValueStore.IsEmpty() && s.negativeValueStore.IsEmpty()
 }
 
+// MemorySize returns an approximation of the memory size in bytes that the
+// sketch uses, including the memory that is held by its index mapping and
+// both of its stores.
+func (s *DDSketch) MemorySize() int {
+	size := int(unsafe.Sizeof(*s))
+	if s.IndexMapping != nil {
+		size += indirectSize(s.IndexMapping)
+	}
+	if s.positiveValueStore != nil {
+		size += s.positiveValueStore.MemorySize()
+	}
+	if s.negativeValueStore != nil {
+		size += s.negativeValueStore.MemorySize()
+	}
+	return size
+}
+
+// indirectSize returns the size of the value that v points to, or 0 if v does
+// not hold a pointer.
+func indirectSize(v interface{}) int {
+	if t := reflect.TypeOf(v); t.Kind() == reflect.Ptr {
+		return int(t.Elem().Size())
+	}
+	return 0
+}
+
 // Return the maximum value that has been added to this sketch. Return a non-nil error if the sketch
 // is empty.
 func (s *DDSketch) GetMaxValue() (float64, error) {
@@ -255,6 +1226,28 @@ func (s *DDSketch) GetMinValue() (float64, error) {
 	}
 }
 
+// GetMode returns the value of the bin with the highest count, which is an
+// approximation of the most frequent value that has been added to this sketch.
+// If several bins have the highest count, the value that is the closest to zero
+// is returned (and the negative one if two values are equally close to zero).
+// Returns a non-nil error if the sketch is empty.
+func (s *DDSketch) GetMode() (float64, error) {
+	if s.IsEmpty() {
+		return math.NaN(), errEmptySketch
+	}
+	mode, maxCount := float64(0), s.zeroCount
+	if bin, err := s.negativeValueStore.MaxCountBin(); err == nil && bin.Count() > maxCount {
+		mode, maxCount = -s.Value(bin.Index()), bin.Count()
+	}
+	if bin, err := s.positiveValueStore.MaxCountBin(); err == nil {
+		value := s.Value(bin.Index())
+		if bin.Count() > maxCount || (bin.Count() == maxCount && mode < 0 && value < -mode) {
+			mode = value
+		}
+	}
+	return mode, nil
+}
+
 // GetSum returns an approximation of the sum of the values that have been added to the sketch. If the
 // values that have been added to the sketch all have the same sign, the approximation error has
 // the relative accuracy guarantees of the mapping used for this sketch.
@@ -266,16 +1259,142 @@ func (s *DDSketch) GetSum() (sum float64) {
 	return sum
 }
 
+// GetTrimmedMean returns an approximation of the mean of the values that have
+// been added to the sketch and whose quantiles are between lowerQuantile and
+// upperQuantile. Bins are weighted by the fraction of their counts that falls
+// in between the two quantiles, so that bins that are only partially within
+// the range contribute proportionally. Return a non-nil error if the quantiles
+// are invalid or if the sketch is empty.
+func (s *DDSketch) GetTrimmedMean(lowerQuantile, upperQuantile float64) (float64, error) {
+	if lowerQuantile < 0 || upperQuantile > 1 || lowerQuantile > upperQuantile {
+		return math.NaN(), errors.New("The quantiles must be between 0 and 1, and the lower quantile cannot be greater than the upper quantile.")
+	}
+	count := s.GetCount()
+	if count == 0 {
+		return math.NaN(), errEmptySketch
+	}
+	if lowerQuantile == upperQuantile {
+		return s.GetValueAtQuantile(lowerQuantile)
+	}
+
+	lowerRank := lowerQuantile * count
+	upperRank := upperQuantile * count
+	cumulCount := float64(0)
+	sum := float64(0)
+	for _, bin := range s.orderedBins() {
+		binLowerRank := cumulCount
+		cumulCount += bin.count
+		if cumulCount <= lowerRank {
+			continue
+		}
+		weight := math.Min(cumulCount, upperRank) - math.Max(binLowerRank, lowerRank)
+		sum += weight * bin.value
+		if cumulCount >= upperRank {
+			break
+		}
+	}
+	return sum / (upperRank - lowerRank), nil
+}
+
+type valueCount struct {
+	value float64
+	count float64
+}
+
+// orderedBins returns the values and counts of the bins of the sketch, sorted
+// by increasing values.
+func (s *DDSketch) orderedBins() []valueCount {
+	bins := make([]valueCount, 0)
+	s.ForEach(func(value, count float64) (stop bool) {
+		bins = append(bins, valueCount{value: value, count: count})
+		return false
+	})
+	sort.Slice(bins, func(i, j int) bool { return bins[i].value < bins[j].value })
+	return bins
+}
+
 // GetPositiveValueStore returns the store.Store object that contains the positive
 // values of the sketch.
 func (s *DDSketch) GetPositiveValueStore() store.Store {
 	return s.positiveValueStore
 }
 
-// GetNegativeValueStore returns the store.Store object that contains the negative
-// values of the sketch.
-func (s *DDSketch) GetNegativeValueStore() store.Store {
-	return s.negativeValueStore
+// GetNegativeValueStore returns the store.Store object that contains the negative
+// values of the sketch.
+func (s *DDSketch) GetNegativeValueStore() store.Store {
+	return s.negativeValueStore
+}
+
+// PositiveStore returns the store that holds the bins of the positive values
+// of the sketch. It is meant for inspecting the sketch, for instance, to export
+// its bins: modifying the store may break the invariants of the sketch.
+func (s *DDSketch) PositiveStore() store.Store {
+	return s.positiveValueStore
+}
+
+// NegativeStore returns the store that holds the bins of the negative values
+// of the sketch, indexed by the absolute values (see PositiveStore).
+func (s *DDSketch) NegativeStore() store.Store {
+	return s.negativeValueStore
+}
+
+// ZeroCount returns the count of the zero bin, which holds the values whose
+// absolute values are lower than the minimum indexable value of the mapping.
+func (s *DDSketch) ZeroCount() float64 {
+	return s.zeroCount
+}
+
+// Mapping returns the index mapping that maps values to the indexes of the
+// bins of the stores of the sketch.
+func (s *DDSketch) Mapping() mapping.IndexMapping {
+	return s.IndexMapping
+}
+
+// ToBinArrays returns the indexes and the counts of the non-empty bins of the
+// negative and positive value stores as parallel arrays, sorted by increasing
+// indexes, as well as the count of the zero bin. Negative values are indexed by
+// their absolute values, as in NegativeStore. It allows exporters to serialize
+// the bins of the sketch to columnar formats without iterating over them.
+func (s *DDSketch) ToBinArrays() (negIndexes []int32, negCounts []float64, zeroCount float64, posIndexes []int32, posCounts []float64) {
+	negIndexes, negCounts = storeToBinArrays(s.negativeValueStore)
+	posIndexes, posCounts = storeToBinArrays(s.positiveValueStore)
+	return negIndexes, negCounts, s.zeroCount, posIndexes, posCounts
+}
+
+// storeToBinArrays returns the indexes and the counts of the non-empty bins of
+// the store, sorted by increasing indexes.
+func storeToBinArrays(st store.Store) ([]int32, []float64) {
+	var indexes []int32
+	var counts []float64
+	sorted := true
+	st.ForEach(func(index int, count float64) (stop bool) {
+		if count == 0 {
+			return false
+		}
+		if len(indexes) > 0 && int32(index) < indexes[len(indexes)-1] {
+			sorted = false
+		}
+		indexes = append(indexes, int32(index))
+		counts = append(counts, count)
+		return false
+	})
+	if !sorted {
+		sort.Sort(binArrays{indexes: indexes, counts: counts})
+	}
+	return indexes, counts
+}
+
+// binArrays sorts parallel arrays of bin indexes and counts by index.
+type binArrays struct {
+	indexes []int32
+	counts  []float64
+}
+
+func (b binArrays) Len() int           { return len(b.indexes) }
+func (b binArrays) Less(i, j int) bool { return b.indexes[i] < b.indexes[j] }
+func (b binArrays) Swap(i, j int) {
+	b.indexes[i], b.indexes[j] = b.indexes[j], b.indexes[i]
+	b.counts[i], b.counts[j] = b.counts[j], b.counts[i]
 }
 
 // ForEach applies f on the bins of the sketches until f returns true.
@@ -297,6 +1416,50 @@ func (s *DDSketch) ForEach(f func(value, count float64) (stop bool)) {
 	})
 }
 
+// Sample draws n random values from the distribution that the sketch encodes,
+// using r as the source of randomness. Bins are picked with a probability that
+// is proportional to their counts, and values are drawn log-uniformly within
+// the bounds of the picked bins, which matches the logarithmic spacing of the
+// bins. Return nil if the sketch is empty or if n is not positive.
+func (s *DDSketch) Sample(n int, r *rand.Rand) []float64 {
+	if n <= 0 || s.IsEmpty() {
+		return nil
+	}
+	var lowerBounds, upperBounds, signs, cumulativeCounts []float64
+	cumulativeCount := float64(0)
+	addBin := func(lowerBound, upperBound, sign, count float64) {
+		if count <= 0 {
+			return
+		}
+		cumulativeCount += count
+		lowerBounds = append(lowerBounds, lowerBound)
+		upperBounds = append(upperBounds, upperBound)
+		signs = append(signs, sign)
+		cumulativeCounts = append(cumulativeCounts, cumulativeCount)
+	}
+	s.negativeValueStore.ForEach(func(index int, count float64) (stop bool) {
+		addBin(s.LowerBound(index), s.UpperBound(index), -1, count)
+		return false
+	})
+	addBin(0, 0, 1, s.zeroCount)
+	s.positiveValueStore.ForEach(func(index int, count float64) (stop bool) {
+		addBin(s.LowerBound(index), s.UpperBound(index), 1, count)
+		return false
+	})
+
+	samples := make([]float64, n)
+	for i := range samples {
+		rank := r.Float64() * cumulativeCount
+		j := sort.Search(len(cumulativeCounts)-1, func(j int) bool { return cumulativeCounts[j] > rank })
+		if lowerBounds[j] == 0 {
+			samples[i] = 0
+		} else {
+			samples[i] = signs[j] * lowerBounds[j] * math.Pow(upperBounds[j]/lowerBounds[j], r.Float64())
+		}
+	}
+	return samples
+}
+
 // Merges the other sketch into this one. After this operation, this sketch encodes the values that
 // were added to both this and the other sketches.
 func (s *DDSketch) MergeWith(other *DDSketch) error {
@@ -306,9 +1469,202 @@ func (s *DDSketch) MergeWith(other *DDSketch) error {
 	s.positiveValueStore.MergeWith(other.positiveValueStore)
 	s.negativeValueStore.MergeWith(other.negativeValueStore)
 	s.zeroCount += other.zeroCount
+	s.clampedCount += other.clampedCount
+	s.enforceMaxNumBins()
+	return s.takeStoreError()
+}
+
+// MergeWithWeight merges the other sketch into this one, multiplying the counts
+// of its bins by w, which has to be strictly positive. It is equivalent to, but
+// faster than, merging a copy of the other sketch that has been reweighted by
+// w, as bins are scaled while being merged.
+func (s *DDSketch) MergeWithWeight(other *DDSketch, w float64) error {
+	if !(w > 0) || math.IsInf(w, 1) {
+		return errors.New("the merging weight must be strictly positive and finite")
+	}
+	if !s.IndexMapping.Equals(other.IndexMapping) {
+		return errors.New("Cannot merge sketches with different index mappings.")
+	}
+	if s == other {
+		return s.Reweight(1 + w)
+	}
+	mergeStoreWithWeight(s.positiveValueStore, other.positiveValueStore, w)
+	mergeStoreWithWeight(s.negativeValueStore, other.negativeValueStore, w)
+	s.zeroCount += w * other.zeroCount
+	s.clampedCount += w * other.clampedCount
+	s.enforceMaxNumBins()
+	return s.takeStoreError()
+}
+
+func mergeStoreWithWeight(s, other store.Store, w float64) {
+	if w == 1 {
+		s.MergeWith(other)
+		return
+	}
+	other.ForEach(func(index int, count float64) (stop bool) {
+		s.AddWithCount(index, w*count)
+		return false
+	})
+}
+
+// MergeWithConverting merges the other sketch into this one, like MergeWith,
+// but it also accepts sketches whose index mappings differ from the one of this
+// sketch, for instance, because they have been configured with a different
+// relative accuracy. The bins of the other sketch are then converted to the
+// mapping of this sketch as in ChangeMapping, by distributing their counts to
+// the bins that they overlap, so that the merged values are no longer
+// guaranteed to be within the relative accuracy of this sketch: their relative
+// error may be up to about the relative accuracy of this sketch plus twice the
+// one of the other sketch, as counts are spread over the whole bins that hold
+// them. Values of the other sketch that are too low to be tracked by this
+// sketch are added to its zero bin. The sketch is not modified if the other
+// sketch holds values that are too high or too low to be tracked by this
+// sketch.
+func (s *DDSketch) MergeWithConverting(other *DDSketch) error {
+	if s.IndexMapping.Equals(other.IndexMapping) {
+		return s.MergeWith(other)
+	}
+	for _, st := range []store.Store{other.positiveValueStore, other.negativeValueStore} {
+		if maxIndex, err := st.MaxIndex(); err == nil && other.LowerBound(maxIndex) > s.MaxIndexableValue() {
+			if st == other.negativeValueStore {
+				return ErrUntrackableTooLow
+			}
+			return ErrUntrackableTooHigh
+		}
+	}
+	s.zeroCount += other.zeroCount + convertStore(other.IndexMapping, s.IndexMapping, other.positiveValueStore, s.positiveValueStore)
+	s.zeroCount += convertStore(other.IndexMapping, s.IndexMapping, other.negativeValueStore, s.negativeValueStore)
+	s.clampedCount += other.clampedCount
+	s.enforceMaxNumBins()
+	return s.takeStoreError()
+}
+
+// convertStore adds the bins of oldStore to newStore, converting them from
+// oldMapping to newMapping, and returns the count of the bins of oldStore that
+// hold values that are too low to be indexed by newMapping.
+func convertStore(oldMapping, newMapping mapping.IndexMapping, oldStore, newStore store.Store) (zeroCount float64) {
+	oldStore.ForEach(func(index int, count float64) (stop bool) {
+		if oldMapping.LowerBound(index) < newMapping.MinIndexableValue() {
+			zeroCount += count
+		} else {
+			addScaledBin(oldMapping, newMapping, newStore, index, count, 1)
+		}
+		return false
+	})
+	return zeroCount
+}
+
+// MergeWithSketch merges the content of the other sketch in this sketch. If the
+// other sketch tracks exact summary statistics, they are ignored.
+func (s *DDSketch) MergeWithSketch(other QuantileSketch) error {
+	switch o := other.(type) {
+	case *DDSketch:
+		return s.MergeWith(o)
+	case *DDSketchWithExactSummaryStatistics:
+		return s.MergeWith(o.DDSketch)
+	default:
+		var b []byte
+		other.Encode(&b, false)
+		return s.DecodeAndMergeWith(b)
+	}
+}
+
+// DiffWith subtracts the counts of the bins of the other sketch from the counts
+// of the bins of this sketch, clamping them at zero. If the other sketch is an
+// earlier snapshot of this sketch, after this operation, this sketch encodes
+// the values that were added since the snapshot was taken.
+func (s *DDSketch) DiffWith(other *DDSketch) error {
+	if !s.IndexMapping.Equals(other.IndexMapping) {
+		return errors.New("Cannot diff sketches with different index mappings.")
+	}
+	if s == other {
+		s.Clear()
+		return nil
+	}
+	diffStore(s.positiveValueStore, other.positiveValueStore)
+	diffStore(s.negativeValueStore, other.negativeValueStore)
+	s.zeroCount = math.Max(s.zeroCount-other.zeroCount, 0)
 	return nil
 }
 
+func diffStore(s, other store.Store) {
+	if b, ok := s.(*store.BufferedPaginatedStore); ok {
+		b.DiffWith(other)
+		return
+	}
+	other.ForEach(func(index int, count float64) (stop bool) {
+		s.SubtractWithCount(index, count)
+		return false
+	})
+}
+
+// MergeAll merges the other sketches into target. After this operation, target
+// encodes the values that were added to target and to all the other sketches.
+// The other sketches are first merged concurrently, using up to parallelism
+// goroutines, by tree reduction into intermediate sketches that are then merged
+// into target. If parallelism is less than 1, runtime.GOMAXPROCS(0) is used.
+// Each sketch must appear at most once in others and must not be concurrently
+// modified. Return a non-nil error, without modifying target, if any of the
+// other sketches has an index mapping that differs from the one of target. If
+// the stores have a memory limit (see store.NewBoundedStore), the bins that
+// would exceed it are dropped and a *store.MemoryLimitError is returned, whose
+// rejected count is the total over all the merges.
+func MergeAll(target *DDSketch, others []*DDSketch, parallelism int) error {
+	for _, other := range others {
+		if !target.IndexMapping.Equals(other.IndexMapping) {
+			return errors.New("Cannot merge sketches with different index mappings.")
+		}
+	}
+	if parallelism < 1 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	if parallelism == 1 || len(others) < 2 {
+		var err error
+		for _, other := range others {
+			err = combineStoreErrors(err, target.MergeWith(other))
+		}
+		return err
+	}
+
+	// Merge chunks of the other sketches into copies of their respective first
+	// sketches.
+	chunkLen := (len(others) + parallelism - 1) / parallelism
+	partials := make([]*DDSketch, (len(others)+chunkLen-1)/chunkLen)
+	errs := make([]error, len(partials))
+	var wg sync.WaitGroup
+	for i := range partials {
+		chunk := others[i*chunkLen:]
+		if len(chunk) > chunkLen {
+			chunk = chunk[:chunkLen]
+		}
+		wg.Add(1)
+		go func(i int, chunk []*DDSketch) {
+			defer wg.Done()
+			partial := chunk[0].Copy()
+			for _, other := range chunk[1:] {
+				errs[i] = combineStoreErrors(errs[i], partial.MergeWith(other))
+			}
+			partials[i] = partial
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	// Merge the intermediate sketches pairwise until only one is left.
+	for len(partials) > 1 {
+		half := (len(partials) + 1) / 2
+		for i := half; i < len(partials); i++ {
+			wg.Add(1)
+			go func(dst, src int) {
+				defer wg.Done()
+				errs[dst] = combineStoreErrors(errs[dst], errs[src], partials[dst].MergeWith(partials[src]))
+			}(i-half, i)
+		}
+		wg.Wait()
+		partials = partials[:half]
+	}
+	return combineStoreErrors(errs[0], target.MergeWith(partials[0]))
+}
+
 // Generates a protobuf representation of this DDSketch.
 func (s *DDSketch) ToProto() *sketchpb.DDSketch {
 	return &sketchpb.DDSketch{
@@ -324,18 +1680,33 @@ func FromProto(pb *sketchpb.DDSketch) (*DDSketch, error) {
 	return FromProtoWithStoreProvider(pb, store.DenseStoreConstructor)
 }
 
+// FromProtoWithStoreProvider builds a sketch from its protobuf representation,
+// using storeProvider to build its stores. As the protobuf representation may
+// come from an untrusted source, it is validated: a non-nil error is returned
+// if counts are NaN, infinite or negative, or if bin indexes are outside the
+// range of the indexes that the index mapping can produce.
 func FromProtoWithStoreProvider(pb *sketchpb.DDSketch, storeProvider store.Provider) (*DDSketch, error) {
+	if pb == nil {
+		return nil, errors.New("cannot create DDSketch from nil protobuf sketch")
+	}
+	m, err := mapping.FromProto(pb.Mapping)
+	if err != nil {
+		return nil, err
+	}
+	if pb.ZeroCount < 0 || math.IsNaN(pb.ZeroCount) || math.IsInf(pb.ZeroCount, 1) {
+		return nil, store.ErrInvalidProtoCount
+	}
 	positiveValueStore := storeProvider()
 	if pb.PositiveValues != nil {
-		store.MergeWithProto(positiveValueStore, pb.PositiveValues)
+		if err := mergeWithProto(m, positiveValueStore, pb.PositiveValues); err != nil {
+			return nil, err
+		}
 	}
 	negativeValueStore := storeProvider()
 	if pb.NegativeValues != nil {
-		store.MergeWithProto(negativeValueStore, pb.NegativeValues)
-	}
-	m, err := mapping.FromProto(pb.Mapping)
-	if err != nil {
-		return nil, err
+		if err := mergeWithProto(m, negativeValueStore, pb.NegativeValues); err != nil {
+			return nil, err
+		}
 	}
 	return &DDSketch{
 		IndexMapping:       m,
@@ -345,6 +1716,30 @@ func FromProtoWithStoreProvider(pb *sketchpb.DDSketch, storeProvider store.Provi
 	}, nil
 }
 
+// mergeWithProto checks that the bin indexes of the protobuf Store can be
+// produced by the index mapping, so that a corrupt payload cannot make dense
+// stores allocate a huge number of bins, then merges it into s.
+func mergeWithProto(m mapping.IndexMapping, s store.Store, pb *sketchpb.Store) error {
+	minIndex, maxIndex := indexRange(m)
+	for index := range pb.BinCounts {
+		if int(index) < minIndex || int(index) > maxIndex {
+			return errIndexOutOfRange
+		}
+	}
+	if len(pb.ContiguousBinCounts) > 0 {
+		if int(pb.ContiguousBinIndexOffset) < minIndex || int64(pb.ContiguousBinIndexOffset)+int64(len(pb.ContiguousBinCounts))-1 > int64(maxIndex) {
+			return errIndexOutOfRange
+		}
+	}
+	return store.MergeWithProto(s, pb)
+}
+
+// indexRange returns the lowest and the highest indexes that the index mapping
+// can produce.
+func indexRange(m mapping.IndexMapping) (minIndex, maxIndex int) {
+	return m.Index(m.MinIndexableValue()), m.Index(m.MaxIndexableValue())
+}
+
 // Encode serializes the sketch and appends the serialized content to the provided []byte.
 // If the capacity of the provided []byte is large enough, Encode does not allocate memory space.
 // When the index mapping is known at the time of deserialization, omitIndexMapping can be set to true to avoid encoding it and to make the serialized content smaller.
@@ -363,6 +1758,107 @@ func (s *DDSketch) Encode(b *[]byte, omitIndexMapping bool) {
 	s.negativeValueStore.Encode(b, enc.FlagTypeNegativeStore)
 }
 
+// EncodeDelta serializes the changes of the sketch since the provided
+// checkpoint, which is an earlier copy of the sketch, and appends them to the
+// provided []byte. Only the bins whose counts have increased since the
+// checkpoint are encoded, with the increase of their counts, so that merging
+// the payload with DecodeAndMergeWith into a sketch that holds the content of
+// the checkpoint makes it hold the content of this sketch. This is much more
+// compact than encoding the whole sketch when it changes sparsely between
+// checkpoints.
+// Return a non-nil error, without appending anything, if the checkpoint does
+// not use the same index mapping or if the count of any bin has decreased
+// since the checkpoint, for instance, if values have been removed or bins have
+// been collapsed, which cannot be expressed as a merge.
+func (s *DDSketch) EncodeDelta(b *[]byte, since *DDSketch, omitIndexMapping bool) error {
+	if !s.IndexMapping.Equals(since.IndexMapping) {
+		return errors.New("the checkpoint does not use the same index mapping as the sketch")
+	}
+	if s.zeroCount < since.zeroCount {
+		return errDecreasedCount
+	}
+	positiveDelta, err := storeDelta(s.positiveValueStore, since.positiveValueStore)
+	if err != nil {
+		return err
+	}
+	negativeDelta, err := storeDelta(s.negativeValueStore, since.negativeValueStore)
+	if err != nil {
+		return err
+	}
+	delta := NewDDSketch(s.IndexMapping, positiveDelta, negativeDelta)
+	delta.zeroCount = s.zeroCount - since.zeroCount
+	delta.Encode(b, omitIndexMapping)
+	return nil
+}
+
+// storeDelta returns a store that holds the increases of the counts of the bins
+// of s since the checkpoint.
+func storeDelta(s, since store.Store) (*store.SparseStore, error) {
+	sinceCounts := make(map[int]float64)
+	since.ForEach(func(index int, count float64) (stop bool) {
+		sinceCounts[index] = count
+		return false
+	})
+	delta := store.NewSparseStore()
+	s.ForEach(func(index int, count float64) (stop bool) {
+		if count > sinceCounts[index] {
+			delta.AddWithCount(index, count-sinceCounts[index])
+		} else if count < sinceCounts[index] {
+			return true
+		}
+		delete(sinceCounts, index)
+		return false
+	})
+	if len(sinceCounts) > 0 {
+		return nil, errDecreasedCount
+	}
+	return delta, nil
+}
+
+// EncodeWithVersion serializes the sketch like Encode does, but prefixes the
+// output with the version of the encoding format, which allows decoders to
+// explicitly reject payloads using a format that they do not support.
+// Decoding functions accept both payloads with and without version.
+func (s *DDSketch) EncodeWithVersion(b *[]byte, omitIndexMapping bool) {
+	encodeVersion(b)
+	s.Encode(b, omitIndexMapping)
+}
+
+func encodeVersion(b *[]byte) {
+	enc.EncodeFlag(b, enc.FlagVersion)
+	enc.EncodeUvarint64(b, enc.Version)
+}
+
+// EncodeTo writes the serialized sketch to w, without building an intermediate
+// []byte holding the whole serialized sketch, which is useful to stream large
+// sketches to files or sockets. The written bytes may differ from those that
+// Encode appends but can be decoded the same way, with DecodeDDSketch or
+// DecodeAndMergeWith. As many small writes are performed, w should generally be
+// buffered (e.g., using bufio.Writer).
+func (s *DDSketch) EncodeTo(w io.Writer, omitIndexMapping bool) error {
+	if s.zeroCount != 0 {
+		if err := enc.WriteFlag(w, enc.FlagZeroCountVarFloat); err != nil {
+			return err
+		}
+		if err := enc.WriteVarfloat64(w, s.zeroCount); err != nil {
+			return err
+		}
+	}
+
+	if !omitIndexMapping {
+		var b []byte
+		s.IndexMapping.Encode(&b)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	if err := store.EncodeTo(w, s.positiveValueStore, enc.FlagTypePositiveStore); err != nil {
+		return err
+	}
+	return store.EncodeTo(w, s.negativeValueStore, enc.FlagTypeNegativeStore)
+}
+
 // DecodeDDSketch deserializes a sketch.
 // Stores are built using storeProvider. The store type needs not match the
 // store that the serialized sketch initially used. However, using the same
@@ -390,38 +1886,130 @@ func DecodeDDSketch(b []byte, storeProvider store.Provider, indexMapping mapping
 	return s, err
 }
 
+// DecodeDDSketchWithOptions is like DecodeDDSketch, but it returns an error
+// if the serialized data has NaN, infinite or negative counts, or bins that
+// are not within the limits of options (see DecodeAndMergeWithOptions). It
+// should be preferred when decoding data that may not be trusted.
+func DecodeDDSketchWithOptions(b []byte, storeProvider store.Provider, indexMapping mapping.IndexMapping, options store.DecodingOptions) (*DDSketch, error) {
+	s := &DDSketch{
+		IndexMapping:       indexMapping,
+		positiveValueStore: storeProvider(),
+		negativeValueStore: storeProvider(),
+		zeroCount:          float64(0),
+	}
+	err := s.DecodeAndMergeWithOptions(b, options)
+	return s, err
+}
+
 // DecodeAndMergeWith deserializes a sketch and merges its content in the
 // receiver sketch.
 // If the serialized content contains an index mapping that differs from the one
 // of the receiver, DecodeAndMergeWith returns an error.
 func (s *DDSketch) DecodeAndMergeWith(bb []byte) error {
-	return s.decodeAndMergeWith(bb, func(b *[]byte, flag enc.Flag) error {
-		switch flag {
-		case enc.FlagCount, enc.FlagSum, enc.FlagMin, enc.FlagMax:
-			// Exact summary stats are ignored.
-			if len(*b) < 8 {
-				return io.EOF
-			}
-			*b = (*b)[8:]
-			return nil
-		default:
-			return errUnknownFlag
+	return s.decodeAndMergeWith(bb, nil, skipExactSummaryStatistics, nil)
+}
+
+// DecodeAndMergeWithOptions is like DecodeAndMergeWith, but it returns an
+// error if the serialized content has NaN, infinite or negative counts, or
+// bins that are not within the limits of options. The limit on the number of
+// bins applies to each of the stores, over all the blocks that encode them.
+// The bins are validated before being merged, so that invalid bins do not
+// make the stores allocate memory, but the receiver may have been partially
+// updated if an error is returned.
+func (s *DDSketch) DecodeAndMergeWithOptions(bb []byte, options store.DecodingOptions) error {
+	return s.decodeAndMergeWith(bb, nil, skipExactSummaryStatistics, &options)
+}
+
+// DecodeInto replaces the content of the receiver with the decoded sketch. The
+// stores of the receiver are cleared while retaining the memory that they have
+// allocated (see ClearRetainingCapacity) and reused, which avoids allocating
+// when repeatedly decoding sketches into the same receiver. If the receiver
+// does not have any stores, they are built using store.DefaultProvider.
+// Unlike clearing the receiver and calling DecodeAndMergeWith, the index
+// mapping of the receiver is replaced with the encoded one, if any, instead of
+// causing a mismatch error. If the index mapping has been omitted from the
+// encoding, the one of the receiver is kept. If an error is returned, the
+// receiver is left empty, with its previous index mapping.
+func (s *DDSketch) DecodeInto(b []byte) error {
+	indexMapping := s.IndexMapping
+	s.resetRetainingCapacity()
+	if err := s.decodeAndMergeWith(b, indexMapping, skipExactSummaryStatistics, nil); err != nil {
+		s.resetRetainingCapacity()
+		s.IndexMapping = indexMapping
+		return err
+	}
+	return nil
+}
+
+// skipExactSummaryStatistics skips the encoded exact summary statistics, which
+// DDSketch does not track.
+func skipExactSummaryStatistics(b *[]byte, flag enc.Flag) error {
+	switch flag {
+	case enc.FlagCount:
+		// The count is encoded as a varfloat, unlike the other statistics.
+		_, err := enc.DecodeVarfloat64(b)
+		return err
+	case enc.FlagSum, enc.FlagMin, enc.FlagMax, enc.FlagSumOfSquaredDeviations:
+		// Exact summary stats are ignored.
+		if len(*b) < 8 {
+			return io.EOF
 		}
-	})
+		*b = (*b)[8:]
+		return nil
+	default:
+		return errUnknownFlag
+	}
+}
+
+// decodeAndMergeWith decodes the sketch and merges it into this one, using
+// fallbackIndexMapping if neither this sketch nor the encoding has an index
+// mapping, and fallbackDecode to decode the flags that DDSketch does not know.
+// If options is not nil, the encoded bins and zero count are validated first.
+// As with Add, a *store.MemoryLimitError is returned if bins have been dropped
+// because they would have exceeded the memory limit of the stores.
+func (s *DDSketch) decodeAndMergeWith(bb []byte, fallbackIndexMapping mapping.IndexMapping, fallbackDecode func(b *[]byte, flag enc.Flag) error, options *store.DecodingOptions) error {
+	if err := s.decodeAndMergeBlocks(bb, fallbackIndexMapping, fallbackDecode, options); err != nil {
+		// The decoding error supersedes the rejections of the stores, which
+		// must not be reported by the next addition.
+		s.takeStoreError()
+		return err
+	}
+	s.enforceMaxNumBins()
+	return s.takeStoreError()
 }
 
-func (s *DDSketch) decodeAndMergeWith(bb []byte, fallbackDecode func(b *[]byte, flag enc.Flag) error) error {
+// decodeAndMergeBlocks decodes the blocks of the encoded sketch and merges
+// them into this one (see decodeAndMergeWith).
+func (s *DDSketch) decodeAndMergeBlocks(bb []byte, fallbackIndexMapping mapping.IndexMapping, fallbackDecode func(b *[]byte, flag enc.Flag) error, options *store.DecodingOptions) error {
 	b := &bb
-	for len(*b) > 0 {
+	var numPositiveBins, numNegativeBins int
+	decodeStore := func(st store.Store, numBins *int, binEncodingMode enc.SubFlag) error {
+		if options != nil {
+			n, err := store.ValidateEncodedBins(*b, binEncodingMode, *options)
+			if err != nil {
+				return err
+			}
+			*numBins += n
+			if options.MaxNumBins > 0 && *numBins > options.MaxNumBins {
+				return store.ErrDecodingLimitExceeded
+			}
+		}
+		return st.DecodeAndMergeWith(b, binEncodingMode)
+	}
+	for isFirstBlock := true; len(*b) > 0; isFirstBlock = false {
 		flag, err := enc.DecodeFlag(b)
 		if err != nil {
 			return err
 		}
 		switch flag.Type() {
 		case enc.FlagTypePositiveStore:
-			s.positiveValueStore.DecodeAndMergeWith(b, flag.SubFlag())
+			if err := decodeStore(s.positiveValueStore, &numPositiveBins, flag.SubFlag()); err != nil {
+				return err
+			}
 		case enc.FlagTypeNegativeStore:
-			s.negativeValueStore.DecodeAndMergeWith(b, flag.SubFlag())
+			if err := decodeStore(s.negativeValueStore, &numNegativeBins, flag.SubFlag()); err != nil {
+				return err
+			}
 		case enc.FlagTypeIndexMapping:
 			decodedIndexMapping, err := mapping.Decode(b, flag)
 			if err != nil {
@@ -439,8 +2027,30 @@ func (s *DDSketch) decodeAndMergeWith(bb []byte, fallbackDecode func(b *[]byte,
 				if err != nil {
 					return err
 				}
+				if options != nil && !(decodedZeroCount >= 0 && !math.IsInf(decodedZeroCount, 1)) {
+					return store.ErrInvalidEncodedCount
+				}
 				s.zeroCount += decodedZeroCount
 
+			case enc.FlagSketchType:
+				// The type only matters to Decode, which picks the function
+				// that decodes the payload.
+				if _, err := enc.DecodeUvarint64(b); err != nil {
+					return err
+				}
+
+			case enc.FlagVersion:
+				if !isFirstBlock {
+					return errors.New("the encoding version must come first")
+				}
+				version, err := enc.DecodeUvarint64(b)
+				if err != nil {
+					return err
+				}
+				if version == 0 || version > enc.Version {
+					return fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+				}
+
 			default:
 				err := fallbackDecode(b, flag)
 				if err != nil {
@@ -450,12 +2060,113 @@ func (s *DDSketch) decodeAndMergeWith(bb []byte, fallbackDecode func(b *[]byte,
 		}
 	}
 
+	if s.IndexMapping == nil {
+		s.IndexMapping = fallbackIndexMapping
+	}
 	if s.IndexMapping == nil {
 		return errors.New("missing index mapping")
 	}
 	return nil
 }
 
+// MarshalBinary implements encoding.BinaryMarshaler. The sketch is serialized
+// with Encode, including its index mapping.
+func (s *DDSketch) MarshalBinary() ([]byte, error) {
+	var b []byte
+	s.Encode(&b, false)
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler. It replaces the
+// content of the receiver, including its index mapping, with the decoded
+// sketch. The stores of the decoded sketch are of the same types as those of
+// the receiver, if any. Otherwise, they are built using store.DefaultProvider.
+// The receiver is not modified if an error is returned.
+func (s *DDSketch) UnmarshalBinary(data []byte) error {
+	decoded := s.emptyLike()
+	if err := decoded.DecodeAndMergeWith(data); err != nil {
+		return err
+	}
+	*s = *decoded
+	return nil
+}
+
+// MarshalProto serializes the protobuf representation of the sketch (see
+// ToProto) using the google.golang.org/protobuf runtime.
+func (s *DDSketch) MarshalProto() ([]byte, error) {
+	return proto.Marshal(s.ToProto())
+}
+
+// UnmarshalProto replaces the content of the receiver, including its index
+// mapping, with the sketch whose serialized protobuf representation is
+// provided (see FromProtoWithStoreProvider). If the receiver already has
+// stores, the decoded sketch has stores of the same types. Otherwise, stores
+// are built using store.DefaultProvider. The receiver is left unchanged if an
+// error is returned.
+func (s *DDSketch) UnmarshalProto(data []byte) error {
+	var pb sketchpb.DDSketch
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return err
+	}
+	sketch, err := FromProtoWithStoreProvider(&pb, s.emptyStoresProvider())
+	if err != nil {
+		return err
+	}
+	sketch.SetMaxNumBins(s.maxNumBins)
+	sketch.quantileInterpolation = s.quantileInterpolation
+	sketch.clampOutOfRange = s.clampOutOfRange
+	*s = *sketch
+	return nil
+}
+
+// emptyStoresProvider returns a provider that successively returns empty
+// stores of the same types as the positive and negative value stores of the
+// sketch, which are left untouched, or new stores if it does not have any.
+func (s *DDSketch) emptyStoresProvider() store.Provider {
+	stores := []store.Store{emptyStoreLike(s.positiveValueStore), emptyStoreLike(s.negativeValueStore)}
+	return func() store.Store {
+		if len(stores) == 0 {
+			return store.DefaultProvider()
+		}
+		st := stores[0]
+		stores = stores[1:]
+		return st
+	}
+}
+
+// emptyLike returns an empty sketch without index mapping, whose stores are of
+// the same types as those of this sketch, and that has the same settings.
+func (s *DDSketch) emptyLike() *DDSketch {
+	return &DDSketch{
+		positiveValueStore:    emptyStoreLike(s.positiveValueStore),
+		negativeValueStore:    emptyStoreLike(s.negativeValueStore),
+		maxNumBins:            s.maxNumBins,
+		quantileInterpolation: s.quantileInterpolation,
+		clampOutOfRange:       s.clampOutOfRange,
+		smallIntIndexes:       s.smallIntIndexes,
+	}
+}
+
+func emptyStoreLike(s store.Store) store.Store {
+	if s == nil {
+		return store.DefaultProvider()
+	}
+	return emptystore.NewLike(s).(store.Store)
+}
+
+// resetRetainingCapacity empties the sketch and removes its index mapping,
+// retaining the memory that the stores have allocated.
+func (s *DDSketch) resetRetainingCapacity() {
+	s.IndexMapping = nil
+	if s.positiveValueStore == nil {
+		s.positiveValueStore = store.DefaultProvider()
+	}
+	if s.negativeValueStore == nil {
+		s.negativeValueStore = store.DefaultProvider()
+	}
+	s.ClearRetainingCapacity()
+}
+
 // ChangeMapping changes the store to a new mapping.
 // it doesn't change s but returns a newly created sketch.
 // positiveStore and negativeStore must be different stores, and be empty when the function is called.
@@ -473,24 +2184,69 @@ func (s *DDSketch) ChangeMapping(newMapping mapping.IndexMapping, positiveStore
 	return newSketch
 }
 
+// ChangeStore returns a new sketch that has the same content and the same
+// index mapping as this sketch, but whose bins are held by stores that are
+// built using storeProvider, for instance, to move to a store that is bounded
+// in size before long-term retention. This sketch is not modified.
+func (s *DDSketch) ChangeStore(storeProvider store.Provider) *DDSketch {
+	positiveValueStore := storeProvider()
+	positiveValueStore.MergeWith(s.positiveValueStore)
+	negativeValueStore := storeProvider()
+	negativeValueStore.MergeWith(s.negativeValueStore)
+	newSketch := NewDDSketch(s.IndexMapping, positiveValueStore, negativeValueStore)
+	newSketch.zeroCount = s.zeroCount
+	newSketch.SetMaxNumBins(s.maxNumBins)
+	newSketch.quantileInterpolation = s.quantileInterpolation
+	newSketch.clampOutOfRange = s.clampOutOfRange
+	newSketch.clampedCount = s.clampedCount
+	return newSketch
+}
+
+// Downsample returns a new sketch whose bins are the bins of this sketch merged
+// by groups of 2^factorLog2 adjacent indexes (see store.Store.Downsample), and
+// whose index mapping is coarsened accordingly (see mapping.Downsample). This
+// reduces the memory and encoded sizes of the sketch, for instance, before
+// long-term retention, at the cost of a relative accuracy that is roughly
+// multiplied by 2^factorLog2. This sketch is not modified.
+func (s *DDSketch) Downsample(factorLog2 int) (*DDSketch, error) {
+	indexMapping, err := mapping.Downsample(s.IndexMapping, factorLog2)
+	if err != nil {
+		return nil, err
+	}
+	newSketch := NewDDSketch(indexMapping, s.positiveValueStore.Downsample(factorLog2), s.negativeValueStore.Downsample(factorLog2))
+	newSketch.zeroCount = s.zeroCount
+	newSketch.SetMaxNumBins(s.maxNumBins)
+	newSketch.quantileInterpolation = s.quantileInterpolation
+	newSketch.clampOutOfRange = s.clampOutOfRange
+	newSketch.clampedCount = s.clampedCount
+	return newSketch, nil
+}
+
 func changeStoreMapping(oldMapping, newMapping mapping.IndexMapping, oldStore, newStore store.Store, scaleFactor float64) {
 	oldStore.ForEach(func(index int, count float64) (stop bool) {
-		inLowerBound := oldMapping.LowerBound(index) * scaleFactor
-		inHigherBound := oldMapping.LowerBound(index+1) * scaleFactor
-		inSize := inHigherBound - inLowerBound
-		for outIndex := newMapping.Index(inLowerBound); newMapping.LowerBound(outIndex) < inHigherBound; outIndex++ {
-			outLowerBound := newMapping.LowerBound(outIndex)
-			outHigherBound := newMapping.LowerBound(outIndex + 1)
-			lowerIntersectionBound := math.Max(outLowerBound, inLowerBound)
-			higherIntersectionBound := math.Min(outHigherBound, inHigherBound)
-			intersectionSize := higherIntersectionBound - lowerIntersectionBound
-			proportion := intersectionSize / inSize
-			newStore.AddWithCount(outIndex, proportion*count)
-		}
+		addScaledBin(oldMapping, newMapping, newStore, index, count, scaleFactor)
 		return false
 	})
 }
 
+// addScaledBin distributes the count of the bin of oldMapping at the provided
+// index, once scaled by scaleFactor, to the overlapping bins of newMapping, in
+// proportion to the size of their intersection.
+func addScaledBin(oldMapping, newMapping mapping.IndexMapping, newStore store.Store, index int, count, scaleFactor float64) {
+	inLowerBound := oldMapping.LowerBound(index) * scaleFactor
+	inHigherBound := oldMapping.UpperBound(index) * scaleFactor
+	inSize := inHigherBound - inLowerBound
+	for outIndex := newMapping.Index(inLowerBound); newMapping.LowerBound(outIndex) < inHigherBound; outIndex++ {
+		outLowerBound := newMapping.LowerBound(outIndex)
+		outHigherBound := newMapping.UpperBound(outIndex)
+		lowerIntersectionBound := math.Max(outLowerBound, inLowerBound)
+		higherIntersectionBound := math.Min(outHigherBound, inHigherBound)
+		intersectionSize := higherIntersectionBound - lowerIntersectionBound
+		proportion := intersectionSize / inSize
+		newStore.AddWithCount(outIndex, proportion*count)
+	}
+}
+
 // Reweight multiplies all values from the sketch by w, but keeps the same global distribution.
 // w has to be strictly greater than 0.
 func (s *DDSketch) Reweight(w float64) error {
@@ -501,13 +2257,86 @@ func (s *DDSketch) Reweight(w float64) error {
 		return nil
 	}
 	s.zeroCount *= w
+	s.clampedCount *= w
 	if err := s.positiveValueStore.Reweight(w); err != nil {
 		return err
 	}
-	if err := s.negativeValueStore.Reweight(w); err != nil {
-		return err
+	if err := s.negativeValueStore.Reweight(w); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Rescale multiplies all the values that have been added to the sketch by
+// factor, which has to be strictly positive, for instance, to convert them to
+// another unit. Unlike ChangeMapping, it keeps the mapping and the stores of
+// the sketch.
+// If multiplying by factor amounts to shifting the bins of the mapping, which
+// is for instance the case if factor is a power of gamma with the logarithmic
+// mapping, bin counts are shifted accordingly. Otherwise, the count of every
+// bin is distributed to the bins that it overlaps once rescaled, which may
+// result in some loss of accuracy.
+// Rescaled values that are too small to be indexed are moved to the zero bin.
+// Return a non-nil error and leave the sketch unchanged if factor is invalid
+// or if rescaled values would be too large to be indexed.
+func (s *DDSketch) Rescale(factor float64) error {
+	if !(factor > 0) || math.IsInf(factor, 1) {
+		return errors.New("the rescaling factor must be strictly positive and finite")
+	}
+	if factor == 1 {
+		return nil
+	}
+	for _, st := range []store.Store{s.positiveValueStore, s.negativeValueStore} {
+		if maxIndex, err := st.MaxIndex(); err == nil && s.UpperBound(maxIndex)*factor > s.MaxIndexableValue() {
+			return errors.New("rescaled values are too large to be indexed")
+		}
+	}
+	s.rescaleStore(s.positiveValueStore, factor)
+	s.rescaleStore(s.negativeValueStore, factor)
+	s.enforceMaxNumBins()
+	return nil
+}
+
+func (s *DDSketch) rescaleStore(st store.Store, factor float64) {
+	if st.IsEmpty() {
+		return
+	}
+	var indexes []int
+	var counts []float64
+	st.ForEach(func(index int, count float64) (stop bool) {
+		indexes = append(indexes, index)
+		counts = append(counts, count)
+		return false
+	})
+
+	// Check whether rescaling amounts to shifting all bins by the same offset.
+	shift := s.Index(s.Value(indexes[0])*factor) - indexes[0]
+	isShift := true
+	for _, index := range indexes {
+		if !s.isScaledLowerBound(index, shift, factor) || !s.isScaledLowerBound(index+1, shift, factor) {
+			isShift = false
+			break
+		}
+	}
+
+	st.ClearRetainingCapacity()
+	for i, index := range indexes {
+		if s.Value(index)*factor < s.MinIndexableValue() {
+			s.zeroCount += counts[i]
+		} else if isShift {
+			st.AddWithCount(index+shift, counts[i])
+		} else {
+			addScaledBin(s.IndexMapping, s.IndexMapping, st, index, counts[i], factor)
+		}
 	}
-	return nil
+}
+
+// isScaledLowerBound returns whether the lower bound of the bin at index+shift
+// is equal, up to floating-point errors, to the lower bound of the bin at index
+// multiplied by factor.
+func (s *DDSketch) isScaledLowerBound(index, shift int, factor float64) bool {
+	expected := s.LowerBound(index) * factor
+	return math.Abs(s.LowerBound(index+shift)-expected) <= 1e-12*expected
 }
 
 // DDSketchWithExactSummaryStatistics returns exact count, sum, min and max, as
@@ -537,6 +2366,42 @@ func NewDDSketchWithExactSummaryStatistics(mapping mapping.IndexMapping, storePr
 	}
 }
 
+// Constructs an instance of DDSketchWithExactSummaryStatistics that is otherwise similar to the one
+// that LogUnboundedDenseDDSketch constructs.
+func LogUnboundedDenseDDSketchWithExactSummaryStatistics(relativeAccuracy float64) (*DDSketchWithExactSummaryStatistics, error) {
+	return withExactSummaryStatistics(LogUnboundedDenseDDSketch(relativeAccuracy))
+}
+
+// Constructs an instance of DDSketchWithExactSummaryStatistics that is otherwise similar to the one
+// that LogCollapsingLowestDenseDDSketch constructs. As min and max are tracked exactly, the lowest
+// quantiles remain bounded by the exact minimum even if bins have been collapsed.
+func LogCollapsingLowestDenseDDSketchWithExactSummaryStatistics(relativeAccuracy float64, maxNumBins int) (*DDSketchWithExactSummaryStatistics, error) {
+	return withExactSummaryStatistics(LogCollapsingLowestDenseDDSketch(relativeAccuracy, maxNumBins))
+}
+
+// Constructs an instance of DDSketchWithExactSummaryStatistics that is otherwise similar to the one
+// that LogCollapsingHighestDenseDDSketch constructs. As min and max are tracked exactly, the highest
+// quantiles remain bounded by the exact maximum even if bins have been collapsed.
+func LogCollapsingHighestDenseDDSketchWithExactSummaryStatistics(relativeAccuracy float64, maxNumBins int) (*DDSketchWithExactSummaryStatistics, error) {
+	return withExactSummaryStatistics(LogCollapsingHighestDenseDDSketch(relativeAccuracy, maxNumBins))
+}
+
+// Constructs an instance of DDSketchWithExactSummaryStatistics that is otherwise similar to the one
+// that LogBufferedPaginatedDDSketch constructs.
+func LogBufferedPaginatedDDSketchWithExactSummaryStatistics(relativeAccuracy float64) (*DDSketchWithExactSummaryStatistics, error) {
+	return withExactSummaryStatistics(LogBufferedPaginatedDDSketch(relativeAccuracy))
+}
+
+func withExactSummaryStatistics(sketch *DDSketch, err error) (*DDSketchWithExactSummaryStatistics, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &DDSketchWithExactSummaryStatistics{
+		DDSketch:          sketch,
+		summaryStatistics: stat.NewSummaryStatistics(),
+	}, nil
+}
+
 // NewDDSketchWithExactSummaryStatisticsFromData constructs DDSketchWithExactSummaryStatistics from the provided sketch and exact summary statistics.
 func NewDDSketchWithExactSummaryStatisticsFromData(sketch *DDSketch, summaryStatistics *stat.SummaryStatistics) (*DDSketchWithExactSummaryStatistics, error) {
 	if sketch.IsEmpty() != (summaryStatistics.Count() == 0) {
@@ -552,6 +2417,12 @@ func (s *DDSketchWithExactSummaryStatistics) IsEmpty() bool {
 	return s.summaryStatistics.Count() == 0
 }
 
+// MemorySize returns an approximation of the memory size in bytes that the
+// sketch uses, including its summary statistics (see DDSketch.MemorySize).
+func (s *DDSketchWithExactSummaryStatistics) MemorySize() int {
+	return int(unsafe.Sizeof(*s)) + s.DDSketch.MemorySize() + int(unsafe.Sizeof(*s.summaryStatistics))
+}
+
 func (s *DDSketchWithExactSummaryStatistics) GetCount() float64 {
 	return s.summaryStatistics.Count()
 }
@@ -567,6 +2438,22 @@ func (s *DDSketchWithExactSummaryStatistics) GetSum() float64 {
 	return s.summaryStatistics.Sum()
 }
 
+// GetVariance returns the exact population variance of the values that have
+// been added to this sketch. Return a non-nil error if the sketch is empty.
+func (s *DDSketchWithExactSummaryStatistics) GetVariance() (float64, error) {
+	if s.DDSketch.IsEmpty() {
+		return math.NaN(), errEmptySketch
+	}
+	return s.summaryStatistics.Variance(), nil
+}
+
+// GetStdDev returns the exact population standard deviation of the values that
+// have been added to this sketch. Return a non-nil error if the sketch is empty.
+func (s *DDSketchWithExactSummaryStatistics) GetStdDev() (float64, error) {
+	variance, err := s.GetVariance()
+	return math.Sqrt(variance), err
+}
+
 // GetPositiveValueStore returns the store.Store object that contains the positive
 // values of the sketch.
 func (s *DDSketchWithExactSummaryStatistics) GetPositiveValueStore() store.Store {
@@ -593,6 +2480,17 @@ func (s *DDSketchWithExactSummaryStatistics) GetMaxValue() (float64, error) {
 	return s.summaryStatistics.Max(), nil
 }
 
+// GetMode returns an approximation of the most frequent value that has been
+// added to this sketch (see DDSketch.GetMode), within the exact minimum and
+// maximum values.
+func (s *DDSketchWithExactSummaryStatistics) GetMode() (float64, error) {
+	mode, err := s.DDSketch.GetMode()
+	if err != nil {
+		return mode, err
+	}
+	return math.Max(s.summaryStatistics.Min(), math.Min(mode, s.summaryStatistics.Max())), nil
+}
+
 func (s *DDSketchWithExactSummaryStatistics) GetValueAtQuantile(quantile float64) (float64, error) {
 	value, err := s.DDSketch.GetValueAtQuantile(quantile)
 	min := s.summaryStatistics.Min()
@@ -606,6 +2504,28 @@ func (s *DDSketchWithExactSummaryStatistics) GetValueAtQuantile(quantile float64
 	return value, err
 }
 
+// GetValueAtQuantileWithBounds returns the value at the specified quantile and
+// the bounds of the range that the actual quantile falls in (see
+// DDSketch.GetValueAtQuantileWithBounds). The value and the bounds are
+// narrowed down using the exact minimum and maximum values.
+func (s *DDSketchWithExactSummaryStatistics) GetValueAtQuantileWithBounds(quantile float64) (value, lower, upper float64, err error) {
+	value, lower, upper, err = s.DDSketch.GetValueAtQuantileWithBounds(quantile)
+	if err != nil {
+		return value, lower, upper, err
+	}
+	min := s.summaryStatistics.Min()
+	max := s.summaryStatistics.Max()
+	return math.Min(math.Max(value, min), max), math.Max(lower, min), math.Min(upper, max), nil
+}
+
+// GetValuesAtQuantilesWithBounds returns the values at the respective specified
+// quantiles and the bounds of the ranges that the actual quantiles fall in,
+// narrowed down using the exact minimum and maximum values (see
+// GetValueAtQuantileWithBounds).
+func (s *DDSketchWithExactSummaryStatistics) GetValuesAtQuantilesWithBounds(quantiles []float64) (values, lowers, uppers []float64, err error) {
+	return valuesAtQuantilesWithBounds(s.GetValueAtQuantileWithBounds, quantiles)
+}
+
 func (s *DDSketchWithExactSummaryStatistics) GetValuesAtQuantiles(quantiles []float64) ([]float64, error) {
 	values, err := s.DDSketch.GetValuesAtQuantiles(quantiles)
 	min := s.summaryStatistics.Min()
@@ -620,21 +2540,60 @@ func (s *DDSketchWithExactSummaryStatistics) GetValuesAtQuantiles(quantiles []fl
 	return values, err
 }
 
+// GetTrimmedMean returns an approximation of the mean of the values whose
+// quantiles are between lowerQuantile and upperQuantile (see
+// DDSketch.GetTrimmedMean). The mean is exact if the range covers all values.
+func (s *DDSketchWithExactSummaryStatistics) GetTrimmedMean(lowerQuantile, upperQuantile float64) (float64, error) {
+	mean, err := s.DDSketch.GetTrimmedMean(lowerQuantile, upperQuantile)
+	if err != nil {
+		return mean, err
+	}
+	if lowerQuantile == 0 && upperQuantile == 1 {
+		return s.summaryStatistics.Sum() / s.summaryStatistics.Count(), nil
+	}
+	return math.Max(s.summaryStatistics.Min(), math.Min(mean, s.summaryStatistics.Max())), nil
+}
+
 func (s *DDSketchWithExactSummaryStatistics) ForEach(f func(value, count float64) (stop bool)) {
 	s.DDSketch.ForEach(f)
 }
 
+// Sample draws n random values from the distribution that the sketch encodes
+// (see DDSketch.Sample), within the exact minimum and maximum values.
+func (s *DDSketchWithExactSummaryStatistics) Sample(n int, r *rand.Rand) []float64 {
+	samples := s.DDSketch.Sample(n, r)
+	for i, sample := range samples {
+		samples[i] = math.Max(s.summaryStatistics.Min(), math.Min(s.summaryStatistics.Max(), sample))
+	}
+	return samples
+}
+
 func (s *DDSketchWithExactSummaryStatistics) Clear() {
 	s.DDSketch.Clear()
 	s.summaryStatistics.Clear()
 }
 
+func (s *DDSketchWithExactSummaryStatistics) ClearRetainingCapacity() {
+	s.DDSketch.ClearRetainingCapacity()
+	s.summaryStatistics.Clear()
+}
+
 func (s *DDSketchWithExactSummaryStatistics) Add(value float64) error {
 	err := s.DDSketch.Add(value)
 	if err != nil {
 		return err
 	}
-	s.summaryStatistics.Add(value, 1)
+	s.summaryStatistics.Add(s.clampValue(value), 1)
+	return nil
+}
+
+// AddInt adds an integer value to the sketch (see DDSketch.AddInt).
+func (s *DDSketchWithExactSummaryStatistics) AddInt(value int64) error {
+	err := s.DDSketch.AddInt(value)
+	if err != nil {
+		return err
+	}
+	s.summaryStatistics.Add(float64(value), 1)
 	return nil
 }
 
@@ -646,16 +2605,227 @@ func (s *DDSketchWithExactSummaryStatistics) AddWithCount(value, count float64)
 	if err != nil {
 		return err
 	}
-	s.summaryStatistics.Add(value, count)
+	s.summaryStatistics.Add(s.clampValue(value), count)
+	return nil
+}
+
+// RemoveWithCount subtracts count from the count of the bin that value falls
+// into, clamping it at zero (see DDSketch.RemoveWithCount). The count, the sum
+// and the variance are adjusted by the count that is actually removed from the
+// bin, but the min and the max cannot be recovered and are kept as bounds of
+// the remaining values.
+func (s *DDSketchWithExactSummaryStatistics) RemoveWithCount(value, count float64) error {
+	if count == 0 {
+		return nil
+	}
+	countBefore := s.DDSketch.GetCount()
+	err := s.DDSketch.RemoveWithCount(value, count)
+	if err != nil {
+		return err
+	}
+	if s.DDSketch.IsEmpty() {
+		s.summaryStatistics.Clear()
+		return nil
+	}
+	s.summaryStatistics.Remove(s.clampValue(value), countBefore-s.DDSketch.GetCount())
+	return nil
+}
+
+// AddValues adds multiple values to the sketch (see DDSketch.AddValues). If the
+// stores of the sketch have a memory limit, the values are added one by one, so
+// that the summary statistics only track the values that the stores accept.
+func (s *DDSketchWithExactSummaryStatistics) AddValues(values []float64) error {
+	if s.hasBoundedStores() {
+		if err := s.checkTrackable(values); err != nil {
+			return err
+		}
+		var err error
+		for _, value := range values {
+			err = combineStoreErrors(err, s.Add(value))
+		}
+		return err
+	}
+	err := s.DDSketch.AddValues(values)
+	if err != nil {
+		return err
+	}
+	for _, value := range values {
+		s.summaryStatistics.Add(s.clampValue(value), 1)
+	}
+	return nil
+}
+
+// AddWithCounts adds multiple values to the sketch, each with the count at the
+// same position in counts (see DDSketch.AddWithCounts). As with AddValues, the
+// summary statistics only track the values that the stores accept. As with
+// AddWithCount, values whose counts are zero are ignored without being checked.
+func (s *DDSketchWithExactSummaryStatistics) AddWithCounts(values, counts []float64) error {
+	values, counts = withoutZeroCounts(values, counts)
+	if s.hasBoundedStores() {
+		if err := s.checkTrackableWithCounts(values, counts); err != nil {
+			return err
+		}
+		var err error
+		for i, value := range values {
+			err = combineStoreErrors(err, s.AddWithCount(value, counts[i]))
+		}
+		return err
+	}
+	err := s.DDSketch.AddWithCounts(values, counts)
+	if err != nil {
+		return err
+	}
+	for i, value := range values {
+		s.summaryStatistics.Add(s.clampValue(value), counts[i])
+	}
 	return nil
 }
 
+// withoutZeroCounts returns the values and the counts without the values whose
+// counts are zero, which AddWithCount ignores without checking them. The
+// provided slices are returned as is if there are no such values or if they do
+// not have the same length.
+func withoutZeroCounts(values, counts []float64) ([]float64, []float64) {
+	numZeroCounts := 0
+	for _, count := range counts {
+		if count == 0 {
+			numZeroCounts++
+		}
+	}
+	if numZeroCounts == 0 || len(values) != len(counts) {
+		return values, counts
+	}
+	nonZeroValues := make([]float64, 0, len(values)-numZeroCounts)
+	nonZeroCounts := make([]float64, 0, len(counts)-numZeroCounts)
+	for i, count := range counts {
+		if count != 0 {
+			nonZeroValues = append(nonZeroValues, values[i])
+			nonZeroCounts = append(nonZeroCounts, count)
+		}
+	}
+	return nonZeroValues, nonZeroCounts
+}
+
+// MergeWith merges the other sketch, including its summary statistics, into
+// this one. If the stores of this sketch have a memory limit that the merge
+// would exceed, the sketch is left unchanged and a *store.MemoryLimitError is
+// returned, as the summary statistics of the bins that do not fit cannot be
+// told apart from the others (see updateAtomically).
 func (s *DDSketchWithExactSummaryStatistics) MergeWith(o *DDSketchWithExactSummaryStatistics) error {
-	err := s.DDSketch.MergeWith(o.DDSketch)
+	return s.updateAtomically(func(s *DDSketchWithExactSummaryStatistics) error {
+		err := s.DDSketch.MergeWith(o.DDSketch)
+		if err != nil {
+			return err
+		}
+		s.summaryStatistics.MergeWith(o.summaryStatistics)
+		return nil
+	})
+}
+
+// updateAtomically calls update with the sketch. If the stores of the sketch
+// have a memory limit, update is rather called with a copy of the sketch, which
+// replaces the content of the sketch only if update succeeds, so that the
+// summary statistics never track values that the stores have rejected. The
+// returned *store.MemoryLimitError then accounts for all the additions that
+// update has made.
+func (s *DDSketchWithExactSummaryStatistics) updateAtomically(update func(s *DDSketchWithExactSummaryStatistics) error) error {
+	if !s.hasBoundedStores() {
+		return update(s)
+	}
+	updated := s.Copy()
+	if err := update(updated); err != nil {
+		var limitErr *store.MemoryLimitError
+		if errors.As(err, &limitErr) {
+			return &store.MemoryLimitError{
+				MaxBytes:      limitErr.MaxBytes,
+				RejectedCount: limitErr.RejectedCount + updated.DDSketch.GetCount() - s.DDSketch.GetCount(),
+			}
+		}
+		return err
+	}
+	*s.DDSketch = *updated.DDSketch
+	s.summaryStatistics = updated.summaryStatistics
+	return nil
+}
+
+// MergeWithConverting merges the other sketch into this one, converting its
+// bins if it uses a different index mapping (see DDSketch.MergeWithConverting).
+// The summary statistics are merged exactly. As with MergeWith, the sketch is
+// left unchanged if the merge would exceed the memory limit of its stores.
+func (s *DDSketchWithExactSummaryStatistics) MergeWithConverting(o *DDSketchWithExactSummaryStatistics) error {
+	return s.updateAtomically(func(s *DDSketchWithExactSummaryStatistics) error {
+		err := s.DDSketch.MergeWithConverting(o.DDSketch)
+		if err != nil {
+			return err
+		}
+		s.summaryStatistics.MergeWith(o.summaryStatistics)
+		return nil
+	})
+}
+
+// MergeWithWeight merges the other sketch into this one, multiplying its counts
+// by w (see DDSketch.MergeWithWeight). The summary statistics are adjusted as
+// if the values of the other sketch had been added with counts multiplied by w.
+// As with MergeWith, the sketch is left unchanged if the merge would exceed the
+// memory limit of its stores.
+func (s *DDSketchWithExactSummaryStatistics) MergeWithWeight(o *DDSketchWithExactSummaryStatistics, w float64) error {
+	otherSummaryStatistics := o.summaryStatistics.Copy()
+	return s.updateAtomically(func(s *DDSketchWithExactSummaryStatistics) error {
+		if err := s.DDSketch.MergeWithWeight(o.DDSketch, w); err != nil {
+			return err
+		}
+		otherSummaryStatistics.Reweight(w)
+		s.summaryStatistics.MergeWith(otherSummaryStatistics)
+		return nil
+	})
+}
+
+// MergeWithSketch merges the content of the other sketch in this sketch. The
+// other sketch must track exact summary statistics, unless it is empty.
+func (s *DDSketchWithExactSummaryStatistics) MergeWithSketch(other QuantileSketch) error {
+	switch o := other.(type) {
+	case *DDSketchWithExactSummaryStatistics:
+		return s.MergeWith(o)
+	case *DDSketch:
+		if !o.IsEmpty() {
+			return errors.New("cannot merge a sketch that does not track exact summary statistics")
+		}
+		return s.DDSketch.MergeWith(o)
+	default:
+		var b []byte
+		other.Encode(&b, false)
+		return s.DecodeAndMergeWith(b)
+	}
+}
+
+// DiffWith subtracts the content of the other sketch from this one (see
+// DDSketch.DiffWith). The count, the sum and the variance are adjusted
+// accordingly, but the min and the max cannot be recovered and are kept as
+// bounds of the remaining values.
+func (s *DDSketchWithExactSummaryStatistics) DiffWith(o *DDSketchWithExactSummaryStatistics) error {
+	if s == o {
+		s.Clear()
+		return nil
+	}
+	err := s.DDSketch.DiffWith(o.DDSketch)
 	if err != nil {
 		return err
 	}
-	s.summaryStatistics.MergeWith(o.summaryStatistics)
+	if s.DDSketch.IsEmpty() {
+		s.summaryStatistics.Clear()
+		return nil
+	}
+	s.summaryStatistics.AddToCount(s.DDSketch.GetCount() - s.summaryStatistics.Count())
+	s.summaryStatistics.AddToSum(-o.summaryStatistics.Sum())
+	// Reverse the merge of the sum of squared deviations (see
+	// stat.SummaryStatistics.MergeWith).
+	count, otherCount := s.summaryStatistics.Count(), o.summaryStatistics.Count()
+	sumOfSquaredDeviations := s.summaryStatistics.SumOfSquaredDeviations() - o.summaryStatistics.SumOfSquaredDeviations()
+	if otherCount > 0 {
+		delta := o.summaryStatistics.Sum()/otherCount - s.summaryStatistics.Sum()/count
+		sumOfSquaredDeviations -= delta * delta * count * otherCount / (count + otherCount)
+	}
+	s.summaryStatistics.AddToSumOfSquaredDeviations(math.Max(0, sumOfSquaredDeviations) - s.summaryStatistics.SumOfSquaredDeviations())
 	return nil
 }
 
@@ -666,6 +2836,42 @@ func (s *DDSketchWithExactSummaryStatistics) Copy() *DDSketchWithExactSummarySta
 	}
 }
 
+// CopyTo overwrites the content of dst with the content of this sketch,
+// including its summary statistics, while reusing the memory that dst has
+// allocated (see DDSketch.CopyTo).
+func (s *DDSketchWithExactSummaryStatistics) CopyTo(dst *DDSketchWithExactSummaryStatistics) {
+	if s == dst {
+		return
+	}
+	if dst.DDSketch == nil {
+		dst.DDSketch = &DDSketch{}
+	}
+	s.DDSketch.CopyTo(dst.DDSketch)
+	if dst.summaryStatistics == nil {
+		dst.summaryStatistics = s.summaryStatistics.Copy()
+	} else {
+		*dst.summaryStatistics = *s.summaryStatistics
+	}
+}
+
+// Equals returns whether the other sketch has the same content and the same
+// summary statistics as this sketch (see DDSketch.Equals).
+func (s *DDSketchWithExactSummaryStatistics) Equals(other *DDSketchWithExactSummaryStatistics) bool {
+	return s.ApproxEquals(other, 0)
+}
+
+// ApproxEquals returns whether the other sketch has approximately the same
+// content as this sketch (see DDSketch.ApproxEquals) and whether the absolute
+// differences between their count, sum, minimum and maximum are at most
+// tolerance.
+func (s *DDSketchWithExactSummaryStatistics) ApproxEquals(other *DDSketchWithExactSummaryStatistics, tolerance float64) bool {
+	return s.DDSketch.ApproxEquals(other.DDSketch, tolerance) &&
+		approxEqual(s.summaryStatistics.Count(), other.summaryStatistics.Count(), tolerance) &&
+		approxEqual(s.summaryStatistics.Sum(), other.summaryStatistics.Sum(), tolerance) &&
+		approxEqual(s.summaryStatistics.Min(), other.summaryStatistics.Min(), tolerance) &&
+		approxEqual(s.summaryStatistics.Max(), other.summaryStatistics.Max(), tolerance)
+}
+
 func (s *DDSketchWithExactSummaryStatistics) Reweight(factor float64) error {
 	err := s.DDSketch.Reweight(factor)
 	if err != nil {
@@ -675,6 +2881,16 @@ func (s *DDSketchWithExactSummaryStatistics) Reweight(factor float64) error {
 	return nil
 }
 
+// Rescale multiplies all the values that have been added to the sketch by
+// factor, adjusting the summary statistics accordingly (see DDSketch.Rescale).
+func (s *DDSketchWithExactSummaryStatistics) Rescale(factor float64) error {
+	if err := s.DDSketch.Rescale(factor); err != nil {
+		return err
+	}
+	s.summaryStatistics.Rescale(factor)
+	return nil
+}
+
 func (s *DDSketchWithExactSummaryStatistics) ChangeMapping(newMapping mapping.IndexMapping, storeProvider store.Provider, scaleFactor float64) *DDSketchWithExactSummaryStatistics {
 	summaryStatisticsCopy := s.summaryStatistics.Copy()
 	summaryStatisticsCopy.Rescale(scaleFactor)
@@ -684,24 +2900,147 @@ func (s *DDSketchWithExactSummaryStatistics) ChangeMapping(newMapping mapping.In
 	}
 }
 
+// ChangeStore returns a new sketch that has the same content and the same
+// summary statistics as this sketch, but whose bins are held by stores that are
+// built using storeProvider (see DDSketch.ChangeStore).
+func (s *DDSketchWithExactSummaryStatistics) ChangeStore(storeProvider store.Provider) *DDSketchWithExactSummaryStatistics {
+	return &DDSketchWithExactSummaryStatistics{
+		DDSketch:          s.DDSketch.ChangeStore(storeProvider),
+		summaryStatistics: s.summaryStatistics.Copy(),
+	}
+}
+
+// Encode serializes the sketch, including its exact summary statistics. The
+// sum of squared deviations, which decoders that predate it do not accept, is
+// not encoded, so that the variance of the decoded sketch is zero. It is
+// encoded by EncodeWithVersion, EncodeWithType, EncodeDelta and MarshalBinary.
 func (s *DDSketchWithExactSummaryStatistics) Encode(b *[]byte, omitIndexMapping bool) {
-	if s.summaryStatistics.Count() != 0 {
+	s.encode(b, omitIndexMapping, false)
+}
+
+func (s *DDSketchWithExactSummaryStatistics) encode(b *[]byte, omitIndexMapping bool, withSumOfSquaredDeviations bool) {
+	encodeSummaryStatistics(b, s.summaryStatistics, withSumOfSquaredDeviations)
+	s.DDSketch.Encode(b, omitIndexMapping)
+}
+
+// EncodeWithVersion serializes the sketch like Encode does, but prefixes the
+// output with the version of the encoding format (see
+// DDSketch.EncodeWithVersion). As the decoders that accept the version also
+// accept the sum of squared deviations, it is encoded as well.
+func (s *DDSketchWithExactSummaryStatistics) EncodeWithVersion(b *[]byte, omitIndexMapping bool) {
+	encodeVersion(b)
+	s.encode(b, omitIndexMapping, true)
+}
+
+// EncodeTo writes the serialized sketch, including its exact summary
+// statistics, to w (see DDSketch.EncodeTo).
+func (s *DDSketchWithExactSummaryStatistics) EncodeTo(w io.Writer, omitIndexMapping bool) error {
+	var b []byte
+	encodeSummaryStatistics(&b, s.summaryStatistics, false)
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	return s.DDSketch.EncodeTo(w, omitIndexMapping)
+}
+
+// EncodeDelta serializes the changes of the sketch, including the changes of
+// its exact summary statistics, since the provided checkpoint (see
+// DDSketch.EncodeDelta). Merging the payload with DecodeAndMergeWith into a
+// sketch that holds the content of the checkpoint makes it hold the content of
+// this sketch, up to the rounding errors of the sum and of the variance.
+func (s *DDSketchWithExactSummaryStatistics) EncodeDelta(b *[]byte, since *DDSketchWithExactSummaryStatistics, omitIndexMapping bool) error {
+	if s.summaryStatistics.Count() < since.summaryStatistics.Count() {
+		return errDecreasedCount
+	}
+	if err := s.DDSketch.EncodeDelta(b, since.DDSketch, omitIndexMapping); err != nil {
+		return err
+	}
+	encodeSummaryStatistics(b, summaryStatisticsDelta(s.summaryStatistics, since.summaryStatistics), true)
+	return nil
+}
+
+// summaryStatisticsDelta returns the summary statistics that, merged into the
+// checkpoint, make it equal to s. The min and the max are those of s, as they
+// are merged by taking the lowest and the highest ones.
+func summaryStatisticsDelta(s, since *stat.SummaryStatistics) *stat.SummaryStatistics {
+	count := s.Count() - since.Count()
+	if count == 0 {
+		return stat.NewSummaryStatistics()
+	}
+	sum := s.Sum() - since.Sum()
+	delta, _ := stat.NewSummaryStatisticsFromData(count, sum, s.Min(), s.Max())
+	sumOfSquaredDeviations := s.SumOfSquaredDeviations() - since.SumOfSquaredDeviations()
+	if since.Count() != 0 {
+		// Merging adds a term that depends on the difference of the means
+		// (see stat.SummaryStatistics.MergeWith).
+		meanDifference := sum/count - since.Sum()/since.Count()
+		sumOfSquaredDeviations -= meanDifference * meanDifference * since.Count() * count / s.Count()
+	}
+	delta.AddToSumOfSquaredDeviations(math.Max(0, sumOfSquaredDeviations))
+	return delta
+}
+
+// encodeSummaryStatistics encodes the exact summary statistics, including the
+// sum of squared deviations only if withSumOfSquaredDeviations is true.
+func encodeSummaryStatistics(b *[]byte, summaryStatistics *stat.SummaryStatistics, withSumOfSquaredDeviations bool) {
+	if summaryStatistics.Count() != 0 {
 		enc.EncodeFlag(b, enc.FlagCount)
-		enc.EncodeVarfloat64(b, s.summaryStatistics.Count())
+		enc.EncodeVarfloat64(b, summaryStatistics.Count())
 	}
-	if s.summaryStatistics.Sum() != 0 {
+	if summaryStatistics.Sum() != 0 {
 		enc.EncodeFlag(b, enc.FlagSum)
-		enc.EncodeFloat64LE(b, s.summaryStatistics.Sum())
+		enc.EncodeFloat64LE(b, summaryStatistics.Sum())
 	}
-	if s.summaryStatistics.Min() != math.Inf(1) {
+	if summaryStatistics.Min() != math.Inf(1) {
 		enc.EncodeFlag(b, enc.FlagMin)
-		enc.EncodeFloat64LE(b, s.summaryStatistics.Min())
+		enc.EncodeFloat64LE(b, summaryStatistics.Min())
 	}
-	if s.summaryStatistics.Max() != math.Inf(-1) {
+	if summaryStatistics.Max() != math.Inf(-1) {
 		enc.EncodeFlag(b, enc.FlagMax)
-		enc.EncodeFloat64LE(b, s.summaryStatistics.Max())
+		enc.EncodeFloat64LE(b, summaryStatistics.Max())
 	}
-	s.DDSketch.Encode(b, omitIndexMapping)
+	if withSumOfSquaredDeviations && summaryStatistics.SumOfSquaredDeviations() != 0 {
+		enc.EncodeFlag(b, enc.FlagSumOfSquaredDeviations)
+		enc.EncodeFloat64LE(b, summaryStatistics.SumOfSquaredDeviations())
+	}
+}
+
+// ToProto generates a protobuf representation of this sketch, including its
+// exact summary statistics.
+func (s *DDSketchWithExactSummaryStatistics) ToProto() *sketchpb.DDSketch {
+	pb := s.DDSketch.ToProto()
+	pb.SummaryStatistics = &sketchpb.SummaryStatistics{
+		Count:                  s.summaryStatistics.Count(),
+		Sum:                    s.summaryStatistics.Sum(),
+		Min:                    s.summaryStatistics.Min(),
+		Max:                    s.summaryStatistics.Max(),
+		SumOfSquaredDeviations: s.summaryStatistics.SumOfSquaredDeviations(),
+	}
+	return pb
+}
+
+// FromProtoWithExactSummaryStatistics builds a new instance of
+// DDSketchWithExactSummaryStatistics based on the provided protobuf
+// representation, using the provided store provider. It returns an error if the
+// protobuf representation does not contain exact summary statistics, unless it
+// is empty.
+func FromProtoWithExactSummaryStatistics(pb *sketchpb.DDSketch, storeProvider store.Provider) (*DDSketchWithExactSummaryStatistics, error) {
+	sketch, err := FromProtoWithStoreProvider(pb, storeProvider)
+	if err != nil {
+		return nil, err
+	}
+	summaryStatistics := stat.NewSummaryStatistics()
+	if pb.SummaryStatistics != nil {
+		summaryStatistics, err = stat.NewSummaryStatisticsFromData(pb.SummaryStatistics.Count, pb.SummaryStatistics.Sum, pb.SummaryStatistics.Min, pb.SummaryStatistics.Max)
+		if err != nil {
+			return nil, err
+		}
+		if !(pb.SummaryStatistics.SumOfSquaredDeviations >= 0) {
+			return nil, errors.New("the sum of squared deviations cannot be negative")
+		}
+		summaryStatistics.AddToSumOfSquaredDeviations(pb.SummaryStatistics.SumOfSquaredDeviations)
+	}
+	return NewDDSketchWithExactSummaryStatisticsFromData(sketch, summaryStatistics)
 }
 
 // DecodeDDSketchWithExactSummaryStatistics deserializes a sketch.
@@ -733,37 +3072,117 @@ func DecodeDDSketchWithExactSummaryStatistics(b []byte, storeProvider store.Prov
 	return s, err
 }
 
+// DecodeDDSketchWithExactSummaryStatisticsWithOptions is like
+// DecodeDDSketchWithExactSummaryStatistics, but it validates the serialized
+// data as DecodeDDSketchWithOptions does. It should be preferred when decoding
+// data that may not be trusted.
+func DecodeDDSketchWithExactSummaryStatisticsWithOptions(b []byte, storeProvider store.Provider, indexMapping mapping.IndexMapping, options store.DecodingOptions) (*DDSketchWithExactSummaryStatistics, error) {
+	s := &DDSketchWithExactSummaryStatistics{
+		DDSketch: &DDSketch{
+			IndexMapping:       indexMapping,
+			positiveValueStore: storeProvider(),
+			negativeValueStore: storeProvider(),
+			zeroCount:          float64(0),
+		},
+		summaryStatistics: stat.NewSummaryStatistics(),
+	}
+	err := s.DecodeAndMergeWithOptions(b, options)
+	return s, err
+}
+
+// DecodeAndMergeWith deserializes a sketch and merges its content, including
+// its exact summary statistics, in the receiver sketch. If the serialized
+// content does not contain the sum of the squared deviations from the mean
+// (which is the case if it was encoded by an earlier version of this
+// package), it is considered to be zero.
 func (s *DDSketchWithExactSummaryStatistics) DecodeAndMergeWith(bb []byte) error {
-	err := s.DDSketch.decodeAndMergeWith(bb, func(b *[]byte, flag enc.Flag) error {
+	return s.decodeAndMergeWith(bb, nil, nil)
+}
+
+// DecodeAndMergeWithOptions is like DecodeAndMergeWith, but it validates the
+// serialized content as DDSketch.DecodeAndMergeWithOptions does. The encoded
+// count must also be neither NaN, infinite nor negative.
+func (s *DDSketchWithExactSummaryStatistics) DecodeAndMergeWithOptions(bb []byte, options store.DecodingOptions) error {
+	return s.decodeAndMergeWith(bb, nil, &options)
+}
+
+// DecodeInto replaces the content of the receiver with the decoded sketch,
+// reusing its stores (see DDSketch.DecodeInto).
+func (s *DDSketchWithExactSummaryStatistics) DecodeInto(b []byte) error {
+	if s.DDSketch == nil {
+		s.DDSketch = &DDSketch{}
+	}
+	indexMapping := s.IndexMapping
+	s.DDSketch.resetRetainingCapacity()
+	if s.summaryStatistics == nil {
+		s.summaryStatistics = stat.NewSummaryStatistics()
+	} else {
+		s.summaryStatistics.Clear()
+	}
+	if err := s.decodeAndMergeWith(b, indexMapping, nil); err != nil {
+		s.DDSketch.resetRetainingCapacity()
+		s.IndexMapping = indexMapping
+		s.summaryStatistics.Clear()
+		return err
+	}
+	return nil
+}
+
+// decodeAndMergeWith decodes the sketch and merges it into this one (see
+// DDSketch.decodeAndMergeWith). If options is not nil, the encoded bins and
+// counts are validated first. As with MergeWith, the sketch is left unchanged
+// if the decoded bins would exceed the memory limit of its stores.
+func (s *DDSketchWithExactSummaryStatistics) decodeAndMergeWith(bb []byte, fallbackIndexMapping mapping.IndexMapping, options *store.DecodingOptions) error {
+	return s.updateAtomically(func(s *DDSketchWithExactSummaryStatistics) error {
+		return s.decodeAndMergeWithStatistics(bb, fallbackIndexMapping, options)
+	})
+}
+
+func (s *DDSketchWithExactSummaryStatistics) decodeAndMergeWithStatistics(bb []byte, fallbackIndexMapping mapping.IndexMapping, options *store.DecodingOptions) error {
+	// The summary statistics are decoded separately so that they can be merged
+	// as a whole, which is required to merge the sum of squared deviations.
+	decoded := stat.NewSummaryStatistics()
+	err := s.DDSketch.decodeAndMergeWith(bb, fallbackIndexMapping, func(b *[]byte, flag enc.Flag) error {
 		switch flag {
 		case enc.FlagCount:
 			count, err := enc.DecodeVarfloat64(b)
 			if err != nil {
 				return err
 			}
-			s.summaryStatistics.AddToCount(count)
+			if options != nil && !(count >= 0 && !math.IsInf(count, 1)) {
+				return store.ErrInvalidEncodedCount
+			}
+			decoded.AddToCount(count)
 			return nil
 		case enc.FlagSum:
 			sum, err := enc.DecodeFloat64LE(b)
 			if err != nil {
 				return err
 			}
-			s.summaryStatistics.AddToSum(sum)
+			decoded.AddToSum(sum)
 			return nil
 		case enc.FlagMin, enc.FlagMax:
 			stat, err := enc.DecodeFloat64LE(b)
 			if err != nil {
 				return err
 			}
-			s.summaryStatistics.Add(stat, 0)
+			decoded.Add(stat, 0)
+			return nil
+		case enc.FlagSumOfSquaredDeviations:
+			sumOfSquaredDeviations, err := enc.DecodeFloat64LE(b)
+			if err != nil {
+				return err
+			}
+			decoded.AddToSumOfSquaredDeviations(sumOfSquaredDeviations)
 			return nil
 		default:
 			return errUnknownFlag
 		}
-	})
+	}, options)
 	if err != nil {
 		return err
 	}
+	s.summaryStatistics.MergeWith(decoded)
 	// It is assumed that if the count is encoded, other exact summary
 	// statistics are encoded as well, which is the case if Encode is used.
 	if s.summaryStatistics.Count() == 0 && !s.DDSketch.IsEmpty() {
@@ -771,3 +3190,55 @@ func (s *DDSketchWithExactSummaryStatistics) DecodeAndMergeWith(bb []byte) error
 	}
 	return nil
 }
+
+// MarshalBinary implements encoding.BinaryMarshaler. The sketch, including
+// its exact summary statistics and their sum of squared deviations, is
+// serialized like Encode does.
+func (s *DDSketchWithExactSummaryStatistics) MarshalBinary() ([]byte, error) {
+	var b []byte
+	s.encode(&b, false, true)
+	return b, nil
+}
+
+// MarshalProto serializes the protobuf representation of the sketch, including
+// its exact summary statistics (see ToProto).
+func (s *DDSketchWithExactSummaryStatistics) MarshalProto() ([]byte, error) {
+	return proto.Marshal(s.ToProto())
+}
+
+// UnmarshalProto replaces the content of the receiver with the sketch whose
+// serialized protobuf representation is provided (see DDSketch.UnmarshalProto
+// and FromProtoWithExactSummaryStatistics).
+func (s *DDSketchWithExactSummaryStatistics) UnmarshalProto(data []byte) error {
+	var pb sketchpb.DDSketch
+	if err := proto.Unmarshal(data, &pb); err != nil {
+		return err
+	}
+	base := s.DDSketch
+	if base == nil {
+		base = &DDSketch{}
+	}
+	sketch, err := FromProtoWithExactSummaryStatistics(&pb, base.emptyStoresProvider())
+	if err != nil {
+		return err
+	}
+	*s = *sketch
+	return nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler (see
+// DDSketch.UnmarshalBinary).
+func (s *DDSketchWithExactSummaryStatistics) UnmarshalBinary(data []byte) error {
+	if s.DDSketch == nil {
+		s.DDSketch = &DDSketch{}
+	}
+	decoded := &DDSketchWithExactSummaryStatistics{
+		DDSketch:          s.DDSketch.emptyLike(),
+		summaryStatistics: stat.NewSummaryStatistics(),
+	}
+	if err := decoded.DecodeAndMergeWith(data); err != nil {
+		return err
+	}
+	*s = *decoded
+	return nil
+}
@@ -6,14 +6,21 @@
 package ddsketch
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
 	"math"
 	"math/rand"
+	"sort"
 	"testing"
 
 	"github.com/DataDog/sketches-go/ddsketch/stat"
 	"google.golang.org/protobuf/proto"
 
 	"github.com/DataDog/sketches-go/dataset"
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
 	"github.com/DataDog/sketches-go/ddsketch/mapping"
 	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
 	"github.com/DataDog/sketches-go/ddsketch/store"
@@ -387,6 +394,99 @@ func TestConsistentMerge(t *testing.T) {
 		}
 	}
 }
+func TestPresetConstructors(t *testing.T) {
+	sketch, err := LogBufferedPaginatedDDSketch(0.01)
+	assert.Nil(t, err)
+	assert.IsType(t, &store.BufferedPaginatedStore{}, sketch.GetPositiveValueStore())
+	assert.IsType(t, &store.BufferedPaginatedStore{}, sketch.GetNegativeValueStore())
+
+	exactSketches := map[string]func(relativeAccuracy float64) (*DDSketchWithExactSummaryStatistics, error){
+		"unbounded_dense":    LogUnboundedDenseDDSketchWithExactSummaryStatistics,
+		"buffered_paginated": LogBufferedPaginatedDDSketchWithExactSummaryStatistics,
+		"collapsing_lowest": func(relativeAccuracy float64) (*DDSketchWithExactSummaryStatistics, error) {
+			return LogCollapsingLowestDenseDDSketchWithExactSummaryStatistics(relativeAccuracy, 1000)
+		},
+		"collapsing_highest": func(relativeAccuracy float64) (*DDSketchWithExactSummaryStatistics, error) {
+			return LogCollapsingHighestDenseDDSketchWithExactSummaryStatistics(relativeAccuracy, 1000)
+		},
+	}
+	for name, newSketch := range exactSketches {
+		t.Run(name, func(t *testing.T) {
+			_, err := newSketch(0)
+			assert.NotNil(t, err)
+			sketch, err := newSketch(0.01)
+			assert.Nil(t, err)
+			assert.InDelta(t, 0.01, sketch.RelativeAccuracy(), floatingPointAcceptableError)
+			for i := 1; i <= 1000; i++ {
+				sketch.Add(float64(i))
+			}
+			min, _ := sketch.GetMinValue()
+			max, _ := sketch.GetMaxValue()
+			assert.Equal(t, []float64{1, 1000, 1000, 500500}, []float64{min, max, sketch.GetCount(), sketch.GetSum()})
+			median, _ := sketch.GetValueAtQuantile(0.5)
+			assert.InEpsilon(t, 500, median, 0.02)
+		})
+	}
+}
+
+func TestAccessors(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	positiveValueStore := store.NewDenseStore()
+	negativeValueStore := store.NewSparseStore()
+	sketch := NewDDSketch(m, positiveValueStore, negativeValueStore)
+	sketch.AddWithCount(1, 2)
+	sketch.AddWithCount(0, 3)
+	sketch.AddWithCount(-1, 4)
+	assert.Same(t, positiveValueStore, sketch.PositiveStore())
+	assert.Same(t, negativeValueStore, sketch.NegativeStore())
+	assert.Equal(t, float64(3), sketch.ZeroCount())
+	assert.Equal(t, m, sketch.Mapping())
+
+	exact := NewDDSketchWithExactSummaryStatistics(m, store.DenseStoreConstructor)
+	exact.AddWithCount(0, 5)
+	assert.Equal(t, float64(5), exact.ZeroCount())
+	assert.Equal(t, m, exact.Mapping())
+}
+
+func TestToBinArrays(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		sketch := NewDDSketchFromStoreProvider(m, storeProvider)
+		negIndexes, negCounts, zeroCount, posIndexes, posCounts := sketch.ToBinArrays()
+		assert.Empty(t, negIndexes)
+		assert.Empty(t, negCounts)
+		assert.Equal(t, float64(0), zeroCount)
+		assert.Empty(t, posIndexes)
+		assert.Empty(t, posCounts)
+
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			sketch.Add(generator.Generate())
+		}
+		sketch.AddWithCount(0, 10)
+		negIndexes, negCounts, zeroCount, posIndexes, posCounts = sketch.ToBinArrays()
+		assert.Equal(t, float64(10), zeroCount)
+		for _, bins := range []struct {
+			st      store.Store
+			indexes []int32
+			counts  []float64
+		}{
+			{sketch.NegativeStore(), negIndexes, negCounts},
+			{sketch.PositiveStore(), posIndexes, posCounts},
+		} {
+			assert.Len(t, bins.counts, len(bins.indexes))
+			assert.True(t, sort.SliceIsSorted(bins.indexes, func(i, j int) bool { return bins.indexes[i] < bins.indexes[j] }))
+			actual := store.NewSparseStore()
+			for i, index := range bins.indexes {
+				assert.Greater(t, bins.counts[i], float64(0))
+				actual.AddWithCount(int(index), bins.counts[i])
+			}
+			assert.True(t, store.Equivalent(bins.st, actual))
+		}
+	}
+}
+
 func TestCopy(t *testing.T) {
 	sketch, _ := LogUnboundedDenseDDSketch(0.01)
 	sketch.AddWithCount(0, 1.2)
@@ -396,6 +496,50 @@ func TestCopy(t *testing.T) {
 	assert.Equal(t, sketch.GetCount(), copy.GetCount())
 }
 
+func TestCopyTo(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		sketch := NewDDSketchFromStoreProvider(m, storeProvider)
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			sketch.Add(generator.Generate())
+		}
+		sketch.AddWithCount(0, 10)
+		sketch.SetMaxNumBins(1000)
+
+		otherMapping, _ := mapping.NewLogarithmicMapping(0.02)
+		dst := NewDDSketchFromStoreProvider(otherMapping, storeProvider)
+		dst.Add(1)
+		sketch.CopyTo(dst)
+		assert.True(t, sketch.Equals(dst))
+		assert.Equal(t, sketch.MaxNumBins(), dst.MaxNumBins())
+
+		// The copy does not share stores with the sketch.
+		dst.Add(1)
+		assert.Equal(t, dst.GetCount()-1, sketch.GetCount())
+
+		var empty DDSketch
+		sketch.CopyTo(&empty)
+		assert.True(t, sketch.Equals(&empty))
+
+		exactSketch := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		for i := 0; i < 1000; i++ {
+			exactSketch.Add(generator.Generate())
+		}
+		exactDst := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		exactDst.Add(1)
+		exactSketch.CopyTo(exactDst)
+		assert.True(t, exactSketch.Equals(exactDst))
+		assertQuantileSketchesEqual(t, exactSketch, exactDst)
+		exactDst.Add(1)
+		assert.Equal(t, exactDst.GetCount()-1, exactSketch.GetCount())
+		var exactEmpty DDSketchWithExactSummaryStatistics
+		exactSketch.CopyTo(&exactEmpty)
+		assert.True(t, exactSketch.Equals(&exactEmpty))
+	}
+}
+
 // TestChangeMapping tests the change of mapping of a DDSketch.
 func TestChangeMapping(t *testing.T) {
 	sketch, _ := LogCollapsingLowestDenseDDSketch(0.01, 2000)
@@ -415,6 +559,106 @@ func TestChangeMapping(t *testing.T) {
 	}
 }
 
+func TestChangeStore(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		sketch := NewDDSketchWithExactSummaryStatistics(m, store.BufferedPaginatedStoreConstructor)
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			sketch.Add(generator.Generate())
+		}
+		sketch.AddWithCount(0, 10)
+		sketch.SetMaxNumBins(1000)
+
+		changed := sketch.ChangeStore(storeProvider)
+		assert.True(t, sketch.Equals(changed))
+		assert.IsType(t, storeProvider(), changed.GetPositiveValueStore())
+		assert.IsType(t, storeProvider(), changed.GetNegativeValueStore())
+		assert.Equal(t, sketch.MaxNumBins(), changed.MaxNumBins())
+		assertQuantileSketchesEqual(t, sketch, changed)
+
+		// The original sketch is not modified.
+		changed.Add(1)
+		assert.Equal(t, changed.GetCount()-1, sketch.GetCount())
+	}
+
+	// Bins are collapsed if the new stores are bounded.
+	sketch, _ := LogUnboundedDenseDDSketch(0.01)
+	for i := 1; i <= 1000; i++ {
+		sketch.Add(float64(i))
+	}
+	changed := sketch.ChangeStore(func() store.Store { return store.NewCollapsingLowestDenseStore(100) })
+	assert.Equal(t, sketch.GetCount(), changed.GetCount())
+	minIndex, _ := changed.GetPositiveValueStore().MinIndex()
+	maxIndex, _ := changed.GetPositiveValueStore().MaxIndex()
+	assert.LessOrEqual(t, maxIndex-minIndex+1, 100)
+}
+
+func TestNewDDSketchWithPool(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	pool := store.NewArenaPool(make([]byte, 1<<20), 5)
+	for window := 0; window < 3; window++ {
+		sketches := make([]*DDSketch, 100)
+		datasets := make([]*dataset.Dataset, len(sketches))
+		generator := dataset.NewNormal(0, 10)
+		for i := range sketches {
+			sketches[i] = NewDDSketchWithPool(m, pool)
+			datasets[i] = dataset.NewDataset()
+			for j := 0; j < 100; j++ {
+				value := generator.Generate()
+				assert.Nil(t, sketches[i].AddWithCount(value, 1.5))
+				datasets[i].Add(value)
+			}
+		}
+		assert.Greater(t, pool.UsedBytes(), 0)
+		assert.Zero(t, pool.HeapBytes())
+		for i, sketch := range sketches {
+			assert.Equal(t, 1.5*datasets[i].Count, sketch.GetCount())
+			quantile, err := sketch.GetValueAtQuantile(0.5)
+			assert.Nil(t, err)
+			assertRelativelyAccurate(assert.New(t), sketch.RelativeAccuracy(), datasets[i].LowerQuantile(0.5), datasets[i].UpperQuantile(0.5), quantile)
+		}
+		// The pages of all the sketches of the window are released at once.
+		pool.Reset()
+		assert.Zero(t, pool.UsedBytes())
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		sketch := NewDDSketchFromStoreProvider(m, storeProvider)
+		generator := dataset.NewNormal(0, 10)
+		data := dataset.NewDataset()
+		values := make([]float64, 0, 1000)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			values = append(values, value)
+			data.Add(value)
+		}
+		assert.Nil(t, sketch.AddValues(values))
+		original := sketch.Copy()
+
+		downsampled, err := sketch.Downsample(2)
+		assert.Nil(t, err)
+		assert.IsType(t, sketch.GetPositiveValueStore(), downsampled.GetPositiveValueStore())
+		assert.InDelta(t, sketch.GetCount(), downsampled.GetCount(), floatingPointAcceptableError)
+		assert.Equal(t, sketch.GetZeroCount(), downsampled.GetZeroCount())
+		assert.LessOrEqual(t, downsampled.GetPositiveValueStore().MemorySize(), sketch.GetPositiveValueStore().MemorySize())
+		// The downsampled sketch is the one that the values would have been
+		// added to if it had been built with the coarser mapping.
+		expected := NewDDSketchFromStoreProvider(downsampled.IndexMapping, storeProvider)
+		assert.Nil(t, expected.AddValues(values))
+		assert.True(t, expected.Equals(downsampled))
+		assertSketchesAccurate(t, data, downsampled, false)
+
+		// The original sketch is not modified.
+		assert.True(t, original.Equals(sketch))
+	}
+}
+
 // TestReweight tests the reweighting of a sketch by a constant.
 func TestReweight(t *testing.T) {
 	m, _ := mapping.NewLogarithmicMapping(0.01)
@@ -423,54 +667,1574 @@ func TestReweight(t *testing.T) {
 		NewDDSketch(m, store.NewSparseStore(), store.NewSparseStore()),
 		NewDDSketch(m, store.NewBufferedPaginatedStore(), store.NewBufferedPaginatedStore()),
 	}
-	testSize := 1000
-	for _, s := range sketches {
-		generator := dataset.NewNormal(50, 1)
-		for i := 0; i < testSize; i++ {
-			s.Add(generator.Generate())
+	testSize := 1000
+	for _, s := range sketches {
+		generator := dataset.NewNormal(50, 1)
+		for i := 0; i < testSize; i++ {
+			s.Add(generator.Generate())
+		}
+		expectedQuantiles, _ := s.GetValuesAtQuantiles(testQuantiles)
+		assert.Nil(t, s.Reweight(3))
+		// no matter the weight constant, the quantiles should stay the same.
+		quantiles, _ := s.GetValuesAtQuantiles(testQuantiles)
+		for i, q := range quantiles {
+			e := expectedQuantiles[i]
+			assert.InDelta(t, e, q, floatingPointAcceptableError+e*0.01)
+		}
+		assert.InDelta(t, float64(3*testSize), s.GetCount(), floatingPointAcceptableError)
+	}
+}
+
+func TestMaxNumBins(t *testing.T) {
+	maxNumBins := 1000
+	sketch, err := LogCollapsingLowestDenseDDSketchWithGlobalMaxNumBins(0.01, maxNumBins)
+	assert.Nil(t, err)
+	assert.Equal(t, maxNumBins, sketch.MaxNumBins())
+	reference, _ := LogUnboundedDenseDDSketch(0.01)
+
+	numBins := func(s *DDSketch) int {
+		n := 0
+		for _, st := range []store.Store{s.positiveValueStore, s.negativeValueStore} {
+			if minIndex, maxIndex, err := storeIndexRange(st); err == nil {
+				n += maxIndex - minIndex + 1
+			}
+		}
+		return n
+	}
+
+	generator := dataset.NewLognormal(0, 2)
+	for i := 0; i < 10000; i++ {
+		value := generator.Generate()
+		assert.Nil(t, sketch.Add(value))
+		assert.Nil(t, reference.Add(value))
+		if i%4 == 0 {
+			assert.Nil(t, sketch.Add(-value))
+			assert.Nil(t, reference.Add(-value))
+		}
+		assert.LessOrEqual(t, numBins(sketch), maxNumBins)
+	}
+	assert.Greater(t, numBins(reference), maxNumBins)
+	assert.InDelta(t, reference.GetCount(), sketch.GetCount(), floatingPointAcceptableError)
+
+	// The values of highest magnitudes are not affected by the collapsing.
+	for _, q := range []float64{0, 0.001, 0.01, 0.99, 0.999, 1} {
+		expected, _ := reference.GetValueAtQuantile(q)
+		actual, _ := sketch.GetValueAtQuantile(q)
+		assert.InEpsilon(t, expected, actual, floatingPointAcceptableError)
+	}
+
+	// Merging, decoding and copying also enforce the limit.
+	other := reference.Copy()
+	assert.Nil(t, other.MergeWith(sketch))
+	assert.Greater(t, numBins(other), maxNumBins)
+	merged := sketch.Copy()
+	assert.Equal(t, maxNumBins, merged.MaxNumBins())
+	assert.Nil(t, merged.MergeWith(reference))
+	assert.LessOrEqual(t, numBins(merged), maxNumBins)
+	var encoded []byte
+	reference.Encode(&encoded, false)
+	decoded := sketch.Copy()
+	assert.Nil(t, decoded.DecodeAndMergeWith(encoded))
+	assert.LessOrEqual(t, numBins(decoded), maxNumBins)
+	assert.InDelta(t, 2*reference.GetCount(), decoded.GetCount(), floatingPointAcceptableError)
+
+	// Lowering the limit collapses bins immediately.
+	reference.SetMaxNumBins(10)
+	assert.LessOrEqual(t, numBins(reference), 10)
+	reference.SetMaxNumBins(1)
+	assert.Equal(t, 2, numBins(reference))
+	reference.SetMaxNumBins(0)
+	assert.Equal(t, 0, reference.MaxNumBins())
+}
+
+func TestRescale(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		for _, factor := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+			assert.NotNil(t, sketch.Rescale(factor))
+		}
+
+		generator := dataset.NewNormal(50, 10)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			assert.Nil(t, sketch.Add(value))
+			assert.Nil(t, sketch.Add(-value))
+		}
+		assert.Nil(t, sketch.AddWithCount(0, 10))
+		assert.NotNil(t, sketch.Rescale(math.MaxFloat64))
+		count := sketch.GetCount()
+		sum := sketch.GetSum()
+		expectedQuantiles, _ := sketch.GetValuesAtQuantiles(testQuantiles)
+
+		// Shifting bins, as the mapping is logarithmic.
+		m, _ := mapping.NewLogarithmicMapping(sketch.RelativeAccuracy())
+		gamma := m.LowerBound(1) / m.LowerBound(0)
+		factor := math.Pow(gamma, 5)
+		assert.Nil(t, sketch.Rescale(factor))
+		assert.InDelta(t, count, sketch.GetCount(), floatingPointAcceptableError)
+		quantiles, _ := sketch.GetValuesAtQuantiles(testQuantiles)
+		for i, q := range quantiles {
+			assert.InDelta(t, expectedQuantiles[i]*factor, q, floatingPointAcceptableError+math.Abs(expectedQuantiles[i]*factor)*1e-9)
+		}
+		if testCase.exactSummaryStatistics {
+			assert.InDelta(t, sum*factor, sketch.GetSum(), floatingPointAcceptableError+math.Abs(sum*factor)*1e-9)
+		}
+
+		// Distributing counts to overlapping bins.
+		assert.Nil(t, sketch.Rescale(0.001/factor))
+		assert.InDelta(t, count, sketch.GetCount(), floatingPointAcceptableError)
+		assert.Equal(t, float64(10), sketch.GetZeroCount())
+		// Splitting the counts of the extreme bins may make the minimum and the
+		// maximum fall back to neighboring values, hence excluding them.
+		quantiles, _ = sketch.GetValuesAtQuantiles(testQuantiles)
+		for i, q := range quantiles {
+			if testQuantiles[i] == 0 || testQuantiles[i] == 1 {
+				continue
+			}
+			e := expectedQuantiles[i] * 0.001
+			assert.InDelta(t, e, q, floatingPointAcceptableError+math.Abs(e)*4*sketch.RelativeAccuracy())
+		}
+
+		// Values that become too small to be indexed are moved to the zero bin.
+		assert.Nil(t, sketch.Rescale(m.MinIndexableValue()/1000))
+		assert.InDelta(t, count, sketch.GetZeroCount(), floatingPointAcceptableError)
+	}
+}
+
+func TestSample(t *testing.T) {
+	random := rand.New(rand.NewSource(5388928120325255124))
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		assert.Nil(t, sketch.Sample(10, random))
+
+		generator := dataset.NewLognormal(0, 2)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, sketch.Add(generator.Generate()))
+			assert.Nil(t, sketch.AddWithCount(-generator.Generate(), 0.5))
+		}
+		assert.Nil(t, sketch.AddWithCount(0, 100))
+		assert.Nil(t, sketch.Sample(0, random))
+
+		samples := sketch.Sample(100000, random)
+		assert.Len(t, samples, 100000)
+		sampled := testCase.sketch()
+		assert.Nil(t, sampled.AddValues(samples))
+
+		// Samples are drawn from the non-empty bins of the sketch.
+		for _, stores := range [][2]store.Store{
+			{sketch.GetPositiveValueStore(), sampled.GetPositiveValueStore()},
+			{sketch.GetNegativeValueStore(), sampled.GetNegativeValueStore()},
+		} {
+			indexes := make(map[int]bool)
+			stores[0].ForEach(func(index int, count float64) (stop bool) {
+				indexes[index] = true
+				return false
+			})
+			stores[1].ForEach(func(index int, count float64) (stop bool) {
+				assert.True(t, indexes[index])
+				return false
+			})
+		}
+		assert.InDelta(t, 100000*100/sketch.GetCount(), sampled.GetZeroCount(), 500)
+
+		// Samples follow the distribution that the sketch encodes.
+		values, _ := sketch.GetValuesAtQuantiles(testQuantiles)
+		for _, value := range values {
+			expected, _ := sketch.GetRankOfValue(value)
+			actual, _ := sampled.GetRankOfValue(value)
+			assert.InDelta(t, expected, actual, 0.01)
+		}
+	}
+}
+
+func TestEquals(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	sketches := []*DDSketch{
+		NewDDSketch(m, store.NewDenseStore(), store.NewDenseStore()),
+		NewDDSketch(m, store.NewSparseStore(), store.NewSparseStore()),
+		NewDDSketch(m, store.NewBufferedPaginatedStore(), store.NewBufferedPaginatedStore()),
+	}
+	for _, s := range sketches {
+		assert.Nil(t, s.AddWithCounts([]float64{-5.6, 0, 1.2, 3.4}, []float64{1, 2, 3, 4}))
+	}
+	for _, s1 := range sketches {
+		for _, s2 := range sketches {
+			assert.True(t, s1.Equals(s2))
+		}
+	}
+
+	other := sketches[0].Copy()
+	assert.Nil(t, other.AddWithCount(78, 0.5))
+	assert.False(t, sketches[1].Equals(other))
+	assert.False(t, other.Equals(sketches[1]))
+	assert.True(t, sketches[1].ApproxEquals(other, 0.5))
+	assert.True(t, other.ApproxEquals(sketches[1], 0.5))
+	assert.False(t, other.ApproxEquals(sketches[1], 0.4))
+	assert.Nil(t, other.AddWithCount(0, 0.1))
+	assert.True(t, other.ApproxEquals(sketches[1], 0.5))
+	assert.False(t, other.ApproxEquals(sketches[1], 0.05))
+
+	otherMapping, _ := mapping.NewLogarithmicMapping(0.02)
+	other = NewDDSketch(otherMapping, store.NewDenseStore(), store.NewDenseStore())
+	assert.Nil(t, other.AddWithCounts([]float64{-5.6, 0, 1.2, 3.4}, []float64{1, 2, 3, 4}))
+	assert.False(t, sketches[0].ApproxEquals(other, 10))
+
+	s1, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	s2, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	assert.True(t, s1.Equals(s2))
+	assert.Nil(t, s1.Add(1.2))
+	assert.Nil(t, s2.Add(1.2001))
+	assert.True(t, s1.DDSketch.Equals(s2.DDSketch))
+	assert.False(t, s1.Equals(s2))
+	assert.True(t, s1.ApproxEquals(s2, 0.001))
+}
+
+func TestClear(t *testing.T) {
+	sketch, _ := LogUnboundedDenseDDSketch(0.01)
+	sketch.AddWithCount(0, 1.2)
+	sketch.Add(3.4)
+	sketch.AddWithCount(-5.6, 7.8)
+	sketch.Clear()
+	assert.Zero(t, sketch.GetCount())
+}
+
+func TestClearRetainingCapacity(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		expected := testCase.sketch()
+		generator := dataset.NewLognormal(0, 2)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			assert.Nil(t, sketch.Add(value))
+			assert.Nil(t, sketch.Add(-value))
+		}
+		assert.Nil(t, sketch.Add(0))
+		memorySize := sketch.MemorySize()
+		sketch.ClearRetainingCapacity()
+		assert.True(t, sketch.IsEmpty())
+		assert.Zero(t, sketch.GetCount())
+		assert.Zero(t, sketch.GetZeroCount())
+		assert.Equal(t, memorySize, sketch.MemorySize())
+
+		for _, value := range []float64{-5.6, 0, 1.2, 3.4} {
+			assert.Nil(t, sketch.Add(value))
+			assert.Nil(t, expected.Add(value))
+		}
+		assertQuantileSketchesEqual(t, expected, sketch)
+		assert.Equal(t, memorySize, sketch.MemorySize())
+	}
+}
+
+func TestForEach(t *testing.T) {
+	{ // Empty.
+		sketch, _ := LogUnboundedDenseDDSketch(0.01)
+		sketch.ForEach(func(value, count float64) (stop bool) {
+			assert.Fail(t, "empty sketch should have no bin")
+			return false
+		})
+	}
+	for i := 0; i < 3; i++ { // Stopping condition.
+		sketch, _ := LogUnboundedDenseDDSketch(0.01)
+		sketch.Add(0)
+		sketch.Add(1)
+		sketch.Add(-1)
+		j := 0
+		sketch.ForEach(func(value, count float64) (stop bool) {
+			assert.LessOrEqual(t, j, i)
+			j++
+			return j > i
+		})
+		assert.Equal(t, i, j-1)
+	}
+}
+
+func TestMergeWithSketch(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	newSketches := []func() QuantileSketch{
+		func() QuantileSketch { return NewDDSketchFromStoreProvider(m, store.DefaultProvider) },
+		func() QuantileSketch { return NewDDSketchWithExactSummaryStatistics(m, store.DefaultProvider) },
+	}
+	for _, newSketch := range newSketches {
+		for _, newOther := range newSketches {
+			sketch, other, expected := newSketch(), newOther(), newSketch()
+			assert.Nil(t, sketch.MergeWithSketch(other))
+			assert.True(t, sketch.IsEmpty())
+			for _, value := range []float64{-1, 0, 2, 3} {
+				assert.Nil(t, sketch.Add(value))
+				assert.Nil(t, expected.Add(value))
+			}
+			for _, value := range []float64{5, 7} {
+				assert.Nil(t, other.Add(value))
+				assert.Nil(t, expected.Add(value))
+			}
+			err := sketch.MergeWithSketch(other)
+			_, exact := sketch.(*DDSketchWithExactSummaryStatistics)
+			_, otherExact := other.(*DDSketchWithExactSummaryStatistics)
+			if exact && !otherExact {
+				assert.NotNil(t, err)
+				continue
+			}
+			assert.Nil(t, err)
+			assertQuantileSketchesEqual(t, expected.(quantileSketch), sketch.(quantileSketch))
+		}
+	}
+
+	sketch, _ := LogUnboundedDenseDDSketch(0.01)
+	other, _ := LogUnboundedDenseDDSketch(0.02)
+	assert.NotNil(t, sketch.MergeWithSketch(other))
+}
+
+func TestMergeAll(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	for _, numSketches := range []int{0, 1, 2, 7, 100} {
+		for _, parallelism := range []int{0, 1, 3, 16} {
+			expected := NewDDSketch(m, store.NewDenseStore(), store.NewDenseStore())
+			target := NewDDSketch(m, store.NewDenseStore(), store.NewDenseStore())
+			target.Add(1)
+			expected.Add(1)
+			others := make([]*DDSketch, numSketches)
+			generator := dataset.NewNormal(0, 10)
+			for i := range others {
+				others[i] = NewDDSketchFromStoreProvider(m, store.DefaultProvider)
+				for j := 0; j < 100; j++ {
+					value := generator.Generate()
+					others[i].Add(value)
+					expected.Add(value)
+				}
+			}
+			assert.Nil(t, MergeAll(target, others, parallelism))
+			assertQuantileSketchesEqual(t, expected, target)
+		}
+	}
+
+	other, _ := LogUnboundedDenseDDSketch(0.02)
+	other.Add(1)
+	target, _ := LogUnboundedDenseDDSketch(0.01)
+	assert.NotNil(t, MergeAll(target, []*DDSketch{other}, 2))
+	assert.True(t, target.IsEmpty())
+}
+
+func TestMergeWithWeight(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		generator := dataset.NewNormal(0, 10)
+		sketch := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		other := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		for i := 0; i < 1000; i++ {
+			sketch.Add(generator.Generate())
+			other.Add(generator.Generate())
+		}
+		other.AddWithCount(0, 2)
+
+		expected := sketch.Copy()
+		reweighted := other.Copy()
+		assert.Nil(t, reweighted.Reweight(0.25))
+		assert.Nil(t, expected.MergeWith(reweighted))
+		plain := sketch.DDSketch.Copy()
+
+		assert.Nil(t, sketch.MergeWithWeight(other, 0.25))
+		assert.True(t, expected.ApproxEquals(sketch, floatingPointAcceptableError))
+		assert.Nil(t, plain.MergeWithWeight(other.DDSketch, 0.25))
+		assert.True(t, expected.DDSketch.ApproxEquals(plain, floatingPointAcceptableError))
+
+		// Merging a sketch with itself.
+		count := plain.GetCount()
+		assert.Nil(t, plain.MergeWithWeight(plain, 0.5))
+		assert.InDelta(t, 1.5*count, plain.GetCount(), floatingPointAcceptableError)
+
+		assert.NotNil(t, sketch.MergeWithWeight(other, 0))
+		assert.NotNil(t, sketch.MergeWithWeight(other, -1))
+		otherMapping, _ := mapping.NewLogarithmicMapping(0.02)
+		assert.NotNil(t, plain.MergeWithWeight(NewDDSketchFromStoreProvider(otherMapping, storeProvider), 1))
+	}
+}
+
+func TestMergeWithConverting(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.02)
+	otherMapping, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		generator := dataset.NewNormal(0, 10)
+		data := dataset.NewDataset()
+		sketch := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		other := NewDDSketchWithExactSummaryStatistics(otherMapping, storeProvider)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			sketch.Add(value)
+			data.Add(value)
+			value = generator.Generate()
+			other.Add(value)
+			data.Add(value)
+		}
+		other.AddWithCount(0, 2)
+		data.Add(0)
+		data.Add(0)
+
+		assert.NotNil(t, sketch.MergeWith(other))
+		assert.Nil(t, sketch.MergeWithConverting(other))
+		assert.True(t, m.Equals(sketch.IndexMapping))
+		assert.InDelta(t, data.Count, sketch.GetCount(), floatingPointAcceptableError)
+		assert.InDelta(t, data.Sum(), sketch.GetSum(), 1e-9)
+		for _, q := range testQuantiles {
+			value, _ := sketch.GetValueAtQuantile(q)
+			// Converted counts are fractional, so that rounding errors may
+			// slightly shift ranks.
+			lower := data.LowerQuantile(math.Max(q-1e-3, 0))
+			upper := data.UpperQuantile(math.Min(q+1e-3, 1))
+			assertRelativelyAccurate(assert.New(t), 0.02+2*0.01, lower, upper, value)
+		}
+
+		// Sketches with the same mapping are merged as with MergeWith.
+		expected := sketch.DDSketch.Copy()
+		assert.Nil(t, expected.MergeWith(sketch.DDSketch))
+		assert.Nil(t, sketch.DDSketch.MergeWithConverting(sketch.DDSketch))
+		assert.True(t, expected.ApproxEquals(sketch.DDSketch, floatingPointAcceptableError))
+
+		// Values that cannot be tracked are rejected.
+		narrowMapping, _ := mapping.NewLogarithmicMappingWithGamma(1.02, math.MaxInt32-5000)
+		narrow := NewDDSketchFromStoreProvider(narrowMapping, storeProvider)
+		tooHigh := NewDDSketchFromStoreProvider(m, storeProvider)
+		assert.Nil(t, tooHigh.Add(2*narrow.MaxIndexableValue()))
+		assert.Equal(t, ErrUntrackableTooHigh, narrow.MergeWithConverting(tooHigh))
+		assert.True(t, narrow.IsEmpty())
+	}
+}
+
+func TestRemoveWithCount(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		generator := dataset.NewNormal(0, 10)
+		sketch := NewDDSketchFromStoreProvider(m, storeProvider)
+		exactSketch := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		expected := NewDDSketchFromStoreProvider(m, storeProvider)
+		exactExpected := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		var removed []float64
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			sketch.Add(value)
+			exactSketch.Add(value)
+			if i%3 == 0 {
+				removed = append(removed, value)
+			} else {
+				expected.Add(value)
+				exactExpected.Add(value)
+			}
+		}
+		sketch.AddWithCount(0, 3)
+		exactSketch.AddWithCount(0, 3)
+		expected.AddWithCount(0, 1)
+		exactExpected.AddWithCount(0, 1)
+
+		for _, value := range removed {
+			assert.Nil(t, sketch.RemoveWithCount(value, 1))
+			assert.Nil(t, exactSketch.RemoveWithCount(value, 1))
+		}
+		assert.Nil(t, sketch.RemoveWithCount(0, 2))
+		assert.Nil(t, exactSketch.RemoveWithCount(0, 2))
+		assertQuantileSketchesEqual(t, expected, sketch)
+		assert.InDelta(t, expected.GetCount(), exactSketch.GetCount(), floatingPointAcceptableError)
+		assert.InDelta(t, exactExpected.GetSum(), exactSketch.GetSum(), floatingPointAcceptableError)
+		expectedVariance, _ := exactExpected.GetVariance()
+		variance, err := exactSketch.GetVariance()
+		assert.Nil(t, err)
+		assert.InEpsilon(t, expectedVariance, variance, 1e-6)
+
+		assert.Equal(t, ErrNegativeCount, sketch.RemoveWithCount(1, -1))
+		assert.Equal(t, ErrUntrackableNaN, exactSketch.RemoveWithCount(math.NaN(), 1))
+		for _, value := range []float64{-1, 0, 1} {
+			for _, count := range []float64{math.NaN(), math.Inf(1)} {
+				assert.Equal(t, store.ErrInvalidBinCount, sketch.RemoveWithCount(value, count))
+				assert.Equal(t, store.ErrInvalidBinCount, exactSketch.RemoveWithCount(value, count))
+			}
+		}
+		assertQuantileSketchesEqual(t, expected, sketch)
+
+		// Counts are clamped at zero.
+		expected.ForEach(func(value, count float64) (stop bool) {
+			assert.Nil(t, sketch.RemoveWithCount(value, 2*count))
+			assert.Nil(t, exactSketch.RemoveWithCount(value, 2*count))
+			return false
+		})
+		assert.True(t, sketch.IsEmpty())
+		assert.True(t, exactSketch.IsEmpty())
+		assert.Equal(t, float64(0), exactSketch.GetSum())
+	}
+}
+
+func TestDiffWith(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		generator := dataset.NewNormal(0, 10)
+		sketch := NewDDSketchFromStoreProvider(m, storeProvider)
+		exactSketch := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			sketch.Add(value)
+			exactSketch.Add(value)
+		}
+		sketch.AddWithCount(0, 3)
+		exactSketch.AddWithCount(0, 3)
+		snapshot := sketch.Copy()
+		exactSnapshot := exactSketch.Copy()
+
+		expected := NewDDSketchFromStoreProvider(m, storeProvider)
+		exactExpected := NewDDSketchWithExactSummaryStatistics(m, storeProvider)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			sketch.Add(value)
+			exactSketch.Add(value)
+			expected.Add(value)
+			exactExpected.Add(value)
+		}
+		sketch.AddWithCount(0, 1)
+		exactSketch.AddWithCount(0, 1)
+		expected.AddWithCount(0, 1)
+		exactExpected.AddWithCount(0, 1)
+
+		assert.Nil(t, sketch.DiffWith(snapshot))
+		assertQuantileSketchesEqual(t, expected, sketch)
+		assert.Nil(t, exactSketch.DiffWith(exactSnapshot))
+		assert.Equal(t, expected.GetCount(), exactSketch.GetCount())
+		assert.InDelta(t, expected.GetSum(), exactSketch.GetSum(), float64(1000)*0.01*10)
+		expectedVariance, _ := exactExpected.GetVariance()
+		variance, err := exactSketch.GetVariance()
+		assert.Nil(t, err)
+		assert.InEpsilon(t, expectedVariance, variance, 1e-6)
+
+		// Counts are clamped at zero.
+		assert.Nil(t, snapshot.DiffWith(sketch))
+		assert.Nil(t, snapshot.DiffWith(snapshot))
+		assert.True(t, snapshot.IsEmpty())
+		assert.Nil(t, exactSnapshot.DiffWith(exactSnapshot))
+		assert.True(t, exactSnapshot.IsEmpty())
+	}
+
+	other, _ := LogUnboundedDenseDDSketch(0.02)
+	sketch, _ := LogUnboundedDenseDDSketch(0.01)
+	assert.NotNil(t, sketch.DiffWith(other))
+}
+
+func TestMemorySize(t *testing.T) {
+	storesMemorySize := func(sketch quantileSketch) int {
+		return sketch.GetPositiveValueStore().MemorySize() + sketch.GetNegativeValueStore().MemorySize()
+	}
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		emptySize := sketch.MemorySize()
+		overhead := emptySize - storesMemorySize(sketch)
+		assert.Greater(t, overhead, 0)
+		generator := dataset.NewLognormal(0, 2)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			assert.Nil(t, sketch.Add(value))
+			assert.Nil(t, sketch.Add(-value))
+		}
+		assert.Greater(t, sketch.MemorySize(), emptySize)
+		assert.Equal(t, overhead, sketch.MemorySize()-storesMemorySize(sketch))
+	}
+}
+
+func TestAddDoesNotAllocate(t *testing.T) {
+	indexMapping, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := map[string]store.Provider{
+		"dense":      store.DenseStoreConstructor,
+		"collapsing": func() store.Store { return store.NewCollapsingLowestDenseStore(2048) },
+		"sparse":     store.SparseStoreConstructor,
+	}
+	for name, storeProvider := range storeProviders {
+		t.Run(name, func(t *testing.T) {
+			sketch := NewDDSketchFromStoreProvider(indexMapping, storeProvider)
+			exact := NewDDSketchWithExactSummaryStatistics(indexMapping, storeProvider)
+			// The bins are allocated beforehand.
+			for _, value := range []float64{-3, 0, 3} {
+				assert.Nil(t, sketch.Add(value))
+				assert.Nil(t, exact.Add(value))
+			}
+			assert.Zero(t, testing.AllocsPerRun(100, func() {
+				sketch.Add(3)
+				sketch.Add(-3)
+				sketch.Add(0)
+				sketch.AddInt(3)
+				sketch.AddWithCount(3, 2)
+			}))
+			assert.Zero(t, testing.AllocsPerRun(100, func() {
+				exact.Add(3)
+				exact.Add(-3)
+				exact.AddWithCount(3, 2)
+			}))
+		})
+	}
+}
+
+func TestBoundedStores(t *testing.T) {
+	maxBytes := 2048
+	indexMapping, _ := mapping.NewLogarithmicMapping(0.01)
+	provider := func() store.Store { return store.NewBoundedStore(store.NewDenseStore(), maxBytes) }
+	sketch := NewDDSketchFromStoreProvider(indexMapping, provider)
+
+	var err error
+	value := 1.0
+	for ; err == nil; value *= 1.01 {
+		err = sketch.Add(value)
+	}
+	var memoryLimitErr *store.MemoryLimitError
+	assert.True(t, errors.As(err, &memoryLimitErr))
+	assert.Equal(t, maxBytes, memoryLimitErr.MaxBytes)
+	assert.Equal(t, 1.0, memoryLimitErr.RejectedCount)
+	assert.LessOrEqual(t, sketch.GetPositiveValueStore().(*store.BoundedStore).TotalCount(), sketch.GetCount())
+
+	// The rejected value is not tracked, while values of existing bins still are.
+	count := sketch.GetCount()
+	assert.Nil(t, sketch.Add(1))
+	assert.Equal(t, count+1, sketch.GetCount())
+	assert.NotNil(t, sketch.AddValues([]float64{2, value * 1e6}))
+	assert.Equal(t, count+2, sketch.GetCount())
+
+	// Merging reports the bins that do not fit.
+	other := NewDDSketchFromStoreProvider(indexMapping, store.DenseStoreConstructor)
+	assert.Nil(t, other.MergeWith(sketch))
+	assert.Nil(t, other.AddWithCount(value*1e-6, 3))
+	err = sketch.MergeWith(other)
+	assert.True(t, errors.As(err, &memoryLimitErr))
+	assert.Equal(t, 3.0, memoryLimitErr.RejectedCount)
+	assert.Equal(t, 2*(count+2), sketch.GetCount())
+
+	// Decoding reports the bins that do not fit, and only once.
+	var encoded []byte
+	other.Encode(&encoded, false)
+	decoded := NewDDSketchFromStoreProvider(indexMapping, provider)
+	err = decoded.DecodeAndMergeWith(encoded)
+	assert.True(t, errors.As(err, &memoryLimitErr))
+	assert.Greater(t, memoryLimitErr.RejectedCount, 0.0)
+	assert.Equal(t, other.GetCount()-memoryLimitErr.RejectedCount, decoded.GetCount())
+	assert.Nil(t, decoded.Add(value*1e-6))
+}
+
+func TestBoundedStoresWithExactSummaryStatistics(t *testing.T) {
+	maxBytes := 2048
+	indexMapping, _ := mapping.NewLogarithmicMapping(0.01)
+	provider := func() store.Store { return store.NewBoundedStore(store.NewDenseStore(), maxBytes) }
+	sketch := NewDDSketchWithExactSummaryStatistics(indexMapping, provider)
+	var values []float64
+	for value := 1.0; value < 1e6; value *= 1.01 {
+		values = append(values, value)
+	}
+
+	// The summary statistics only track the values that the stores accept.
+	var memoryLimitErr *store.MemoryLimitError
+	err := sketch.AddValues(values)
+	assert.True(t, errors.As(err, &memoryLimitErr))
+	assert.Equal(t, float64(len(values)), sketch.DDSketch.GetCount()+memoryLimitErr.RejectedCount)
+	assert.Equal(t, sketch.DDSketch.GetCount(), sketch.GetCount())
+	counts := make([]float64, len(values))
+	for i := range counts {
+		counts[i] = 2
+	}
+	err = sketch.AddWithCounts(values, counts)
+	assert.True(t, errors.As(err, &memoryLimitErr))
+	assert.Equal(t, sketch.DDSketch.GetCount(), sketch.GetCount())
+	maxValue, _ := sketch.GetMaxValue()
+	assert.Less(t, maxValue, values[len(values)-1])
+
+	// Merges that do not fit are rejected as a whole.
+	other := NewDDSketchWithExactSummaryStatistics(indexMapping, store.DenseStoreConstructor)
+	assert.Nil(t, other.AddValues(values))
+	expected := sketch.Copy()
+	for _, testCase := range []struct {
+		merge         func() error
+		rejectedCount float64
+	}{
+		{merge: func() error { return sketch.MergeWith(other) }, rejectedCount: float64(len(values))},
+		{merge: func() error { return sketch.MergeWithWeight(other, 2) }, rejectedCount: float64(2 * len(values))},
+		{merge: func() error { return sketch.MergeWithConverting(other) }, rejectedCount: float64(len(values))},
+	} {
+		err = testCase.merge()
+		assert.True(t, errors.As(err, &memoryLimitErr))
+		assert.Equal(t, testCase.rejectedCount, memoryLimitErr.RejectedCount)
+		assert.True(t, expected.Equals(sketch))
+		assert.Nil(t, sketch.Add(1))
+		assert.Nil(t, expected.Add(1))
+	}
+	var encoded []byte
+	other.Encode(&encoded, false)
+	assert.True(t, errors.As(sketch.DecodeAndMergeWith(encoded), &memoryLimitErr))
+	assert.Equal(t, float64(len(values)), memoryLimitErr.RejectedCount)
+	assert.True(t, expected.Equals(sketch))
+	assert.Equal(t, sketch.DDSketch.GetCount(), sketch.GetCount())
+
+	// Merges that fit are made.
+	small := NewDDSketchWithExactSummaryStatistics(indexMapping, store.DenseStoreConstructor)
+	assert.Nil(t, small.AddWithCount(1, 3))
+	assert.Nil(t, sketch.MergeWith(small))
+	assert.Nil(t, expected.MergeWith(small))
+	assert.True(t, expected.Equals(sketch))
+}
+
+func TestMergeAllBoundedStores(t *testing.T) {
+	indexMapping, _ := mapping.NewLogarithmicMapping(0.01)
+	provider := func() store.Store { return store.NewBoundedStore(store.NewDenseStore(), 2048) }
+	for _, parallelism := range []int{1, 3} {
+		target := NewDDSketchFromStoreProvider(indexMapping, provider)
+		var others []*DDSketch
+		numValues := 0
+		for value := 1.0; value < 1e6; value *= 1.1 {
+			other := NewDDSketchFromStoreProvider(indexMapping, store.DenseStoreConstructor)
+			assert.Nil(t, other.Add(value))
+			others = append(others, other)
+			numValues++
+		}
+		var memoryLimitErr *store.MemoryLimitError
+		err := MergeAll(target, others, parallelism)
+		assert.True(t, errors.As(err, &memoryLimitErr))
+		assert.Equal(t, float64(numValues), target.GetCount()+memoryLimitErr.RejectedCount)
+	}
+}
+
+func TestGetMode(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		_, err := sketch.GetMode()
+		assert.NotNil(t, err)
+
+		assert.Nil(t, sketch.AddWithCount(-10, 2))
+		assert.Nil(t, sketch.AddWithCount(5, 3))
+		assert.Nil(t, sketch.AddWithCount(100, 1))
+		mode, err := sketch.GetMode()
+		assert.Nil(t, err)
+		assertRelativelyAccurate(assert.New(t), sketch.RelativeAccuracy(), 5, 5, mode)
+
+		// Ties are broken in favor of the value that is the closest to zero.
+		assert.Nil(t, sketch.AddWithCount(-10, 1))
+		mode, _ = sketch.GetMode()
+		assertRelativelyAccurate(assert.New(t), sketch.RelativeAccuracy(), 5, 5, mode)
+		assert.Nil(t, sketch.AddWithCount(-2, 3))
+		mode, _ = sketch.GetMode()
+		assertRelativelyAccurate(assert.New(t), sketch.RelativeAccuracy(), -2, -2, mode)
+		assert.Nil(t, sketch.AddWithCount(2, 3))
+		mode, _ = sketch.GetMode()
+		assertRelativelyAccurate(assert.New(t), sketch.RelativeAccuracy(), -2, -2, mode)
+		assert.Nil(t, sketch.AddWithCount(0, 3))
+		mode, _ = sketch.GetMode()
+		assert.Equal(t, float64(0), mode)
+		assert.Nil(t, sketch.AddWithCount(100, 3))
+		mode, _ = sketch.GetMode()
+		assertRelativelyAccurate(assert.New(t), sketch.RelativeAccuracy(), 100, 100, mode)
+	}
+}
+
+// decodeWithBaselineFlags decodes the sketch like the decoders that predate the
+// sum of squared deviations do, rejecting the flags that they do not know.
+func decodeWithBaselineFlags(b []byte) (*DDSketch, error) {
+	sketch := NewDDSketchFromStoreProvider(nil, store.DefaultProvider)
+	err := sketch.decodeAndMergeWith(b, nil, func(b *[]byte, flag enc.Flag) error {
+		switch flag {
+		case enc.FlagCount, enc.FlagSum, enc.FlagMin, enc.FlagMax:
+			return skipExactSummaryStatistics(b, flag)
+		default:
+			return errUnknownFlag
+		}
+	}, nil)
+	return sketch, err
+}
+
+func TestEncodeWithBaselineFlags(t *testing.T) {
+	sketch, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	for _, value := range []float64{-3, -1, 0, 1, 2, 2, 1e6} {
+		assert.Nil(t, sketch.Add(value))
+	}
+	variance, _ := sketch.GetVariance()
+	assert.NotZero(t, variance)
+
+	var encoded []byte
+	sketch.Encode(&encoded, false)
+	var buffer bytes.Buffer
+	assert.Nil(t, sketch.EncodeTo(&buffer, false))
+	for _, b := range [][]byte{encoded, buffer.Bytes()} {
+		decoded, err := decodeWithBaselineFlags(b)
+		assert.Nil(t, err)
+		assertSketchesEquivalent(t, sketch.DDSketch, decoded)
+	}
+
+	// The versioned encoding, which they do not accept anyway, includes the
+	// sum of squared deviations.
+	var versioned []byte
+	sketch.EncodeWithVersion(&versioned, false)
+	_, err := decodeWithBaselineFlags(versioned)
+	assert.NotNil(t, err)
+}
+
+func TestVariance(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	generator := dataset.NewNormal(3, 10)
+	values := make([]float64, 1000)
+	for i := range values {
+		values[i] = generator.Generate()
+	}
+	expectedVariance := func(values []float64) float64 {
+		mean := 0.0
+		for _, value := range values {
+			mean += value
+		}
+		mean /= float64(len(values))
+		variance := 0.0
+		for _, value := range values {
+			variance += (value - mean) * (value - mean)
+		}
+		return variance / float64(len(values))
+	}
+
+	sketch := NewDDSketchWithExactSummaryStatistics(m, store.DefaultProvider)
+	_, err := sketch.GetVariance()
+	assert.NotNil(t, err)
+	_, err = sketch.GetStdDev()
+	assert.NotNil(t, err)
+	half := NewDDSketchWithExactSummaryStatistics(m, store.DefaultProvider)
+	otherHalf := NewDDSketchWithExactSummaryStatistics(m, store.DefaultProvider)
+	for i, value := range values {
+		assert.Nil(t, sketch.Add(value))
+		if i < len(values)/2 {
+			assert.Nil(t, half.Add(value))
+		} else {
+			assert.Nil(t, otherHalf.Add(value))
+		}
+	}
+	variance, err := sketch.GetVariance()
+	assert.Nil(t, err)
+	assert.InEpsilon(t, expectedVariance(values), variance, 1e-9)
+	stdDev, err := sketch.GetStdDev()
+	assert.Nil(t, err)
+	assert.InEpsilon(t, math.Sqrt(expectedVariance(values)), stdDev, 1e-9)
+
+	assert.Nil(t, half.MergeWith(otherHalf))
+	mergedVariance, _ := half.GetVariance()
+	assert.InEpsilon(t, variance, mergedVariance, 1e-9)
+
+	// The variance survives the versioned encoding, but not the default one,
+	// which decoders that predate it must accept.
+	var encoded, unversioned []byte
+	sketch.EncodeWithVersion(&encoded, false)
+	sketch.Encode(&unversioned, false)
+	decoded, err := DecodeDDSketchWithExactSummaryStatistics(unversioned, store.DefaultProvider, nil)
+	assert.Nil(t, err)
+	decodedVariance, _ := decoded.GetVariance()
+	assert.Zero(t, decodedVariance)
+	decoded, err = DecodeDDSketchWithExactSummaryStatistics(encoded, store.DefaultProvider, nil)
+	assert.Nil(t, err)
+	decodedVariance, _ = decoded.GetVariance()
+	assert.Equal(t, variance, decodedVariance)
+	assert.Nil(t, decoded.DecodeAndMergeWith(encoded))
+	decodedVariance, _ = decoded.GetVariance()
+	assert.InEpsilon(t, variance, decodedVariance, 1e-9)
+
+	serialized, err := proto.Marshal(sketch.ToProto())
+	assert.Nil(t, err)
+	var sketchPb sketchpb.DDSketch
+	assert.Nil(t, proto.Unmarshal(serialized, &sketchPb))
+	fromProto, err := FromProtoWithExactSummaryStatistics(&sketchPb, store.DefaultProvider)
+	assert.Nil(t, err)
+	assertQuantileSketchesEqual(t, sketch, fromProto)
+	fromProtoVariance, _ := fromProto.GetVariance()
+	assert.Equal(t, variance, fromProtoVariance)
+	sketchPb.SummaryStatistics = nil
+	_, err = FromProtoWithExactSummaryStatistics(&sketchPb, store.DefaultProvider)
+	assert.NotNil(t, err)
+
+	b, err := json.Marshal(sketch)
+	assert.Nil(t, err)
+	var fromJSON DDSketchWithExactSummaryStatistics
+	assert.Nil(t, json.Unmarshal(b, &fromJSON))
+	fromJSONVariance, _ := fromJSON.GetVariance()
+	assert.Equal(t, variance, fromJSONVariance)
+}
+
+func TestAddValues(t *testing.T) {
+	for _, testCase := range testCases {
+		generator := dataset.NewNormal(0, 10)
+		values := make([]float64, 1000)
+		counts := make([]float64, len(values))
+		for i := range values {
+			values[i] = generator.Generate()
+			counts[i] = float64(i % 3)
+		}
+		values[0] = 0
+
+		expected := testCase.sketch()
+		withCounts := testCase.sketch()
+		for i, value := range values {
+			assert.Nil(t, expected.Add(value))
+			assert.Nil(t, withCounts.AddWithCount(value, counts[i]))
+		}
+		actual := testCase.sketch()
+		assert.Nil(t, actual.AddValues(values))
+		assertQuantileSketchesEqual(t, expected, actual)
+		actualWithCounts := testCase.sketch()
+		assert.Nil(t, actualWithCounts.AddWithCounts(values, counts))
+		assertQuantileSketchesEqual(t, withCounts, actualWithCounts)
+
+		// Invalid inputs do not modify the sketch.
+		sketch := testCase.sketch()
+		assert.Equal(t, ErrUntrackableNaN, sketch.AddValues([]float64{1, math.NaN()}))
+		assert.Equal(t, ErrUntrackableTooHigh, sketch.AddValues([]float64{1, math.Inf(1)}))
+		assert.Equal(t, ErrUntrackableTooLow, sketch.AddValues([]float64{1, math.Inf(-1)}))
+		assert.Equal(t, ErrNegativeCount, sketch.AddWithCounts([]float64{1, 2}, []float64{1, -1}))
+		assert.NotNil(t, sketch.AddWithCounts([]float64{1, 2}, []float64{1}))
+		assert.True(t, sketch.IsEmpty())
+
+		// AddWithCounts validates values and counts like AddWithCount does.
+		for _, value := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1} {
+			for _, count := range []float64{0, 1, -1} {
+				single, batched := testCase.sketch(), testCase.sketch()
+				assert.Nil(t, single.Add(2))
+				assert.Nil(t, batched.Add(2))
+				err := single.AddWithCount(value, count)
+				assert.Equal(t, err, batched.AddWithCounts([]float64{value}, []float64{count}), "value: %v, count: %v", value, count)
+				assert.Equal(t, single.GetCount(), batched.GetCount())
+				if err == nil {
+					assert.Nil(t, batched.AddWithCounts([]float64{value, 2}, []float64{count, 1}))
+					assert.Equal(t, single.GetCount()+count+1, batched.GetCount())
+				}
+			}
+		}
+	}
+}
+
+func assertQuantileSketchesEqual(t *testing.T, expected, actual quantileSketch) {
+	assert.Equal(t, expected.GetCount(), actual.GetCount())
+	assert.Equal(t, expected.GetZeroCount(), actual.GetZeroCount())
+	assert.InDelta(t, expected.GetSum(), actual.GetSum(), floatingPointAcceptableError)
+	expectedQuantiles, err := expected.GetValuesAtQuantiles(testQuantiles)
+	assert.Nil(t, err)
+	actualQuantiles, err := actual.GetValuesAtQuantiles(testQuantiles)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedQuantiles, actualQuantiles)
+}
+
+func TestAddHDRBuckets(t *testing.T) {
+	buckets := []HDRBucket{
+		{From: 0, To: 0, Count: 3},
+		{From: 1, To: 1, Count: 1},
+		{From: 1000, To: 1001, Count: 5},
+		{From: 2048, To: 2051, Count: 0},
+		{From: 1 << 40, To: 1<<40 + 1<<30, Count: 2},
+	}
+	for _, testCase := range testCases {
+		expected := testCase.sketch()
+		for _, bucket := range buckets {
+			assert.Nil(t, expected.AddWithCount((float64(bucket.From)+float64(bucket.To))/2, float64(bucket.Count)))
+		}
+		actual := testCase.sketch()
+		assert.Nil(t, actual.AddHDRBuckets(buckets))
+		assertQuantileSketchesEqual(t, expected, actual)
+		assert.Equal(t, float64(11), actual.GetCount())
+
+		sketch := testCase.sketch()
+		assert.NotNil(t, sketch.AddHDRBuckets([]HDRBucket{{From: 1, To: 1, Count: 1}, {From: 2, To: 1, Count: 1}}))
+		assert.Equal(t, ErrNegativeCount, sketch.AddHDRBuckets([]HDRBucket{{From: 1, To: 1, Count: 1}, {From: 1, To: 2, Count: -1}}))
+		assert.True(t, sketch.IsEmpty())
+	}
+
+	sketch, err := NewDDSketchFromHDRBuckets(0.01, buckets)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(11), sketch.GetCount())
+	assert.Equal(t, float64(3), sketch.GetZeroCount())
+	_, err = NewDDSketchFromHDRBuckets(0, buckets)
+	assert.NotNil(t, err)
+}
+
+func TestCentroids(t *testing.T) {
+	centroids := []Centroid{
+		{Mean: -12.5, Weight: 2},
+		{Mean: 0, Weight: 1.5},
+		{Mean: 3.25, Weight: 4},
+		{Mean: 1e9, Weight: 1},
+	}
+	for _, testCase := range testCases {
+		expected := testCase.sketch()
+		for _, centroid := range centroids {
+			assert.Nil(t, expected.AddWithCount(centroid.Mean, centroid.Weight))
+		}
+		sketch := testCase.sketch()
+		assert.Nil(t, sketch.AddCentroids(centroids))
+		assertQuantileSketchesEqual(t, expected, sketch)
+
+		emitted := sketch.ToCentroids()
+		assert.Len(t, emitted, len(centroids))
+		for i, centroid := range emitted {
+			assert.Equal(t, centroids[i].Weight, centroid.Weight)
+			if centroids[i].Mean == 0 {
+				assert.Equal(t, float64(0), centroid.Mean)
+			} else {
+				assertRelativelyAccurate(assert.New(t), sketch.RelativeAccuracy(), centroids[i].Mean, centroids[i].Mean, centroid.Mean)
+			}
+		}
+
+		// Converting back and forth does not change the sketch.
+		converted := testCase.sketch()
+		assert.Nil(t, converted.AddCentroids(emitted))
+		assert.Equal(t, sketch.ToHistogram([]float64{-10, 0, 10}), converted.ToHistogram([]float64{-10, 0, 10}))
+		assert.Equal(t, emitted, converted.ToCentroids())
+
+		invalid := testCase.sketch()
+		assert.Equal(t, ErrNegativeCount, invalid.AddCentroids([]Centroid{{Mean: 1, Weight: 1}, {Mean: 2, Weight: -1}}))
+		assert.Equal(t, ErrUntrackableNaN, invalid.AddCentroids([]Centroid{{Mean: 1, Weight: 1}, {Mean: math.NaN(), Weight: 1}}))
+		assert.True(t, invalid.IsEmpty())
+		assert.Empty(t, invalid.ToCentroids())
+	}
+
+	sketch, err := NewDDSketchFromCentroids(0.01, centroids)
+	assert.Nil(t, err)
+	assert.Equal(t, 8.5, sketch.GetCount())
+	_, err = NewDDSketchFromCentroids(0.01, []Centroid{{Mean: math.Inf(1), Weight: 1}})
+	assert.Equal(t, ErrUntrackableTooHigh, err)
+}
+
+func TestGetValueAtQuantileWithBounds(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		_, _, _, err := sketch.GetValueAtQuantileWithBounds(0.5)
+		assert.NotNil(t, err)
+
+		generator := dataset.NewNormal(0, 100)
+		data := dataset.NewDataset()
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			assert.Nil(t, sketch.Add(value))
+			data.Add(value)
+		}
+		assert.Nil(t, sketch.Add(0))
+		data.Add(0)
+		for _, q := range testQuantiles {
+			value, lower, upper, err := sketch.GetValueAtQuantileWithBounds(q)
+			assert.Nil(t, err)
+			expectedValue, _ := sketch.GetValueAtQuantile(q)
+			assert.Equal(t, expectedValue, value)
+			assert.LessOrEqual(t, lower, value)
+			assert.GreaterOrEqual(t, upper, value)
+			assert.LessOrEqual(t, lower, data.LowerQuantile(q))
+			assert.GreaterOrEqual(t, upper, data.LowerQuantile(q))
+		}
+		values, lowers, uppers, err := sketch.GetValuesAtQuantilesWithBounds(testQuantiles)
+		assert.Nil(t, err)
+		for i, q := range testQuantiles {
+			value, lower, upper, _ := sketch.GetValueAtQuantileWithBounds(q)
+			assert.Equal(t, []float64{value, lower, upper}, []float64{values[i], lowers[i], uppers[i]})
+		}
+		_, _, _, err = sketch.GetValueAtQuantileWithBounds(1.1)
+		assert.NotNil(t, err)
+		_, _, _, err = sketch.GetValuesAtQuantilesWithBounds([]float64{0.5, 1.1})
+		assert.NotNil(t, err)
+	}
+
+	// Bounds are void on collapsed bins.
+	lowest, _ := LogCollapsingLowestDenseDDSketch(0.01, 10)
+	highest, _ := LogCollapsingHighestDenseDDSketch(0.01, 10)
+	for i := 1; i <= 1000; i++ {
+		assert.Nil(t, lowest.Add(float64(i)))
+		assert.Nil(t, highest.Add(float64(i)))
+		assert.Nil(t, lowest.Add(-float64(i)))
+		assert.Nil(t, highest.Add(-float64(i)))
+	}
+	_, lower, upper, _ := lowest.GetValueAtQuantileWithBounds(0.6)
+	assert.Equal(t, float64(0), lower)
+	assert.Less(t, upper, float64(1000))
+	_, lower, upper, _ = lowest.GetValueAtQuantileWithBounds(0.4)
+	assert.Greater(t, lower, float64(-1000))
+	assert.Equal(t, float64(0), upper)
+	_, lower, upper, _ = lowest.GetValueAtQuantileWithBounds(1)
+	assert.InEpsilon(t, 1000, lower, 0.03)
+	assert.InEpsilon(t, 1000, upper, 0.03)
+	_, lower, upper, _ = highest.GetValueAtQuantileWithBounds(1)
+	assert.Greater(t, lower, float64(0))
+	assert.Equal(t, math.Inf(1), upper)
+	_, lower, upper, _ = highest.GetValueAtQuantileWithBounds(0)
+	assert.Equal(t, math.Inf(-1), lower)
+	assert.Less(t, upper, float64(0))
+
+	// Exact summary statistics narrow down the bounds.
+	exact, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	assert.Nil(t, exact.Add(100))
+	value, lower, upper, err := exact.GetValueAtQuantileWithBounds(0.5)
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{100, 100, 100}, []float64{value, lower, upper})
+}
+
+func TestGetCollapsedCount(t *testing.T) {
+	sketch, _ := NewDefaultDDSketch(0.01)
+	lowest, _ := LogCollapsingLowestDenseDDSketch(0.01, 10)
+	highest, _ := LogCollapsingHighestDenseDDSketch(0.01, 10)
+	for i := 1; i <= 1000; i++ {
+		for _, s := range []*DDSketch{sketch, lowest, highest} {
+			assert.Nil(t, s.Add(float64(i)))
+			assert.Nil(t, s.Add(-float64(i)))
+		}
+	}
+	assert.Zero(t, sketch.GetCollapsedCount())
+
+	// The lowest indexes are the ones of the values of lowest magnitudes.
+	positiveMinIndex, _ := lowest.positiveValueStore.MinIndex()
+	negativeMinIndex, _ := lowest.negativeValueStore.MinIndex()
+	highestMaxIndex, _ := highest.positiveValueStore.MaxIndex()
+	expectedLowest, expectedHighest := float64(0), float64(0)
+	for i := 1; i <= 1000; i++ {
+		if lowest.Index(float64(i)) < positiveMinIndex {
+			expectedLowest++
+		}
+		if lowest.Index(float64(i)) < negativeMinIndex {
+			expectedLowest++
+		}
+		if highest.Index(float64(i)) > highestMaxIndex {
+			expectedHighest += 2
+		}
+	}
+	assert.Greater(t, expectedLowest, float64(0))
+	assert.Equal(t, expectedLowest, lowest.GetCollapsedCount())
+	assert.Equal(t, expectedHighest, highest.GetCollapsedCount())
+
+	lowest.Clear()
+	assert.Zero(t, lowest.GetCollapsedCount())
+}
+
+func TestQuantileInterpolation(t *testing.T) {
+	sketch, _ := NewDefaultDDSketch(0.01)
+	assert.Equal(t, QuantileInterpolationMidpoint, sketch.QuantileInterpolation())
+	for _, v := range []float64{-10, 1, 2, 100} {
+		assert.Nil(t, sketch.Add(v))
+	}
+	for _, q := range testQuantiles {
+		midpoint, _ := sketch.GetValueAtQuantile(q)
+		_, lower, upper, _ := sketch.GetValueAtQuantileWithBounds(q)
+
+		sketch.SetQuantileInterpolation(QuantileInterpolationLowerBound)
+		value, _ := sketch.GetValueAtQuantile(q)
+		assert.Equal(t, lower, value)
+		sketch.SetQuantileInterpolation(QuantileInterpolationUpperBound)
+		value, _ = sketch.GetValueAtQuantile(q)
+		assert.Equal(t, upper, value)
+		sketch.SetQuantileInterpolation(QuantileInterpolationMidpoint)
+		value, _ = sketch.GetValueAtQuantile(q)
+		assert.Equal(t, midpoint, value)
+	}
+
+	// Linear interpolation between the bins of the ranks 1 and 2.
+	sketch.SetQuantileInterpolation(QuantileInterpolationLinear)
+	value, err := sketch.GetValueAtQuantile(0.5)
+	assert.Nil(t, err)
+	assert.InEpsilon(t, 1.5, value, 0.01)
+	value, _ = sketch.GetValueAtQuantile(0.25)
+	assert.InEpsilon(t, -1.75, value, 0.01)
+	value, _ = sketch.GetValueAtQuantile(1)
+	assert.InEpsilon(t, 100, value, 0.01)
+	value, lower, upper, _ := sketch.GetValueAtQuantileWithBounds(0.5)
+	assert.Equal(t, upper, value)
+	assert.InEpsilon(t, 1, lower, 0.01)
+
+	// The interpolation is kept by copies.
+	assert.Equal(t, QuantileInterpolationLinear, sketch.Copy().QuantileInterpolation())
+	assert.Equal(t, QuantileInterpolationLinear, sketch.ChangeStore(store.SparseStoreConstructor).QuantileInterpolation())
+	exact, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	exact.SetQuantileInterpolation(QuantileInterpolationUpperBound)
+	assert.Nil(t, exact.Add(3))
+	assert.Nil(t, exact.Add(5))
+	value, _ = exact.Copy().GetValueAtQuantile(0)
+	assert.Equal(t, exact.LowerBound(exact.Index(3)+1), value)
+}
+
+func TestClampOutOfRange(t *testing.T) {
+	sketch, _ := NewDefaultDDSketch(0.01)
+	assert.False(t, sketch.ClampOutOfRange())
+	assert.Equal(t, ErrUntrackableTooHigh, sketch.Add(math.Inf(1)))
+	assert.Equal(t, ErrUntrackableTooLow, sketch.Add(math.Inf(-1)))
+
+	sketch.SetClampOutOfRange(true)
+	assert.Nil(t, sketch.Add(math.Inf(1)))
+	assert.Nil(t, sketch.AddWithCount(-math.MaxFloat64, 2))
+	assert.Nil(t, sketch.AddValues([]float64{1, math.Inf(1)}))
+	assert.Nil(t, sketch.AddWithCounts([]float64{math.Inf(-1)}, []float64{3}))
+	assert.Equal(t, ErrUntrackableNaN, sketch.Add(math.NaN()))
+	assert.Equal(t, ErrUntrackableNaN, sketch.AddValues([]float64{math.NaN()}))
+	assert.Equal(t, float64(7), sketch.ClampedCount())
+	assert.Equal(t, float64(8), sketch.GetCount())
+	maxValue, _ := sketch.GetMaxValue()
+	assert.InEpsilon(t, sketch.MaxIndexableValue(), maxValue, 0.02)
+	minValue, _ := sketch.GetMinValue()
+	assert.InEpsilon(t, -sketch.MaxIndexableValue(), minValue, 0.02)
+
+	assert.Nil(t, sketch.RemoveWithCount(math.Inf(-1), 5))
+	assert.Equal(t, float64(3), sketch.GetCount())
+	assert.Equal(t, float64(7), sketch.ClampedCount())
+
+	other := sketch.Copy()
+	assert.True(t, other.ClampOutOfRange())
+	assert.Nil(t, other.MergeWith(sketch))
+	assert.Equal(t, float64(14), other.ClampedCount())
+	assert.Nil(t, other.MergeWithWeight(sketch, 0.5))
+	assert.Equal(t, float64(17.5), other.ClampedCount())
+	assert.Nil(t, other.MergeWithWeight(other, 1))
+	assert.Equal(t, float64(35), other.ClampedCount())
+	other.Clear()
+	assert.Equal(t, float64(0), other.ClampedCount())
+
+	// Exact summary statistics track the clamped values.
+	exact, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	exact.SetClampOutOfRange(true)
+	assert.Nil(t, exact.Add(math.Inf(1)))
+	assert.Nil(t, exact.Add(1))
+	maxValue, _ = exact.GetMaxValue()
+	assert.Equal(t, exact.MaxIndexableValue(), maxValue)
+	assert.False(t, math.IsInf(exact.GetSum(), 0))
+}
+
+// nonComparableMapping is a mapping whose type is not comparable.
+type nonComparableMapping struct {
+	mapping.IndexMapping
+	_ []int
+}
+
+func TestAddInt(t *testing.T) {
+	for _, testCase := range dataTestCases {
+		expected := NewDDSketchFromStoreProvider(testCase.indexMapping, testCase.storeProvider)
+		actual := NewDDSketchFromStoreProvider(testCase.indexMapping, testCase.storeProvider)
+		for _, value := range []int64{0, 1, -1, 2, 3, 1000, 1023, -1023, 1024, -1024, 123456789, -987654321} {
+			assert.Nil(t, expected.Add(float64(value)))
+			assert.Nil(t, actual.AddInt(value))
+		}
+		assert.Equal(t, expected.GetZeroCount(), actual.GetZeroCount())
+		assert.True(t, store.Equivalent(expected.PositiveStore(), actual.PositiveStore()))
+		assert.True(t, store.Equivalent(expected.NegativeStore(), actual.NegativeStore()))
+	}
+
+	// The cached indexes follow changes of the mapping.
+	sketch, _ := NewDefaultDDSketch(0.01)
+	assert.Nil(t, sketch.AddInt(100))
+	sketch.IndexMapping, _ = mapping.NewLogarithmicMapping(0.1)
+	sketch.Clear()
+	assert.Nil(t, sketch.AddInt(100))
+	index, _ := sketch.PositiveStore().MinIndex()
+	assert.Equal(t, sketch.Index(100), index)
+
+	// Sketches with equal mappings share the cached indexes.
+	other, _ := NewDefaultDDSketch(0.1)
+	assert.Nil(t, other.AddInt(100))
+	assert.Same(t, sketch.smallIntIndexes.indexes, other.smallIntIndexes.indexes)
+
+	// Mappings of non-comparable types are supported.
+	sketch.IndexMapping = nonComparableMapping{IndexMapping: sketch.IndexMapping}
+	assert.Nil(t, sketch.AddInt(100))
+	assert.Nil(t, sketch.AddInt(100))
+	assert.Equal(t, 3.0, sketch.GetCount())
+
+	exact, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	assert.Nil(t, exact.AddInt(-3))
+	assert.Nil(t, exact.AddInt(5))
+	assert.Equal(t, float64(2), exact.GetSum())
+}
+
+func TestGetRankOfValue(t *testing.T) {
+	{ // Empty.
+		sketch, _ := LogUnboundedDenseDDSketch(0.01)
+		_, err := sketch.GetRankOfValue(1)
+		assert.NotNil(t, err)
+	}
+	{ // Tiny values of either sign are mapped to the zero bin.
+		sketch, _ := LogUnboundedDenseDDSketch(0.01)
+		assert.Nil(t, sketch.AddValues([]float64{-1, 0, 0, 1}))
+		tiny := sketch.MinIndexableValue() / 2
+		for _, value := range []float64{-sketch.MinIndexableValue(), -tiny, 0, tiny, sketch.MinIndexableValue()} {
+			rank, err := sketch.GetRankOfValue(value)
+			assert.Nil(t, err)
+			assert.Equal(t, 0.75, rank)
+		}
+	}
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		data := dataset.NewDataset()
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			sketch.Add(value)
+			data.Add(value)
+		}
+		sketch.AddWithCount(0, 10)
+		for i := 0; i < 10; i++ {
+			data.Add(0)
+		}
+
+		gamma := (1 + sketch.RelativeAccuracy()) / (1 - sketch.RelativeAccuracy())
+		for _, q := range testQuantiles {
+			value := data.LowerQuantile(q)
+			rank, err := sketch.GetRankOfValue(value)
+			assert.Nil(t, err)
+			lower := math.Min(value*gamma, value/gamma)
+			upper := math.Max(value*gamma, value/gamma)
+			assert.LessOrEqual(t, fractionLessThan(data, lower), rank+floatingPointAcceptableError)
+			assert.GreaterOrEqual(t, fractionLessThanOrEqual(data, upper), rank-floatingPointAcceptableError)
+		}
+
+		rank, err := sketch.GetRankOfValue(0)
+		assert.Nil(t, err)
+		assert.InDelta(t, fractionLessThanOrEqual(data, 0), rank, floatingPointAcceptableError)
+		rank, err = sketch.GetRankOfValue(math.Inf(-1))
+		assert.Nil(t, err)
+		assert.Equal(t, float64(0), rank)
+		rank, err = sketch.GetRankOfValue(math.Inf(1))
+		assert.Nil(t, err)
+		assert.Equal(t, float64(1), rank)
+		_, err = sketch.GetRankOfValue(math.NaN())
+		assert.Equal(t, ErrUntrackableNaN, err)
+	}
+}
+
+func TestGetCountAtValue(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		assert.Zero(t, sketch.GetCountAtValue(1))
+
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			sketch.Add(generator.Generate())
+		}
+		sketch.AddWithCount(0, 10)
+
+		sketch.ForEach(func(value, count float64) (stop bool) {
+			assert.Equal(t, count, sketch.GetCountAtValue(value), "value: %g", value)
+			return false
+		})
+		assert.Equal(t, float64(10), sketch.GetCountAtValue(0))
+		assert.Equal(t, float64(10), sketch.GetCountAtValue(-math.SmallestNonzeroFloat64))
+		assert.Zero(t, sketch.GetCountAtValue(1e6))
+		assert.Zero(t, sketch.GetCountAtValue(math.Inf(1)))
+		assert.Zero(t, sketch.GetCountAtValue(math.Inf(-1)))
+		assert.Zero(t, sketch.GetCountAtValue(math.NaN()))
+	}
+}
+
+func TestGetCountBetween(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		assert.Zero(t, sketch.GetCountBetween(math.Inf(-1), math.Inf(1)))
+
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			sketch.Add(generator.Generate())
+		}
+		sketch.AddWithCount(0, 10)
+
+		assert.InDelta(t, sketch.GetCount(), sketch.GetCountBetween(math.Inf(-1), math.Inf(1)), floatingPointAcceptableError)
+		assert.Equal(t, float64(10), sketch.GetCountBetween(0, math.SmallestNonzeroFloat64))
+		assert.Zero(t, sketch.GetCountBetween(1, 1))
+		assert.Zero(t, sketch.GetCountBetween(1, -1))
+
+		bounds := []float64{math.Inf(-1), -20, -5, -1, 0, 1, 5, 20, math.Inf(1)}
+		total := float64(0)
+		for i := 0; i < len(bounds)-1; i++ {
+			expected := float64(0)
+			sketch.ForEach(func(value, count float64) (stop bool) {
+				if bounds[i] <= value && value < bounds[i+1] {
+					expected += count
+				}
+				return false
+			})
+			count := sketch.GetCountBetween(bounds[i], bounds[i+1])
+			assert.InDelta(t, expected, count, floatingPointAcceptableError)
+			total += count
+		}
+		assert.InDelta(t, sketch.GetCount(), total, floatingPointAcceptableError)
+	}
+}
+
+func TestSplitAtValue(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		sketch := NewDDSketchFromStoreProvider(m, storeProvider)
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			sketch.Add(generator.Generate())
+		}
+		sketch.AddWithCount(0, 10)
+
+		for _, v := range []float64{math.Inf(-1), -20, -5, 0, 0.5, 5, 20, math.Inf(1)} {
+			below, above, err := sketch.SplitAtValue(v)
+			assert.Nil(t, err)
+			histogram := sketch.ToHistogram([]float64{v})
+			assert.InDelta(t, histogram[0], below.GetCount(), floatingPointAcceptableError)
+			assert.InDelta(t, histogram[1], above.GetCount(), floatingPointAcceptableError)
+			merged := below.Copy()
+			assert.Nil(t, merged.MergeWith(above))
+			assert.True(t, sketch.ApproxEquals(merged, floatingPointAcceptableError))
+		}
+
+		// The bin that the boundary falls into is split.
+		index := sketch.Index(5)
+		lower := sketch.LowerBound(index)
+		upper := sketch.LowerBound(index + 1)
+		below, above, err := sketch.SplitAtValue(lower + (upper-lower)/4)
+		assert.Nil(t, err)
+		assert.InDelta(t, sketch.GetCountBetween(math.Inf(-1), lower), below.GetCountBetween(math.Inf(-1), lower), floatingPointAcceptableError)
+		assert.InDelta(t, sketch.GetCountBetween(upper, math.Inf(1)), above.GetCountBetween(upper, math.Inf(1)), floatingPointAcceptableError)
+		binCount := sketch.GetCountBetween(sketch.Value(index), sketch.Value(index)+floatingPointAcceptableError)
+		assert.InDelta(t, binCount/4, below.GetCount()-below.GetCountBetween(math.Inf(-1), lower), floatingPointAcceptableError)
+		assert.InDelta(t, 3*binCount/4, above.GetCount()-above.GetCountBetween(upper, math.Inf(1)), floatingPointAcceptableError)
+
+		below, above, err = sketch.SplitAtQuantile(0.5)
+		assert.Nil(t, err)
+		assert.InDelta(t, sketch.GetCount(), below.GetCount()+above.GetCount(), floatingPointAcceptableError)
+		assert.InDelta(t, 0.5*sketch.GetCount(), below.GetCount(), 0.05*sketch.GetCount())
+
+		_, _, err = sketch.SplitAtValue(math.NaN())
+		assert.Equal(t, ErrUntrackableNaN, err)
+		_, _, err = NewDDSketchFromStoreProvider(m, storeProvider).SplitAtQuantile(0.5)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestToHistogram(t *testing.T) {
+	sketch, _ := LogUnboundedDenseDDSketch(0.01)
+	assert.Equal(t, []float64{0}, sketch.ToHistogram(nil))
+	assert.Equal(t, []float64{0, 0, 0}, sketch.ToHistogram([]float64{-1, 1}))
+
+	sketch.AddWithCount(10, 2)
+	sketch.AddWithCount(0, 3)
+	sketch.AddWithCount(-10, 4)
+	assert.Equal(t, []float64{9}, sketch.ToHistogram(nil))
+	assert.Equal(t, []float64{4, 3, 2}, sketch.ToHistogram([]float64{-5, 5}))
+	assert.Equal(t, []float64{4, 0, 3, 2}, sketch.ToHistogram([]float64{-5, 0, 5}))
+	assert.Equal(t, []float64{0, 4, 3, 2, 0}, sketch.ToHistogram([]float64{-20, -5, 5, 20}))
+
+	// The count of a bin is split among the buckets it overlaps.
+	index := sketch.Index(10)
+	lower := sketch.LowerBound(index)
+	upper := sketch.LowerBound(index + 1)
+	histogram := sketch.ToHistogram([]float64{0.5, lower + (upper-lower)/4})
+	assert.Equal(t, 3, len(histogram))
+	assert.InDelta(t, 7, histogram[0], floatingPointAcceptableError)
+	assert.InDelta(t, 0.5, histogram[1], floatingPointAcceptableError)
+	assert.InDelta(t, 1.5, histogram[2], floatingPointAcceptableError)
+
+	// The bins of the highest indexes, whose upper bounds are infinite, are
+	// counted in the open-ended buckets.
+	extreme, _ := LogUnboundedDenseDDSketch(0.01)
+	assert.Nil(t, extreme.AddWithCount(extreme.MaxIndexableValue(), 2))
+	assert.Nil(t, extreme.AddWithCount(-extreme.MaxIndexableValue(), 3))
+	assert.True(t, math.IsInf(extreme.UpperBound(extreme.Index(extreme.MaxIndexableValue())), 1))
+	assert.Equal(t, []float64{3, 2}, extreme.ToHistogram([]float64{0}))
+	assert.Equal(t, []float64{3, 0, 2}, extreme.ToHistogram([]float64{0, extreme.MaxIndexableValue() / (1 + 1e-3)}))
+	assert.Equal(t, []float64{3, 0, 0, 2}, extreme.ToHistogram([]float64{0, 1, extreme.MaxIndexableValue()}))
+	assert.Equal(t, []float64{0, 3, 2, 0}, extreme.ToHistogram([]float64{math.Inf(-1), 0, math.Inf(1)}))
+	below, above, err := extreme.SplitAtValue(math.Inf(1))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(5), below.GetCount())
+	assert.True(t, above.IsEmpty())
+
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		data := dataset.NewDataset()
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			sketch.Add(value)
+			data.Add(value)
+		}
+		boundaries := []float64{-20, -10, -1, 0, 0.5, 1, 10, 20}
+		histogram := sketch.ToHistogram(boundaries)
+		total := float64(0)
+		for i, count := range histogram {
+			assert.GreaterOrEqual(t, count, float64(0))
+			total += count
+			// Only values that are close to the bucket boundaries can end up in
+			// other buckets.
+			lower, upper := math.Inf(-1), math.Inf(1)
+			if i > 0 {
+				lower = boundaries[i-1]
+			}
+			if i < len(boundaries) {
+				upper = boundaries[i]
+			}
+			alpha := 2 * sketch.RelativeAccuracy()
+			minExpected := fractionLessThan(data, upper-math.Abs(upper)*alpha) - fractionLessThanOrEqual(data, lower+math.Abs(lower)*alpha)
+			maxExpected := fractionLessThan(data, upper+math.Abs(upper)*alpha) - fractionLessThanOrEqual(data, lower-math.Abs(lower)*alpha)
+			assert.LessOrEqual(t, math.Max(minExpected, 0)*data.Count, count+floatingPointAcceptableError)
+			assert.GreaterOrEqual(t, maxExpected*data.Count, count-floatingPointAcceptableError)
+		}
+		assert.InDelta(t, data.Count, total, floatingPointAcceptableError)
+	}
+}
+
+func TestGetTrimmedMean(t *testing.T) {
+	quantileRanges := [][2]float64{{0, 1}, {0, 0.5}, {0.1, 0.9}, {0.25, 0.75}, {0.5, 1}, {0.99, 1}, {0.333, 0.334}}
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		_, err := sketch.GetTrimmedMean(0, 1)
+		assert.Error(t, err)
+
+		data := dataset.NewDataset()
+		generator := dataset.NewLognormal(0, 2)
+		for i := 0; i < 1000; i++ {
+			value := generator.Generate()
+			sketch.Add(value)
+			data.Add(value)
 		}
-		expectedQuantiles, _ := s.GetValuesAtQuantiles(testQuantiles)
-		assert.Nil(t, s.Reweight(3))
-		// no matter the weight constant, the quantiles should stay the same.
-		quantiles, _ := s.GetValuesAtQuantiles(testQuantiles)
-		for i, q := range quantiles {
-			e := expectedQuantiles[i]
-			assert.InDelta(t, e, q, floatingPointAcceptableError+e*0.01)
+
+		for _, quantileRange := range quantileRanges {
+			mean, err := sketch.GetTrimmedMean(quantileRange[0], quantileRange[1])
+			assert.Nil(t, err)
+			expected := trimmedMean(data, quantileRange[0], quantileRange[1])
+			assert.InEpsilon(t, expected, mean, sketch.RelativeAccuracy()+floatingPointAcceptableError)
 		}
-		assert.InDelta(t, float64(3*testSize), s.GetCount(), floatingPointAcceptableError)
+
+		median, _ := sketch.GetValueAtQuantile(0.5)
+		mean, err := sketch.GetTrimmedMean(0.5, 0.5)
+		assert.Nil(t, err)
+		assert.Equal(t, median, mean)
+
+		_, err = sketch.GetTrimmedMean(0.6, 0.4)
+		assert.Error(t, err)
+		_, err = sketch.GetTrimmedMean(-0.1, 0.4)
+		assert.Error(t, err)
+		_, err = sketch.GetTrimmedMean(0.1, 1.1)
+		assert.Error(t, err)
 	}
 }
 
-func TestClear(t *testing.T) {
-	sketch, _ := LogUnboundedDenseDDSketch(0.01)
-	sketch.AddWithCount(0, 1.2)
-	sketch.Add(3.4)
-	sketch.AddWithCount(-5.6, 7.8)
-	sketch.Clear()
-	assert.Zero(t, sketch.GetCount())
+// trimmedMean returns the mean of the values whose ranks are between
+// lowerQuantile*count and upperQuantile*count, partially weighting the values
+// at the boundaries.
+func trimmedMean(data *dataset.Dataset, lowerQuantile, upperQuantile float64) float64 {
+	values := append([]float64{}, data.Values...)
+	sort.Float64s(values)
+	lowerRank := lowerQuantile * data.Count
+	upperRank := upperQuantile * data.Count
+	sum := float64(0)
+	for i, value := range values {
+		weight := math.Min(float64(i+1), upperRank) - math.Max(float64(i), lowerRank)
+		if weight > 0 {
+			sum += weight * value
+		}
+	}
+	return sum / (upperRank - lowerRank)
 }
 
-func TestForEach(t *testing.T) {
-	{ // Empty.
-		sketch, _ := LogUnboundedDenseDDSketch(0.01)
-		sketch.ForEach(func(value, count float64) (stop bool) {
-			assert.Fail(t, "empty sketch should have no bin")
-			return false
-		})
+func fractionLessThan(data *dataset.Dataset, value float64) float64 {
+	count := 0
+	for _, v := range data.Values {
+		if v < value {
+			count++
+		}
 	}
-	for i := 0; i < 3; i++ { // Stopping condition.
-		sketch, _ := LogUnboundedDenseDDSketch(0.01)
-		sketch.Add(0)
-		sketch.Add(1)
-		sketch.Add(-1)
-		j := 0
-		sketch.ForEach(func(value, count float64) (stop bool) {
-			assert.LessOrEqual(t, j, i)
-			j++
-			return j > i
-		})
-		assert.Equal(t, i, j-1)
+	return float64(count) / data.Count
+}
+
+func fractionLessThanOrEqual(data *dataset.Dataset, value float64) float64 {
+	count := 0
+	for _, v := range data.Values {
+		if v <= value {
+			count++
+		}
 	}
+	return float64(count) / data.Count
 }
 
 func TestErrors(t *testing.T) {
@@ -761,6 +2525,15 @@ var serTestCases []serTestCase = []serTestCase{
 			return err
 		},
 	},
+	{
+		name: "proto_methods",
+		ser: func(s *DDSketch, b *[]byte) {
+			*b, _ = s.MarshalProto()
+		},
+		deser: func(b []byte, s *DDSketch, p store.Provider) error {
+			return s.UnmarshalProto(b)
+		},
+	},
 	{
 		name: "proto_nil_positive_values",
 		ser: func(s *DDSketch, b *[]byte) {
@@ -830,6 +2603,31 @@ var serTestCases []serTestCase = []serTestCase{
 			return err
 		},
 	},
+	{
+		name: "custom_writer",
+		ser: func(s *DDSketch, b *[]byte) {
+			var buf bytes.Buffer
+			s.EncodeTo(&buf, false)
+			*b = buf.Bytes()
+		},
+		deser: func(b []byte, s *DDSketch, p store.Provider) error {
+			sketch, err := DecodeDDSketch(b, p, nil)
+			*s = *sketch
+			return err
+		},
+	},
+	{
+		name: "custom_versioned",
+		ser: func(s *DDSketch, b *[]byte) {
+			*b = []byte{}
+			s.EncodeWithVersion(b, false)
+		},
+		deser: func(b []byte, s *DDSketch, p store.Provider) error {
+			sketch, err := DecodeDDSketch(b, p, nil)
+			*s = *sketch
+			return err
+		},
+	},
 	{
 		name: "custom_reusing",
 		ser: func(s *DDSketch, b *[]byte) {
@@ -841,6 +2639,617 @@ var serTestCases []serTestCase = []serTestCase{
 			return s.DecodeAndMergeWith(b)
 		},
 	},
+	{
+		name: "custom_decode_into",
+		ser: func(s *DDSketch, b *[]byte) {
+			*b = (*b)[:0]
+			s.Encode(b, false)
+		},
+		deser: func(b []byte, s *DDSketch, p store.Provider) error {
+			return s.DecodeInto(b)
+		},
+	},
+	{
+		name: "json",
+		ser: func(s *DDSketch, b *[]byte) {
+			*b, _ = json.Marshal(s)
+		},
+		deser: func(b []byte, s *DDSketch, p store.Provider) error {
+			return json.Unmarshal(b, s)
+		},
+	},
+	{
+		name: "binary",
+		ser: func(s *DDSketch, b *[]byte) {
+			*b, _ = s.MarshalBinary()
+		},
+		deser: func(b []byte, s *DDSketch, p store.Provider) error {
+			return s.UnmarshalBinary(b)
+		},
+	},
+}
+
+type failingWriter struct {
+	remaining int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.remaining {
+		return 0, errors.New("write failed")
+	}
+	w.remaining -= len(b)
+	return len(b), nil
+}
+
+func TestEncodeTo(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		for _, value := range []float64{-3, -1, 0, 0, 1, 2, 2, 2, 1e6} {
+			assert.Nil(t, sketch.Add(value))
+		}
+		var buf bytes.Buffer
+		assert.Nil(t, sketch.EncodeTo(&buf, false))
+		decoded, err := testCase.decode(buf.Bytes())
+		assert.Nil(t, err)
+		assertQuantileSketchesEqual(t, sketch, decoded)
+
+		for i := 0; i < buf.Len(); i++ {
+			assert.NotNil(t, sketch.EncodeTo(&failingWriter{remaining: i}, false))
+		}
+		assert.Nil(t, sketch.EncodeTo(&failingWriter{remaining: buf.Len()}, false))
+	}
+}
+
+func TestEncodeDelta(t *testing.T) {
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		sketch := NewDDSketchFromStoreProvider(m, storeProvider)
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 10000; i++ {
+			sketch.Add(generator.Generate())
+		}
+		receiver := sketch.Copy()
+		checkpoint := sketch.Copy()
+
+		for i := 0; i < 10; i++ {
+			sketch.Add(generator.Generate())
+		}
+		sketch.AddWithCount(0, 2)
+		var delta []byte
+		assert.Nil(t, sketch.EncodeDelta(&delta, checkpoint, false))
+		var full []byte
+		sketch.Encode(&full, false)
+		assert.Less(t, len(delta), len(full)/10)
+		assert.Nil(t, receiver.DecodeAndMergeWith(delta))
+		assert.True(t, sketch.ApproxEquals(receiver, floatingPointAcceptableError))
+
+		// Nothing has changed since the checkpoint.
+		var empty []byte
+		assert.Nil(t, sketch.EncodeDelta(&empty, sketch.Copy(), true))
+		assert.Empty(t, empty)
+
+		// Counts cannot decrease.
+		var b []byte
+		assert.NotNil(t, checkpoint.EncodeDelta(&b, sketch, false))
+		assert.Empty(t, b)
+		otherMapping, _ := mapping.NewLogarithmicMapping(0.02)
+		assert.NotNil(t, sketch.EncodeDelta(&b, NewDDSketchFromStoreProvider(otherMapping, storeProvider), false))
+	}
+}
+
+func TestEncodeDeltaWithExactSummaryStatistics(t *testing.T) {
+	sketch, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	generator := dataset.NewNormal(0, 10)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, sketch.Add(generator.Generate()))
+	}
+	receiver := sketch.Copy()
+	checkpoint := sketch.Copy()
+
+	for _, value := range []float64{-100, 3, 3, 100} {
+		assert.Nil(t, sketch.Add(value))
+	}
+	assert.Nil(t, sketch.AddWithCount(0, 2))
+	var delta []byte
+	assert.Nil(t, sketch.EncodeDelta(&delta, checkpoint, false))
+	assert.Nil(t, receiver.DecodeAndMergeWith(delta))
+	assert.True(t, sketch.ApproxEquals(receiver, floatingPointAcceptableError))
+	assert.Equal(t, sketch.GetCount(), receiver.GetCount())
+	maxValue, _ := receiver.GetMaxValue()
+	assert.Equal(t, 100.0, maxValue)
+	variance, _ := sketch.GetVariance()
+	receiverVariance, _ := receiver.GetVariance()
+	assert.InEpsilon(t, variance, receiverVariance, floatingPointAcceptableError)
+
+	// The checkpoint may be empty.
+	receiver, _ = NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	delta = nil
+	assert.Nil(t, sketch.EncodeDelta(&delta, receiver.Copy(), false))
+	assert.Nil(t, receiver.DecodeAndMergeWith(delta))
+	assert.True(t, sketch.ApproxEquals(receiver, floatingPointAcceptableError))
+
+	// Nothing has changed since the checkpoint.
+	var empty []byte
+	assert.Nil(t, sketch.EncodeDelta(&empty, sketch.Copy(), true))
+	assert.Empty(t, empty)
+
+	// Counts cannot decrease.
+	var b []byte
+	assert.NotNil(t, checkpoint.EncodeDelta(&b, sketch, false))
+	assert.Empty(t, b)
+}
+
+func TestBatch(t *testing.T) {
+	newSketches := func(relativeAccuracies ...float64) []*DDSketch {
+		sketches := make([]*DDSketch, 0, len(relativeAccuracies))
+		for i, relativeAccuracy := range relativeAccuracies {
+			sketch, _ := NewDefaultDDSketch(relativeAccuracy)
+			for j := 0; j < i; j++ {
+				assert.Nil(t, sketch.Add(float64(j-1)))
+			}
+			sketches = append(sketches, sketch)
+		}
+		return sketches
+	}
+
+	for _, sketches := range [][]*DDSketch{
+		{},
+		newSketches(0.01),
+		newSketches(0.01, 0.01, 0.01, 0.01),
+		newSketches(0.01, 0.02, 0.01, 0.05),
+	} {
+		b := EncodeBatch(sketches)
+		decoded, err := DecodeBatch(b, store.DefaultProvider)
+		assert.Nil(t, err)
+		assert.Len(t, decoded, len(sketches))
+		for i, sketch := range sketches {
+			assert.True(t, sketch.Equals(decoded[i]))
+		}
+
+		// Skipping sketches.
+		decoder, err := NewBatchDecoder(b)
+		assert.Nil(t, err)
+		for i, sketch := range sketches {
+			assert.Equal(t, len(sketches)-i, decoder.Remaining())
+			if i%2 == 0 {
+				assert.Nil(t, decoder.Skip())
+			} else {
+				decoded, err := decoder.Next(store.DefaultProvider)
+				assert.Nil(t, err)
+				assert.True(t, sketch.Equals(decoded))
+			}
+		}
+		assert.Zero(t, decoder.Remaining())
+		assert.Equal(t, io.EOF, decoder.Skip())
+
+		// Truncated payloads.
+		for i := 0; i < len(b); i++ {
+			_, err := DecodeBatch(b[:i], store.DefaultProvider)
+			assert.NotNil(t, err)
+		}
+	}
+
+	// Sketches share the index mapping, which is encoded only once.
+	sketches := newSketches(0.01, 0.01, 0.01, 0.01)
+	var encodedIndexMapping []byte
+	sketches[0].IndexMapping.Encode(&encodedIndexMapping)
+	assert.Less(t, len(EncodeBatch(sketches)), len(EncodeBatch(newSketches(0.01, 0.02, 0.03, 0.04)))-2*len(encodedIndexMapping))
+
+	_, err := NewBatchDecoder([]byte{2})
+	assert.NotNil(t, err)
+}
+
+func TestEncodeWithVersion(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		for _, value := range []float64{-3, -1, 0, 0, 1, 2, 2, 2, 1e6} {
+			assert.Nil(t, sketch.Add(value))
+		}
+		var header, legacy, versioned []byte
+		encodeVersion(&header)
+		sketch.Encode(&legacy, false)
+		sketch.EncodeWithVersion(&versioned, false)
+		assert.Equal(t, header, versioned[:len(header)])
+		if _, ok := sketch.(*DDSketchWithExactSummaryStatistics); !ok {
+			assert.Equal(t, legacy, versioned[len(header):])
+		}
+		for _, b := range [][]byte{legacy, versioned} {
+			decoded, err := testCase.decode(b)
+			assert.Nil(t, err)
+			assertQuantileSketchesEqual(t, sketch, decoded)
+		}
+
+		for _, version := range []uint64{0, enc.Version + 1} {
+			var unsupported []byte
+			enc.EncodeFlag(&unsupported, enc.FlagVersion)
+			enc.EncodeUvarint64(&unsupported, version)
+			unsupported = append(unsupported, legacy...)
+			_, err := testCase.decode(unsupported)
+			assert.True(t, errors.Is(err, ErrUnsupportedVersion))
+		}
+
+		// The version must come first.
+		_, err := testCase.decode(append(legacy, versioned[:len(versioned)-len(legacy)]...))
+		assert.NotNil(t, err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		for _, value := range []float64{-3, -1, 0, 0, 1, 2, 2, 2, 1e6} {
+			assert.Nil(t, sketch.Add(value))
+		}
+		var legacy, versioned, typed []byte
+		sketch.Encode(&legacy, false)
+		sketch.EncodeWithVersion(&versioned, false)
+		encodeVersion(&typed)
+		sketch.EncodeWithType(&typed)
+		for _, b := range [][]byte{legacy, versioned, typed} {
+			decoded, err := Decode(b)
+			assert.Nil(t, err)
+			assert.IsType(t, sketch, decoded)
+			assertQuantileSketchesEqual(t, sketch, decoded.(quantileSketch))
+			// The type is ignored by type-specific decoding functions.
+			decodedWithoutType, err := testCase.decode(b)
+			assert.Nil(t, err)
+			assertQuantileSketchesEqual(t, sketch, decodedWithoutType)
+		}
+	}
+
+	var b []byte
+	encodeSketchType(&b, 42)
+	_, err := Decode(b)
+	assert.NotNil(t, err)
+	// A nil decoder is not registered.
+	assert.NotNil(t, RegisterDecoder(42, nil))
+	_, err = Decode(b)
+	assert.NotNil(t, err)
+	defer func() {
+		decodersMutex.Lock()
+		delete(decoders, 42)
+		decodersMutex.Unlock()
+	}()
+	assert.Nil(t, RegisterDecoder(42, func(b []byte) (QuantileSketch, error) {
+		return NewDefaultDDSketch(0.02)
+	}))
+	assert.NotNil(t, RegisterDecoder(42, nil))
+	assert.NotNil(t, RegisterDecoder(SketchTypeDDSketch, nil))
+	decoded, err := Decode(b)
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.02, decoded.RelativeAccuracy(), floatingPointAcceptableError)
+
+	// The type must come first, or right after the version.
+	sketch, _ := NewDefaultDDSketch(0.01)
+	b = nil
+	encodeSketchType(&b, SketchTypeDDSketch)
+	encodeVersion(&b)
+	sketch.Encode(&b, false)
+	_, err = Decode(b)
+	assert.NotNil(t, err)
+}
+
+func TestDecodeInto(t *testing.T) {
+	m1, _ := mapping.NewLogarithmicMapping(0.01)
+	m2, _ := mapping.NewLogarithmicMapping(0.02)
+	storeProviders := []store.Provider{store.DenseStoreConstructor, store.SparseStoreConstructor, store.BufferedPaginatedStoreConstructor}
+	for _, storeProvider := range storeProviders {
+		sketch := NewDDSketchFromStoreProvider(m1, storeProvider)
+		other := NewDDSketchFromStoreProvider(m2, storeProvider)
+		generator := dataset.NewNormal(0, 10)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, sketch.Add(generator.Generate()))
+			assert.Nil(t, other.Add(generator.Generate()))
+		}
+		var b, bWithoutMapping []byte
+		other.Encode(&b, false)
+		other.Encode(&bWithoutMapping, true)
+
+		// The mapping of the receiver is replaced by the encoded one and its
+		// stores are reused.
+		decoded := sketch.Copy()
+		positiveValueStore := decoded.PositiveStore()
+		assert.Nil(t, decoded.DecodeInto(b))
+		assert.True(t, m2.Equals(decoded.IndexMapping))
+		assert.Same(t, positiveValueStore, decoded.PositiveStore())
+		assertQuantileSketchesEqual(t, other, decoded)
+
+		// The mapping of the receiver is kept if the encoding omits it.
+		assert.Nil(t, decoded.DecodeInto(bWithoutMapping))
+		assertQuantileSketchesEqual(t, other, decoded)
+		empty := &DDSketch{}
+		assert.NotNil(t, empty.DecodeInto(bWithoutMapping))
+		assert.Nil(t, empty.DecodeInto(b))
+		assertQuantileSketchesEqual(t, other, empty)
+
+		exact := NewDDSketchWithExactSummaryStatistics(m2, storeProvider)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, exact.Add(generator.Generate()))
+		}
+		b = b[:0]
+		exact.Encode(&b, false)
+		decodedExact := NewDDSketchWithExactSummaryStatistics(m1, storeProvider)
+		assert.Nil(t, decodedExact.Add(1))
+		assert.Nil(t, decodedExact.DecodeInto(b))
+		assert.True(t, exact.ApproxEquals(decodedExact, floatingPointAcceptableError))
+		assert.Nil(t, decoded.DecodeInto(b))
+		assertQuantileSketchesEqual(t, exact.DDSketch, decoded)
+	}
+}
+
+func TestDecodeErrorLeavesSketchUsable(t *testing.T) {
+	m1, _ := mapping.NewLogarithmicMapping(0.01)
+	m2, _ := mapping.NewLogarithmicMapping(0.02)
+	other := NewDDSketchFromStoreProvider(m2, store.DenseStoreConstructor)
+	for _, value := range []float64{-1, 0, 1, 2, 3} {
+		assert.Nil(t, other.Add(value))
+	}
+	var b []byte
+	other.Encode(&b, false)
+	truncated := b[:len(b)-1]
+
+	// UnmarshalBinary does not modify the receiver on error.
+	sketch := NewDDSketchFromStoreProvider(m1, store.DenseStoreConstructor)
+	assert.Nil(t, sketch.Add(5))
+	assert.NotNil(t, sketch.UnmarshalBinary(truncated))
+	assert.True(t, m1.Equals(sketch.IndexMapping))
+	assert.Equal(t, 1.0, sketch.GetCount())
+	assert.Nil(t, sketch.Add(6))
+	assert.Nil(t, sketch.UnmarshalBinary(b))
+	assertQuantileSketchesEqual(t, other, sketch)
+
+	exact, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	assert.Nil(t, exact.Add(5))
+	assert.NotNil(t, exact.UnmarshalBinary(truncated))
+	assert.Equal(t, 1.0, exact.GetCount())
+	assert.Equal(t, 5.0, exact.GetSum())
+
+	// DecodeInto leaves the receiver empty, with its index mapping.
+	sketch = NewDDSketchFromStoreProvider(m1, store.DenseStoreConstructor)
+	assert.Nil(t, sketch.Add(5))
+	assert.NotNil(t, sketch.DecodeInto(truncated))
+	assert.True(t, m1.Equals(sketch.IndexMapping))
+	assert.True(t, sketch.IsEmpty())
+	assert.Nil(t, sketch.Add(6))
+
+	exact, _ = NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	assert.Nil(t, exact.Add(5))
+	assert.NotNil(t, exact.DecodeInto(truncated))
+	assert.True(t, exact.IsEmpty())
+	assert.Equal(t, 0.0, exact.GetCount())
+	assert.Nil(t, exact.Add(6))
+}
+
+func TestDecodeWithOptions(t *testing.T) {
+	sketch, _ := NewDefaultDDSketch(0.01)
+	for _, value := range []float64{-3, -1, 0, 1, 2, 2, 1e6} {
+		assert.Nil(t, sketch.Add(value))
+	}
+	var b []byte
+	sketch.Encode(&b, false)
+	maxIndex := sketch.Index(1e6)
+
+	// Stores may encode empty bins, which count towards the limit.
+	decoded, err := DecodeDDSketchWithOptions(b, store.DefaultProvider, nil, store.DecodingOptions{MaxNumBins: 10000, MaxIndexMagnitude: maxIndex})
+	assert.Nil(t, err)
+	assertQuantileSketchesEqual(t, sketch, decoded)
+	for _, options := range []store.DecodingOptions{
+		{MaxNumBins: 1},
+		{MaxIndexMagnitude: maxIndex - 1},
+	} {
+		_, err := DecodeDDSketchWithOptions(b, store.DefaultProvider, nil, options)
+		assert.True(t, errors.Is(err, store.ErrDecodingLimitExceeded))
+	}
+
+	// The limit on the number of bins applies over all the blocks of a store.
+	var twoBlocks []byte
+	for i := 0; i < 2; i++ {
+		enc.EncodeFlag(&twoBlocks, enc.NewFlag(enc.FlagTypePositiveStore, enc.BinEncodingIndexDeltas))
+		enc.EncodeUvarint64(&twoBlocks, 2)
+		enc.EncodeVarint64(&twoBlocks, 1)
+		enc.EncodeVarint64(&twoBlocks, 1)
+	}
+	_, err = DecodeDDSketchWithOptions(twoBlocks, store.DefaultProvider, sketch.IndexMapping, store.DecodingOptions{MaxNumBins: 4})
+	assert.Nil(t, err)
+	_, err = DecodeDDSketchWithOptions(twoBlocks, store.DefaultProvider, sketch.IndexMapping, store.DecodingOptions{MaxNumBins: 3})
+	assert.True(t, errors.Is(err, store.ErrDecodingLimitExceeded))
+
+	var invalidCount, invalidZeroCount []byte
+	enc.EncodeFlag(&invalidCount, enc.NewFlag(enc.FlagTypeNegativeStore, enc.BinEncodingContiguousCounts))
+	enc.EncodeUvarint64(&invalidCount, 2)
+	enc.EncodeVarint64(&invalidCount, 10)
+	enc.EncodeVarint64(&invalidCount, 1)
+	enc.EncodeVarfloat64(&invalidCount, 1)
+	enc.EncodeVarfloat64(&invalidCount, math.NaN())
+	enc.EncodeFlag(&invalidZeroCount, enc.FlagZeroCountVarFloat)
+	enc.EncodeVarfloat64(&invalidZeroCount, -1)
+	for _, invalid := range [][]byte{invalidCount, invalidZeroCount} {
+		decoded, err := DecodeDDSketchWithOptions(invalid, store.DefaultProvider, sketch.IndexMapping, store.DecodingOptions{})
+		assert.True(t, errors.Is(err, store.ErrInvalidEncodedCount))
+		assert.True(t, decoded.IsEmpty())
+		// Decoding without options does not validate counts.
+		_, err = DecodeDDSketch(invalid, store.DefaultProvider, sketch.IndexMapping)
+		assert.Nil(t, err)
+	}
+}
+
+func TestDecodeExactSummaryStatisticsWithOptions(t *testing.T) {
+	sketch, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	for _, value := range []float64{-3, 0, 2} {
+		assert.Nil(t, sketch.Add(value))
+	}
+	var b []byte
+	sketch.Encode(&b, false)
+
+	decoded, err := DecodeDDSketchWithExactSummaryStatisticsWithOptions(b, store.DefaultProvider, nil, store.DecodingOptions{MaxNumBins: 10000})
+	assert.Nil(t, err)
+	assert.Equal(t, 3.0, decoded.GetCount())
+	assert.Equal(t, -1.0, decoded.GetSum())
+	maxValue, err := decoded.GetMaxValue()
+	assert.Nil(t, err)
+	assert.Equal(t, 2.0, maxValue)
+
+	_, err = DecodeDDSketchWithExactSummaryStatisticsWithOptions(b, store.DefaultProvider, nil, store.DecodingOptions{MaxIndexMagnitude: sketch.Index(2) - 1})
+	assert.True(t, errors.Is(err, store.ErrDecodingLimitExceeded))
+
+	var invalidCount []byte
+	enc.EncodeFlag(&invalidCount, enc.FlagCount)
+	enc.EncodeVarfloat64(&invalidCount, math.Inf(1))
+	_, err = DecodeDDSketchWithExactSummaryStatisticsWithOptions(invalidCount, store.DefaultProvider, sketch.IndexMapping, store.DecodingOptions{})
+	assert.True(t, errors.Is(err, store.ErrInvalidEncodedCount))
+}
+
+func TestFromProtoInvalid(t *testing.T) {
+	sketch, _ := NewDefaultDDSketch(0.01)
+	assert.Nil(t, sketch.AddWithCounts([]float64{-1, 0, 1, 2}, []float64{1, 2, 3, 4}))
+	maxIndex := int32(sketch.Index(sketch.MaxIndexableValue()))
+	for _, corrupt := range []func(pb *sketchpb.DDSketch){
+		func(pb *sketchpb.DDSketch) { pb.ZeroCount = math.NaN() },
+		func(pb *sketchpb.DDSketch) { pb.ZeroCount = -1 },
+		func(pb *sketchpb.DDSketch) { pb.PositiveValues.BinCounts = map[int32]float64{1: math.Inf(1)} },
+		func(pb *sketchpb.DDSketch) { pb.NegativeValues.BinCounts = map[int32]float64{1: -1} },
+		func(pb *sketchpb.DDSketch) { pb.PositiveValues.ContiguousBinCounts = []float64{1, math.NaN()} },
+		func(pb *sketchpb.DDSketch) { pb.PositiveValues.BinCounts = map[int32]float64{math.MaxInt32: 1} },
+		func(pb *sketchpb.DDSketch) { pb.NegativeValues.BinCounts = map[int32]float64{math.MinInt32: 1} },
+		func(pb *sketchpb.DDSketch) {
+			pb.PositiveValues.ContiguousBinCounts = []float64{1, 2}
+			pb.PositiveValues.ContiguousBinIndexOffset = maxIndex
+		},
+	} {
+		pb := sketch.ToProto()
+		corrupt(pb)
+		_, err := FromProto(pb)
+		assert.NotNil(t, err)
+		_, err = FromProtoWithExactSummaryStatistics(pb, store.DefaultProvider)
+		assert.NotNil(t, err)
+	}
+	_, err := FromProto(nil)
+	assert.NotNil(t, err)
+}
+
+func TestMarshalProto(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		for _, value := range []float64{-3, -1, 0, 0, 1, 2, 2, 2, 1e6} {
+			assert.Nil(t, sketch.Add(value))
+		}
+		b, err := sketch.MarshalProto()
+		assert.Nil(t, err)
+		decoded := testCase.sketch()
+		assert.Nil(t, decoded.Add(42))
+		assert.Nil(t, decoded.UnmarshalProto(b))
+		assertQuantileSketchesEqual(t, sketch, decoded)
+		assert.NotNil(t, decoded.UnmarshalProto([]byte{0xff}))
+
+		// The receiver is left unchanged if the payload is invalid.
+		for _, corrupt := range []func(pb *sketchpb.DDSketch){
+			func(pb *sketchpb.DDSketch) { pb.ZeroCount = math.NaN() },
+			func(pb *sketchpb.DDSketch) { pb.PositiveValues.BinCounts = map[int32]float64{1: 1, 2: math.NaN()} },
+			func(pb *sketchpb.DDSketch) { pb.NegativeValues.BinCounts = map[int32]float64{1: -1} },
+		} {
+			var pb sketchpb.DDSketch
+			assert.Nil(t, proto.Unmarshal(b, &pb))
+			corrupt(&pb)
+			corrupted, err := proto.Marshal(&pb)
+			assert.Nil(t, err)
+			assert.NotNil(t, decoded.UnmarshalProto(corrupted))
+			assertQuantileSketchesEqual(t, sketch, decoded)
+		}
+	}
+
+	var sketch DDSketchWithExactSummaryStatistics
+	exact, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	assert.Nil(t, exact.Add(1.5))
+	b, err := exact.MarshalProto()
+	assert.Nil(t, err)
+	assert.Nil(t, sketch.UnmarshalProto(b))
+	assert.True(t, exact.Equals(&sketch))
+}
+
+func TestGob(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		for _, value := range []float64{-3, -1, 0, 0, 1, 2, 2, 2, 1e6} {
+			assert.Nil(t, sketch.Add(value))
+		}
+		var buf bytes.Buffer
+		assert.Nil(t, gob.NewEncoder(&buf).Encode(sketch))
+		decoded := testCase.sketch()
+		assert.Nil(t, decoded.Add(42))
+		assert.Nil(t, gob.NewDecoder(&buf).Decode(decoded))
+		assertQuantileSketchesEqual(t, sketch, decoded)
+	}
+
+	empty, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	b, err := empty.MarshalBinary()
+	assert.Nil(t, err)
+	var sketch DDSketchWithExactSummaryStatistics
+	assert.Nil(t, sketch.UnmarshalBinary(b))
+	assert.True(t, sketch.IsEmpty())
+	assert.Equal(t, empty.RelativeAccuracy(), sketch.RelativeAccuracy())
+	assert.NotNil(t, sketch.UnmarshalBinary([]byte{0xff}))
+}
+
+func TestJSON(t *testing.T) {
+	for _, testCase := range testCases {
+		sketch := testCase.sketch()
+		for _, value := range []float64{-3, -1, 0, 0, 1, 2, 2, 2, 1e6} {
+			assert.Nil(t, sketch.Add(value))
+		}
+		b, err := json.Marshal(sketch)
+		assert.Nil(t, err)
+		decoded := testCase.sketch()
+		assert.Nil(t, json.Unmarshal(b, decoded))
+		assertQuantileSketchesEqual(t, sketch, decoded)
+	}
+
+	exact, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	assert.Nil(t, exact.AddValues([]float64{-2.5, 0.1, 3.7}))
+	b, err := json.Marshal(exact)
+	assert.Nil(t, err)
+	var decodedExact DDSketchWithExactSummaryStatistics
+	assert.Nil(t, json.Unmarshal(b, &decodedExact))
+	assertQuantileSketchesEqual(t, exact, &decodedExact)
+	min, _ := decodedExact.GetMinValue()
+	assert.Equal(t, -2.5, min)
+
+	// Mappings whose interpolations are not named by the protobuf enumeration
+	// are written with their numeric values.
+	bitExponentialMapping, _ := mapping.NewBitExponentialMapping(6)
+	bitExponential := NewDDSketchFromStoreProvider(bitExponentialMapping, store.DefaultProvider)
+	assert.Nil(t, bitExponential.AddValues([]float64{-3, 0, 1, 2, 1e6}))
+	b, err = json.Marshal(bitExponential)
+	assert.Nil(t, err)
+	var decodedBitExponential DDSketch
+	assert.Nil(t, json.Unmarshal(b, &decodedBitExponential))
+	assert.True(t, bitExponentialMapping.Equals(decodedBitExponential.IndexMapping))
+	assertQuantileSketchesEqual(t, bitExponential, &decodedBitExponential)
+
+	var sketch DDSketch
+	assert.Nil(t, json.Unmarshal([]byte(`{"mapping":{"interpolation":"NONE","gamma":1.02,"indexOffset":0},"zeroCount":1,"positiveValues":{"indexes":[3,5],"counts":[1,2]},"negativeValues":{"indexes":[],"counts":[]}}`), &sketch))
+	assert.Equal(t, float64(4), sketch.GetCount())
+	assert.NotNil(t, json.Unmarshal([]byte(`{"mapping":{"interpolation":"QUADRATIC","gamma":1.02}}`), &sketch))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"mapping":{"interpolation":"NONE","gamma":0.5}}`), &sketch))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"mapping":{"interpolation":"NONE","gamma":1.02},"zeroCount":-1}`), &sketch))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"mapping":{"interpolation":"NONE","gamma":1.02},"positiveValues":{"indexes":[1,2],"counts":[1]}}`), &sketch))
+	assert.NotNil(t, json.Unmarshal([]byte(`{"mapping":{"interpolation":"NONE","gamma":1.02},"zeroCount":1}`), &decodedExact))
+
+	// Indexes that the mapping cannot produce are rejected, so that dense
+	// stores do not allocate a huge number of bins, and so are infinite counts.
+	assert.Equal(t, errIndexOutOfRange, json.Unmarshal([]byte(`{"mapping":{"interpolation":"NONE","gamma":1.02},"positiveValues":{"indexes":[-4000000000,4000000000],"counts":[1,1]}}`), &sketch))
+	assert.Equal(t, errIndexOutOfRange, json.Unmarshal([]byte(`{"mapping":{"interpolation":"NONE","gamma":1.02},"negativeValues":{"indexes":[4000000000],"counts":[1]}}`), &sketch))
+	assert.Equal(t, float64(4), sketch.GetCount())
+	m, _ := mapping.NewLogarithmicMapping(0.01)
+	minIndex, maxIndex := indexRange(m)
+	bins := jsonBins{Indexes: []int{minIndex, maxIndex}, Counts: []float64{1, 1}}
+	assert.Nil(t, bins.validate(m))
+	bins.Indexes[1] = maxIndex + 1
+	assert.Equal(t, errIndexOutOfRange, bins.validate(m))
+	bins = jsonBins{Indexes: []int{0, 1}, Counts: []float64{1, math.Inf(1)}}
+	assert.Equal(t, store.ErrInvalidBinCount, bins.validate(m))
+	bins = jsonBins{Indexes: []int{0}, Counts: []float64{math.NaN()}}
+	assert.Equal(t, ErrNegativeCount, bins.validate(m))
 }
 
 func TestSerDeser(t *testing.T) {
@@ -937,6 +3346,32 @@ func BenchmarkAdd(b *testing.B) {
 	}
 }
 
+func BenchmarkAddInt(b *testing.B) {
+	relativeAccuracy := 1e-2
+	indexMapping, _ := mapping.NewLogarithmicMapping(relativeAccuracy)
+	storeProvider := store.Provider(func() store.Store { return store.NewCollapsingLowestDenseStore(2048) })
+	sinkSketch = NewDDSketchFromStoreProvider(indexMapping, storeProvider)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sinkSketch.AddInt(int64(100 * rand.ExpFloat64()))
+	}
+}
+
+func BenchmarkAddValues(b *testing.B) {
+	relativeAccuracy := 1e-2
+	indexMapping, _ := mapping.NewLogarithmicMapping(relativeAccuracy)
+	storeProvider := store.Provider(func() store.Store { return store.NewCollapsingLowestDenseStore(2048) })
+	values := make([]float64, 1000)
+	for i := range values {
+		values[i] = rand.ExpFloat64()
+	}
+	sinkSketch = NewDDSketchFromStoreProvider(indexMapping, storeProvider)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(values) {
+		sinkSketch.AddValues(values)
+	}
+}
+
 func BenchmarkEncode(b *testing.B) {
 	for _, testCase := range dataTestCases {
 		b.Run(testCase.name, func(b *testing.B) {
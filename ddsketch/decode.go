@@ -0,0 +1,129 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/store"
+)
+
+// SketchType identifies a type of sketch in payloads that are encoded with
+// EncodeWithType, so that Decode can pick the function that decodes them.
+type SketchType uint64
+
+const (
+	SketchTypeDDSketch                           SketchType = 1
+	SketchTypeDDSketchWithExactSummaryStatistics SketchType = 2
+)
+
+// Decoder deserializes a payload into a sketch. The payload is the whole
+// output of EncodeWithType, including the type of the sketch.
+type Decoder func(b []byte) (QuantileSketch, error)
+
+var (
+	decodersMutex sync.RWMutex
+	decoders      = map[SketchType]Decoder{
+		SketchTypeDDSketch: func(b []byte) (QuantileSketch, error) {
+			return DecodeDDSketch(b, store.DefaultProvider, nil)
+		},
+		SketchTypeDDSketchWithExactSummaryStatistics: func(b []byte) (QuantileSketch, error) {
+			return DecodeDDSketchWithExactSummaryStatistics(b, store.DefaultProvider, nil)
+		},
+	}
+)
+
+// RegisterDecoder registers the function that Decode uses to deserialize
+// payloads of the provided sketch type, which allows decoding sketch types
+// that are defined outside of this package. Return a non-nil error if the
+// decoder is nil or if a decoder is already registered for the type.
+func RegisterDecoder(sketchType SketchType, decoder Decoder) error {
+	if decoder == nil {
+		return errors.New("the decoder must not be nil")
+	}
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+	if _, ok := decoders[sketchType]; ok {
+		return fmt.Errorf("a decoder is already registered for sketch type %d", sketchType)
+	}
+	decoders[sketchType] = decoder
+	return nil
+}
+
+// EncodeWithType serializes the sketch like Encode does, including the index
+// mapping, but prefixes the output with the type of the sketch, so that it can
+// be decoded with Decode.
+func (s *DDSketch) EncodeWithType(b *[]byte) {
+	encodeSketchType(b, SketchTypeDDSketch)
+	s.Encode(b, false)
+}
+
+// EncodeWithType serializes the sketch like Encode does, including the index
+// mapping, but prefixes the output with the type of the sketch, so that it can
+// be decoded with Decode.
+func (s *DDSketchWithExactSummaryStatistics) EncodeWithType(b *[]byte) {
+	encodeSketchType(b, SketchTypeDDSketchWithExactSummaryStatistics)
+	s.encode(b, false, true)
+}
+
+func encodeSketchType(b *[]byte, sketchType SketchType) {
+	enc.EncodeFlag(b, enc.FlagSketchType)
+	enc.EncodeUvarint64(b, uint64(sketchType))
+}
+
+// Decode deserializes a sketch whose type is encoded in the payload (see
+// EncodeWithType), using the decoder that is registered for the type. Stores
+// of the built-in sketch types are built with store.DefaultProvider.
+// Payloads that do not encode the type, such as those produced by Encode, are
+// decoded as DDSketchWithExactSummaryStatistics if they start with exact
+// summary statistics, which is the case unless the sketch is empty, and as
+// DDSketch otherwise. Return a non-nil error if no decoder is registered for
+// the type.
+func Decode(b []byte) (QuantileSketch, error) {
+	sketchType, err := peekSketchType(b)
+	if err != nil {
+		return nil, err
+	}
+	decodersMutex.RLock()
+	decoder, ok := decoders[sketchType]
+	decodersMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no decoder is registered for sketch type %d", sketchType)
+	}
+	return decoder(b)
+}
+
+// peekSketchType returns the type of the sketch that is encoded in the
+// payload, without consuming it.
+func peekSketchType(bb []byte) (SketchType, error) {
+	b := &bb
+	for isFirstBlock := true; len(*b) > 0; isFirstBlock = false {
+		flag, err := enc.DecodeFlag(b)
+		if err != nil {
+			return 0, err
+		}
+		switch flag {
+		case enc.FlagVersion:
+			if !isFirstBlock {
+				return 0, errors.New("the encoding version must come first")
+			}
+			if _, err := enc.DecodeUvarint64(b); err != nil {
+				return 0, err
+			}
+		case enc.FlagSketchType:
+			sketchType, err := enc.DecodeUvarint64(b)
+			return SketchType(sketchType), err
+		case enc.FlagCount:
+			return SketchTypeDDSketchWithExactSummaryStatistics, nil
+		default:
+			return SketchTypeDDSketch, nil
+		}
+	}
+	return SketchTypeDDSketch, nil
+}
@@ -14,7 +14,9 @@ import (
 )
 
 // Encoding functions append bytes to the provided *[]byte, allowing avoiding
-// allocations if the slice initially has a large enough capacity.
+// allocations if the slice initially has a large enough capacity. Their
+// writer-based variants (e.g., WriteUvarint64 for EncodeUvarint64) write the
+// same bytes to the provided io.Writer instead.
 // Decoding functions also take *[]byte as input, and when they do not return an
 // error, advance the slice so that it starts at the immediate byte after the
 // decoded part (or so that it is empty if there is no such byte).
@@ -44,6 +46,15 @@ func EncodeUvarint64(b *[]byte, v uint64) {
 	*b = append(*b, byte(v))
 }
 
+// WriteUvarint64 writes the output of EncodeUvarint64 to w.
+func WriteUvarint64(w io.Writer, v uint64) error {
+	var buf [MaxVarLen64]byte
+	b := buf[:0]
+	EncodeUvarint64(&b, v)
+	_, err := w.Write(b)
+	return err
+}
+
 // DecodeUvarint64 deserializes 64-bit unsigned integers that have been encoded
 // using EncodeUvarint64.
 func DecodeUvarint64(b *[]byte) (uint64, error) {
@@ -88,6 +99,11 @@ func EncodeVarint64(b *[]byte, v int64) {
 	EncodeUvarint64(b, uint64(v>>(64-1)^(v<<1)))
 }
 
+// WriteVarint64 writes the output of EncodeVarint64 to w.
+func WriteVarint64(w io.Writer, v int64) error {
+	return WriteUvarint64(w, uint64(v>>(64-1)^(v<<1)))
+}
+
 // DecodeVarint64 deserializes 64-bit signed integers that have been encoded
 // using EncodeVarint32.
 func DecodeVarint64(b *[]byte) (int64, error) {
@@ -123,6 +139,14 @@ func EncodeFloat64LE(b *[]byte, v float64) {
 	binary.LittleEndian.PutUint64((*b)[len(*b)-8:], math.Float64bits(v))
 }
 
+// WriteFloat64LE writes the output of EncodeFloat64LE to w.
+func WriteFloat64LE(w io.Writer, v float64) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(v))
+	_, err := w.Write(buf[:])
+	return err
+}
+
 // DecodeFloat64LE deserializes 64-bit floating-point values that have been
 // encoded with EncodeFloat64LE.
 func DecodeFloat64LE(b *[]byte) (float64, error) {
@@ -162,6 +186,15 @@ func EncodeVarfloat64(b *[]byte, v float64) {
 	*b = append(*b, n)
 }
 
+// WriteVarfloat64 writes the output of EncodeVarfloat64 to w.
+func WriteVarfloat64(w io.Writer, v float64) error {
+	var buf [MaxVarLen64]byte
+	b := buf[:0]
+	EncodeVarfloat64(&b, v)
+	_, err := w.Write(b)
+	return err
+}
+
 // DecodeVarfloat64 deserializes 64-bit floating-point values that have been
 // encoded with EncodeVarfloat64.
 func DecodeVarfloat64(b *[]byte) (float64, error) {
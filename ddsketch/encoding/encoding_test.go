@@ -6,6 +6,7 @@
 package encoding
 
 import (
+	"bytes"
 	"io"
 	"math"
 	"testing"
@@ -301,3 +302,30 @@ func TestVarfloat64Size(t *testing.T) {
 		assert.Equal(t, len(testCase.encoded), Varfloat64Size(testCase.decoded))
 	}
 }
+
+func TestWrite(t *testing.T) {
+	var buf bytes.Buffer
+	for _, testCase := range varuint64TestCases {
+		buf.Reset()
+		assert.Nil(t, WriteUvarint64(&buf, testCase.decoded))
+		assert.Equal(t, testCase.encoded, buf.Bytes())
+	}
+	for _, testCase := range varint64TestCases {
+		buf.Reset()
+		assert.Nil(t, WriteVarint64(&buf, testCase.decoded))
+		assert.Equal(t, testCase.encoded, buf.Bytes())
+	}
+	for _, testCase := range float64LETestCases {
+		buf.Reset()
+		assert.Nil(t, WriteFloat64LE(&buf, testCase.decoded))
+		assert.Equal(t, testCase.encoded, buf.Bytes())
+	}
+	for _, testCase := range varfloat64TestCases {
+		buf.Reset()
+		assert.Nil(t, WriteVarfloat64(&buf, testCase.decoded))
+		assert.Equal(t, testCase.encoded, buf.Bytes())
+	}
+	buf.Reset()
+	assert.Nil(t, WriteFlag(&buf, FlagCount))
+	assert.Equal(t, []byte{FlagCount.byte}, buf.Bytes())
+}
@@ -6,6 +6,7 @@
 package encoding
 
 import (
+	"fmt"
 	"io"
 )
 
@@ -29,6 +30,10 @@ import (
 // how,
 // - for the store flag types, it indicates how bins are encoded.
 
+// Version is the latest version of the encoding format, which is the one that
+// is used when encoding FlagVersion.
+const Version uint64 = 1
+
 const (
 	numBitsForType byte = 2
 	flagTypeMask   byte = (1 << numBitsForType) - 1
@@ -69,6 +74,31 @@ var (
 	FlagMin = NewFlag(flagTypeSketchFeatures, newSubFlag(0x22))
 	FlagMax = NewFlag(flagTypeSketchFeatures, newSubFlag(0x23))
 
+	// Encode the sum of the squared deviations from the mean, from which the
+	// variance can be computed.
+	// Encoding format:
+	// - [byte] flag
+	// - [float64LE] sum of squared deviations
+	FlagSumOfSquaredDeviations = NewFlag(flagTypeSketchFeatures, newSubFlag(0x24))
+
+	// Encodes the version of the encoding format. It is optional but, if
+	// present, it has to be the first block, so that decoders can reject
+	// payloads that use a version that they do not support before decoding
+	// anything else. Payloads without it are decoded as if they used version 1.
+	// Encoding format:
+	// - [byte] flag
+	// - [uvarint64] version
+	FlagVersion = NewFlag(flagTypeSketchFeatures, newSubFlag(0x30))
+
+	// Encodes the type of the sketch, so that payloads can be decoded without
+	// knowing out-of-band which type of sketch they hold. It is optional but,
+	// if present, it has to be the first block, or the second one if the
+	// version of the encoding format is encoded.
+	// Encoding format:
+	// - [byte] flag
+	// - [uvarint64] sketch type
+	FlagSketchType = NewFlag(flagTypeSketchFeatures, newSubFlag(0x31))
+
 	// INDEX MAPPING
 
 	// Encodes log-like index mappings, specifying the base (gamma) and the index offset
@@ -83,6 +113,11 @@ var (
 	FlagIndexMappingBaseCubic       = NewFlag(FlagTypeIndexMapping, newSubFlag(3))
 	FlagIndexMappingBaseQuartic     = NewFlag(FlagTypeIndexMapping, newSubFlag(4))
 
+	// Encodes the bit exponential index mapping, whose bins are the buckets of
+	// the exponential histograms of OpenTelemetry, with the same layout as the
+	// log-like index mappings. The index offset is always zero.
+	FlagIndexMappingBitExponential = NewFlag(FlagTypeIndexMapping, newSubFlag(5))
+
 	// BINS
 
 	// Encodes N bins, each one with its index and its count.
@@ -143,11 +178,28 @@ func newSubFlag(b byte) SubFlag {
 	return SubFlag{b << numBitsForType}
 }
 
+// NewSubFlag returns the subflag of the provided value, so that flags can be
+// defined outside of this package, e.g., for index mappings that are
+// registered with mapping.RegisterDecoder. Return a non-nil error if the value
+// does not fit in the bits of subflags.
+func NewSubFlag(b byte) (SubFlag, error) {
+	if b > subFlagMask>>numBitsForType {
+		return SubFlag{}, fmt.Errorf("subflag value out of range: %d", b)
+	}
+	return newSubFlag(b), nil
+}
+
 // EncodeFlag encodes a flag and appends its content to the provided []byte.
 func EncodeFlag(b *[]byte, f Flag) {
 	*b = append(*b, f.byte)
 }
 
+// WriteFlag writes the output of EncodeFlag to w.
+func WriteFlag(w io.Writer, f Flag) error {
+	_, err := w.Write([]byte{f.byte})
+	return err
+}
+
 // DecodeFlag decodes a flag and updates the provided []byte so that it starts
 // immediately after the encoded flag.
 func DecodeFlag(b *[]byte) (Flag, error) {
@@ -0,0 +1,80 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"errors"
+)
+
+// HDRBucket describes a bucket of an HdrHistogram: Count values have been
+// recorded in the range [From, To]. The buckets of an HdrHistogram can be
+// obtained by iterating over its recorded values, for instance, with
+// github.com/HdrHistogram/hdrhistogram-go:
+//
+//	for _, bar := range histogram.Distribution() {
+//		if bar.Count > 0 {
+//			buckets = append(buckets, ddsketch.HDRBucket{From: bar.From, To: bar.To, Count: bar.Count})
+//		}
+//	}
+type HDRBucket struct {
+	From  int64
+	To    int64
+	Count int64
+}
+
+// NewDDSketchFromHDRBuckets returns a sketch with the provided relative
+// accuracy that encodes the values of the buckets of an HdrHistogram (see
+// AddHDRBuckets).
+func NewDDSketchFromHDRBuckets(relativeAccuracy float64, buckets []HDRBucket) (*DDSketch, error) {
+	sketch, err := NewDefaultDDSketch(relativeAccuracy)
+	if err != nil {
+		return nil, err
+	}
+	if err := sketch.AddHDRBuckets(buckets); err != nil {
+		return nil, err
+	}
+	return sketch, nil
+}
+
+// AddHDRBuckets adds the values of the buckets of an HdrHistogram to the
+// sketch. The counts of the buckets are preserved: the count of each bucket is
+// added at the midpoint of its range, which is the value that HdrHistogram
+// itself considers equivalent to the values of the bucket. Therefore, the
+// relative accuracy of the resulting sketch is bounded by the accuracy of the
+// sketch combined with the precision of the HdrHistogram.
+// If any of the buckets is invalid or cannot be tracked, none of the buckets
+// are added to the sketch and a non-nil error is returned.
+func (s *DDSketch) AddHDRBuckets(buckets []HDRBucket) error {
+	values, counts, err := hdrValuesAndCounts(buckets)
+	if err != nil {
+		return err
+	}
+	return s.AddWithCounts(values, counts)
+}
+
+// AddHDRBuckets adds the values of the buckets of an HdrHistogram to the
+// sketch (see DDSketch.AddHDRBuckets). The exact summary statistics are
+// updated as if the values of each bucket were equal to its midpoint.
+func (s *DDSketchWithExactSummaryStatistics) AddHDRBuckets(buckets []HDRBucket) error {
+	values, counts, err := hdrValuesAndCounts(buckets)
+	if err != nil {
+		return err
+	}
+	return s.AddWithCounts(values, counts)
+}
+
+func hdrValuesAndCounts(buckets []HDRBucket) ([]float64, []float64, error) {
+	values := make([]float64, len(buckets))
+	counts := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		if bucket.From > bucket.To {
+			return nil, nil, errors.New("the lower bound of an HDR bucket cannot be greater than its upper bound")
+		}
+		values[i] = float64(bucket.From) + (float64(bucket.To)-float64(bucket.From))/2
+		counts[i] = float64(bucket.Count)
+	}
+	return values, counts, nil
+}
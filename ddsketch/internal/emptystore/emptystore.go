@@ -0,0 +1,15 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+// Package emptystore lets the ddsketch package build empty stores of the same
+// types and with the same settings as other stores, without making it part of
+// the API of the store package.
+package emptystore
+
+// NewLike returns an empty store of the same type as s, with the same
+// settings, without copying the bins of s. Both s and the returned store are
+// of type store.Store, which cannot be referred to here, as the store package,
+// which sets NewLike, imports this package.
+var NewLike func(s interface{}) interface{}
@@ -0,0 +1,22 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+//go:build go1.23
+
+package ddsketch
+
+import "iter"
+
+// Bins returns an iterator over the non-empty bins of the sketch, yielding the
+// value that each bin represents along with its count, in the same order as
+// ForEach. Unlike store.Store.Bins, it does not spawn a goroutine and can be
+// safely stopped before being iterated to completion.
+func (s *DDSketch) Bins() iter.Seq2[float64, float64] {
+	return func(yield func(value, count float64) bool) {
+		s.ForEach(func(value, count float64) (stop bool) {
+			return !yield(value, count)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+//go:build go1.23
+
+package ddsketch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBins(t *testing.T) {
+	sketch, _ := NewDefaultDDSketchWithExactSummaryStatistics(0.01)
+	for range sketch.Bins() {
+		t.Fatal("an empty sketch has no bins")
+	}
+
+	assert.Nil(t, sketch.AddWithCounts([]float64{-5.6, 0, 1.2, 3.4, 3.4}, []float64{1, 2, 3, 4, 5}))
+	expected := make(map[float64]float64)
+	sketch.ForEach(func(value, count float64) (stop bool) {
+		expected[value] = count
+		return false
+	})
+	actual := make(map[float64]float64)
+	for value, count := range sketch.Bins() {
+		actual[value] = count
+	}
+	assert.Equal(t, expected, actual)
+	assert.Len(t, actual, 4)
+
+	// Iteration can be stopped early.
+	numBins := 0
+	for range sketch.Bins() {
+		numBins++
+		if numBins == 2 {
+			break
+		}
+	}
+	assert.Equal(t, 2, numBins)
+}
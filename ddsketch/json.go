@@ -0,0 +1,271 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/DataDog/sketches-go/ddsketch/mapping"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+	"github.com/DataDog/sketches-go/ddsketch/stat"
+	"github.com/DataDog/sketches-go/ddsketch/store"
+)
+
+// The JSON representation of a sketch is meant to be human-readable. It is
+// neither as compact nor as fast to encode and decode as the custom binary
+// encoding (see Encode) or the protobuf representation (see ToProto).
+//
+// Example:
+//
+//	{
+//	  "mapping": {"interpolation": "NONE", "gamma": 1.02, "indexOffset": 0},
+//	  "zeroCount": 1,
+//	  "positiveValues": {"indexes": [3, 5], "counts": [1, 2]},
+//	  "negativeValues": {"indexes": [], "counts": []}
+//	}
+//
+// Bins are sorted by increasing indexes. The interpolations that the protobuf
+// enumeration does not name, such as the one of BitExponentialMapping and those
+// of the mappings registered with mapping.RegisterProtoDecoder, are written as
+// their numeric values (e.g., "5").
+
+type jsonDDSketch struct {
+	Mapping        jsonIndexMapping `json:"mapping"`
+	ZeroCount      float64          `json:"zeroCount"`
+	PositiveValues jsonBins         `json:"positiveValues"`
+	NegativeValues jsonBins         `json:"negativeValues"`
+}
+
+type jsonIndexMapping struct {
+	Interpolation string  `json:"interpolation"`
+	Gamma         float64 `json:"gamma"`
+	IndexOffset   float64 `json:"indexOffset"`
+}
+
+type jsonBins struct {
+	Indexes []int     `json:"indexes"`
+	Counts  []float64 `json:"counts"`
+}
+
+type jsonSummaryStatistics struct {
+	Count                  float64 `json:"count"`
+	Sum                    float64 `json:"sum"`
+	Min                    float64 `json:"min"`
+	Max                    float64 `json:"max"`
+	SumOfSquaredDeviations float64 `json:"sumOfSquaredDeviations,omitempty"`
+}
+
+type jsonDDSketchWithExactSummaryStatistics struct {
+	jsonDDSketch
+	SummaryStatistics *jsonSummaryStatistics `json:"summaryStatistics,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (s *DDSketch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.toJSON())
+}
+
+// UnmarshalJSON implements json.Unmarshaler. If the receiver already has
+// stores, they are cleared and reused. Otherwise, stores are built using
+// store.DefaultProvider.
+func (s *DDSketch) UnmarshalJSON(b []byte) error {
+	var j jsonDDSketch
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	return s.fromJSON(&j)
+}
+
+func (s *DDSketch) toJSON() *jsonDDSketch {
+	pb := s.IndexMapping.ToProto()
+	return &jsonDDSketch{
+		Mapping: jsonIndexMapping{
+			Interpolation: pb.Interpolation.String(),
+			Gamma:         pb.Gamma,
+			IndexOffset:   pb.IndexOffset,
+		},
+		ZeroCount:      s.zeroCount,
+		PositiveValues: storeToJSON(s.positiveValueStore),
+		NegativeValues: storeToJSON(s.negativeValueStore),
+	}
+}
+
+func (s *DDSketch) fromJSON(j *jsonDDSketch) error {
+	interpolation, err := interpolationFromJSON(j.Mapping.Interpolation)
+	if err != nil {
+		return err
+	}
+	m, err := mapping.FromProto(&sketchpb.IndexMapping{
+		Gamma:         j.Mapping.Gamma,
+		IndexOffset:   j.Mapping.IndexOffset,
+		Interpolation: interpolation,
+	})
+	if err != nil {
+		return err
+	}
+	if !(j.ZeroCount >= 0) {
+		return ErrNegativeCount
+	}
+	if math.IsInf(j.ZeroCount, 1) {
+		return store.ErrInvalidBinCount
+	}
+	if err := j.PositiveValues.validate(m); err != nil {
+		return err
+	}
+	if err := j.NegativeValues.validate(m); err != nil {
+		return err
+	}
+
+	s.IndexMapping = m
+	s.positiveValueStore = clearedOrNewStore(s.positiveValueStore)
+	s.negativeValueStore = clearedOrNewStore(s.negativeValueStore)
+	j.PositiveValues.addTo(s.positiveValueStore)
+	j.NegativeValues.addTo(s.negativeValueStore)
+	s.zeroCount = j.ZeroCount
+	return nil
+}
+
+// interpolationFromJSON parses either the name or the numeric value of an
+// interpolation, as written by the String method of the protobuf enumeration.
+func interpolationFromJSON(name string) (sketchpb.IndexMapping_Interpolation, error) {
+	if interpolation, ok := sketchpb.IndexMapping_Interpolation_value[name]; ok {
+		return sketchpb.IndexMapping_Interpolation(interpolation), nil
+	}
+	if interpolation, err := strconv.ParseInt(name, 10, 32); err == nil {
+		return sketchpb.IndexMapping_Interpolation(interpolation), nil
+	}
+	return 0, fmt.Errorf("unknown interpolation: %q", name)
+}
+
+func clearedOrNewStore(s store.Store) store.Store {
+	if s == nil {
+		return store.DefaultProvider()
+	}
+	s.Clear()
+	return s
+}
+
+func storeToJSON(s store.Store) jsonBins {
+	j := jsonBins{
+		Indexes: make([]int, 0),
+		Counts:  make([]float64, 0),
+	}
+	s.ForEach(func(index int, count float64) (stop bool) {
+		j.Indexes = append(j.Indexes, index)
+		j.Counts = append(j.Counts, count)
+		return false
+	})
+	sort.Sort(&j)
+	return j
+}
+
+func (j *jsonBins) Len() int {
+	return len(j.Indexes)
+}
+
+func (j *jsonBins) Less(a, b int) bool {
+	return j.Indexes[a] < j.Indexes[b]
+}
+
+func (j *jsonBins) Swap(a, b int) {
+	j.Indexes[a], j.Indexes[b] = j.Indexes[b], j.Indexes[a]
+	j.Counts[a], j.Counts[b] = j.Counts[b], j.Counts[a]
+}
+
+func (j *jsonBins) isEmpty() bool {
+	for _, count := range j.Counts {
+		if count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// validate checks that the bins can be added to a store, which is the case if
+// their counts are finite and non-negative, and if their indexes can be
+// produced by the index mapping, so that a corrupt payload cannot make dense
+// stores allocate a huge number of bins (see mergeWithProto).
+func (j *jsonBins) validate(m mapping.IndexMapping) error {
+	if len(j.Indexes) != len(j.Counts) {
+		return errors.New("bin indexes and counts must have the same length")
+	}
+	for _, count := range j.Counts {
+		if !(count >= 0) {
+			return ErrNegativeCount
+		}
+		if math.IsInf(count, 1) {
+			return store.ErrInvalidBinCount
+		}
+	}
+	minIndex, maxIndex := indexRange(m)
+	for _, index := range j.Indexes {
+		if index < minIndex || index > maxIndex {
+			return errIndexOutOfRange
+		}
+	}
+	return nil
+}
+
+func (j *jsonBins) addTo(s store.Store) {
+	for i, index := range j.Indexes {
+		s.AddWithCount(index, j.Counts[i])
+	}
+}
+
+// MarshalJSON implements json.Marshaler. The exact summary statistics are
+// encoded alongside the content of the sketch.
+func (s *DDSketchWithExactSummaryStatistics) MarshalJSON() ([]byte, error) {
+	j := jsonDDSketchWithExactSummaryStatistics{jsonDDSketch: *s.DDSketch.toJSON()}
+	if s.summaryStatistics.Count() != 0 {
+		j.SummaryStatistics = &jsonSummaryStatistics{
+			Count:                  s.summaryStatistics.Count(),
+			Sum:                    s.summaryStatistics.Sum(),
+			Min:                    s.summaryStatistics.Min(),
+			Max:                    s.summaryStatistics.Max(),
+			SumOfSquaredDeviations: s.summaryStatistics.SumOfSquaredDeviations(),
+		}
+	}
+	return json.Marshal(&j)
+}
+
+// UnmarshalJSON implements json.Unmarshaler (see DDSketch.UnmarshalJSON).
+func (s *DDSketchWithExactSummaryStatistics) UnmarshalJSON(b []byte) error {
+	var j jsonDDSketchWithExactSummaryStatistics
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	summaryStatistics := stat.NewSummaryStatistics()
+	if j.SummaryStatistics != nil {
+		var err error
+		summaryStatistics, err = stat.NewSummaryStatisticsFromData(j.SummaryStatistics.Count, j.SummaryStatistics.Sum, j.SummaryStatistics.Min, j.SummaryStatistics.Max)
+		if err != nil {
+			return err
+		}
+		if !(j.SummaryStatistics.SumOfSquaredDeviations >= 0) {
+			return errors.New("the sum of squared deviations cannot be negative")
+		}
+		summaryStatistics.AddToSumOfSquaredDeviations(j.SummaryStatistics.SumOfSquaredDeviations)
+	}
+	isEmpty := j.ZeroCount == 0 && j.PositiveValues.isEmpty() && j.NegativeValues.isEmpty()
+	if isEmpty != (summaryStatistics.Count() == 0) {
+		return errors.New("sketch and summary statistics do not match")
+	}
+	sketch := s.DDSketch
+	if sketch == nil {
+		sketch = &DDSketch{}
+	}
+	if err := sketch.fromJSON(&j.jsonDDSketch); err != nil {
+		return err
+	}
+	s.DDSketch = sketch
+	s.summaryStatistics = summaryStatistics
+	return nil
+}
@@ -0,0 +1,182 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package mapping
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+const (
+	// MinBitExponentialScale is the lowest scale of BitExponentialMapping.
+	// OpenTelemetry also allows -10, whose base, 2^1024, is not representable.
+	MinBitExponentialScale = -9
+	// MaxBitExponentialScale is the highest scale of BitExponentialMapping, as
+	// in OpenTelemetry.
+	MaxBitExponentialScale = 20
+
+	// bitExponentialInterpolation is the interpolation of the protobuf
+	// definitions of BitExponentialMapping, which is not a value of the enum.
+	bitExponentialInterpolation = sketchpb.IndexMapping_Interpolation(5)
+)
+
+// BitExponentialMapping is an IndexMapping whose bins are the buckets of the
+// exponential histograms of OpenTelemetry of the same scale: the base (gamma)
+// is 2^(2^-scale) and the bin of index i holds the values that are greater
+// than base^i and lower than or equal to base^(i+1), so that the bins of
+// sketches and exponential histograms can be converted to one another without
+// being redistributed. Powers of two are mapped exactly, using the binary
+// representation of values. Other values are mapped with the logarithm of their
+// significand, which may map the values that are closest to bin boundaries to
+// adjacent bins, as the reference implementation of OpenTelemetry does.
+//
+// The mapping is encoded with enc.FlagIndexMappingBitExponential and its
+// protobuf definition has an interpolation that is not part of the protobuf
+// enum, so that decoding it returns a BitExponentialMapping that maps all
+// values, including the ones at bin boundaries, to the same bins. Other
+// implementations of DDSketch cannot decode it.
+type BitExponentialMapping struct {
+	scale              int
+	gamma              float64
+	scaleFactor        float64 // 2^scale/ln(2), precomputed for performance
+	inverseScaleFactor float64 // ln(2)/2^scale, precomputed for performance
+	maxIndexableValue  float64
+}
+
+// NewBitExponentialMapping returns the BitExponentialMapping of the provided
+// scale, which must be between MinBitExponentialScale and
+// MaxBitExponentialScale.
+func NewBitExponentialMapping(scale int) (*BitExponentialMapping, error) {
+	if scale < MinBitExponentialScale || scale > MaxBitExponentialScale {
+		return nil, fmt.Errorf("the scale must be between %d and %d", MinBitExponentialScale, MaxBitExponentialScale)
+	}
+	m := &BitExponentialMapping{
+		scale:              scale,
+		gamma:              math.Exp2(math.Ldexp(1, -scale)),
+		scaleFactor:        math.Ldexp(math.Log2E, scale),
+		inverseScaleFactor: math.Ldexp(math.Ln2, -scale),
+	}
+	// So that Value does not overflow.
+	m.maxIndexableValue = math.MaxFloat64 / (1 + m.RelativeAccuracy())
+	return m, nil
+}
+
+func newBitExponentialMappingWithGamma(gamma, indexOffset float64) (*BitExponentialMapping, error) {
+	if indexOffset != 0 {
+		return nil, errors.New("the index offset of a bit exponential mapping must be 0")
+	}
+	scale := int(math.Round(-math.Log2(math.Log2(gamma))))
+	if scale < MinBitExponentialScale || scale > MaxBitExponentialScale {
+		return nil, fmt.Errorf("%v is not the base of a bit exponential mapping", gamma)
+	}
+	m, _ := NewBitExponentialMapping(scale)
+	if m.gamma != gamma {
+		return nil, fmt.Errorf("%v is not the base of a bit exponential mapping", gamma)
+	}
+	return m, nil
+}
+
+// Scale returns the scale of the mapping, as defined by OpenTelemetry.
+func (m *BitExponentialMapping) Scale() int {
+	return m.scale
+}
+
+func (m *BitExponentialMapping) Equals(other IndexMapping) bool {
+	o, ok := other.(*BitExponentialMapping)
+	return ok && m.scale == o.scale
+}
+
+func (m *BitExponentialMapping) Index(value float64) int {
+	bits := math.Float64bits(value)
+	exponent := int(getExponent(bits))
+	isPowerOfTwo := bits&significandMask == 0
+	if m.scale <= 0 {
+		if isPowerOfTwo {
+			// Bins include their upper bound.
+			exponent--
+		}
+		return exponent >> -m.scale
+	}
+	if isPowerOfTwo {
+		return exponent<<m.scale - 1
+	}
+	// The logarithm of the significand is more accurate than the one of the
+	// value, and it is non-negative, so that truncating it rounds it down.
+	return exponent<<m.scale + int(math.Log(getSignificandPlusOne(bits))*m.scaleFactor)
+}
+
+func (m *BitExponentialMapping) Value(index int) float64 {
+	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
+}
+
+func (m *BitExponentialMapping) Values(indexes []int, out []float64) {
+	factor := 1 + m.RelativeAccuracy()
+	for i, index := range indexes {
+		out[i] = m.LowerBound(index) * factor
+	}
+}
+
+func (m *BitExponentialMapping) LowerBound(index int) float64 {
+	if m.scale <= 0 {
+		return math.Ldexp(1, index<<-m.scale)
+	}
+	subIndex := index & (1<<m.scale - 1)
+	if subIndex == 0 {
+		return math.Ldexp(1, index>>m.scale)
+	}
+	return math.Ldexp(math.Exp(float64(subIndex)*m.inverseScaleFactor), index>>m.scale)
+}
+
+func (m *BitExponentialMapping) UpperBound(index int) float64 {
+	return m.LowerBound(index + 1)
+}
+
+func (m *BitExponentialMapping) MinIndexableValue() float64 {
+	return minNormalFloat64
+}
+
+func (m *BitExponentialMapping) MaxIndexableValue() float64 {
+	return m.maxIndexableValue
+}
+
+func (m *BitExponentialMapping) RelativeAccuracy() float64 {
+	return 1 - 2/(1+m.gamma)
+}
+
+func (m *BitExponentialMapping) Gamma() float64 {
+	return m.gamma
+}
+
+func (m *BitExponentialMapping) IndexOffset() float64 {
+	return 0
+}
+
+func (m *BitExponentialMapping) ToProto() *sketchpb.IndexMapping {
+	return &sketchpb.IndexMapping{
+		Gamma:         m.gamma,
+		IndexOffset:   0,
+		Interpolation: bitExponentialInterpolation,
+	}
+}
+
+func (m *BitExponentialMapping) Encode(b *[]byte) {
+	enc.EncodeFlag(b, enc.FlagIndexMappingBitExponential)
+	enc.EncodeFloat64LE(b, m.gamma)
+	enc.EncodeFloat64LE(b, 0)
+}
+
+func (m *BitExponentialMapping) string() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("scale: %v, gamma: %v\n", m.scale, m.gamma))
+	return buffer.String()
+}
+
+var _ IndexMapping = (*BitExponentialMapping)(nil)
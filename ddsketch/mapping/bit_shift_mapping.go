@@ -0,0 +1,157 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package mapping
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+// The number of bins per power of two of a BitShiftMapping is at most
+// 2^maxBitShiftBinsPerPowerOfTwoLog2, so that multiplying it by significands
+// does not overflow.
+const maxBitShiftBinsPerPowerOfTwoLog2 = 11
+
+// BitShiftMapping is a fast IndexMapping that splits each power of two into k
+// bins of equal width, k being a positive integer, so that indexes are
+// computed from the exponent and the significand of the binary representation
+// of values with integer operations only: shifts and masks, and a
+// multiplication if k is not a power of two.
+//
+// It is the LinearlyInterpolatedMapping whose gamma is 2^(1/k) and whose index
+// offset is zero, which is how it is encoded, and it has the same relative
+// accuracy, about 1/(2k). It is meant for use cases where a relative accuracy
+// of a few percent is enough, for which it is faster than the other mappings.
+type BitShiftMapping struct {
+	binsPerPowerOfTwo int
+	gamma             float64
+	maxIndexableValue float64
+}
+
+// NewBitShiftMapping returns the BitShiftMapping with the fewest bins per
+// power of two whose relative accuracy is lower than or equal to
+// relativeAccuracy.
+func NewBitShiftMapping(relativeAccuracy float64) (*BitShiftMapping, error) {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		return nil, errors.New("The relative accuracy must be between 0 and 1.")
+	}
+	binsPerPowerOfTwo := math.Ceil(1 / math.Log((1+relativeAccuracy)/(1-relativeAccuracy)))
+	if binsPerPowerOfTwo > 1<<maxBitShiftBinsPerPowerOfTwoLog2 {
+		return nil, errors.New("The relative accuracy is too low for the mapping.")
+	}
+	return NewBitShiftMappingWithBinsPerPowerOfTwo(int(binsPerPowerOfTwo))
+}
+
+// NewBitShiftMappingWithBinsPerPowerOfTwo returns the BitShiftMapping that
+// splits each power of two into binsPerPowerOfTwo bins, which must be between
+// 1 and 2^11.
+func NewBitShiftMappingWithBinsPerPowerOfTwo(binsPerPowerOfTwo int) (*BitShiftMapping, error) {
+	if binsPerPowerOfTwo < 1 || binsPerPowerOfTwo > 1<<maxBitShiftBinsPerPowerOfTwoLog2 {
+		return nil, fmt.Errorf("The number of bins per power of two must be between 1 and %d.", 1<<maxBitShiftBinsPerPowerOfTwoLog2)
+	}
+	m := &BitShiftMapping{
+		binsPerPowerOfTwo: binsPerPowerOfTwo,
+		gamma:             math.Exp2(1 / float64(binsPerPowerOfTwo)),
+	}
+	// So that Value does not overflow.
+	m.maxIndexableValue = math.MaxFloat64 / (1 + m.RelativeAccuracy())
+	return m, nil
+}
+
+// BinsPerPowerOfTwo returns the number of bins that each power of two is split
+// into.
+func (m *BitShiftMapping) BinsPerPowerOfTwo() int {
+	return m.binsPerPowerOfTwo
+}
+
+func (m *BitShiftMapping) Equals(other IndexMapping) bool {
+	o, ok := other.(*BitShiftMapping)
+	return ok && m.binsPerPowerOfTwo == o.binsPerPowerOfTwo
+}
+
+func (m *BitShiftMapping) Index(value float64) int {
+	bits := math.Float64bits(value)
+	exponent := int((bits&exponentMask)>>exponentShift) - exponentBias
+	return exponent*m.binsPerPowerOfTwo + int(((bits&significandMask)*uint64(m.binsPerPowerOfTwo))>>exponentShift)
+}
+
+func (m *BitShiftMapping) Value(index int) float64 {
+	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
+}
+
+func (m *BitShiftMapping) Values(indexes []int, out []float64) {
+	factor := 1 + m.RelativeAccuracy()
+	for i, index := range indexes {
+		out[i] = m.LowerBound(index) * factor
+	}
+}
+
+func (m *BitShiftMapping) LowerBound(index int) float64 {
+	exponent := index / m.binsPerPowerOfTwo
+	binIndex := index % m.binsPerPowerOfTwo
+	if binIndex < 0 {
+		exponent--
+		binIndex += m.binsPerPowerOfTwo
+	}
+	// The lowest significand that Index maps to the bin.
+	k := uint64(m.binsPerPowerOfTwo)
+	significand := (uint64(binIndex)<<exponentShift + k - 1) / k
+	return math.Ldexp(math.Float64frombits(oneMask|significand), exponent)
+}
+
+func (m *BitShiftMapping) UpperBound(index int) float64 {
+	return m.LowerBound(index + 1)
+}
+
+func (m *BitShiftMapping) MinIndexableValue() float64 {
+	return minNormalFloat64
+}
+
+func (m *BitShiftMapping) MaxIndexableValue() float64 {
+	return m.maxIndexableValue
+}
+
+func (m *BitShiftMapping) RelativeAccuracy() float64 {
+	return 1 - 2/(1+math.Exp(1/float64(m.binsPerPowerOfTwo)))
+}
+
+func (m *BitShiftMapping) Gamma() float64 {
+	return m.gamma
+}
+
+func (m *BitShiftMapping) IndexOffset() float64 {
+	return 0
+}
+
+// ToProto returns the protobuf representation of the equivalent
+// LinearlyInterpolatedMapping.
+func (m *BitShiftMapping) ToProto() *sketchpb.IndexMapping {
+	return &sketchpb.IndexMapping{
+		Gamma:         m.gamma,
+		IndexOffset:   0,
+		Interpolation: sketchpb.IndexMapping_LINEAR,
+	}
+}
+
+// Encode encodes the equivalent LinearlyInterpolatedMapping.
+func (m *BitShiftMapping) Encode(b *[]byte) {
+	enc.EncodeFlag(b, enc.FlagIndexMappingBaseLinear)
+	enc.EncodeFloat64LE(b, m.gamma)
+	enc.EncodeFloat64LE(b, 0)
+}
+
+func (m *BitShiftMapping) string() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("binsPerPowerOfTwo: %v, gamma: %v\n", m.binsPerPowerOfTwo, m.gamma))
+	return buffer.String()
+}
+
+var _ IndexMapping = (*BitShiftMapping)(nil)
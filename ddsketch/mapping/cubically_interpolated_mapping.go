@@ -88,10 +88,21 @@ func (m *CubicallyInterpolatedMapping) Value(index int) float64 {
 	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
 }
 
+func (m *CubicallyInterpolatedMapping) Values(indexes []int, out []float64) {
+	factor := 1 + m.RelativeAccuracy()
+	for i, index := range indexes {
+		out[i] = m.LowerBound(index) * factor
+	}
+}
+
 func (m *CubicallyInterpolatedMapping) LowerBound(index int) float64 {
 	return m.approximateInverseLog((float64(index) - m.indexOffset) / m.multiplier)
 }
 
+func (m *CubicallyInterpolatedMapping) UpperBound(index int) float64 {
+	return m.LowerBound(index + 1)
+}
+
 // Return an approximation of Math.log(x) / Math.log(base(2)).
 func (m *CubicallyInterpolatedMapping) approximateLog(x float64) float64 {
 	bits := math.Float64bits(x)
@@ -123,6 +134,14 @@ func (m *CubicallyInterpolatedMapping) RelativeAccuracy() float64 {
 	return 1 - 2/(1+math.Exp(7.0/10*math.Log2(m.gamma)))
 }
 
+func (m *CubicallyInterpolatedMapping) Gamma() float64 {
+	return m.gamma
+}
+
+func (m *CubicallyInterpolatedMapping) IndexOffset() float64 {
+	return m.indexOffset
+}
+
 func (m *CubicallyInterpolatedMapping) ToProto() *sketchpb.IndexMapping {
 	return &sketchpb.IndexMapping{
 		Gamma:         m.gamma,
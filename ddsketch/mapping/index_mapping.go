@@ -8,6 +8,7 @@ package mapping
 import (
 	"errors"
 	"fmt"
+	"math"
 
 	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
 	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
@@ -22,8 +23,20 @@ type IndexMapping interface {
 	Equals(other IndexMapping) bool
 	Index(value float64) int
 	Value(index int) float64
+	// Values sets out[i] to Value(indexes[i]) for every i, which is faster than
+	// calling Value for each index. out must be at least as long as indexes.
+	Values(indexes []int, out []float64)
+	// LowerBound returns the lowest value that is mapped to the bin of the
+	// provided index.
 	LowerBound(index int) float64
+	// UpperBound returns the upper bound of the bin of the provided index,
+	// which is the lower bound of the next bin.
+	UpperBound(index int) float64
 	RelativeAccuracy() float64
+	// Gamma returns the base of the mapping, as it is encoded.
+	Gamma() float64
+	// IndexOffset returns the index offset of the mapping, as it is encoded.
+	IndexOffset() float64
 	// MinIndexableValue returns the minimum positive value that can be mapped to an index.
 	MinIndexableValue() float64
 	// MaxIndexableValue returns the maximum positive value that can be mapped to an index.
@@ -37,52 +50,59 @@ func NewDefaultMapping(relativeAccuracy float64) (IndexMapping, error) {
 	return NewLogarithmicMapping(relativeAccuracy)
 }
 
-// FromProto returns an Index mapping from the protobuf definition of it
+// FromProto returns an Index mapping from the protobuf definition of it, using
+// the decoder that is registered for its interpolation (see
+// RegisterProtoDecoder).
 func FromProto(m *sketchpb.IndexMapping) (IndexMapping, error) {
 	if m == nil {
 		return nil, errors.New("cannot create IndexMapping from nil protobuf index mapping")
 	}
-	switch m.Interpolation {
-	case sketchpb.IndexMapping_NONE:
-		return NewLogarithmicMappingWithGamma(m.Gamma, m.IndexOffset)
-	case sketchpb.IndexMapping_LINEAR:
-		return NewLinearlyInterpolatedMappingWithGamma(m.Gamma, m.IndexOffset)
-	case sketchpb.IndexMapping_CUBIC:
-		return NewCubicallyInterpolatedMappingWithGamma(m.Gamma, m.IndexOffset)
-	default:
+	decoder, ok := protoDecoderByInterpolation(m.Interpolation)
+	if !ok {
 		return nil, fmt.Errorf("interpolation not supported: %d", m.Interpolation)
 	}
+	return decoder(m)
 }
 
-// Decode decodes a mapping and updates the provided []byte so that it starts
-// immediately after the encoded mapping.
-func Decode(b *[]byte, flag enc.Flag) (IndexMapping, error) {
-	switch flag {
-
-	case enc.FlagIndexMappingBaseLogarithmic:
-		gamma, indexOffset, err := decodeLogLikeIndexMapping(b)
-		if err != nil {
-			return nil, err
-		}
-		return NewLogarithmicMappingWithGamma(gamma, indexOffset)
-
-	case enc.FlagIndexMappingBaseLinear:
-		gamma, indexOffset, err := decodeLogLikeIndexMapping(b)
-		if err != nil {
-			return nil, err
-		}
-		return NewLinearlyInterpolatedMappingWithGamma(gamma, indexOffset)
-
-	case enc.FlagIndexMappingBaseCubic:
-		gamma, indexOffset, err := decodeLogLikeIndexMapping(b)
-		if err != nil {
-			return nil, err
+// Downsample returns the mapping that maps values to the indexes that m maps
+// them to, shifted right by factorLog2 bits, that is, divided by 2^factorLog2
+// and rounded down, up to floating-point errors. Its gamma is the one of m
+// raised to the power of 2^factorLog2, and its relative accuracy is lower
+// accordingly. It is the mapping of the bins of a store that has been
+// downsampled by the same factor (see store.Store.Downsample).
+func Downsample(m IndexMapping, factorLog2 int) (IndexMapping, error) {
+	if factorLog2 <= 0 {
+		return m, nil
+	}
+	if b, ok := m.(*BitExponentialMapping); ok {
+		// Downscaling exponential histograms also shifts their indexes.
+		if b.scale-factorLog2 < MinBitExponentialScale {
+			return nil, errors.New("the downsampled scale is too low")
 		}
-		return NewCubicallyInterpolatedMappingWithGamma(gamma, indexOffset)
+		return NewBitExponentialMapping(b.scale - factorLog2)
+	}
+	if b, ok := m.(*BitShiftMapping); ok && factorLog2 < 64 && b.binsPerPowerOfTwo%(1<<factorLog2) == 0 {
+		return NewBitShiftMappingWithBinsPerPowerOfTwo(b.binsPerPowerOfTwo >> factorLog2)
+	}
+	pb := m.ToProto()
+	factor := math.Ldexp(1, factorLog2)
+	pb.Gamma = math.Pow(pb.Gamma, factor)
+	pb.IndexOffset /= factor
+	if math.IsInf(pb.Gamma, 1) {
+		return nil, errors.New("the downsampled gamma overflows")
+	}
+	return FromProto(pb)
+}
 
-	default:
+// Decode decodes a mapping and updates the provided []byte so that it starts
+// immediately after the encoded mapping, using the decoder that is registered
+// for the provided flag (see RegisterDecoder).
+func Decode(b *[]byte, flag enc.Flag) (IndexMapping, error) {
+	decoder, ok := decoderByFlag(flag)
+	if !ok {
 		return nil, errors.New("unknown mapping")
 	}
+	return decoder(b)
 }
 
 func decodeLogLikeIndexMapping(b *[]byte) (gamma, indexOffset float64, err error) {
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -103,6 +104,56 @@ func TestLowerBound(t *testing.T) {
 	}
 }
 
+func TestUpperBound(t *testing.T) {
+	for _, testCase := range testCases {
+		mapping, _ := testCase.fromRelativeAccuracy(0.01)
+		for _, i := range []int{-1000, -1, 0, 2, 10, 25, 100, 10000} {
+			upperBound := mapping.UpperBound(i)
+			assert.Equal(t, mapping.LowerBound(i+1), upperBound, testCase.name)
+			assert.Greater(t, upperBound, mapping.LowerBound(i), testCase.name)
+			assert.GreaterOrEqual(t, upperBound, mapping.Value(i), testCase.name)
+		}
+	}
+}
+
+func TestValues(t *testing.T) {
+	bitExponentialMapping, _ := NewBitExponentialMapping(6)
+	lookupTableMapping, _ := NewLookupTableMapping(0.01)
+	bitShiftMapping, _ := NewBitShiftMapping(0.01)
+	mappings := []IndexMapping{bitExponentialMapping, lookupTableMapping, bitShiftMapping}
+	for _, testCase := range testCases {
+		m, _ := testCase.fromRelativeAccuracy(0.01)
+		mappings = append(mappings, m)
+	}
+	indexes := []int{-10000, -1000, -25, -1, 0, 1, 2, 10, 25, 100, 10000}
+	for _, mapping := range mappings {
+		values := make([]float64, len(indexes))
+		mapping.Values(indexes, values)
+		for i, index := range indexes {
+			assert.Equal(t, mapping.Value(index), values[i])
+		}
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	for _, testCase := range testCases {
+		m, _ := testCase.fromRelativeAccuracy(0.01)
+		for _, factorLog2 := range []int{0, 1, 2, 5} {
+			downsampled, err := Downsample(m, factorLog2)
+			assert.Nil(t, err)
+			assert.Greater(t, downsampled.RelativeAccuracy(), m.RelativeAccuracy()*float64(int(1)<<factorLog2)*0.9)
+			for index := -1000; index <= 1000; index++ {
+				// Values at the center of bins are not subject to floating-point
+				// errors at the bin boundaries.
+				value := (m.LowerBound(index) + m.LowerBound(index+1)) / 2
+				assert.Equal(t, m.Index(value)>>factorLog2, downsampled.Index(value), testCase.name)
+			}
+		}
+		_, err := Downsample(m, 100)
+		assert.NotNil(t, err)
+	}
+}
+
 func TestSerialization(t *testing.T) {
 	m, _ := NewCubicallyInterpolatedMapping(1e-2)
 	deserializedMapping, err := FromProto(m.ToProto())
@@ -110,11 +161,78 @@ func TestSerialization(t *testing.T) {
 	assert.True(t, m.Equals(deserializedMapping))
 }
 
+func TestGammaAndIndexOffset(t *testing.T) {
+	bitExponentialMapping, _ := NewBitExponentialMapping(6)
+	lookupTableMapping, _ := NewLookupTableMapping(0.01)
+	bitShiftMapping, _ := NewBitShiftMapping(0.01)
+	mappings := []IndexMapping{bitExponentialMapping, lookupTableMapping, bitShiftMapping}
+	for _, testCase := range testCases {
+		m, _ := testCase.fromRelativeAccuracy(0.01)
+		mappings = append(mappings, m)
+	}
+	for _, mapping := range mappings {
+		pb := mapping.ToProto()
+		assert.Equal(t, pb.Gamma, mapping.Gamma())
+		assert.Equal(t, pb.IndexOffset, mapping.IndexOffset())
+	}
+	m, _ := NewLogarithmicMappingWithGamma(1.5, 2)
+	assert.Equal(t, 1.5, m.Gamma())
+	assert.Equal(t, 2.0, m.IndexOffset())
+}
+
 func TestDeserializationNil(t *testing.T) {
 	_, err := FromProto(nil)
 	assert.EqualError(t, err, "cannot create IndexMapping from nil protobuf index mapping")
 }
 
+func TestRegisterDecoder(t *testing.T) {
+	// Registers BitShiftMapping, which is otherwise decoded as a
+	// LinearlyInterpolatedMapping, with its own flag and interpolation.
+	subFlag, err := encoding.NewSubFlag(42)
+	assert.Nil(t, err)
+	flag := encoding.NewFlag(encoding.FlagTypeIndexMapping, subFlag)
+	assert.NotNil(t, RegisterDecoder(flag, nil))
+	assert.Nil(t, RegisterDecoder(flag, func(b *[]byte) (IndexMapping, error) {
+		binsPerPowerOfTwo, err := encoding.DecodeUvarint64(b)
+		if err != nil {
+			return nil, err
+		}
+		return NewBitShiftMappingWithBinsPerPowerOfTwo(int(binsPerPowerOfTwo))
+	}))
+	t.Cleanup(func() { unregisterDecoder(flag) })
+	decoder, _ := decoderByFlag(flag)
+	assert.NotNil(t, RegisterDecoder(flag, decoder))
+	assert.NotNil(t, RegisterDecoder(encoding.FlagCount, decoder))
+	interpolation := sketchpb.IndexMapping_Interpolation(42)
+	protoDecoder := func(m *sketchpb.IndexMapping) (IndexMapping, error) {
+		return NewBitShiftMappingWithBinsPerPowerOfTwo(int(math.Round(1 / math.Log2(m.Gamma))))
+	}
+	assert.NotNil(t, RegisterProtoDecoder(interpolation, nil))
+	assert.Nil(t, RegisterProtoDecoder(interpolation, protoDecoder))
+	t.Cleanup(func() { unregisterProtoDecoder(interpolation) })
+	assert.NotNil(t, RegisterProtoDecoder(sketchpb.IndexMapping_NONE, protoDecoder))
+
+	m, _ := NewBitShiftMappingWithBinsPerPowerOfTwo(64)
+	var b []byte
+	encoding.EncodeFlag(&b, flag)
+	encoding.EncodeUvarint64(&b, uint64(m.BinsPerPowerOfTwo()))
+	decodedFlag, err := encoding.DecodeFlag(&b)
+	assert.Nil(t, err)
+	decoded, err := Decode(&b, decodedFlag)
+	assert.Nil(t, err)
+	assert.True(t, m.Equals(decoded))
+	assert.Empty(t, b)
+
+	pb := m.ToProto()
+	pb.Interpolation = interpolation
+	decoded, err = FromProto(pb)
+	assert.Nil(t, err)
+	assert.True(t, m.Equals(decoded))
+
+	_, err = encoding.NewSubFlag(64)
+	assert.NotNil(t, err)
+}
+
 func TestEncodeDecodeEquality(t *testing.T) {
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -134,3 +252,148 @@ func TestEncodeDecodeEquality(t *testing.T) {
 		})
 	}
 }
+
+func TestBitExponentialMapping(t *testing.T) {
+	for scale := MinBitExponentialScale; scale <= MaxBitExponentialScale; scale++ {
+		mapping, err := NewBitExponentialMapping(scale)
+		assert.Nil(t, err)
+		assert.Equal(t, scale, mapping.Scale())
+		EvaluateMappingAccuracy(t, mapping, mapping.RelativeAccuracy())
+		for exponent := -1022; exponent <= 1023; exponent += 13 {
+			// Bins include their upper bound, as the buckets of OpenTelemetry.
+			powerOfTwo := math.Ldexp(1, exponent)
+			assert.Equal(t, (exponent<<20-1)>>(20-scale), mapping.Index(powerOfTwo), "scale: %d", scale)
+			assert.Equal(t, (exponent<<20)>>(20-scale), mapping.Index(math.Nextafter(powerOfTwo, math.Inf(1))), "scale: %d", scale)
+			if scale > 0 || exponent&(1<<-scale-1) == 0 {
+				assert.Equal(t, powerOfTwo, mapping.LowerBound((exponent<<20)>>(20-scale)), "scale: %d", scale)
+			}
+		}
+	}
+	for _, scale := range []int{MinBitExponentialScale - 1, MaxBitExponentialScale + 1} {
+		_, err := NewBitExponentialMapping(scale)
+		assert.NotNil(t, err)
+	}
+
+	mapping, _ := NewBitExponentialMapping(0)
+	assert.Equal(t, []int{-1, 0, 0, 1, 1}, []int{mapping.Index(1), mapping.Index(1.5), mapping.Index(2), mapping.Index(3), mapping.Index(4)})
+	mapping, _ = NewBitExponentialMapping(1)
+	assert.Equal(t, []int{-1, 0, 1, 1, 2}, []int{mapping.Index(1), mapping.Index(1.2), mapping.Index(1.5), mapping.Index(2), mapping.Index(2.5)})
+}
+
+func TestBitExponentialMappingDownsample(t *testing.T) {
+	mapping, _ := NewBitExponentialMapping(8)
+	for _, factorLog2 := range []int{1, 3, 8, 10} {
+		downsampled, err := Downsample(mapping, factorLog2)
+		assert.Nil(t, err)
+		assert.Equal(t, 8-factorLog2, downsampled.(*BitExponentialMapping).Scale())
+		for value := mapping.MinIndexableValue(); value < mapping.MaxIndexableValue(); value *= multiplier {
+			assert.Equal(t, mapping.Index(value)>>factorLog2, downsampled.Index(value))
+		}
+	}
+	_, err := Downsample(mapping, 8-MinBitExponentialScale+1)
+	assert.NotNil(t, err)
+}
+
+func TestBitExponentialMappingSerialization(t *testing.T) {
+	for scale := MinBitExponentialScale; scale <= MaxBitExponentialScale; scale++ {
+		mapping, _ := NewBitExponentialMapping(scale)
+		fromProto, err := FromProto(mapping.ToProto())
+		assert.Nil(t, err)
+		var b []byte
+		mapping.Encode(&b)
+		flag, err := encoding.DecodeFlag(&b)
+		assert.Nil(t, err)
+		assert.Equal(t, encoding.FlagIndexMappingBitExponential, flag)
+		decoded, err := Decode(&b, flag)
+		assert.Nil(t, err)
+		assert.Empty(t, b)
+		assert.Equal(t, mapping, fromProto, "scale: %d", scale)
+		assert.Equal(t, mapping, decoded, "scale: %d", scale)
+		for index := -1000; index <= 1000; index++ {
+			// Bin boundaries, including the exact powers of two, are mapped to
+			// the same bins.
+			for _, value := range []float64{mapping.LowerBound(index), math.Nextafter(mapping.LowerBound(index), math.Inf(1))} {
+				assert.Equal(t, mapping.Index(value), fromProto.Index(value), "scale: %d", scale)
+				assert.Equal(t, mapping.Index(value), decoded.Index(value), "scale: %d", scale)
+			}
+		}
+	}
+
+	_, err := FromProto(&sketchpb.IndexMapping{Gamma: 1.01, Interpolation: bitExponentialInterpolation})
+	assert.NotNil(t, err)
+	_, err = FromProto(&sketchpb.IndexMapping{Gamma: 2, IndexOffset: 1, Interpolation: bitExponentialInterpolation})
+	assert.NotNil(t, err)
+}
+
+func TestLookupTableMapping(t *testing.T) {
+	for relativeAccuracy := testMaxRelativeAccuracy; relativeAccuracy >= 1e-5; relativeAccuracy *= testMaxRelativeAccuracy {
+		mapping, err := NewLookupTableMapping(relativeAccuracy)
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, mapping.RelativeAccuracy(), relativeAccuracy)
+		EvaluateMappingAccuracy(t, mapping, relativeAccuracy)
+	}
+	_, err := NewLookupTableMapping(1e-7)
+	assert.NotNil(t, err)
+
+	for _, binsPerPowerOfTwo := range []int{1, 3, 64, 100, 1000} {
+		mapping, err := NewLookupTableMappingWithBinsPerPowerOfTwo(binsPerPowerOfTwo)
+		assert.Nil(t, err)
+		// The mapping is encoded as the logarithmic mapping that maps values
+		// to the same bins.
+		logarithmic, err := FromProto(mapping.ToProto())
+		assert.Nil(t, err)
+		assert.IsType(t, &LogarithmicMapping{}, logarithmic)
+		for index := -3000; index <= 3000; index++ {
+			lowerBound := mapping.LowerBound(index)
+			if lowerBound <= mapping.MinIndexableValue() || lowerBound >= mapping.MaxIndexableValue() {
+				continue
+			}
+			assert.Equal(t, index, mapping.Index(lowerBound))
+			assert.Equal(t, index-1, mapping.Index(math.Nextafter(lowerBound, 0)))
+			if value := (lowerBound + mapping.LowerBound(index+1)) / 2; value < mapping.MaxIndexableValue() {
+				assert.Equal(t, logarithmic.Index(value), mapping.Index(value))
+			}
+		}
+	}
+}
+
+func TestBitShiftMapping(t *testing.T) {
+	for relativeAccuracy := testMaxRelativeAccuracy; relativeAccuracy >= 1e-3; relativeAccuracy *= testMaxRelativeAccuracy {
+		mapping, err := NewBitShiftMapping(relativeAccuracy)
+		assert.Nil(t, err)
+		assert.LessOrEqual(t, mapping.RelativeAccuracy(), relativeAccuracy)
+		EvaluateMappingAccuracy(t, mapping, relativeAccuracy)
+	}
+	_, err := NewBitShiftMapping(1e-4)
+	assert.NotNil(t, err)
+
+	for _, binsPerPowerOfTwo := range []int{1, 3, 8, 12, 1 << maxBitShiftBinsPerPowerOfTwoLog2} {
+		mapping, err := NewBitShiftMappingWithBinsPerPowerOfTwo(binsPerPowerOfTwo)
+		assert.Nil(t, err)
+		// The mapping is encoded as the equivalent linearly interpolated
+		// mapping.
+		linear, err := FromProto(mapping.ToProto())
+		assert.Nil(t, err)
+		assert.IsType(t, &LinearlyInterpolatedMapping{}, linear)
+		assert.InDelta(t, mapping.RelativeAccuracy(), linear.RelativeAccuracy(), floatingPointAcceptableError)
+		for index := -3000; index <= 3000; index++ {
+			lowerBound := mapping.LowerBound(index)
+			if lowerBound <= mapping.MinIndexableValue() || lowerBound >= mapping.MaxIndexableValue() {
+				continue
+			}
+			assert.Equal(t, index, mapping.Index(lowerBound))
+			assert.Equal(t, index-1, mapping.Index(math.Nextafter(lowerBound, 0)))
+			if value := (lowerBound + mapping.LowerBound(index+1)) / 2; value < mapping.MaxIndexableValue() {
+				assert.Equal(t, linear.Index(value), mapping.Index(value))
+			}
+		}
+	}
+
+	mapping, _ := NewBitShiftMappingWithBinsPerPowerOfTwo(12)
+	downsampled, err := Downsample(mapping, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, downsampled.(*BitShiftMapping).BinsPerPowerOfTwo())
+	downsampled, err = Downsample(mapping, 3)
+	assert.Nil(t, err)
+	assert.IsType(t, &LinearlyInterpolatedMapping{}, downsampled)
+}
@@ -81,10 +81,21 @@ func (m *LinearlyInterpolatedMapping) Value(index int) float64 {
 	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
 }
 
+func (m *LinearlyInterpolatedMapping) Values(indexes []int, out []float64) {
+	factor := 1 + m.RelativeAccuracy()
+	for i, index := range indexes {
+		out[i] = m.LowerBound(index) * factor
+	}
+}
+
 func (m *LinearlyInterpolatedMapping) LowerBound(index int) float64 {
 	return m.approximateInverseLog((float64(index) - m.indexOffset) / m.multiplier)
 }
 
+func (m *LinearlyInterpolatedMapping) UpperBound(index int) float64 {
+	return m.LowerBound(index + 1)
+}
+
 // Return an approximation of Math.log(x) / Math.log(2)
 func (m *LinearlyInterpolatedMapping) approximateLog(x float64) float64 {
 	bits := math.Float64bits(x)
@@ -110,6 +121,14 @@ func (m *LinearlyInterpolatedMapping) RelativeAccuracy() float64 {
 	return 1 - 2/(1+math.Exp(math.Log2(m.gamma)))
 }
 
+func (m *LinearlyInterpolatedMapping) Gamma() float64 {
+	return m.gamma
+}
+
+func (m *LinearlyInterpolatedMapping) IndexOffset() float64 {
+	return m.indexOffset
+}
+
 // Generates a protobuf representation of this LinearlyInterpolatedMapping.
 func (m *LinearlyInterpolatedMapping) ToProto() *sketchpb.IndexMapping {
 	return &sketchpb.IndexMapping{
@@ -79,10 +79,21 @@ func (m *LogarithmicMapping) Value(index int) float64 {
 	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
 }
 
+func (m *LogarithmicMapping) Values(indexes []int, out []float64) {
+	factor := 1 + m.RelativeAccuracy()
+	for i, index := range indexes {
+		out[i] = math.Exp((float64(index)-m.indexOffset)/m.multiplier) * factor
+	}
+}
+
 func (m *LogarithmicMapping) LowerBound(index int) float64 {
 	return math.Exp((float64(index) - m.indexOffset) / m.multiplier)
 }
 
+func (m *LogarithmicMapping) UpperBound(index int) float64 {
+	return m.LowerBound(index + 1)
+}
+
 func (m *LogarithmicMapping) MinIndexableValue() float64 {
 	return m.minIndexableValue
 }
@@ -95,6 +106,14 @@ func (m *LogarithmicMapping) RelativeAccuracy() float64 {
 	return 1 - 2/(1+m.gamma)
 }
 
+func (m *LogarithmicMapping) Gamma() float64 {
+	return m.gamma
+}
+
+func (m *LogarithmicMapping) IndexOffset() float64 {
+	return m.indexOffset
+}
+
 // Generates a protobuf representation of this LogarithicMapping.
 func (m *LogarithmicMapping) ToProto() *sketchpb.IndexMapping {
 	return &sketchpb.IndexMapping{
@@ -0,0 +1,201 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package mapping
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+// The table of a LookupTableMapping has at most 2^maxLookupTableBits entries.
+const maxLookupTableBits = 16
+
+// lookupTableEntry describes the range of significands that share their
+// highest bits: the index of the bin, within its power of two, of the lowest
+// significand of the range, and the lowest significand of the range that
+// belongs to the next bin, if any.
+type lookupTableEntry struct {
+	index    int
+	boundary uint64 // 1 << exponentShift if the range does not contain the start of another bin
+}
+
+// LookupTableMapping is a logarithmic IndexMapping whose gamma is 2^(1/k), for
+// some positive integer k, so that each power of two is split into k bins,
+// and that computes indexes without evaluating logarithms. It precomputes, for
+// the ranges of significands that share their highest bits, the bin that they
+// start in and the significand at which the next bin starts, if any, which is
+// at most one as the ranges are chosen to be narrower than the bins. Index is
+// then a table lookup and a comparison.
+//
+// It maps values to the same bins as a LogarithmicMapping of the same gamma
+// with no index offset, up to floating-point errors at the bin boundaries. As
+// the protobuf and the custom encodings do not have a representation of that
+// mapping, it is encoded as such a LogarithmicMapping, which is what decoding
+// it returns.
+type LookupTableMapping struct {
+	binsPerPowerOfTwo int
+	gamma             float64
+	tableShift        int                // the number of low significand bits that are not used to look up the table
+	table             []lookupTableEntry // indexed by the highest bits of significands
+	lowerBounds       []float64          // the lower bounds of the bins of [1, 2)
+	maxIndexableValue float64
+}
+
+// NewLookupTableMapping returns a LookupTableMapping whose relative accuracy
+// is the lowest one that is greater than or equal to relativeAccuracy. The
+// size of the table of the mapping grows as the relative accuracy decreases,
+// and relative accuracies that would require more than 2^16 entries are not
+// supported.
+func NewLookupTableMapping(relativeAccuracy float64) (*LookupTableMapping, error) {
+	if relativeAccuracy <= 0 || relativeAccuracy >= 1 {
+		return nil, errors.New("The relative accuracy must be between 0 and 1.")
+	}
+	gamma := (1 + relativeAccuracy) / (1 - relativeAccuracy)
+	return NewLookupTableMappingWithBinsPerPowerOfTwo(int(math.Ceil(1 / math.Log2(gamma))))
+}
+
+// NewLookupTableMappingWithBinsPerPowerOfTwo returns the LookupTableMapping
+// whose gamma is 2^(1/binsPerPowerOfTwo).
+func NewLookupTableMappingWithBinsPerPowerOfTwo(binsPerPowerOfTwo int) (*LookupTableMapping, error) {
+	if binsPerPowerOfTwo < 1 {
+		return nil, errors.New("The number of bins per power of two must be positive.")
+	}
+	gamma := math.Exp2(1 / float64(binsPerPowerOfTwo))
+	// The ranges of significands must be narrower than the narrowest bin,
+	// which is the lowest one.
+	tableBits := 0
+	for math.Ldexp(1, -tableBits) >= gamma-1 {
+		tableBits++
+		if tableBits > maxLookupTableBits {
+			return nil, errors.New("The relative accuracy is too low for the mapping table.")
+		}
+	}
+	m := &LookupTableMapping{
+		binsPerPowerOfTwo: binsPerPowerOfTwo,
+		gamma:             gamma,
+		tableShift:        exponentShift - tableBits,
+		table:             make([]lookupTableEntry, 1<<tableBits),
+		lowerBounds:       make([]float64, binsPerPowerOfTwo),
+	}
+	boundaries := make([]uint64, binsPerPowerOfTwo+1)
+	for i := range m.lowerBounds {
+		m.lowerBounds[i] = math.Exp2(float64(i) / float64(binsPerPowerOfTwo))
+		boundaries[i] = math.Float64bits(m.lowerBounds[i]) & significandMask
+	}
+	boundaries[binsPerPowerOfTwo] = 1 << exponentShift
+	index := 0
+	for i := range m.table {
+		rangeStart := uint64(i) << m.tableShift
+		for boundaries[index+1] <= rangeStart {
+			index++
+		}
+		m.table[i].index = index
+		m.table[i].boundary = boundaries[index+1]
+		if rangeEnd := uint64(i+1) << m.tableShift; m.table[i].boundary >= rangeEnd {
+			m.table[i].boundary = 1 << exponentShift
+		}
+	}
+	// So that Value does not overflow.
+	m.maxIndexableValue = math.MaxFloat64 / (1 + m.RelativeAccuracy())
+	return m, nil
+}
+
+// BinsPerPowerOfTwo returns the number of bins that each power of two is split
+// into.
+func (m *LookupTableMapping) BinsPerPowerOfTwo() int {
+	return m.binsPerPowerOfTwo
+}
+
+func (m *LookupTableMapping) Equals(other IndexMapping) bool {
+	o, ok := other.(*LookupTableMapping)
+	return ok && m.binsPerPowerOfTwo == o.binsPerPowerOfTwo
+}
+
+func (m *LookupTableMapping) Index(value float64) int {
+	bits := math.Float64bits(value)
+	significand := bits & significandMask
+	entry := &m.table[significand>>m.tableShift]
+	index := (int((bits&exponentMask)>>exponentShift)-exponentBias)*m.binsPerPowerOfTwo + entry.index
+	if significand >= entry.boundary {
+		index++
+	}
+	return index
+}
+
+func (m *LookupTableMapping) Value(index int) float64 {
+	return m.LowerBound(index) * (1 + m.RelativeAccuracy())
+}
+
+func (m *LookupTableMapping) Values(indexes []int, out []float64) {
+	factor := 1 + m.RelativeAccuracy()
+	for i, index := range indexes {
+		out[i] = m.LowerBound(index) * factor
+	}
+}
+
+func (m *LookupTableMapping) LowerBound(index int) float64 {
+	exponent := index / m.binsPerPowerOfTwo
+	binIndex := index % m.binsPerPowerOfTwo
+	if binIndex < 0 {
+		exponent--
+		binIndex += m.binsPerPowerOfTwo
+	}
+	return math.Ldexp(m.lowerBounds[binIndex], exponent)
+}
+
+func (m *LookupTableMapping) UpperBound(index int) float64 {
+	return m.LowerBound(index + 1)
+}
+
+func (m *LookupTableMapping) MinIndexableValue() float64 {
+	return minNormalFloat64
+}
+
+func (m *LookupTableMapping) MaxIndexableValue() float64 {
+	return m.maxIndexableValue
+}
+
+func (m *LookupTableMapping) RelativeAccuracy() float64 {
+	return 1 - 2/(1+m.gamma)
+}
+
+func (m *LookupTableMapping) Gamma() float64 {
+	return m.gamma
+}
+
+func (m *LookupTableMapping) IndexOffset() float64 {
+	return 0
+}
+
+// ToProto returns the protobuf representation of the LogarithmicMapping of
+// the same gamma.
+func (m *LookupTableMapping) ToProto() *sketchpb.IndexMapping {
+	return &sketchpb.IndexMapping{
+		Gamma:         m.gamma,
+		IndexOffset:   0,
+		Interpolation: sketchpb.IndexMapping_NONE,
+	}
+}
+
+// Encode encodes the LogarithmicMapping of the same gamma.
+func (m *LookupTableMapping) Encode(b *[]byte) {
+	enc.EncodeFlag(b, enc.FlagIndexMappingBaseLogarithmic)
+	enc.EncodeFloat64LE(b, m.gamma)
+	enc.EncodeFloat64LE(b, 0)
+}
+
+func (m *LookupTableMapping) string() string {
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("binsPerPowerOfTwo: %v, gamma: %v\n", m.binsPerPowerOfTwo, m.gamma))
+	return buffer.String()
+}
+
+var _ IndexMapping = (*LookupTableMapping)(nil)
@@ -0,0 +1,124 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+// Decoder decodes a mapping whose flag has already been read and updates the
+// provided []byte so that it starts immediately after the encoded mapping.
+type Decoder func(b *[]byte) (IndexMapping, error)
+
+// ProtoDecoder returns the mapping of the provided protobuf definition.
+type ProtoDecoder func(m *sketchpb.IndexMapping) (IndexMapping, error)
+
+var (
+	decodersMutex sync.RWMutex
+	decoders      = map[enc.Flag]Decoder{
+		enc.FlagIndexMappingBaseLogarithmic: logLikeDecoder(NewLogarithmicMappingWithGamma),
+		enc.FlagIndexMappingBaseLinear:      logLikeDecoder(NewLinearlyInterpolatedMappingWithGamma),
+		enc.FlagIndexMappingBaseCubic:       logLikeDecoder(NewCubicallyInterpolatedMappingWithGamma),
+		enc.FlagIndexMappingBitExponential:  logLikeDecoder(newBitExponentialMappingWithGamma),
+	}
+	protoDecoders = map[sketchpb.IndexMapping_Interpolation]ProtoDecoder{
+		sketchpb.IndexMapping_NONE:   logLikeProtoDecoder(NewLogarithmicMappingWithGamma),
+		sketchpb.IndexMapping_LINEAR: logLikeProtoDecoder(NewLinearlyInterpolatedMappingWithGamma),
+		sketchpb.IndexMapping_CUBIC:  logLikeProtoDecoder(NewCubicallyInterpolatedMappingWithGamma),
+		bitExponentialInterpolation:  logLikeProtoDecoder(newBitExponentialMappingWithGamma),
+	}
+)
+
+func logLikeDecoder[M IndexMapping](newMapping func(gamma, indexOffset float64) (M, error)) Decoder {
+	return func(b *[]byte) (IndexMapping, error) {
+		gamma, indexOffset, err := decodeLogLikeIndexMapping(b)
+		if err != nil {
+			return nil, err
+		}
+		return newMapping(gamma, indexOffset)
+	}
+}
+
+func logLikeProtoDecoder[M IndexMapping](newMapping func(gamma, indexOffset float64) (M, error)) ProtoDecoder {
+	return func(m *sketchpb.IndexMapping) (IndexMapping, error) {
+		return newMapping(m.Gamma, m.IndexOffset)
+	}
+}
+
+// RegisterDecoder registers the decoder that Decode uses to decode the
+// mappings that are encoded with the provided flag, which allows decoding
+// mappings that are defined outside of this package. The flag must be of type
+// enc.FlagTypeIndexMapping, and its subflag can be made with enc.NewSubFlag.
+// Return a non-nil error if the decoder is nil or if a decoder is already
+// registered for the flag.
+func RegisterDecoder(flag enc.Flag, decoder Decoder) error {
+	if flag.Type() != enc.FlagTypeIndexMapping {
+		return errors.New("not an index mapping flag")
+	}
+	if decoder == nil {
+		return errors.New("the decoder must not be nil")
+	}
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+	if _, ok := decoders[flag]; ok {
+		return errors.New("a decoder is already registered for the flag")
+	}
+	decoders[flag] = decoder
+	return nil
+}
+
+// RegisterProtoDecoder registers the decoder that FromProto uses to get the
+// mappings whose protobuf definitions have the provided interpolation, which
+// allows decoding mappings that are defined outside of this package. Return a
+// non-nil error if the decoder is nil or if a decoder is already registered for
+// the interpolation.
+func RegisterProtoDecoder(interpolation sketchpb.IndexMapping_Interpolation, decoder ProtoDecoder) error {
+	if decoder == nil {
+		return errors.New("the decoder must not be nil")
+	}
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+	if _, ok := protoDecoders[interpolation]; ok {
+		return fmt.Errorf("a decoder is already registered for interpolation %d", interpolation)
+	}
+	protoDecoders[interpolation] = decoder
+	return nil
+}
+
+// unregisterDecoder removes the decoder that is registered for the flag, so
+// that tests do not leave decoders registered.
+func unregisterDecoder(flag enc.Flag) {
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+	delete(decoders, flag)
+}
+
+// unregisterProtoDecoder removes the decoder that is registered for the
+// interpolation, so that tests do not leave decoders registered.
+func unregisterProtoDecoder(interpolation sketchpb.IndexMapping_Interpolation) {
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+	delete(protoDecoders, interpolation)
+}
+
+func decoderByFlag(flag enc.Flag) (Decoder, bool) {
+	decodersMutex.RLock()
+	defer decodersMutex.RUnlock()
+	decoder, ok := decoders[flag]
+	return decoder, ok
+}
+
+func protoDecoderByInterpolation(interpolation sketchpb.IndexMapping_Interpolation) (ProtoDecoder, bool) {
+	decodersMutex.RLock()
+	defer decodersMutex.RUnlock()
+	decoder, ok := protoDecoders[interpolation]
+	return decoder, ok
+}
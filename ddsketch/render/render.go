@@ -0,0 +1,237 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+// Package render draws the distributions that sketches encode as text bar
+// charts, for instance, to quickly inspect a serialized sketch from a terminal.
+package render
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/DataDog/sketches-go/ddsketch"
+	"github.com/DataDog/sketches-go/ddsketch/store"
+)
+
+const (
+	defaultWidth      = 60
+	defaultNumBuckets = 20
+)
+
+var (
+	// DefaultQuantiles are the quantiles that are marked on the chart if none
+	// are specified in Options.
+	DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+	// Eighths of a block, from the thinnest to the full block.
+	unicodeBlocks = []rune{'▏', '▎', '▍', '▌', '▋', '▊', '▉', '█'}
+)
+
+// Options configures how a sketch is rendered. The zero value is valid and
+// renders the chart with the default settings.
+type Options struct {
+	// Width is the number of characters of the longest bar. If not positive,
+	// 60 characters are used.
+	Width int
+	// NumBuckets is the approximate number of buckets that the chart is made
+	// of, not including the bucket of zero. Buckets are logarithmically
+	// spaced, so that each of them spans the same relative range of values.
+	// If not positive, 20 buckets are used.
+	NumBuckets int
+	// Quantiles are the quantiles whose values are marked next to the
+	// buckets they fall in. If nil, DefaultQuantiles are marked. If empty but
+	// non-nil, no quantile is marked.
+	Quantiles []float64
+	// ASCII makes the chart use '#' characters rather than Unicode blocks,
+	// which are rendered more accurately but are not supported by all
+	// terminals.
+	ASCII bool
+}
+
+// Render writes to w a bar chart of the distribution that the sketch encodes,
+// with one line per bucket, by increasing values. Each line shows the range of
+// values of the bucket, its count and a bar whose length is proportional to
+// the count. Counts of the bins of the sketch are distributed to the buckets
+// that they overlap (see ddsketch.DDSketch.ToHistogram).
+func Render(w io.Writer, sketch *ddsketch.DDSketch, options Options) error {
+	bw := bufio.NewWriter(w)
+	if sketch.IsEmpty() {
+		if _, err := bw.WriteString("(empty sketch)\n"); err != nil {
+			return err
+		}
+		return bw.Flush()
+	}
+	width := options.Width
+	if width <= 0 {
+		width = defaultWidth
+	}
+	numBuckets := options.NumBuckets
+	if numBuckets <= 0 {
+		numBuckets = defaultNumBuckets
+	}
+	quantiles := options.Quantiles
+	if quantiles == nil {
+		quantiles = DefaultQuantiles
+	}
+
+	boundaries := bucketBoundaries(sketch, numBuckets)
+	histogram := sketch.ToHistogram(boundaries)
+	markers := make([][]string, len(histogram))
+	for _, q := range quantiles {
+		value, err := sketch.GetValueAtQuantile(q)
+		if err != nil {
+			return err
+		}
+		i := bucketIndex(boundaries, value)
+		markers[i] = append(markers[i], "p"+strconv.FormatFloat(100*q, 'g', -1, 64))
+	}
+
+	// The first and the last buckets of the histogram are empty, as the
+	// boundaries span all the values of the sketch.
+	labels := make([]string, len(boundaries)-1)
+	counts := make([]string, len(boundaries)-1)
+	labelWidth, countWidth, maxCount := 0, 0, float64(0)
+	for i := range labels {
+		lower, upper := boundaries[i], boundaries[i+1]
+		if lower < 0 && upper > 0 {
+			labels[i] = "0"
+		} else {
+			labels[i] = fmt.Sprintf("[%.4g, %.4g)", lower, upper)
+		}
+		counts[i] = strconv.FormatFloat(histogram[i+1], 'g', 6, 64)
+		labelWidth = max(labelWidth, len(labels[i]))
+		countWidth = max(countWidth, len(counts[i]))
+		maxCount = math.Max(maxCount, histogram[i+1])
+	}
+	for i := range labels {
+		fmt.Fprintf(bw, "%*s %*s %s", labelWidth, labels[i], countWidth, counts[i], bar(histogram[i+1]/maxCount*float64(width), options.ASCII))
+		if len(markers[i+1]) > 0 {
+			fmt.Fprintf(bw, " %s", strings.Join(markers[i+1], " "))
+		}
+		if err := bw.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// bucketBoundaries returns increasing boundaries that delimit logarithmically
+// spaced buckets that span all the values of the sketch. If the sketch has
+// values of both signs or values in its zero bin, a bucket that contains zero
+// and no other values separates negative and positive buckets. The buckets are
+// split between the negative and positive values proportionally to the
+// logarithmic ranges that they span.
+func bucketBoundaries(sketch *ddsketch.DDSketch, numBuckets int) []float64 {
+	negativeLower, negativeUpper, hasNegative := storeRange(sketch, sketch.NegativeStore())
+	positiveLower, positiveUpper, hasPositive := storeRange(sketch, sketch.PositiveStore())
+	negativeSpan, positiveSpan := float64(0), float64(0)
+	if hasNegative {
+		negativeSpan = math.Log(negativeUpper / negativeLower)
+	}
+	if hasPositive {
+		positiveSpan = math.Log(positiveUpper / positiveLower)
+	}
+	numNegativeBuckets, numPositiveBuckets := 0, 0
+	if hasNegative && hasPositive {
+		numNegativeBuckets = int(math.Round(float64(numBuckets) * negativeSpan / (negativeSpan + positiveSpan)))
+		numNegativeBuckets = max(min(numNegativeBuckets, numBuckets-1), 1)
+		numPositiveBuckets = max(numBuckets-numNegativeBuckets, 1)
+	} else if hasNegative {
+		numNegativeBuckets = numBuckets
+	} else if hasPositive {
+		numPositiveBuckets = numBuckets
+	}
+
+	var boundaries []float64
+	if hasNegative {
+		negativeBoundaries := geometricBoundaries(negativeLower, negativeUpper, numNegativeBuckets)
+		for i := len(negativeBoundaries) - 1; i >= 0; i-- {
+			boundaries = append(boundaries, -negativeBoundaries[i])
+		}
+	}
+	if sketch.ZeroCount() > 0 {
+		// Values of the zero bin are counted as 0 by ToHistogram. If there
+		// are values of both signs, they fall in the bucket between them.
+		if !hasNegative {
+			boundaries = append(boundaries, -sketch.MinIndexableValue())
+		}
+		if !hasPositive {
+			boundaries = append(boundaries, sketch.MinIndexableValue())
+		}
+	}
+	if hasPositive {
+		boundaries = append(boundaries, geometricBoundaries(positiveLower, positiveUpper, numPositiveBuckets)...)
+	}
+	return boundaries
+}
+
+// geometricBoundaries returns the numBuckets+1 boundaries of buckets that
+// evenly split [lower, upper] on a logarithmic scale. The first and the last
+// boundaries are exactly lower and upper, so that no count is distributed
+// beyond them.
+func geometricBoundaries(lower, upper float64, numBuckets int) []float64 {
+	boundaries := make([]float64, numBuckets+1)
+	for i := range boundaries {
+		boundaries[i] = lower * math.Pow(upper/lower, float64(i)/float64(numBuckets))
+	}
+	boundaries[0] = lower
+	boundaries[numBuckets] = upper
+	return boundaries
+}
+
+// storeRange returns the lower bound of the lowest bin of the store and the
+// upper bound of its highest bin.
+func storeRange(sketch *ddsketch.DDSketch, s store.Store) (lower, upper float64, ok bool) {
+	minIndex, err := s.MinIndex()
+	if err != nil {
+		return 0, 0, false
+	}
+	maxIndex, err := s.MaxIndex()
+	if err != nil {
+		return 0, 0, false
+	}
+	return sketch.LowerBound(minIndex), sketch.UpperBound(maxIndex), true
+}
+
+// bucketIndex returns the index of the bucket of the histogram delimited by
+// boundaries that the value belongs to.
+func bucketIndex(boundaries []float64, value float64) int {
+	i := 0
+	for i < len(boundaries) && boundaries[i] <= value {
+		i++
+	}
+	return i
+}
+
+// bar returns a bar of the provided length, in characters.
+func bar(length float64, ascii bool) string {
+	if ascii {
+		return strings.Repeat("#", int(math.Round(length)))
+	}
+	eighths := int(math.Round(8 * length))
+	s := strings.Repeat(string(unicodeBlocks[7]), eighths/8)
+	if eighths%8 > 0 {
+		s += string(unicodeBlocks[eighths%8-1])
+	}
+	return s
+}
+
+func max(x, y int) int {
+	if x > y {
+		return x
+	}
+	return y
+}
+
+func min(x, y int) int {
+	if x < y {
+		return x
+	}
+	return y
+}
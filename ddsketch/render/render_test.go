@@ -0,0 +1,72 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package render
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/DataDog/sketches-go/ddsketch"
+	"github.com/stretchr/testify/assert"
+)
+
+func render(t *testing.T, sketch *ddsketch.DDSketch, options Options) []string {
+	var b bytes.Buffer
+	assert.NoError(t, Render(&b, sketch, options))
+	return strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+}
+
+func TestEmpty(t *testing.T) {
+	sketch, _ := ddsketch.NewDefaultDDSketch(0.01)
+	assert.Equal(t, []string{"(empty sketch)"}, render(t, sketch, Options{}))
+}
+
+func TestPositive(t *testing.T) {
+	sketch, _ := ddsketch.NewDefaultDDSketch(0.01)
+	for i := 1; i <= 1000; i++ {
+		assert.NoError(t, sketch.Add(float64(i)))
+	}
+	lines := render(t, sketch, Options{Width: 40, NumBuckets: 10, Quantiles: []float64{0.5, 0.999}, ASCII: true})
+	assert.Len(t, lines, 10)
+	assert.True(t, strings.HasPrefix(strings.TrimSpace(lines[0]), "[1, "))
+	// Buckets are logarithmically spaced, hence, the highest ones are the
+	// largest and the longest bar is the last one.
+	assert.Equal(t, 40, strings.Count(lines[9], "#"))
+	assert.Less(t, strings.Count(lines[0], "#"), strings.Count(lines[9], "#"))
+	assert.True(t, strings.HasSuffix(lines[9], " p99.9"))
+	assert.Equal(t, 1, strings.Count(strings.Join(lines, "\n"), "p50"))
+	for _, line := range lines {
+		assert.Equal(t, len(lines[0]) > 0, len(line) > 0)
+	}
+}
+
+func TestMixedSigns(t *testing.T) {
+	sketch, _ := ddsketch.NewDefaultDDSketch(0.01)
+	assert.NoError(t, sketch.AddWithCount(-100, 10))
+	assert.NoError(t, sketch.AddWithCount(0, 20))
+	assert.NoError(t, sketch.AddWithCount(100, 40))
+	lines := render(t, sketch, Options{Width: 8, NumBuckets: 2, Quantiles: []float64{}})
+	assert.Len(t, lines, 3)
+	assert.True(t, strings.HasPrefix(strings.TrimSpace(lines[0]), "[-101"))
+	assert.True(t, strings.HasSuffix(lines[0], " 10 ██"))
+	assert.True(t, strings.HasPrefix(strings.TrimSpace(lines[1]), "0 "))
+	assert.True(t, strings.HasSuffix(lines[1], " 20 ████"))
+	assert.True(t, strings.HasSuffix(lines[2], " 40 ████████"))
+}
+
+func TestZeroOnly(t *testing.T) {
+	sketch, _ := ddsketch.NewDefaultDDSketch(0.01)
+	assert.NoError(t, sketch.AddWithCount(0, 3))
+	assert.Equal(t, []string{"0 3 ████████████████████████████████████████████████████████████ p50 p90 p99"}, render(t, sketch, Options{}))
+}
+
+func TestBar(t *testing.T) {
+	assert.Equal(t, "", bar(0, false))
+	assert.Equal(t, "██▌", bar(2.5, false))
+	assert.Equal(t, "▏", bar(0.1, false))
+	assert.Equal(t, "###", bar(2.5, true))
+}
@@ -13,27 +13,35 @@ import (
 // SummaryStatistics keeps track of the count, the sum, the min and the max of
 // recorded values. We use a compensated sum to avoid accumulating rounding
 // errors (see https://en.wikipedia.org/wiki/Kahan_summation_algorithm).
+// It also keeps track of the sum of the squared deviations from the mean, which
+// is updated using the algorithm of Welford and its parallel variant by Chan et
+// al. so that the variance can be computed accurately and merged (see
+// https://en.wikipedia.org/wiki/Algorithms_for_calculating_variance).
 type SummaryStatistics struct {
-	count           float64
-	sum             float64
-	sumCompensation float64
-	simpleSum       float64
-	min             float64
-	max             float64
+	count                  float64
+	sum                    float64
+	sumCompensation        float64
+	simpleSum              float64
+	sumOfSquaredDeviations float64
+	min                    float64
+	max                    float64
 }
 
 func NewSummaryStatistics() *SummaryStatistics {
 	return &SummaryStatistics{
-		count:           0,
-		sum:             0,
-		sumCompensation: 0,
-		simpleSum:       0,
-		min:             math.Inf(1),
-		max:             math.Inf(-1),
+		count:                  0,
+		sum:                    0,
+		sumCompensation:        0,
+		simpleSum:              0,
+		sumOfSquaredDeviations: 0,
+		min:                    math.Inf(1),
+		max:                    math.Inf(-1),
 	}
 }
 
 // NewSummaryStatisticsFromData constructs SummaryStatistics from the provided data.
+// The sum of the squared deviations from the mean is unknown and set to zero;
+// it can be set with AddToSumOfSquaredDeviations.
 func NewSummaryStatisticsFromData(count, sum, min, max float64) (*SummaryStatistics, error) {
 	if !(count >= 0) {
 		return nil, fmt.Errorf("count (%g) must be positive or zero", count)
@@ -45,12 +53,13 @@ func NewSummaryStatisticsFromData(count, sum, min, max float64) (*SummaryStatist
 		return nil, fmt.Errorf("empty summary statistics must have min (%g) and max (%g) equal to positive and negative infinities respectively", min, max)
 	}
 	return &SummaryStatistics{
-		count:           count,
-		sum:             sum,
-		sumCompensation: 0,
-		simpleSum:       sum,
-		min:             min,
-		max:             max,
+		count:                  count,
+		sum:                    sum,
+		sumCompensation:        0,
+		simpleSum:              sum,
+		sumOfSquaredDeviations: 0,
+		min:                    min,
+		max:                    max,
 	}, nil
 }
 
@@ -70,6 +79,21 @@ func (s *SummaryStatistics) Sum() float64 {
 	}
 }
 
+// SumOfSquaredDeviations returns the sum of the squared deviations of the
+// recorded values from their mean.
+func (s *SummaryStatistics) SumOfSquaredDeviations() float64 {
+	return s.sumOfSquaredDeviations
+}
+
+// Variance returns the population variance of the recorded values, or NaN if
+// no values have been recorded.
+func (s *SummaryStatistics) Variance() float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+	return s.sumOfSquaredDeviations / s.count
+}
+
 func (s *SummaryStatistics) Min() float64 {
 	return s.min
 }
@@ -79,6 +103,7 @@ func (s *SummaryStatistics) Max() float64 {
 }
 
 func (s *SummaryStatistics) Add(value, count float64) {
+	s.addToSumOfSquaredDeviations(value, count, 0)
 	s.AddToCount(count)
 	s.AddToSum(value * count)
 	if value < s.min {
@@ -89,6 +114,27 @@ func (s *SummaryStatistics) Add(value, count float64) {
 	}
 }
 
+// Remove adjusts the statistics as if values equal to value had been added
+// with a count lower by count. The minimum and the maximum cannot be recovered
+// and are kept as bounds of the remaining values. If count is not lower than
+// the count of the statistics, they are cleared.
+func (s *SummaryStatistics) Remove(value, count float64) {
+	if count == 0 {
+		return
+	}
+	newCount := s.count - count
+	if !(newCount > 0) {
+		s.Clear()
+		return
+	}
+	// Reverse the update of the sum of squared deviations (see
+	// addToSumOfSquaredDeviations).
+	delta := value - (s.Sum()-value*count)/newCount
+	s.sumOfSquaredDeviations = math.Max(0, s.sumOfSquaredDeviations-delta*delta*newCount*count/s.count)
+	s.AddToCount(-count)
+	s.AddToSum(-value * count)
+}
+
 func (s *SummaryStatistics) AddToCount(addend float64) {
 	s.count += addend
 }
@@ -98,7 +144,18 @@ func (s *SummaryStatistics) AddToSum(addend float64) {
 	s.simpleSum += addend
 }
 
+// AddToSumOfSquaredDeviations adds addend to the sum of the squared
+// deviations from the mean, regardless of the count and the sum.
+func (s *SummaryStatistics) AddToSumOfSquaredDeviations(addend float64) {
+	s.sumOfSquaredDeviations += addend
+}
+
 func (s *SummaryStatistics) MergeWith(o *SummaryStatistics) {
+	if o.count != 0 {
+		s.addToSumOfSquaredDeviations(o.Sum()/o.count, o.count, o.sumOfSquaredDeviations)
+	} else {
+		s.sumOfSquaredDeviations += o.sumOfSquaredDeviations
+	}
 	s.count += o.count
 	s.sumWithCompensation(o.sum)
 	s.sumWithCompensation(o.sumCompensation)
@@ -111,6 +168,20 @@ func (s *SummaryStatistics) MergeWith(o *SummaryStatistics) {
 	}
 }
 
+// addToSumOfSquaredDeviations updates the sum of the squared deviations from
+// the mean as if values whose count is count, whose mean is mean, and whose sum
+// of squared deviations is sumOfSquaredDeviations were added. It must be
+// called before the count and the sum are updated.
+func (s *SummaryStatistics) addToSumOfSquaredDeviations(mean, count, sumOfSquaredDeviations float64) {
+	s.sumOfSquaredDeviations += sumOfSquaredDeviations
+	newCount := s.count + count
+	if s.count == 0 || count == 0 || newCount == 0 {
+		return
+	}
+	delta := mean - s.Sum()/s.count
+	s.sumOfSquaredDeviations += delta * delta * s.count * count / newCount
+}
+
 func (s *SummaryStatistics) sumWithCompensation(value float64) {
 	tmp := value - s.sumCompensation
 	velvel := s.sum + tmp // little wolf of rounding error
@@ -125,6 +196,7 @@ func (s *SummaryStatistics) Reweight(factor float64) {
 	s.sum *= factor
 	s.sumCompensation *= factor
 	s.simpleSum *= factor
+	s.sumOfSquaredDeviations *= factor
 	if factor == 0 {
 		s.min = math.Inf(1)
 		s.max = math.Inf(-1)
@@ -137,6 +209,7 @@ func (s *SummaryStatistics) Rescale(factor float64) {
 	s.sum *= factor
 	s.sumCompensation *= factor
 	s.simpleSum *= factor
+	s.sumOfSquaredDeviations *= factor * factor
 	if factor > 0 {
 		s.min *= factor
 		s.max *= factor
@@ -155,17 +228,19 @@ func (s *SummaryStatistics) Clear() {
 	s.sum = 0
 	s.sumCompensation = 0
 	s.simpleSum = 0
+	s.sumOfSquaredDeviations = 0
 	s.min = math.Inf(1)
 	s.max = math.Inf(-1)
 }
 
 func (s *SummaryStatistics) Copy() *SummaryStatistics {
 	return &SummaryStatistics{
-		count:           s.count,
-		sum:             s.sum,
-		sumCompensation: s.sumCompensation,
-		simpleSum:       s.simpleSum,
-		min:             s.min,
-		max:             s.max,
+		count:                  s.count,
+		sum:                    s.sum,
+		sumCompensation:        s.sumCompensation,
+		simpleSum:              s.simpleSum,
+		sumOfSquaredDeviations: s.sumOfSquaredDeviations,
+		min:                    s.min,
+		max:                    s.max,
 	}
 }
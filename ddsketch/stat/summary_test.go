@@ -65,6 +65,31 @@ func TestAddWithCount(t *testing.T) {
 	assert.Equal(t, 1.0, s.Max(), "max")
 }
 
+func TestRemove(t *testing.T) {
+	s := NewSummaryStatistics()
+	s.Add(1, 2)
+	s.Add(-2, 3)
+	s.Add(5, 1)
+	s.Remove(5, 0)
+	s.Remove(5, 1)
+	s2 := NewSummaryStatistics()
+	s2.Add(1, 2)
+	s2.Add(-2, 3)
+	assert.Equal(t, s2.Count(), s.Count(), "count")
+	assert.InDelta(t, s2.Sum(), s.Sum(), 1e-12, "sum")
+	assert.InDelta(t, s2.SumOfSquaredDeviations(), s.SumOfSquaredDeviations(), 1e-12, "sum of squared deviations")
+	assert.Equal(t, -2.0, s.Min(), "min")
+	assert.Equal(t, 5.0, s.Max(), "max")
+
+	s.Remove(-2, 3)
+	assert.Equal(t, 2.0, s.Count(), "count")
+	assert.InDelta(t, 2.0, s.Sum(), 1e-12, "sum")
+	assert.InDelta(t, 0.0, s.SumOfSquaredDeviations(), 1e-12, "sum of squared deviations")
+
+	s.Remove(1, 3)
+	assertEmpty(t, s)
+}
+
 func TestMergeWith(t *testing.T) {
 	s1 := NewSummaryStatistics()
 	s2 := NewSummaryStatistics()
@@ -161,11 +186,61 @@ func TestRescale(t *testing.T) {
 	assertEqual(t, s, s4)
 }
 
+func TestVariance(t *testing.T) {
+	values := []float64{-3.5, 0, 1, 1, 2.25, 10, 1e3}
+	counts := []float64{1, 2, 0.5, 1, 3, 1, 0.25}
+	expected := func(values, counts []float64) float64 {
+		count, sum := 0.0, 0.0
+		for i, value := range values {
+			count += counts[i]
+			sum += value * counts[i]
+		}
+		mean := sum / count
+		sumOfSquaredDeviations := 0.0
+		for i, value := range values {
+			sumOfSquaredDeviations += counts[i] * (value - mean) * (value - mean)
+		}
+		return sumOfSquaredDeviations / count
+	}
+
+	s := NewSummaryStatistics()
+	assert.True(t, math.IsNaN(s.Variance()))
+	s1 := NewSummaryStatistics()
+	s2 := NewSummaryStatistics()
+	for i, value := range values {
+		s.Add(value, counts[i])
+		if i%2 == 0 {
+			s1.Add(value, counts[i])
+		} else {
+			s2.Add(value, counts[i])
+		}
+	}
+	assert.InEpsilon(t, expected(values, counts), s.Variance(), 1e-12)
+	s1.MergeWith(s2)
+	assert.InEpsilon(t, expected(values, counts), s1.Variance(), 1e-12)
+	assert.InEpsilon(t, s.SumOfSquaredDeviations(), s.Copy().SumOfSquaredDeviations(), 1e-12)
+
+	s.Reweight(2.5)
+	assert.InEpsilon(t, expected(values, counts), s.Variance(), 1e-12)
+	s.Rescale(-3)
+	scaledValues := make([]float64, len(values))
+	for i, value := range values {
+		scaledValues[i] = -3 * value
+	}
+	assert.InEpsilon(t, expected(scaledValues, counts), s.Variance(), 1e-12)
+
+	constant := NewSummaryStatistics()
+	constant.Add(5, 3)
+	constant.Add(5, 2)
+	assert.Equal(t, 0.0, constant.Variance())
+}
+
 func assertEmpty(t *testing.T, s *SummaryStatistics) {
 	assert.Equal(t, 0.0, s.Count(), "count")
 	assert.Equal(t, 0.0, s.Sum(), "sum")
 	assert.Equal(t, math.Inf(1), s.Min(), "min")
 	assert.Equal(t, math.Inf(-1), s.Max(), "max")
+	assert.Equal(t, 0.0, s.SumOfSquaredDeviations(), "sum of squared deviations")
 }
 
 func assertEqual(t *testing.T, s1 *SummaryStatistics, s2 *SummaryStatistics) {
@@ -0,0 +1,246 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import (
+	"unsafe"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+// MemoryAccountant is notified of the changes of the memory size of the
+// stores that are wrapped in an AccountedStore, so that host applications can
+// integrate it in their own memory accounting. It is called synchronously by
+// the methods of the store, and must therefore be fast, and safe for
+// concurrent use if it is shared by stores that are used concurrently.
+type MemoryAccountant interface {
+	// OnAlloc is called with the number of bytes by which the memory size of a
+	// store has grown.
+	OnAlloc(bytes int)
+	// OnFree is called with the number of bytes by which the memory size of a
+	// store has shrunk.
+	OnFree(bytes int)
+}
+
+// AccountedStore wraps a store and reports the changes of the memory size of
+// the wrapped store, as reported by its MemorySize method, to a
+// MemoryAccountant. The accountant is notified of the initial memory size of
+// the wrapped store when the AccountedStore is created. As a store cannot know
+// when it is no longer used, Release must be called to notify the accountant
+// that its memory is freed.
+//
+// The memory size is computed after every modification of the store, except
+// for the additions that the dense and unbuffered paginated stores of this
+// package can tell do not change it, such as additions to the range of bins
+// that a dense store has allocated. Other modifications are therefore slower,
+// especially for stores whose MemorySize method does not run in constant time.
+type AccountedStore struct {
+	inner      Store
+	accountant MemoryAccountant
+	memorySize int // the memory size of inner that has been reported to accountant
+}
+
+// NewAccountedStore returns an AccountedStore that wraps inner and reports the
+// changes of its memory size to accountant.
+func NewAccountedStore(inner Store, accountant MemoryAccountant) *AccountedStore {
+	s := &AccountedStore{inner: inner, accountant: accountant}
+	s.account()
+	return s
+}
+
+// account notifies the accountant of the change of the memory size of the
+// wrapped store since the last call.
+func (s *AccountedStore) account() {
+	memorySize := s.inner.MemorySize()
+	if memorySize > s.memorySize {
+		s.accountant.OnAlloc(memorySize - s.memorySize)
+	} else if memorySize < s.memorySize {
+		s.accountant.OnFree(s.memorySize - memorySize)
+	}
+	s.memorySize = memorySize
+}
+
+// Release notifies the accountant that the memory of the wrapped store is
+// freed. The store must not be used afterwards.
+func (s *AccountedStore) Release() {
+	if s.memorySize > 0 {
+		s.accountant.OnFree(s.memorySize)
+	}
+	s.memorySize = 0
+}
+
+// changesMemorySize returns whether adding a count at the provided index may
+// change the memory size of the wrapped store.
+func (s *AccountedStore) changesMemorySize(index int) bool {
+	p, ok := s.inner.(memoryProjector)
+	if !ok {
+		return true
+	}
+	increase, undoable := p.memorySizeIncrease(index)
+	return increase != 0 || !undoable
+}
+
+func (s *AccountedStore) Add(index int) {
+	changesMemorySize := s.changesMemorySize(index)
+	s.inner.Add(index)
+	if changesMemorySize {
+		s.account()
+	}
+}
+
+func (s *AccountedStore) AddBin(bin Bin) {
+	s.AddWithCount(bin.index, bin.count)
+}
+
+func (s *AccountedStore) AddBins(bins []Bin) {
+	s.inner.AddBins(bins)
+	s.account()
+}
+
+func (s *AccountedStore) AddWithCount(index int, count float64) {
+	changesMemorySize := s.changesMemorySize(index)
+	s.inner.AddWithCount(index, count)
+	if changesMemorySize {
+		s.account()
+	}
+}
+
+func (s *AccountedStore) SubtractWithCount(index int, count float64) {
+	s.inner.SubtractWithCount(index, count)
+	s.account()
+}
+
+func (s *AccountedStore) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
+}
+
+func (s *AccountedStore) Bins() <-chan Bin {
+	return s.inner.Bins()
+}
+
+func (s *AccountedStore) ForEach(f func(index int, count float64) (stop bool)) {
+	s.inner.ForEach(f)
+}
+
+func (s *AccountedStore) ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool)) {
+	s.inner.ForEachInRange(minIndex, maxIndex, f)
+}
+
+// Copy returns a copy of the store whose memory is reported to the same
+// accountant.
+func (s *AccountedStore) Copy() Store {
+	return NewAccountedStore(s.inner.Copy(), s.accountant)
+}
+
+func (s *AccountedStore) newEmpty() Store {
+	return NewAccountedStore(newEmptyLike(s.inner), s.accountant)
+}
+
+func (s *AccountedStore) Downsample(factorLog2 int) Store {
+	return NewAccountedStore(s.inner.Downsample(factorLog2), s.accountant)
+}
+
+func (s *AccountedStore) Trim(minIndex, maxIndex int) {
+	s.inner.Trim(minIndex, maxIndex)
+	s.account()
+}
+
+func (s *AccountedStore) CopyTo(dst Store) {
+	if s == dst {
+		return
+	}
+	if d, ok := dst.(*AccountedStore); ok {
+		s.inner.CopyTo(d.inner)
+		d.account()
+		return
+	}
+	s.inner.CopyTo(dst)
+}
+
+func (s *AccountedStore) Clear() {
+	s.inner.Clear()
+	s.account()
+}
+
+func (s *AccountedStore) ClearRetainingCapacity() {
+	s.inner.ClearRetainingCapacity()
+	s.account()
+}
+
+func (s *AccountedStore) IsEmpty() bool {
+	return s.inner.IsEmpty()
+}
+
+func (s *AccountedStore) MaxIndex() (int, error) {
+	return s.inner.MaxIndex()
+}
+
+func (s *AccountedStore) MinIndex() (int, error) {
+	return s.inner.MinIndex()
+}
+
+func (s *AccountedStore) MaxCountBin() (Bin, error) {
+	return s.inner.MaxCountBin()
+}
+
+func (s *AccountedStore) TotalCount() float64 {
+	return s.inner.TotalCount()
+}
+
+func (s *AccountedStore) GetCountAtIndex(index int) float64 {
+	return s.inner.GetCountAtIndex(index)
+}
+
+// MemorySize returns the memory size of the wrapped store, which is what is
+// reported to the accountant, plus the small constant size of the wrapper.
+func (s *AccountedStore) MemorySize() int {
+	return int(unsafe.Sizeof(*s)) + s.inner.MemorySize()
+}
+
+func (s *AccountedStore) KeyAtRank(rank float64) int {
+	return s.inner.KeyAtRank(rank)
+}
+
+func (s *AccountedStore) MergeWith(other Store) {
+	if o, ok := other.(*AccountedStore); ok {
+		other = o.inner
+	}
+	s.inner.MergeWith(other)
+	s.account()
+}
+
+func (s *AccountedStore) ToProto() *sketchpb.Store {
+	return s.inner.ToProto()
+}
+
+func (s *AccountedStore) ToColumns() ([]int32, []float64) {
+	return s.inner.ToColumns()
+}
+
+func (s *AccountedStore) Stats() Stats {
+	st := s.inner.Stats()
+	st.MemorySize = s.MemorySize()
+	return st
+}
+
+func (s *AccountedStore) Reweight(w float64) error {
+	err := s.inner.Reweight(w)
+	s.account()
+	return err
+}
+
+func (s *AccountedStore) Encode(b *[]byte, t enc.FlagType) {
+	s.inner.Encode(b, t)
+}
+
+func (s *AccountedStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.SubFlag) error {
+	err := s.inner.DecodeAndMergeWith(b, encodingMode)
+	s.account()
+	return err
+}
+
+var _ Store = (*AccountedStore)(nil)
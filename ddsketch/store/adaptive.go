@@ -0,0 +1,273 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import (
+	"unsafe"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+const (
+	defaultAdaptiveDensityThreshold = 0.25
+	// The density of the bins is first checked once the store holds that many
+	// bins, then every time their number doubles.
+	adaptiveMinNumBinsToCheck = 16
+)
+
+// AdaptiveStore is a store that starts as a SparseStore, which is compact when
+// it holds only few bins, and that converts itself to a denser store (e.g., a
+// DenseStore or a BufferedPaginatedStore) once the density of its bins, that
+// is, their number divided by the width of the range of their indexes, reaches
+// a threshold. Clearing the store makes it sparse again. The conversion is
+// transparent: it does not change the bins of the store.
+type AdaptiveStore struct {
+	store            Store
+	sparse           *SparseStore // == store while the store is sparse, nil otherwise
+	denseProvider    Provider
+	densityThreshold float64
+	nextCheckNumBins int
+}
+
+// NewAdaptiveStore returns an AdaptiveStore that converts itself to a
+// DenseStore once a quarter of the indexes within the range of its bins are
+// used.
+func NewAdaptiveStore() *AdaptiveStore {
+	return NewAdaptiveStoreWithThreshold(DenseStoreConstructor, defaultAdaptiveDensityThreshold)
+}
+
+// NewAdaptiveStoreWithThreshold returns an AdaptiveStore that converts itself
+// to a store provided by denseProvider once the density of its bins reaches
+// densityThreshold.
+func NewAdaptiveStoreWithThreshold(denseProvider Provider, densityThreshold float64) *AdaptiveStore {
+	sparse := NewSparseStore()
+	return &AdaptiveStore{
+		store:            sparse,
+		sparse:           sparse,
+		denseProvider:    denseProvider,
+		densityThreshold: densityThreshold,
+		nextCheckNumBins: adaptiveMinNumBinsToCheck,
+	}
+}
+
+// IsSparse returns whether the bins of the store are currently held in a
+// SparseStore.
+func (s *AdaptiveStore) IsSparse() bool {
+	return s.sparse != nil
+}
+
+// adapt converts the store if it is sparse and its bins are dense enough. As
+// computing the density requires going through the bins, it is only done
+// every time the number of bins doubles.
+func (s *AdaptiveStore) adapt() {
+	if s.sparse == nil || len(s.sparse.counts) < s.nextCheckNumBins {
+		return
+	}
+	numBins := len(s.sparse.counts)
+	s.nextCheckNumBins = 2 * numBins
+	minIndex, maxIndex := maxInt, minInt
+	for index := range s.sparse.counts {
+		minIndex = min(minIndex, index)
+		maxIndex = max(maxIndex, index)
+	}
+	if float64(numBins) < s.densityThreshold*(float64(maxIndex)-float64(minIndex)+1) {
+		return
+	}
+	dense := s.denseProvider()
+	dense.MergeWith(s.sparse)
+	s.store = dense
+	s.sparse = nil
+}
+
+func (s *AdaptiveStore) Add(index int) {
+	s.store.Add(index)
+	s.adapt()
+}
+
+func (s *AdaptiveStore) AddBin(bin Bin) {
+	s.store.AddBin(bin)
+	s.adapt()
+}
+
+func (s *AdaptiveStore) AddBins(bins []Bin) {
+	s.store.AddBins(bins)
+	s.adapt()
+}
+
+func (s *AdaptiveStore) AddWithCount(index int, count float64) {
+	s.store.AddWithCount(index, count)
+	s.adapt()
+}
+
+func (s *AdaptiveStore) SubtractWithCount(index int, count float64) {
+	s.store.SubtractWithCount(index, count)
+}
+
+func (s *AdaptiveStore) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
+}
+
+func (s *AdaptiveStore) Bins() <-chan Bin {
+	return s.store.Bins()
+}
+
+func (s *AdaptiveStore) ForEach(f func(index int, count float64) (stop bool)) {
+	s.store.ForEach(f)
+}
+
+func (s *AdaptiveStore) ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool)) {
+	s.store.ForEachInRange(minIndex, maxIndex, f)
+}
+
+func (s *AdaptiveStore) Copy() Store {
+	c := *s
+	c.store = s.store.Copy()
+	if s.sparse != nil {
+		c.sparse = c.store.(*SparseStore)
+	}
+	return &c
+}
+
+func (s *AdaptiveStore) newEmpty() Store {
+	return NewAdaptiveStoreWithThreshold(s.denseProvider, s.densityThreshold)
+}
+
+func (s *AdaptiveStore) Downsample(factorLog2 int) Store {
+	return downsample(s, factorLog2, NewAdaptiveStoreWithThreshold(s.denseProvider, s.densityThreshold))
+}
+
+func (s *AdaptiveStore) Trim(minIndex, maxIndex int) {
+	s.store.Trim(minIndex, maxIndex)
+}
+
+func (s *AdaptiveStore) CopyTo(dst Store) {
+	d, ok := dst.(*AdaptiveStore)
+	if !ok {
+		copyTo(s, dst)
+		return
+	}
+	if s == d {
+		return
+	}
+	if (s.sparse == nil) == (d.sparse == nil) && !(s.sparse == nil && !sameType(s.store, d.store)) {
+		s.store.CopyTo(d.store)
+	} else {
+		d.store = s.store.Copy()
+	}
+	d.sparse = nil
+	if s.sparse != nil {
+		d.sparse = d.store.(*SparseStore)
+	}
+	d.denseProvider = s.denseProvider
+	d.densityThreshold = s.densityThreshold
+	d.nextCheckNumBins = s.nextCheckNumBins
+}
+
+// sameType returns whether s1 and s2 have the same dynamic type.
+func sameType(s1, s2 Store) bool {
+	switch s1.(type) {
+	case *DenseStore:
+		_, ok := s2.(*DenseStore)
+		return ok
+	case *BufferedPaginatedStore:
+		_, ok := s2.(*BufferedPaginatedStore)
+		return ok
+	case *UnbufferedPaginatedStore:
+		_, ok := s2.(*UnbufferedPaginatedStore)
+		return ok
+	default:
+		return false
+	}
+}
+
+// Clear empties the store and makes it sparse again.
+func (s *AdaptiveStore) Clear() {
+	if s.sparse == nil {
+		s.sparse = NewSparseStore()
+		s.store = s.sparse
+	} else {
+		s.sparse.Clear()
+	}
+	s.nextCheckNumBins = adaptiveMinNumBinsToCheck
+}
+
+// ClearRetainingCapacity empties the store while keeping its current
+// representation, so that it does not need to be converted again if it is
+// refilled with similarly distributed data.
+func (s *AdaptiveStore) ClearRetainingCapacity() {
+	s.store.ClearRetainingCapacity()
+}
+
+func (s *AdaptiveStore) IsEmpty() bool {
+	return s.store.IsEmpty()
+}
+
+func (s *AdaptiveStore) MaxIndex() (int, error) {
+	return s.store.MaxIndex()
+}
+
+func (s *AdaptiveStore) MinIndex() (int, error) {
+	return s.store.MinIndex()
+}
+
+func (s *AdaptiveStore) MaxCountBin() (Bin, error) {
+	return s.store.MaxCountBin()
+}
+
+func (s *AdaptiveStore) TotalCount() float64 {
+	return s.store.TotalCount()
+}
+
+func (s *AdaptiveStore) GetCountAtIndex(index int) float64 {
+	return s.store.GetCountAtIndex(index)
+}
+
+func (s *AdaptiveStore) MemorySize() int {
+	return int(unsafe.Sizeof(*s)) + s.store.MemorySize()
+}
+
+func (s *AdaptiveStore) KeyAtRank(rank float64) int {
+	return s.store.KeyAtRank(rank)
+}
+
+func (s *AdaptiveStore) MergeWith(other Store) {
+	if o, ok := other.(*AdaptiveStore); ok {
+		other = o.store
+	}
+	s.store.MergeWith(other)
+	s.adapt()
+}
+
+func (s *AdaptiveStore) ToProto() *sketchpb.Store {
+	return s.store.ToProto()
+}
+
+func (s *AdaptiveStore) ToColumns() ([]int32, []float64) {
+	return s.store.ToColumns()
+}
+
+func (s *AdaptiveStore) Stats() Stats {
+	st := s.store.Stats()
+	st.MemorySize = s.MemorySize()
+	return st
+}
+
+func (s *AdaptiveStore) Reweight(w float64) error {
+	return s.store.Reweight(w)
+}
+
+func (s *AdaptiveStore) Encode(b *[]byte, t enc.FlagType) {
+	s.store.Encode(b, t)
+}
+
+func (s *AdaptiveStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.SubFlag) error {
+	err := s.store.DecodeAndMergeWith(b, encodingMode)
+	s.adapt()
+	return err
+}
+
+var _ Store = (*AdaptiveStore)(nil)
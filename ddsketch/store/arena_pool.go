@@ -0,0 +1,282 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// ArenaPool hands out to BufferedPaginatedStores pages that live in a
+// caller-provided byte arena, for instance, memory that has been mapped with
+// syscall.Mmap, possibly from a file. Such memory is not managed by the Go
+// garbage collector, so that the pages of many mostly idle stores do not add
+// to its work. Only the pages live in the arena: the rest of the stores,
+// including their references to their pages, are still allocated on the heap.
+//
+// Once the arena is exhausted, stores are denied the pages that they do not
+// strictly need, as with PoolPolicyDeny, and the pages that they need are
+// allocated on the heap. The pages that stores release are kept for reuse if
+// they belong to the arena, and left to the garbage collector otherwise.
+// The arena must outlive the stores that use the pool. ArenaPool is not safe
+// for concurrent use.
+//
+// Stores can be persisted in the arena and restored from it, possibly by
+// another process that maps the same file, without being serialized: Persist
+// moves the content of a store to its pages and records in the arena, next to
+// the pages, which store and which page index each page belongs to, and
+// Restore builds a store that uses those pages again. The arena starts with a
+// header, then the page directory, then the pages, so that a bit less of it
+// than its size holds pages.
+type ArenaPool struct {
+	pageLenLog2 int
+	// directory holds, for each page of the arena, the key of the store that
+	// it has been persisted for (zero if none) and its page index. Pages that
+	// have been persisted are not handed out until they are released.
+	directory []uint64
+	arena     []float64   // the pages, which follow the header and the directory in the 8-byte aligned part of the arena
+	next      int         // the position in arena of the first page that has never been allocated
+	free      [][]float64 // zeroed arena pages kept for reuse
+	numUsed   int         // number of pages held by stores
+	numOnHeap int         // number of pages held by stores that have been allocated on the heap
+}
+
+const (
+	// arenaMagic is the first word of the header of an arena, followed by the
+	// page size, as a number of counts.
+	arenaMagic           uint64 = 0x6464736b65746368
+	arenaHeaderLen              = 2
+	arenaDirectoryStride        = 2
+)
+
+// NewArenaPool returns a pool of pages of 2^pageLenLog2 counts (pageLenLog2
+// being capped at 16) that live in arena. The content of arena does not
+// matter, as the pool overwrites its header and its directory, and as pages
+// are zeroed when first allocated.
+func NewArenaPool(arena []byte, pageLenLog2 uint8) *ArenaPool {
+	p := newArenaPool(arena, pageLenLog2)
+	if p.directory != nil {
+		p.directory[0] = arenaMagic
+		p.directory[1] = uint64(p.pageLen())
+		p.directory = p.directory[arenaHeaderLen:]
+		for i := range p.directory {
+			p.directory[i] = 0
+		}
+	}
+	return p
+}
+
+// OpenArenaPool returns a pool of pages of 2^pageLenLog2 counts (pageLenLog2
+// being capped at 16) that live in arena, which has been used by a pool with
+// the same page size, for instance, in a previous run of the process. The
+// pages that have been persisted in the arena can be restored with Restore,
+// and are otherwise kept until Reset is called. Return a non-nil error if the
+// arena has not been initialized by NewArenaPool with the same page size.
+func OpenArenaPool(arena []byte, pageLenLog2 uint8) (*ArenaPool, error) {
+	p := newArenaPool(arena, pageLenLog2)
+	if p.directory == nil {
+		return nil, errors.New("the arena is too small to hold any page")
+	}
+	if p.directory[0] != arenaMagic {
+		return nil, errors.New("the arena has not been initialized by an ArenaPool")
+	}
+	if p.directory[1] != uint64(p.pageLen()) {
+		return nil, fmt.Errorf("the arena holds pages of %d counts, not %d", p.directory[1], p.pageLen())
+	}
+	p.directory = p.directory[arenaHeaderLen:]
+	return p, nil
+}
+
+func newArenaPool(arena []byte, pageLenLog2 uint8) *ArenaPool {
+	if pageLenLog2 > maxPageLenLog2 {
+		pageLenLog2 = maxPageLenLog2
+	}
+	p := &ArenaPool{pageLenLog2: int(pageLenLog2)}
+	offset := 0
+	for offset < len(arena) && uintptr(unsafe.Pointer(&arena[offset]))%unsafe.Alignof(float64(0)) != 0 {
+		offset++
+	}
+	numWords := (len(arena) - offset) / int(unsafe.Sizeof(float64(0)))
+	numPages := (numWords - arenaHeaderLen) / (p.pageLen() + arenaDirectoryStride)
+	if numPages <= 0 {
+		return p
+	}
+	directoryLen := arenaHeaderLen + numPages*arenaDirectoryStride
+	p.directory = unsafe.Slice((*uint64)(unsafe.Pointer(&arena[offset])), directoryLen)
+	p.arena = unsafe.Slice((*float64)(unsafe.Pointer(&arena[offset+directoryLen*8])), numPages*p.pageLen())
+	return p
+}
+
+func (p *ArenaPool) pageLen() int {
+	return 1 << p.pageLenLog2
+}
+
+func (p *ArenaPool) pageBytes() int {
+	return p.pageLen() * countSize / 8
+}
+
+// ArenaBytes returns the number of bytes of the arena that can hold pages.
+func (p *ArenaPool) ArenaBytes() int {
+	return len(p.arena) / p.pageLen() * p.pageBytes()
+}
+
+// UsedBytes returns the memory size of the pages that are held by stores,
+// including the ones that have been allocated on the heap.
+func (p *ArenaPool) UsedBytes() int {
+	return p.numUsed * p.pageBytes()
+}
+
+// HeapBytes returns the memory size of the pages that are held by stores and
+// that have been allocated on the heap because the arena was exhausted.
+func (p *ArenaPool) HeapBytes() int {
+	return p.numOnHeap * p.pageBytes()
+}
+
+// Reset makes the whole arena available again, as if all the pages had been
+// released at once, which is cheaper than clearing the stores one by one, for
+// instance, at the end of an aggregation window. The stores that use the pool
+// must not be used anymore, not even cleared, once the pool has been reset.
+func (p *ArenaPool) Reset() {
+	for i := range p.directory {
+		p.directory[i] = 0
+	}
+	for i := range p.free {
+		p.free[i] = nil
+	}
+	p.free = p.free[:0]
+	p.next = 0
+	p.numUsed = 0
+	p.numOnHeap = 0
+}
+
+func (p *ArenaPool) canAllocate() bool {
+	p.skipPersistedPages()
+	return len(p.free) > 0 || p.next+p.pageLen() <= len(p.arena)
+}
+
+// skipPersistedPages moves next past the pages that have been persisted, which
+// are only found in arenas that have been opened with OpenArenaPool.
+func (p *ArenaPool) skipPersistedPages() {
+	for p.next+p.pageLen() <= len(p.arena) && p.directory[(p.next>>p.pageLenLog2)*arenaDirectoryStride] != 0 {
+		p.next += p.pageLen()
+	}
+}
+
+func (p *ArenaPool) allocate() []float64 {
+	p.numUsed++
+	if n := len(p.free); n > 0 {
+		page := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		return page
+	}
+	p.skipPersistedPages()
+	if p.next+p.pageLen() <= len(p.arena) {
+		page := p.arena[p.next : p.next+p.pageLen() : p.next+p.pageLen()]
+		p.next += p.pageLen()
+		for i := range page {
+			page[i] = 0
+		}
+		return page
+	}
+	p.numOnHeap++
+	return make([]float64, p.pageLen())
+}
+
+func (p *ArenaPool) release(page []float64) {
+	p.numUsed--
+	if !p.inArena(page) {
+		p.numOnHeap--
+		return
+	}
+	page = page[:p.pageLen()]
+	for i := range page {
+		page[i] = 0
+	}
+	p.directory[p.pagePos(page)*arenaDirectoryStride] = 0
+	p.free = append(p.free, page)
+}
+
+// pagePos returns the position of a page of the arena among its pages.
+func (p *ArenaPool) pagePos(page []float64) int {
+	offset := uintptr(unsafe.Pointer(&page[:1][0])) - uintptr(unsafe.Pointer(&p.arena[0]))
+	return int((offset / unsafe.Sizeof(float64(0))) >> p.pageLenLog2)
+}
+
+// Persist flushes the buffer of the store into its pages and records in the
+// arena that its pages belong to the store of the provided key, which must
+// not be zero, replacing what a previous call with the same key recorded.
+// Once the arena is mapped again, for instance, by another process,
+// Restore(key) returns a store with the same content, provided that the store
+// has not been modified since the last call. The store must allocate its pages
+// from the pool, and stays usable. Return a non-nil error, without recording
+// anything, if some of its pages are not in the arena because it is exhausted.
+func (p *ArenaPool) Persist(key uint64, s *BufferedPaginatedStore) error {
+	if key == 0 {
+		return errors.New("the key of a persisted store must not be zero")
+	}
+	if s.pool != p {
+		return errors.New("the store does not allocate its pages from the pool")
+	}
+	s.flushBuffer()
+	for _, page := range s.pages {
+		if len(page) > 0 && !p.inArena(page) {
+			return errors.New("the arena is exhausted, some pages of the store are on the heap")
+		}
+	}
+	for i := 0; i < len(p.directory); i += arenaDirectoryStride {
+		if p.directory[i] == key {
+			p.directory[i] = 0
+		}
+	}
+	for pagePos, page := range s.pages {
+		if len(page) > 0 {
+			entry := p.directory[p.pagePos(page)*arenaDirectoryStride:]
+			entry[0] = key
+			entry[1] = uint64(s.minPageIndex + pagePos)
+		}
+	}
+	return nil
+}
+
+// Restore returns a store whose pages are the ones that have been persisted
+// in the arena for the provided key (see Persist), and that allocates its
+// pages from the pool. The store is empty if no page has been persisted for
+// that key. Restoring a key more than once, or while the store that has been
+// persisted with it is still in use, makes stores share pages.
+func (p *ArenaPool) Restore(key uint64) *BufferedPaginatedStore {
+	s := NewBufferedPaginatedStoreWithPool(p)
+	if key == 0 {
+		return s
+	}
+	for i := 0; i < len(p.directory); i += arenaDirectoryStride {
+		if p.directory[i] != key {
+			continue
+		}
+		start := (i / arenaDirectoryStride) << p.pageLenLog2
+		page := p.arena[start : start+p.pageLen() : start+p.pageLen()]
+		*s.pageSlot(int(p.directory[i+1])) = page
+		for _, count := range page {
+			s.pagesCount += count
+		}
+		p.numUsed++
+	}
+	s.isIndexRangeStale = true
+	return s
+}
+
+// inArena returns whether page has been allocated from the arena.
+func (p *ArenaPool) inArena(page []float64) bool {
+	if cap(page) == 0 || len(p.arena) == 0 {
+		return false
+	}
+	start := uintptr(unsafe.Pointer(&p.arena[0]))
+	address := uintptr(unsafe.Pointer(&page[:1][0]))
+	return address >= start && address < start+uintptr(len(p.arena))*unsafe.Sizeof(float64(0))
+}
+
+var _ PagePool = (*ArenaPool)(nil)
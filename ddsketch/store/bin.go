@@ -7,16 +7,25 @@ package store
 
 import "errors"
 
+// ErrInvalidBinCount is the error that NewBin and Bin.WithCount return when the
+// count is NaN, infinite or negative.
+var ErrInvalidBinCount = errors.New("bin counts must be finite and non-negative")
+
+// Bin is a bin of a store, that is, an index and the count at that index. The
+// zero value is the empty bin at index 0.
 type Bin struct {
 	index int
 	count float64
 }
 
-func NewBin(index int, count float64) (*Bin, error) {
-	if count < 0 {
-		return nil, errors.New("The count cannot be negative")
+// NewBin returns the bin of the provided index and count, which can be added
+// to a store with AddBin. It returns ErrInvalidBinCount if the count is NaN,
+// infinite or negative.
+func NewBin(index int, count float64) (Bin, error) {
+	if !isValidCount(count) {
+		return Bin{}, ErrInvalidBinCount
 	}
-	return &Bin{index: index, count: count}, nil
+	return Bin{index: index, count: count}, nil
 }
 
 func (b Bin) Index() int {
@@ -26,3 +35,19 @@ func (b Bin) Index() int {
 func (b Bin) Count() float64 {
 	return b.count
 }
+
+// WithIndex returns a copy of the bin at the provided index.
+func (b Bin) WithIndex(index int) Bin {
+	b.index = index
+	return b
+}
+
+// WithCount returns a copy of the bin with the provided count. As NewBin, it
+// returns ErrInvalidBinCount if the count is NaN, infinite or negative.
+func (b Bin) WithCount(count float64) (Bin, error) {
+	if !isValidCount(count) {
+		return Bin{}, ErrInvalidBinCount
+	}
+	b.count = count
+	return b, nil
+}
@@ -0,0 +1,263 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import (
+	"fmt"
+	"unsafe"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+// MemoryLimitError is the error that a BoundedStore reports when it has
+// rejected additions because they would have made the memory size of its inner
+// store exceed its limit.
+type MemoryLimitError struct {
+	MaxBytes int
+	// RejectedCount is the total count of the rejected additions.
+	RejectedCount float64
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("the memory size of the store would exceed %d bytes, rejected a total count of %g", e.MaxBytes, e.RejectedCount)
+}
+
+// BoundedStore wraps a store and rejects the additions that would make the
+// memory size of the wrapped store, as reported by its MemorySize method,
+// exceed a limit. As the methods of Store do not return errors, rejections are
+// recorded and reported by TakeError. DDSketch reports them as the error of the
+// method that caused them.
+//
+// Most stores of this package tell the memory size that an addition would lead
+// to, so that most additions are rejected before being made. The others are
+// undone in place, by subtracting the added count and, if the memory size still
+// exceeds the limit, trimming the wrapped store to the range of its bins, which
+// releases the memory that the addition allocated as far as the store allows
+// it.
+type BoundedStore struct {
+	inner         Store
+	maxBytes      int
+	rejectedCount float64
+}
+
+// NewBoundedStore returns a BoundedStore that wraps inner and keeps its memory
+// size lower than or equal to maxBytes.
+func NewBoundedStore(inner Store, maxBytes int) *BoundedStore {
+	return &BoundedStore{inner: inner, maxBytes: maxBytes}
+}
+
+// memoryProjector is implemented by the stores that can tell, before a count
+// is added at an index, the lowest increase of their memory size that it would
+// lead to, and whether the addition is undoable, that is, whether it only
+// allocates memory to extend the range of the store and can be undone by
+// subtracting the count. Undoable additions whose increase is zero leave the
+// memory size unchanged.
+type memoryProjector interface {
+	memorySizeIncrease(index int) (bytes int, undoable bool)
+}
+
+// MaxBytes returns the limit on the memory size of the wrapped store.
+func (s *BoundedStore) MaxBytes() int {
+	return s.maxBytes
+}
+
+// TakeError returns a *MemoryLimitError if additions have been rejected since
+// the last call, and nil otherwise.
+func (s *BoundedStore) TakeError() error {
+	if s.rejectedCount == 0 {
+		return nil
+	}
+	err := &MemoryLimitError{MaxBytes: s.maxBytes, RejectedCount: s.rejectedCount}
+	s.rejectedCount = 0
+	return err
+}
+
+func (s *BoundedStore) Add(index int) {
+	s.AddWithCount(index, float64(1))
+}
+
+func (s *BoundedStore) AddBin(bin Bin) {
+	s.AddWithCount(bin.Index(), bin.Count())
+}
+
+// AddBins adds the provided bins one at a time, so that the memory limit is
+// enforced as it is by AddBin.
+func (s *BoundedStore) AddBins(bins []Bin) {
+	addBins(s, bins)
+}
+
+func (s *BoundedStore) AddWithCount(index int, count float64) {
+	if count == 0 {
+		return
+	}
+	memorySize := s.inner.MemorySize()
+	undoable := true
+	if p, ok := s.inner.(memoryProjector); ok {
+		var increase int
+		increase, undoable = p.memorySizeIncrease(index)
+		if newMemorySize := memorySize + increase; newMemorySize > s.maxBytes && newMemorySize > memorySize {
+			s.rejectedCount += count
+			return
+		}
+	}
+	s.inner.AddWithCount(index, count)
+	// Once the buffer of a BufferedPaginatedStore has made it exceed the limit,
+	// the additions that do not require more memory are still accepted.
+	if newMemorySize := s.inner.MemorySize(); !undoable || newMemorySize <= s.maxBytes || newMemorySize <= memorySize {
+		return
+	}
+	s.inner.SubtractWithCount(index, count)
+	if s.inner.MemorySize() > max(s.maxBytes, memorySize) {
+		if minIndex, err := s.inner.MinIndex(); err != nil {
+			s.inner.Clear()
+		} else {
+			maxIndex, _ := s.inner.MaxIndex()
+			s.inner.Trim(minIndex, maxIndex)
+		}
+	}
+	s.rejectedCount += count
+}
+
+func (s *BoundedStore) SubtractWithCount(index int, count float64) {
+	s.inner.SubtractWithCount(index, count)
+}
+
+func (s *BoundedStore) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
+}
+
+func (s *BoundedStore) Bins() <-chan Bin {
+	return s.inner.Bins()
+}
+
+func (s *BoundedStore) ForEach(f func(index int, count float64) (stop bool)) {
+	s.inner.ForEach(f)
+}
+
+func (s *BoundedStore) ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool)) {
+	s.inner.ForEachInRange(minIndex, maxIndex, f)
+}
+
+func (s *BoundedStore) Copy() Store {
+	return &BoundedStore{inner: s.inner.Copy(), maxBytes: s.maxBytes}
+}
+
+func (s *BoundedStore) newEmpty() Store {
+	return NewBoundedStore(newEmptyLike(s.inner), s.maxBytes)
+}
+
+func (s *BoundedStore) Downsample(factorLog2 int) Store {
+	// Merging bins does not make the inner store larger.
+	return &BoundedStore{inner: s.inner.Downsample(factorLog2), maxBytes: s.maxBytes}
+}
+
+func (s *BoundedStore) Trim(minIndex, maxIndex int) {
+	s.inner.Trim(minIndex, maxIndex)
+}
+
+// CopyTo overwrites the content of dst with the content of the store (see
+// Store.CopyTo). If dst is a BoundedStore, its limit applies.
+func (s *BoundedStore) CopyTo(dst Store) {
+	if s == dst {
+		return
+	}
+	if d, ok := dst.(*BoundedStore); ok {
+		d.Clear()
+		d.MergeWith(s)
+		return
+	}
+	s.inner.CopyTo(dst)
+}
+
+func (s *BoundedStore) Clear() {
+	s.inner.Clear()
+}
+
+func (s *BoundedStore) ClearRetainingCapacity() {
+	s.inner.ClearRetainingCapacity()
+}
+
+func (s *BoundedStore) IsEmpty() bool {
+	return s.inner.IsEmpty()
+}
+
+func (s *BoundedStore) MaxIndex() (int, error) {
+	return s.inner.MaxIndex()
+}
+
+func (s *BoundedStore) MinIndex() (int, error) {
+	return s.inner.MinIndex()
+}
+
+func (s *BoundedStore) MaxCountBin() (Bin, error) {
+	return s.inner.MaxCountBin()
+}
+
+func (s *BoundedStore) TotalCount() float64 {
+	return s.inner.TotalCount()
+}
+
+func (s *BoundedStore) GetCountAtIndex(index int) float64 {
+	return s.inner.GetCountAtIndex(index)
+}
+
+// MemorySize returns the memory size of the wrapped store, which is bounded,
+// plus the small constant size of the wrapper.
+func (s *BoundedStore) MemorySize() int {
+	return int(unsafe.Sizeof(*s)) + s.inner.MemorySize()
+}
+
+func (s *BoundedStore) KeyAtRank(rank float64) int {
+	return s.inner.KeyAtRank(rank)
+}
+
+// MergeWith merges the bins of other one by one, so that only the ones that
+// would exceed the limit are rejected.
+func (s *BoundedStore) MergeWith(other Store) {
+	if s == other {
+		// Doubling counts does not require more memory.
+		s.inner.MergeWith(s.inner)
+		return
+	}
+	other.ForEach(func(index int, count float64) (stop bool) {
+		s.AddWithCount(index, count)
+		return false
+	})
+}
+
+func (s *BoundedStore) ToProto() *sketchpb.Store {
+	return s.inner.ToProto()
+}
+
+func (s *BoundedStore) ToColumns() ([]int32, []float64) {
+	return s.inner.ToColumns()
+}
+
+func (s *BoundedStore) Stats() Stats {
+	st := s.inner.Stats()
+	st.MemorySize = s.MemorySize()
+	return st
+}
+
+func (s *BoundedStore) Reweight(w float64) error {
+	return s.inner.Reweight(w)
+}
+
+func (s *BoundedStore) Encode(b *[]byte, t enc.FlagType) {
+	s.inner.Encode(b, t)
+}
+
+func (s *BoundedStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.SubFlag) error {
+	decoded := NewSparseStore()
+	if err := decoded.DecodeAndMergeWith(b, encodingMode); err != nil {
+		return err
+	}
+	s.MergeWith(decoded)
+	return nil
+}
+
+var _ Store = (*BoundedStore)(nil)
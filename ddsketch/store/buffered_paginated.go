@@ -7,7 +7,10 @@ package store
 
 import (
 	"errors"
+	"math"
+	"math/bits"
 	"sort"
+	"unsafe"
 
 	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
 	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
@@ -20,7 +23,8 @@ const (
 	bufferEntrySize = intSize
 	countSize       = float64size
 
-	defaultPageLenLog2 = 5 // pageLen = 32
+	defaultPageLenLog2 = 5  // pageLen = 32
+	maxPageLenLog2     = 16 // pageLen = 65536
 )
 
 // BufferedPaginatedStore allocates storage for counts in aligned fixed-size
@@ -50,14 +54,45 @@ type BufferedPaginatedStore struct {
 	bufferCompactionTriggerLen int   // compaction happens only after this buffer length is reached
 
 	pages        [][]float64 // len == cap, the slice is always used to its maximum capacity
+	pagesCount   float64     // the sum of the counts of the pages, so that the total count is known without iterating over them
 	minPageIndex int         // minPageIndex == maxInt iff pages are unused (they may still be allocated)
-	pageLenLog2  int
-	pageLenMask  int
+	minIndex     int         // the lowest index of the non-empty bins, or maxInt if there is none, unless isIndexRangeStale
+	maxIndex     int         // the highest index of the non-empty bins, or minInt if there is none, unless isIndexRangeStale
+	// isIndexRangeStale is true if bins may have been emptied since minIndex
+	// and maxIndex were computed, in which case they need to be recomputed.
+	isIndexRangeStale bool
+	pageLenLog2       int
+	pageLenMask       int
+	pool              PagePool // pages are allocated from pool if not nil
+	sharedPages       []bool   // if not nil, len(sharedPages) == len(pages) and shared pages must be copied before being modified
+
+	// cumulPageCounts[i] is the sum of the counts of pages[0] to pages[i]. It
+	// is lazily computed by KeyAtRank and is valid iff len(cumulPageCounts) ==
+	// len(pages), which modifying the pages resets. As a cache that takes a
+	// small fraction of the size of the pages, it is not accounted for by
+	// MemorySize, which therefore does not depend on queries.
+	cumulPageCounts []float64
+
+	numCompactions int // number of times the buffer has been compacted, reported by Stats
 }
 
 func NewBufferedPaginatedStore() *BufferedPaginatedStore {
+	return NewBufferedPaginatedStoreWithPageSize(defaultPageLenLog2)
+}
+
+// NewBufferedPaginatedStoreWithPageSize returns a BufferedPaginatedStore whose
+// pages hold 2^pageLenLog2 counts (the default is 2^5), pageLenLog2 being
+// capped at 16. Smaller pages waste less memory on narrow distributions,
+// while larger pages save page allocations on wide ones. The page size also
+// determines how many indexes the buffer may hold before being compacted.
+// Stores with different page sizes can be merged with one another, but
+// merging is then done bin by bin rather than page by page, and is
+// therefore slower.
+func NewBufferedPaginatedStoreWithPageSize(pageLenLog2 uint8) *BufferedPaginatedStore {
 	initialBufferCapacity := 4
-	pageLenLog2 := defaultPageLenLog2
+	if pageLenLog2 > maxPageLenLog2 {
+		pageLenLog2 = maxPageLenLog2
+	}
 	pageLen := 1 << pageLenLog2
 
 	return &BufferedPaginatedStore{
@@ -65,11 +100,25 @@ func NewBufferedPaginatedStore() *BufferedPaginatedStore {
 		bufferCompactionTriggerLen: 2 * pageLen,
 		pages:                      nil,
 		minPageIndex:               maxInt,
-		pageLenLog2:                pageLenLog2,
+		minIndex:                   maxInt,
+		maxIndex:                   minInt,
+		pageLenLog2:                int(pageLenLog2),
 		pageLenMask:                pageLen - 1,
 	}
 }
 
+// NewBufferedPaginatedStoreWithPool returns a BufferedPaginatedStore that
+// allocates its pages from pool and whose page size is the one of the pool.
+// The pages of the store are returned to the pool when it is cleared, so that
+// other stores sharing the pool can reuse them. The store itself is not safe
+// for concurrent use, but stores that are used by different goroutines may
+// share a pool if the pool is safe for concurrent use, as SyncMemoryPool is.
+func NewBufferedPaginatedStoreWithPool(pool PagePool) *BufferedPaginatedStore {
+	s := NewBufferedPaginatedStoreWithPageSize(uint8(bits.TrailingZeros(uint(pool.pageLen()))))
+	s.pool = pool
+	return s
+}
+
 // pageIndex returns the page number the given index falls on.
 func (s *BufferedPaginatedStore) pageIndex(index int) int {
 	return index >> s.pageLenLog2
@@ -88,13 +137,14 @@ func (s *BufferedPaginatedStore) index(pageIndex, lineIndex int) int {
 // page returns the page for the provided pageIndex, or nil. When unexisting,
 // the page is created if and only if ensureExists is true.
 func (s *BufferedPaginatedStore) page(pageIndex int, ensureExists bool) []float64 {
-	pageLen := 1 << s.pageLenLog2
-
 	if pageIndex >= s.minPageIndex && pageIndex < s.minPageIndex+len(s.pages) {
 		// No need to extend s.pages.
 		page := &s.pages[pageIndex-s.minPageIndex]
-		if ensureExists && len(*page) == 0 {
-			*page = append(*page, make([]float64, pageLen)...)
+		if len(*page) > 0 {
+			return s.ownPage(pageIndex - s.minPageIndex)
+		}
+		if ensureExists {
+			s.allocatePage(page)
 		}
 		return *page
 	}
@@ -103,10 +153,27 @@ func (s *BufferedPaginatedStore) page(pageIndex int, ensureExists bool) []float6
 		return nil
 	}
 
+	page := s.pageSlot(pageIndex)
+	if len(*page) == 0 {
+		s.allocatePage(page)
+	}
+	return *page
+}
+
+// pageSlot returns a pointer to the element of s.pages for the provided
+// pageIndex, extending s.pages if needed, without allocating the page.
+func (s *BufferedPaginatedStore) pageSlot(pageIndex int) *[]float64 {
+	if pageIndex >= s.minPageIndex && pageIndex < s.minPageIndex+len(s.pages) {
+		return &s.pages[pageIndex-s.minPageIndex]
+	}
+
 	if pageIndex < s.minPageIndex {
 		if s.minPageIndex == maxInt {
 			if len(s.pages) == 0 {
 				s.pages = append(s.pages, make([][]float64, s.newPagesLen(1))...)
+				if s.sharedPages != nil {
+					s.sharedPages = make([]bool, len(s.pages))
+				}
 			}
 			s.minPageIndex = pageIndex - len(s.pages)/2
 		} else {
@@ -118,18 +185,82 @@ func (s *BufferedPaginatedStore) page(pageIndex int, ensureExists bool) []float6
 			for i := 0; i < addedLen; i++ {
 				s.pages[i] = nil
 			}
+			if s.sharedPages != nil {
+				s.sharedPages = append(s.sharedPages, make([]bool, addedLen)...)
+				copy(s.sharedPages[addedLen:], s.sharedPages)
+				for i := 0; i < addedLen; i++ {
+					s.sharedPages[i] = false
+				}
+			}
 			s.minPageIndex -= addedLen
 		}
 	} else {
 		// Extends s.pages right.
-		s.pages = append(s.pages, make([][]float64, s.newPagesLen(pageIndex-s.minPageIndex+1)-len(s.pages))...)
+		addedLen := s.newPagesLen(pageIndex-s.minPageIndex+1) - len(s.pages)
+		s.pages = append(s.pages, make([][]float64, addedLen)...)
+		if s.sharedPages != nil {
+			s.sharedPages = append(s.sharedPages, make([]bool, addedLen)...)
+		}
 	}
 
-	page := &s.pages[pageIndex-s.minPageIndex]
-	if len(*page) == 0 {
-		*page = append(*page, make([]float64, pageLen)...)
+	return &s.pages[pageIndex-s.minPageIndex]
+}
+
+// ownPage copies the page at the provided position in s.pages if it may be
+// shared with a snapshot, so that it can be modified, and returns it.
+func (s *BufferedPaginatedStore) ownPage(pagePos int) []float64 {
+	if s.sharedPages != nil && s.sharedPages[pagePos] {
+		s.pages[pagePos] = append([]float64(nil), s.pages[pagePos]...)
+		s.sharedPages[pagePos] = false
 	}
-	return *page
+	return s.pages[pagePos]
+}
+
+// Snapshot returns a copy of the store that shares its pages with the store. A
+// page is only copied once either the store or the snapshot modifies it, which
+// makes taking a snapshot much cheaper than copying the store if only few
+// pages are modified in between. The snapshot can be read by another
+// goroutine while the store keeps being modified, but neither of them is
+// otherwise safe for concurrent use. If the store allocates its pages from a
+// pool, the snapshot is a regular copy of the store.
+func (s *BufferedPaginatedStore) Snapshot() *BufferedPaginatedStore {
+	if s.pool != nil {
+		return s.Copy().(*BufferedPaginatedStore)
+	}
+	if s.sharedPages == nil {
+		s.sharedPages = make([]bool, len(s.pages))
+	}
+	snapshot := &BufferedPaginatedStore{
+		buffer:                     append([]int(nil), s.buffer...),
+		bufferCompactionTriggerLen: s.bufferCompactionTriggerLen,
+		pages:                      make([][]float64, len(s.pages)),
+		pagesCount:                 s.pagesCount,
+		minPageIndex:               s.minPageIndex,
+		minIndex:                   s.minIndex,
+		maxIndex:                   s.maxIndex,
+		isIndexRangeStale:          s.isIndexRangeStale,
+		pageLenLog2:                s.pageLenLog2,
+		pageLenMask:                s.pageLenMask,
+		sharedPages:                make([]bool, len(s.pages)),
+	}
+	for i, page := range s.pages {
+		if len(page) > 0 {
+			snapshot.pages[i] = page[:len(page):len(page)]
+			snapshot.sharedPages[i] = true
+			s.sharedPages[i] = true
+		}
+	}
+	return snapshot
+}
+
+// allocatePage makes the empty page usable, reusing its capacity if it has
+// been retained, or allocating it from the pool of the store, if any.
+func (s *BufferedPaginatedStore) allocatePage(page *[]float64) {
+	if s.pool != nil && cap(*page) == 0 {
+		*page = s.pool.allocate()
+		return
+	}
+	*page = append(*page, make([]float64, 1<<s.pageLenLog2)...)
 }
 
 func (s *BufferedPaginatedStore) newPagesLen(required int) int {
@@ -142,6 +273,7 @@ func (s *BufferedPaginatedStore) newPagesLen(required int) int {
 // pages if they can encode enough buffered indexes so that it frees more space
 // in the buffer than the new page takes.
 func (s *BufferedPaginatedStore) compact() {
+	s.numCompactions++
 	pageLen := 1 << s.pageLenLog2
 
 	s.sortBuffer()
@@ -161,12 +293,16 @@ func (s *BufferedPaginatedStore) compact() {
 		// in the page, because we may have to extend s.pages, the store may end
 		// up larger. However, for the sake of simplicity, we ignore the length
 		// of s.pages.
-		ensureExists := (bufferPageEnd-bufferPageStart)*bufferEntrySize >= pageLen*float64size
+		// The pool of the store may also deny creating the page.
+		ensureExists := (bufferPageEnd-bufferPageStart)*bufferEntrySize >= pageLen*float64size &&
+			(s.pool == nil || s.pool.canAllocate())
 		newPage := s.page(pageIndex, ensureExists)
 		if len(newPage) > 0 {
 			for _, index := range s.buffer[bufferPageStart:bufferPageEnd] {
 				newPage[s.lineIndex(index)]++
 			}
+			s.pagesCount += float64(bufferPageEnd - bufferPageStart)
+			s.cumulPageCounts = s.cumulPageCounts[:0]
 			copy(s.buffer[bufferPageStart:], s.buffer[bufferPageEnd:])
 			s.buffer = s.buffer[:len(s.buffer)+bufferPageStart-bufferPageEnd]
 			bufferPos = bufferPageStart
@@ -176,16 +312,36 @@ func (s *BufferedPaginatedStore) compact() {
 	s.bufferCompactionTriggerLen = len(s.buffer) + pageLen
 }
 
+// flushBuffer transfers all the indexes of the buffer to the pages, creating
+// them as needed, unlike compaction.
+func (s *BufferedPaginatedStore) flushBuffer() {
+	if len(s.buffer) == 0 {
+		return
+	}
+	for _, index := range s.buffer {
+		s.page(s.pageIndex(index), true)[s.lineIndex(index)]++
+	}
+	s.pagesCount += float64(len(s.buffer))
+	s.cumulPageCounts = s.cumulPageCounts[:0]
+	s.buffer = s.buffer[:0]
+}
+
 func (s *BufferedPaginatedStore) sortBuffer() {
 	sort.Ints(s.buffer)
 }
 
 func (s *BufferedPaginatedStore) Add(index int) {
+	s.extendIndexRange(index)
 	pageIndex := s.pageIndex(index)
 	if pageIndex >= s.minPageIndex && pageIndex < s.minPageIndex+len(s.pages) {
 		page := s.pages[pageIndex-s.minPageIndex]
 		if len(page) > 0 {
+			if s.sharedPages != nil {
+				page = s.ownPage(pageIndex - s.minPageIndex)
+			}
 			page[s.lineIndex(index)]++
+			s.pagesCount++
+			s.cumulPageCounts = s.cumulPageCounts[:0]
 			return
 		}
 	}
@@ -202,6 +358,29 @@ func (s *BufferedPaginatedStore) AddBin(bin Bin) {
 	s.AddWithCount(bin.Index(), bin.Count())
 }
 
+// AddBins adds the provided bins to the store. The bins with a count of 1 that
+// do not fall on existing pages are appended to the buffer, which is then
+// sorted and compacted at most once, rather than as it fills up.
+func (s *BufferedPaginatedStore) AddBins(bins []Bin) {
+	for _, bin := range bins {
+		if bin.count != 1 {
+			s.AddWithCount(bin.index, bin.count)
+			continue
+		}
+		if page := s.page(s.pageIndex(bin.index), false); len(page) > 0 {
+			page[s.lineIndex(bin.index)]++
+			s.pagesCount++
+			s.cumulPageCounts = s.cumulPageCounts[:0]
+		} else {
+			s.buffer = append(s.buffer, bin.index)
+		}
+		s.extendIndexRange(bin.index)
+	}
+	if len(s.buffer) >= s.bufferCompactionTriggerLen {
+		s.compact()
+	}
+}
+
 func (s *BufferedPaginatedStore) AddWithCount(index int, count float64) {
 	if count == 0 {
 		return
@@ -209,7 +388,160 @@ func (s *BufferedPaginatedStore) AddWithCount(index int, count float64) {
 		s.Add(index)
 	} else {
 		s.page(s.pageIndex(index), true)[s.lineIndex(index)] += count
+		s.pagesCount += count
+		s.extendIndexRange(index)
+		s.cumulPageCounts = s.cumulPageCounts[:0]
+	}
+}
+
+func (s *BufferedPaginatedStore) SubtractWithCount(index int, count float64) {
+	if !isSubtractableCount(count) {
+		return
+	}
+	if index == s.minIndex || index == s.maxIndex {
+		s.isIndexRangeStale = true
+	}
+	pageIndex := s.pageIndex(index)
+	lineIndex := s.lineIndex(index)
+	if page := s.page(pageIndex, false); len(page) > 0 {
+		removed := math.Min(page[lineIndex], count)
+		page[lineIndex] -= removed
+		s.pagesCount -= removed
+		s.cumulPageCounts = s.cumulPageCounts[:0]
+		count -= removed
+	}
+	// Each occurrence of the index in the buffer accounts for a count of 1.
+	for bufferPos := 0; count > 0 && bufferPos < len(s.buffer); {
+		if s.buffer[bufferPos] != index {
+			bufferPos++
+			continue
+		}
+		s.buffer[bufferPos] = s.buffer[len(s.buffer)-1]
+		s.buffer = s.buffer[:len(s.buffer)-1]
+		if count < 1 {
+			// Keep the remainder in a page.
+			s.page(pageIndex, true)[lineIndex] += 1 - count
+			s.pagesCount += 1 - count
+			s.cumulPageCounts = s.cumulPageCounts[:0]
+		}
+		count--
+	}
+	s.spillPage(pageIndex)
+}
+
+// spillPage is the reverse of compaction: it transfers the counts of the page
+// of the provided pageIndex to the buffer and releases the page if the
+// buffered indexes take at most half the memory space of the page, so that
+// the memory size of the store follows its content as counts are subtracted
+// rather than staying at its peak. The margin prevents the page from being
+// created again by the next compaction. Pages with non-integer counts, which
+// the buffer cannot hold, are kept.
+func (s *BufferedPaginatedStore) spillPage(pageIndex int) {
+	if pageIndex < s.minPageIndex || pageIndex >= s.minPageIndex+len(s.pages) {
+		return
+	}
+	pagePos := pageIndex - s.minPageIndex
+	page := s.pages[pagePos]
+	if len(page) == 0 {
+		return
+	}
+	var pageCount float64
+	for _, count := range page {
+		if count != math.Trunc(count) {
+			return
+		}
+		pageCount += count
+	}
+	if 2*pageCount*bufferEntrySize > float64(len(page)*float64size) {
+		return
+	}
+	for lineIndex, count := range page {
+		for ; count > 0; count-- {
+			s.buffer = append(s.buffer, s.index(pageIndex, lineIndex))
+		}
+	}
+	s.pagesCount -= pageCount
+	s.cumulPageCounts = s.cumulPageCounts[:0]
+	if s.sharedPages != nil && s.sharedPages[pagePos] {
+		s.sharedPages[pagePos] = false
+	} else if s.pool != nil {
+		s.pool.release(page)
+	}
+	s.pages[pagePos] = nil
+}
+
+// DiffWith subtracts the counts of the bins of other from the counts of the
+// bins of the store, clamping them at zero, as SubtractWithCount does for each
+// of them. Rather than scanning the buffer for each bin, it sorts the buffer
+// once and removes the subtracted indexes from it in a single pass, and it
+// spills each page at most once, so that diffing is not quadratic in the
+// length of the buffer.
+func (s *BufferedPaginatedStore) DiffWith(other Store) {
+	if s == other {
+		s.Clear()
+		return
+	}
+	// The counts that are left to subtract from the buffer, once subtracted
+	// from the pages.
+	var fromBuffer []Bin
+	var pageIndexes []int
+	other.ForEach(func(index int, count float64) (stop bool) {
+		if !isSubtractableCount(count) {
+			return false
+		}
+		if index == s.minIndex || index == s.maxIndex {
+			s.isIndexRangeStale = true
+		}
+		pageIndex := s.pageIndex(index)
+		if page := s.page(pageIndex, false); len(page) > 0 {
+			lineIndex := s.lineIndex(index)
+			removed := math.Min(page[lineIndex], count)
+			page[lineIndex] -= removed
+			s.pagesCount -= removed
+			count -= removed
+		}
+		if count > 0 {
+			fromBuffer = append(fromBuffer, Bin{index: index, count: count})
+		}
+		pageIndexes = append(pageIndexes, pageIndex)
+		return false
+	})
+
+	if len(fromBuffer) > 0 && len(s.buffer) > 0 {
+		s.sortBuffer()
+		sort.Slice(fromBuffer, func(i, j int) bool { return fromBuffer[i].index < fromBuffer[j].index })
+		kept := s.buffer[:0]
+		i := 0
+		for _, index := range s.buffer {
+			for i < len(fromBuffer) && fromBuffer[i].index < index {
+				i++
+			}
+			if i == len(fromBuffer) || fromBuffer[i].index != index || fromBuffer[i].count <= 0 {
+				kept = append(kept, index)
+				continue
+			}
+			// Each occurrence of the index in the buffer accounts for a count of 1.
+			if fromBuffer[i].count < 1 {
+				// Keep the remainder in a page.
+				s.page(s.pageIndex(index), true)[s.lineIndex(index)] += 1 - fromBuffer[i].count
+				s.pagesCount += 1 - fromBuffer[i].count
+			}
+			fromBuffer[i].count--
+		}
+		s.buffer = kept
 	}
+	s.cumulPageCounts = s.cumulPageCounts[:0]
+
+	sort.Ints(pageIndexes)
+	for i, pageIndex := range pageIndexes {
+		if i == 0 || pageIndex != pageIndexes[i-1] {
+			s.spillPage(pageIndex)
+		}
+	}
+}
+
+func (s *BufferedPaginatedStore) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
 }
 
 func (s *BufferedPaginatedStore) IsEmpty() bool {
@@ -226,17 +558,83 @@ func (s *BufferedPaginatedStore) IsEmpty() bool {
 	return true
 }
 
-func (s *BufferedPaginatedStore) TotalCount() float64 {
-	totalCount := float64(len(s.buffer))
-	for _, page := range s.pages {
-		for _, count := range page {
-			totalCount += count
+// GetCountAtIndex returns the count of the bin of the provided index. It runs
+// in time linear in the length of the buffer.
+func (s *BufferedPaginatedStore) GetCountAtIndex(index int) float64 {
+	var count float64
+	// Not using s.page, which copies pages that are shared with snapshots.
+	if pageIndex := s.pageIndex(index); pageIndex >= s.minPageIndex && pageIndex < s.minPageIndex+len(s.pages) {
+		if page := s.pages[pageIndex-s.minPageIndex]; len(page) > 0 {
+			count = page[s.lineIndex(index)]
 		}
 	}
-	return totalCount
+	for _, bufferedIndex := range s.buffer {
+		if bufferedIndex == index {
+			count++
+		}
+	}
+	return count
 }
 
+// TotalCount returns the sum of the counts of the bins of the store. It runs in
+// constant time.
+func (s *BufferedPaginatedStore) TotalCount() float64 {
+	return float64(len(s.buffer)) + s.pagesCount
+}
+
+// MinIndex returns the lowest index of the non-empty bins of the store. It runs
+// in constant time, unless bins have been emptied since the last call.
 func (s *BufferedPaginatedStore) MinIndex() (int, error) {
+	s.refreshIndexRange()
+	if s.minIndex > s.maxIndex {
+		return 0, errUndefinedMinIndex
+	}
+	return s.minIndex, nil
+}
+
+// MaxIndex returns the highest index of the non-empty bins of the store. It
+// runs in constant time, unless bins have been emptied since the last call.
+func (s *BufferedPaginatedStore) MaxIndex() (int, error) {
+	s.refreshIndexRange()
+	if s.minIndex > s.maxIndex {
+		return 0, errUndefinedMaxIndex
+	}
+	return s.maxIndex, nil
+}
+
+// extendIndexRange makes the cached index range include index, whose bin is
+// non-empty.
+func (s *BufferedPaginatedStore) extendIndexRange(index int) {
+	if index < s.minIndex {
+		s.minIndex = index
+	}
+	if index > s.maxIndex {
+		s.maxIndex = index
+	}
+}
+
+// resetIndexRange sets the cached index range to the one of an empty store.
+func (s *BufferedPaginatedStore) resetIndexRange() {
+	s.minIndex = maxInt
+	s.maxIndex = minInt
+	s.isIndexRangeStale = false
+}
+
+// refreshIndexRange recomputes the cached index range if it is stale.
+func (s *BufferedPaginatedStore) refreshIndexRange() {
+	if !s.isIndexRangeStale {
+		return
+	}
+	s.resetIndexRange()
+	if minIndex, err := s.scanMinIndex(); err == nil {
+		s.minIndex = minIndex
+		s.maxIndex, _ = s.scanMaxIndex()
+	}
+}
+
+// scanMinIndex returns the lowest index of the non-empty bins of the store,
+// iterating over the buffer and the pages.
+func (s *BufferedPaginatedStore) scanMinIndex() (int, error) {
 	isEmpty := true
 
 	// Iterate over the buffer.
@@ -276,7 +674,9 @@ func (s *BufferedPaginatedStore) MinIndex() (int, error) {
 	}
 }
 
-func (s *BufferedPaginatedStore) MaxIndex() (int, error) {
+// scanMaxIndex returns the highest index of the non-empty bins of the store,
+// iterating over the buffer and the pages.
+func (s *BufferedPaginatedStore) scanMaxIndex() (int, error) {
 	isEmpty := true
 
 	// Iterate over the buffer.
@@ -316,6 +716,32 @@ func (s *BufferedPaginatedStore) MaxIndex() (int, error) {
 	}
 }
 
+func (s *BufferedPaginatedStore) MaxCountBin() (Bin, error) {
+	if s.IsEmpty() {
+		return Bin{}, errUndefinedMaxCount
+	}
+	// ForEach iterates over bins by increasing indexes, so the first bin with
+	// the highest count is kept in case of ties.
+	maxCountBin := Bin{count: math.Inf(-1)}
+	s.ForEach(func(index int, count float64) (stop bool) {
+		if count > maxCountBin.count {
+			maxCountBin = Bin{index: index, count: count}
+		}
+		return false
+	})
+	return maxCountBin, nil
+}
+
+func (s *BufferedPaginatedStore) MemorySize() int {
+	size := int(unsafe.Sizeof(*s))
+	size += cap(s.buffer) * int(unsafe.Sizeof(int(0)))
+	size += cap(s.pages) * int(unsafe.Sizeof([]float64(nil)))
+	for _, page := range s.pages {
+		size += cap(page) * int(unsafe.Sizeof(float64(0)))
+	}
+	return size
+}
+
 func (s *BufferedPaginatedStore) KeyAtRank(rank float64) int {
 	if rank < 0 {
 		rank = 0
@@ -338,14 +764,17 @@ func (s *BufferedPaginatedStore) KeyAtRank(rank float64) int {
 
 // minIndexWithCumulCount returns the minimum index whose cumulative count (that
 // is, the sum of the counts associated with the indexes less than or equal to
-// the index) verifies the predicate.
+// the index) verifies the predicate, which is required to be monotonic (i.e.,
+// to remain verified for greater cumulative counts). The page that holds the
+// index is found by binary search over the cumulative counts of the pages, so
+// that only that page is iterated over.
 func (s *BufferedPaginatedStore) minIndexWithCumulCount(predicate func(float64) bool) (int, error) {
 	s.sortBuffer()
-	cumulCount := float64(0)
+	fromPageOffset, cumulCount, bufferPos := s.pageWithCumulCount(predicate)
 
 	// Iterate over the pages and the buffer simultaneously.
-	bufferPos := 0
-	for pageOffset, page := range s.pages {
+	for pageOffset := fromPageOffset; pageOffset < len(s.pages); pageOffset++ {
+		page := s.pages[pageOffset]
 		for lineIndex, count := range page {
 			index := s.index(s.minPageIndex+pageOffset, lineIndex)
 
@@ -374,10 +803,45 @@ func (s *BufferedPaginatedStore) minIndexWithCumulCount(predicate func(float64)
 	return 0, errors.New("the predicate on the cumulative count is never verified")
 }
 
+// pageWithCumulCount returns the offset of the first page at the end of which
+// the cumulative count verifies the monotonic predicate, or len(s.pages) if
+// there is none, as well as the cumulative count and the position in the
+// sorted buffer at the start of that page.
+func (s *BufferedPaginatedStore) pageWithCumulCount(predicate func(float64) bool) (pageOffset int, cumulCount float64, bufferPos int) {
+	if s.minPageIndex == maxInt {
+		return len(s.pages), 0, 0
+	}
+	if len(s.cumulPageCounts) != len(s.pages) {
+		s.cumulPageCounts = s.cumulPageCounts[:0]
+		cumulPageCount := float64(0)
+		for _, page := range s.pages {
+			for _, count := range page {
+				cumulPageCount += count
+			}
+			s.cumulPageCounts = append(s.cumulPageCounts, cumulPageCount)
+		}
+	}
+	// The number of buffered indexes that are lower than the first index of
+	// the page at the provided offset.
+	numBufferedBefore := func(pageOffset int) int {
+		return sort.SearchInts(s.buffer, s.index(s.minPageIndex+pageOffset, 0))
+	}
+	pageOffset = sort.Search(len(s.pages), func(pageOffset int) bool {
+		return predicate(s.cumulPageCounts[pageOffset] + float64(numBufferedBefore(pageOffset+1)))
+	})
+	if pageOffset == 0 {
+		// The index may also be lower than the ones of the pages.
+		return 0, 0, 0
+	}
+	bufferPos = numBufferedBefore(pageOffset)
+	return pageOffset, s.cumulPageCounts[pageOffset-1] + float64(bufferPos), bufferPos
+}
+
 func (s *BufferedPaginatedStore) MergeWith(other Store) {
 	o, ok := other.(*BufferedPaginatedStore)
 	if ok && s.pageLenLog2 == o.pageLenLog2 {
 		// Merge pages.
+		s.cumulPageCounts = s.cumulPageCounts[:0]
 		for oPageOffset, oPage := range o.pages {
 			if len(oPage) == 0 {
 				continue
@@ -386,15 +850,27 @@ func (s *BufferedPaginatedStore) MergeWith(other Store) {
 			page := s.page(oPageIndex, true)
 			for i, oCount := range oPage {
 				page[i] += oCount
+				s.pagesCount += oCount
 			}
 		}
+		if oMinIndex, err := o.MinIndex(); err == nil {
+			s.extendIndexRange(oMinIndex)
+			oMaxIndex, _ := o.MaxIndex()
+			s.extendIndexRange(oMaxIndex)
+		}
 
 		// Merge buffers.
-		for _, index := range o.buffer {
+		buffer := o.buffer
+		if s == o {
+			// Adding may compact the buffer that is being iterated over.
+			buffer = append([]int(nil), buffer...)
+		}
+		for _, index := range buffer {
 			s.Add(index)
 		}
 	} else {
 		// Fallback merging.
+		s.reservePages(other)
 		other.ForEach(func(index int, count float64) (stop bool) {
 			s.AddWithCount(index, count)
 			return false
@@ -402,13 +878,95 @@ func (s *BufferedPaginatedStore) MergeWith(other Store) {
 	}
 }
 
-func (s *BufferedPaginatedStore) MergeWithProto(pb *sketchpb.Store) {
-	for index, count := range pb.BinCounts {
-		s.AddWithCount(int(index), count)
+// reservePages extends s.pages once so that it covers the range of the indexes
+// of the other store, without allocating pages, rather than as pages are
+// created while merging it. It does not do so if s.pages would take more
+// memory than the other store, so that merging a sparse store whose indexes
+// are far apart does not make s.pages unnecessarily large.
+func (s *BufferedPaginatedStore) reservePages(other Store) {
+	minIndex, minErr := other.MinIndex()
+	maxIndex, maxErr := other.MaxIndex()
+	if minErr != nil || maxErr != nil {
+		return
+	}
+	minPageIndex, maxPageIndex := s.pageIndex(minIndex), s.pageIndex(maxIndex)
+	if rangeLength(minPageIndex, maxPageIndex) > other.MemorySize()/int(unsafe.Sizeof(s.pages[:0])) {
+		return
+	}
+	s.pageSlot(minPageIndex)
+	s.pageSlot(maxPageIndex)
+}
+
+// MergeAndClear merges other into the store and clears other. Rather than
+// adding their counts, the pages of other whose range of indexes is not yet
+// covered by the store are moved to the store, which saves copying them and
+// allocating new pages. The pages of other that are not moved are released
+// to its pool, if any, as Clear does. Pages can only be moved between stores
+// that have the same page size and allocate their pages from the same pool
+// (or both from none of them); otherwise, MergeAndClear is equivalent to
+// MergeWith followed by Clear. If other is the store itself, it is merged with
+// itself and not cleared.
+func (s *BufferedPaginatedStore) MergeAndClear(other *BufferedPaginatedStore) {
+	if s == other {
+		s.MergeWith(other)
+		return
 	}
-	for indexOffset, count := range pb.ContiguousBinCounts {
-		s.AddWithCount(int(pb.ContiguousBinIndexOffset)+indexOffset, count)
+	if s.pageLenLog2 != other.pageLenLog2 || s.pool != other.pool {
+		s.MergeWith(other)
+		other.Clear()
+		return
 	}
+
+	// The index range of the other store is read before its pages are moved,
+	// as it may have to be computed by scanning them.
+	oMinIndex, minErr := other.MinIndex()
+	oMaxIndex, _ := other.MaxIndex()
+	otherIsEmpty := minErr != nil
+	s.cumulPageCounts = s.cumulPageCounts[:0]
+	for oPageOffset, oPage := range other.pages {
+		if len(oPage) == 0 {
+			continue
+		}
+		oPageIndex := other.minPageIndex + oPageOffset
+		isShared := other.sharedPages != nil && other.sharedPages[oPageOffset]
+		if !isShared && len(s.page(oPageIndex, false)) == 0 {
+			// Move the page.
+			slot := s.pageSlot(oPageIndex)
+			if s.pool != nil && cap(*slot) > 0 {
+				s.pool.release(*slot)
+			}
+			*slot = oPage
+			if s.sharedPages != nil {
+				s.sharedPages[oPageIndex-s.minPageIndex] = false
+			}
+			other.pages[oPageOffset] = nil
+			for _, oCount := range oPage {
+				s.pagesCount += oCount
+			}
+			continue
+		}
+		page := s.page(oPageIndex, true)
+		for i, oCount := range oPage {
+			page[i] += oCount
+			s.pagesCount += oCount
+		}
+	}
+	if !otherIsEmpty {
+		s.extendIndexRange(oMinIndex)
+		s.extendIndexRange(oMaxIndex)
+	}
+	for _, index := range other.buffer {
+		s.Add(index)
+	}
+	other.Clear()
+}
+
+// MergeWithProto merges the bins of the protobuf Store into the store. The
+// protobuf Store is validated first (see ValidateProto), and the store is left
+// unchanged if it is invalid, so that a corrupt payload cannot make the counts
+// of the store NaN, infinite or negative.
+func (s *BufferedPaginatedStore) MergeWithProto(pb *sketchpb.Store) error {
+	return MergeWithProto(s, pb)
 }
 
 func (s *BufferedPaginatedStore) Bins() <-chan Bin {
@@ -511,41 +1069,253 @@ func (s *BufferedPaginatedStore) ForEach(f func(index int, count float64) (stop
 	}
 }
 
+func (s *BufferedPaginatedStore) ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool)) {
+	if minIndex > maxIndex {
+		return
+	}
+	s.sortBuffer()
+	bufferPos := sort.SearchInts(s.buffer, minIndex)
+
+	// nextBuffered returns the next buffered index that is in the range, and
+	// the number of times it occurs in the buffer, or ok == false.
+	nextBuffered := func() (index int, count float64, ok bool) {
+		if bufferPos >= len(s.buffer) || s.buffer[bufferPos] > maxIndex {
+			return 0, 0, false
+		}
+		startPos := bufferPos
+		for bufferPos < len(s.buffer) && s.buffer[bufferPos] == s.buffer[startPos] {
+			bufferPos++
+		}
+		return s.buffer[startPos], float64(bufferPos - startPos), true
+	}
+
+	// Iterate over the pages that overlap the range and the buffer
+	// simultaneously.
+	if s.minPageIndex != maxInt {
+		fromPageOffset := max(s.pageIndex(minIndex), s.minPageIndex) - s.minPageIndex
+		toPageOffset := min(s.pageIndex(maxIndex), s.minPageIndex+len(s.pages)-1) - s.minPageIndex
+		for pageOffset := fromPageOffset; pageOffset <= toPageOffset; pageOffset++ {
+			for lineIndex, count := range s.pages[pageOffset] {
+				index := s.index(s.minPageIndex+pageOffset, lineIndex)
+				if count == 0 || index < minIndex || index > maxIndex {
+					continue
+				}
+				for bufferPos < len(s.buffer) && s.buffer[bufferPos] < index {
+					bufferedIndex, bufferedCount, _ := nextBuffered()
+					if f(bufferedIndex, bufferedCount) {
+						return
+					}
+				}
+				if bufferPos < len(s.buffer) && s.buffer[bufferPos] == index {
+					_, bufferedCount, _ := nextBuffered()
+					count += bufferedCount
+				}
+				if f(index, count) {
+					return
+				}
+			}
+		}
+	}
+
+	// Iterate over the rest of the buffer.
+	for {
+		index, count, ok := nextBuffered()
+		if !ok || f(index, count) {
+			return
+		}
+	}
+}
+
 func (s *BufferedPaginatedStore) Copy() Store {
 	bufferCopy := make([]int, len(s.buffer))
 	copy(bufferCopy, s.buffer)
-	pagesCopy := make([][]float64, len(s.pages))
-	for i, page := range s.pages {
-		if len(page) > 0 {
-			pageCopy := make([]float64, len(page))
-			copy(pageCopy, page)
-			pagesCopy[i] = pageCopy
-		}
-	}
-	return &BufferedPaginatedStore{
+	c := &BufferedPaginatedStore{
 		buffer:                     bufferCopy,
 		bufferCompactionTriggerLen: s.bufferCompactionTriggerLen,
-		pages:                      pagesCopy,
+		pages:                      make([][]float64, len(s.pages)),
+		pagesCount:                 s.pagesCount,
 		minPageIndex:               s.minPageIndex,
+		minIndex:                   s.minIndex,
+		maxIndex:                   s.maxIndex,
+		isIndexRangeStale:          s.isIndexRangeStale,
 		pageLenLog2:                s.pageLenLog2,
 		pageLenMask:                s.pageLenMask,
+		pool:                       s.pool,
+	}
+	for i, page := range s.pages {
+		if len(page) > 0 {
+			c.allocatePage(&c.pages[i])
+			copy(c.pages[i], page)
+		}
+	}
+	return c
+}
+
+func (s *BufferedPaginatedStore) newEmpty() Store {
+	empty := NewBufferedPaginatedStoreWithPageSize(uint8(s.pageLenLog2))
+	empty.pool = s.pool
+	return empty
+}
+
+func (s *BufferedPaginatedStore) Downsample(factorLog2 int) Store {
+	d := NewBufferedPaginatedStoreWithPageSize(uint8(s.pageLenLog2))
+	d.pool = s.pool
+	return downsample(s, factorLog2, d)
+}
+
+// Trim removes the bins whose indexes are lower than minIndex or greater than
+// maxIndex. The remaining bins are moved to newly allocated pages, so that the
+// memory that the removed bins used is released, or returned to the pool of
+// the store, if any.
+func (s *BufferedPaginatedStore) Trim(minIndex, maxIndex int) {
+	trimmed := NewBufferedPaginatedStoreWithPageSize(uint8(s.pageLenLog2))
+	trimmed.pool = s.pool
+	addBinsInRange(s, minIndex, maxIndex, trimmed)
+	s.Clear()
+	*s = *trimmed
+}
+
+// CopyTo overwrites the content of dst with the content of the store (see
+// Store.CopyTo). If dst is a BufferedPaginatedStore, its buffer and its pages
+// are reused where their capacities allow it. dst keeps its pool, if any, in
+// which case the stores are required to have the same page size for dst to be
+// made identical to the store.
+func (s *BufferedPaginatedStore) CopyTo(dst Store) {
+	d, ok := dst.(*BufferedPaginatedStore)
+	if !ok || (d.pool != nil && d.pageLenLog2 != s.pageLenLog2) {
+		copyTo(s, dst)
+		return
+	}
+	if s == d {
+		return
 	}
+	d.dropSharedPages()
+	d.buffer = append(d.buffer[:0], s.buffer...)
+	if len(d.pages) < len(s.pages) {
+		d.pages = append(d.pages, make([][]float64, len(s.pages)-len(d.pages))...)
+	}
+	for i := range d.pages {
+		if i < len(s.pages) {
+			if d.pool != nil && cap(d.pages[i]) == 0 && len(s.pages[i]) > 0 {
+				d.pages[i] = d.pool.allocate()
+			}
+			d.pages[i] = append(d.pages[i][:0], s.pages[i]...)
+		} else {
+			// Extra pages are kept allocated to the right of the copied ones.
+			d.pages[i] = d.pages[i][:0]
+		}
+	}
+	d.bufferCompactionTriggerLen = s.bufferCompactionTriggerLen
+	d.pagesCount = s.pagesCount
+	d.cumulPageCounts = d.cumulPageCounts[:0]
+	d.minPageIndex = s.minPageIndex
+	d.minIndex = s.minIndex
+	d.maxIndex = s.maxIndex
+	d.isIndexRangeStale = s.isIndexRangeStale
+	d.pageLenLog2 = s.pageLenLog2
+	d.pageLenMask = s.pageLenMask
 }
 
+// Clear empties the store. If the store has a pool, its pages are returned to
+// the pool; otherwise, they are kept allocated.
 func (s *BufferedPaginatedStore) Clear() {
+	s.dropSharedPages()
 	s.buffer = s.buffer[:0]
 	for i := range s.pages {
-		s.pages[i] = s.pages[i][:0]
+		if s.pool != nil && cap(s.pages[i]) > 0 {
+			s.pool.release(s.pages[i])
+			s.pages[i] = nil
+		} else {
+			s.pages[i] = s.pages[i][:0]
+		}
 	}
+	s.pagesCount = 0
+	s.cumulPageCounts = s.cumulPageCounts[:0]
 	s.minPageIndex = maxInt
+	s.resetIndexRange()
+}
+
+// dropSharedPages removes from the store the pages that may be shared with a
+// snapshot, so that the memory of the remaining ones can be reused.
+func (s *BufferedPaginatedStore) dropSharedPages() {
+	for i, shared := range s.sharedPages {
+		if shared {
+			s.pages[i] = nil
+		}
+	}
+	s.sharedPages = nil
+}
+
+// ClearRetainingCapacity empties the store while keeping its pages allocated
+// and in place, so that adding indexes within the same range again does not
+// require reallocating them.
+func (s *BufferedPaginatedStore) ClearRetainingCapacity() {
+	s.dropSharedPages()
+	s.buffer = s.buffer[:0]
+	for _, page := range s.pages {
+		for i := range page {
+			page[i] = 0
+		}
+	}
+	s.pagesCount = 0
+	s.resetIndexRange()
+	s.cumulPageCounts = s.cumulPageCounts[:0]
+}
+
+// ClearRetainingPages empties the store while keeping all its pages attached,
+// zeroed, so that counts keep being added to them directly rather than to the
+// buffer. Unlike ClearRetainingCapacity, which drops the pages that are shared
+// with a snapshot, it replaces them with newly allocated pages, which suits
+// stores that are snapshotted and cleared at every interval while the range of
+// their indexes remains stable.
+func (s *BufferedPaginatedStore) ClearRetainingPages() {
+	s.buffer = s.buffer[:0]
+	for i, page := range s.pages {
+		if len(page) == 0 {
+			continue
+		}
+		if s.sharedPages != nil && s.sharedPages[i] {
+			s.pages[i] = nil
+			s.allocatePage(&s.pages[i])
+			continue
+		}
+		for j := range page {
+			page[j] = 0
+		}
+	}
+	s.sharedPages = nil
+	s.pagesCount = 0
+	s.resetIndexRange()
+	s.cumulPageCounts = s.cumulPageCounts[:0]
 }
 
 func (s *BufferedPaginatedStore) ToProto() *sketchpb.Store {
 	if s.IsEmpty() {
 		return &sketchpb.Store{}
 	}
-	// FIXME: add heuristic to use contiguousBinCounts when cheaper.
-	binCounts := make(map[int32]float64)
+	minIndex, _ := s.MinIndex()
+	maxIndex, _ := s.MaxIndex()
+	numBins := 0
+	s.ForEach(func(index int, count float64) (stop bool) {
+		numBins++
+		return false
+	})
+	// A map entry is encoded with its key, its value and some framing, which
+	// is about twice the size of a packed count of ContiguousBinCounts, so the
+	// latter is used when at least half of the indexes within the range of the
+	// non-empty bins are used.
+	if rangeLength(minIndex, maxIndex) <= 2*numBins {
+		contiguousBinCounts := make([]float64, maxIndex-minIndex+1)
+		s.ForEach(func(index int, count float64) (stop bool) {
+			contiguousBinCounts[index-minIndex] = count
+			return false
+		})
+		return &sketchpb.Store{
+			ContiguousBinCounts:      contiguousBinCounts,
+			ContiguousBinIndexOffset: int32(minIndex),
+		}
+	}
+	binCounts := make(map[int32]float64, numBins)
 	s.ForEach(func(index int, count float64) (stop bool) {
 		binCounts[int32(index)] = count
 		return false
@@ -555,6 +1325,22 @@ func (s *BufferedPaginatedStore) ToProto() *sketchpb.Store {
 	}
 }
 
+func (s *BufferedPaginatedStore) ToColumns() ([]int32, []float64) {
+	return toColumns(s)
+}
+
+func (s *BufferedPaginatedStore) Stats() Stats {
+	st := stats(s)
+	for _, page := range s.pages {
+		if len(page) > 0 {
+			st.NumPages++
+		}
+	}
+	st.NumBufferedIndexes = len(s.buffer)
+	st.NumCompactions = s.numCompactions
+	return st
+}
+
 func (s *BufferedPaginatedStore) Reweight(w float64) error {
 	if w <= 0 {
 		return errors.New("can't reweight by a negative factor")
@@ -564,9 +1350,15 @@ func (s *BufferedPaginatedStore) Reweight(w float64) error {
 	}
 	buffer := s.buffer
 	s.buffer = s.buffer[:0]
-	for _, p := range s.pages {
+	s.pagesCount = 0
+	s.cumulPageCounts = s.cumulPageCounts[:0]
+	// Tiny counts may be rounded to zero.
+	s.isIndexRangeStale = true
+	for pagePos := range s.pages {
+		p := s.ownPage(pagePos)
 		for i := range p {
 			p[i] *= w
+			s.pagesCount += p[i]
 		}
 	}
 	for _, index := range buffer {
@@ -578,13 +1370,7 @@ func (s *BufferedPaginatedStore) Reweight(w float64) error {
 func (s *BufferedPaginatedStore) Encode(b *[]byte, t enc.FlagType) {
 	s.compact()
 	if len(s.buffer) > 0 {
-		enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingIndexDeltas))
-		enc.EncodeUvarint64(b, uint64(len(s.buffer)))
-		previousIndex := 0
-		for _, index := range s.buffer {
-			enc.EncodeVarint64(b, int64(index-previousIndex))
-			previousIndex = index
-		}
+		s.encodeBuffer(b, t)
 	}
 
 	for pageOffset, page := range s.pages {
@@ -600,6 +1386,55 @@ func (s *BufferedPaginatedStore) Encode(b *[]byte, t enc.FlagType) {
 	}
 }
 
+// encodeBuffer encodes the indexes of the buffer, which compaction has sorted.
+// Repeated indexes are encoded once, along with the number of times they are
+// repeated, if that takes less space than encoding each of them.
+func (s *BufferedPaginatedStore) encodeBuffer(b *[]byte, t enc.FlagType) {
+	deltasSize := 0
+	deltasAndCountsSize := 0
+	numDistinctIndexes := 0
+	previousIndex := 0
+	for pos := 0; pos < len(s.buffer); {
+		index := s.buffer[pos]
+		end := pos + 1
+		for end < len(s.buffer) && s.buffer[end] == index {
+			end++
+		}
+		deltaSize := enc.Varint64Size(int64(index - previousIndex))
+		deltasSize += deltaSize + (end-pos-1)*enc.Varint64Size(0)
+		deltasAndCountsSize += deltaSize + enc.Varfloat64Size(float64(end-pos))
+		numDistinctIndexes++
+		previousIndex = index
+		pos = end
+	}
+	deltasSize += enc.Uvarint64Size(uint64(len(s.buffer)))
+	deltasAndCountsSize += enc.Uvarint64Size(uint64(numDistinctIndexes))
+
+	previousIndex = 0
+	if deltasSize <= deltasAndCountsSize {
+		enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingIndexDeltas))
+		enc.EncodeUvarint64(b, uint64(len(s.buffer)))
+		for _, index := range s.buffer {
+			enc.EncodeVarint64(b, int64(index-previousIndex))
+			previousIndex = index
+		}
+		return
+	}
+	enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingIndexDeltasAndCounts))
+	enc.EncodeUvarint64(b, uint64(numDistinctIndexes))
+	for pos := 0; pos < len(s.buffer); {
+		index := s.buffer[pos]
+		end := pos + 1
+		for end < len(s.buffer) && s.buffer[end] == index {
+			end++
+		}
+		enc.EncodeVarint64(b, int64(index-previousIndex))
+		enc.EncodeVarfloat64(b, float64(end-pos))
+		previousIndex = index
+		pos = end
+	}
+}
+
 func (s *BufferedPaginatedStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.SubFlag) error {
 	switch encodingMode {
 
@@ -621,6 +1456,7 @@ func (s *BufferedPaginatedStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.
 				}
 				index += indexDelta
 				s.buffer = append(s.buffer, int(index))
+				s.extendIndexRange(int(index))
 			}
 			remaining -= batchSize
 			if remaining == 0 {
@@ -643,6 +1479,7 @@ func (s *BufferedPaginatedStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.
 			return err
 		}
 		pageLen := 1 << s.pageLenLog2
+		s.cumulPageCounts = s.cumulPageCounts[:0]
 		for i := uint64(0); i < numBins; {
 			page := s.page(s.pageIndex(int(indexOffset)), true)
 			lineIndex := s.lineIndex(int(indexOffset))
@@ -652,6 +1489,10 @@ func (s *BufferedPaginatedStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.
 					return err
 				}
 				page[lineIndex] += count
+				s.pagesCount += count
+				if count > 0 {
+					s.extendIndexRange(int(indexOffset))
+				}
 				lineIndex += int(indexDelta)
 				indexOffset += indexDelta
 				i++
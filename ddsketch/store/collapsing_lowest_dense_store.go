@@ -7,6 +7,7 @@ package store
 
 import (
 	"math"
+	"unsafe"
 
 	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
 )
@@ -17,6 +18,9 @@ type CollapsingLowestDenseStore struct {
 	DenseStore
 	maxNumBins  int
 	isCollapsed bool
+	// collapsedCount is the part of the count of the bin of lowest index that
+	// has been added on behalf of lower indexes.
+	collapsedCount float64
 }
 
 func NewCollapsingLowestDenseStore(maxNumBins int) *CollapsingLowestDenseStore {
@@ -24,7 +28,7 @@ func NewCollapsingLowestDenseStore(maxNumBins int) *CollapsingLowestDenseStore {
 	// When the first value is added, a small number of bins are allocated. The number of bins will
 	// grow as needed up to maxNumBins.
 	return &CollapsingLowestDenseStore{
-		DenseStore:  DenseStore{minIndex: math.MaxInt32, maxIndex: math.MinInt32},
+		DenseStore:  DenseStore{denseBins: newDenseBins[float64]()},
 		maxNumBins:  maxNumBins,
 		isCollapsed: false,
 	}
@@ -43,24 +47,96 @@ func (s *CollapsingLowestDenseStore) AddBin(bin Bin) {
 	s.AddWithCount(index, count)
 }
 
+// AddBins adds the provided bins to the store, extending the range of its
+// bins, and collapsing them if needed, at most once.
+func (s *CollapsingLowestDenseStore) AddBins(bins []Bin) {
+	minIndex, maxIndex, ok := binsRange(bins)
+	if !ok {
+		return
+	}
+	s.own()
+	added := -1
+	if s.IsEmpty() {
+		// The range of an empty store can only be extended to a single index,
+		// so the highest bin, which is never collapsed, is added first.
+		for i, bin := range bins {
+			if bin.index == maxIndex && bin.count != 0 {
+				s.AddWithCount(bin.index, bin.count)
+				added = i
+				break
+			}
+		}
+	}
+	if s.isCollapsed {
+		// The range is not extended towards the collapsed bins.
+		minIndex = s.minIndex
+	}
+	s.extendRange(minIndex, max(minIndex, maxIndex))
+	for i, bin := range bins {
+		if i != added {
+			s.AddWithCount(bin.index, bin.count)
+		}
+	}
+}
+
 func (s *CollapsingLowestDenseStore) AddWithCount(index int, count float64) {
 	if count == 0 {
 		return
 	}
+	s.own()
 	arrayIndex := s.normalize(index)
+	if arrayIndex+s.offset != index {
+		s.collapsedCount += count
+	}
 	s.bins[arrayIndex] += count
 	s.count += count
 }
 
+func (s *CollapsingLowestDenseStore) SubtractWithCount(index int, count float64) {
+	if !isSubtractableCount(count) || s.IsEmpty() || index > s.maxIndex {
+		return
+	}
+	if index < s.minIndex {
+		if !s.isCollapsed {
+			return
+		}
+		index = s.minIndex
+	}
+	edgeIndex := s.minIndex
+	s.subtractAt(index-s.offset, count)
+	s.updateCollapsedCount(edgeIndex)
+}
+
+func (s *CollapsingLowestDenseStore) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
+}
+
+// updateCollapsedCount updates the collapsed count after counts have been
+// removed, given the index of the bin of lowest index beforehand. The
+// counts that are removed from that bin are assumed to be the ones that have
+// not been collapsed first.
+func (s *CollapsingLowestDenseStore) updateCollapsedCount(edgeIndex int) {
+	if s.IsEmpty() {
+		s.isCollapsed = false
+		s.collapsedCount = 0
+	} else if s.minIndex != edgeIndex {
+		s.collapsedCount = 0
+	} else {
+		s.collapsedCount = math.Min(s.collapsedCount, s.bins[s.minIndex-s.offset])
+	}
+}
+
 // Normalize the store, if necessary, so that the counter of the specified index can be updated.
+// Collapsed indexes are mapped to the bin of lowest index, which is s.minIndex rather
+// than the start of the array, as SubtractWithCount may have shrunk the range.
 func (s *CollapsingLowestDenseStore) normalize(index int) int {
 	if index < s.minIndex {
 		if s.isCollapsed {
-			return 0
+			return s.minIndex - s.offset
 		} else {
 			s.extendRange(index, index)
 			if s.isCollapsed {
-				return 0
+				return s.minIndex - s.offset
 			}
 		}
 	} else if index > s.maxIndex {
@@ -73,38 +149,54 @@ func (s *CollapsingLowestDenseStore) getNewLength(newMinIndex, newMaxIndex int)
 	return min(s.DenseStore.getNewLength(newMinIndex, newMaxIndex), s.maxNumBins)
 }
 
-func (s *CollapsingLowestDenseStore) extendRange(newMinIndex, newMaxIndex int) {
-	newMinIndex = min(newMinIndex, s.minIndex)
-	newMaxIndex = max(newMaxIndex, s.maxIndex)
+// Shrink reallocates the bins of the store so that they only span the range
+// of its non-empty bins, with some margin (see DenseStore.Shrink).
+func (s *CollapsingLowestDenseStore) Shrink() {
+	s.shrink(s.getNewLength)
 	if s.IsEmpty() {
-		initialLength := s.getNewLength(newMinIndex, newMaxIndex)
-		s.bins = append(s.bins, make([]float64, initialLength)...)
-		s.offset = newMinIndex
-		s.minIndex = newMinIndex
-		s.maxIndex = newMaxIndex
-		s.adjust(newMinIndex, newMaxIndex)
-	} else if newMinIndex >= s.offset && newMaxIndex < s.offset+len(s.bins) {
-		s.minIndex = newMinIndex
-		s.maxIndex = newMaxIndex
-	} else {
-		// To avoid shifting too often when nearing the capacity of the array,
-		// we may grow it before we actually reach the capacity.
-		newLength := s.getNewLength(newMinIndex, newMaxIndex)
-		if newLength > len(s.bins) {
-			s.bins = append(s.bins, make([]float64, newLength-len(s.bins))...)
-		}
-		s.adjust(newMinIndex, newMaxIndex)
+		s.isCollapsed = false
+		s.collapsedCount = 0
 	}
 }
 
+// Trim removes the bins whose indexes are lower than minIndex or greater than
+// maxIndex, then reallocates the bins of the store, as Shrink does.
+func (s *CollapsingLowestDenseStore) Trim(minIndex, maxIndex int) {
+	edgeIndex := s.minIndex
+	s.trim(minIndex, maxIndex)
+	s.updateCollapsedCount(edgeIndex)
+	s.Shrink()
+}
+
+func (s *CollapsingLowestDenseStore) Stats() Stats {
+	return stats(s)
+}
+
+func (s *CollapsingLowestDenseStore) Reweight(w float64) error {
+	if err := s.DenseStore.Reweight(w); err != nil {
+		return err
+	}
+	s.collapsedCount *= w
+	return nil
+}
+
+func (s *CollapsingLowestDenseStore) extendRange(newMinIndex, newMaxIndex int) {
+	s.extend(newMinIndex, newMaxIndex, s.IsEmpty(), s.getNewLength, s.adjust)
+}
+
 // Adjust bins, offset, minIndex and maxIndex, without resizing the bins slice in order to make it fit the
 // specified range.
 func (s *CollapsingLowestDenseStore) adjust(newMinIndex, newMaxIndex int) {
-	if newMaxIndex-newMinIndex+1 > len(s.bins) {
+	if rangeLength(newMinIndex, newMaxIndex) > len(s.bins) {
 		// The range of indices is too wide, buckets of lowest indices need to be collapsed.
 		newMinIndex = newMaxIndex - len(s.bins) + 1
 		if newMinIndex >= s.maxIndex {
 			// There will be only one non-empty bucket.
+			if newMinIndex > s.maxIndex {
+				s.collapsedCount = s.count
+			} else if s.minIndex < s.maxIndex {
+				s.collapsedCount = s.count - s.bins[s.maxIndex-s.offset]
+			}
 			s.bins = make([]float64, len(s.bins))
 			s.offset = newMinIndex
 			s.minIndex = newMinIndex
@@ -119,6 +211,10 @@ func (s *CollapsingLowestDenseStore) adjust(newMinIndex, newMaxIndex int) {
 				}
 				s.resetBins(s.minIndex, newMinIndex-1)
 				s.bins[newMinIndex-s.offset] += n
+				if s.minIndex < newMinIndex {
+					// The collapsed bins include the former bin of lowest index.
+					s.collapsedCount = n
+				}
 				s.minIndex = newMinIndex
 				// Shift the buckets to make room for newMaxIndex.
 				s.shiftCounts(shift)
@@ -147,12 +243,19 @@ func (s *CollapsingLowestDenseStore) MergeWith(other Store) {
 		})
 		return
 	}
+	s.own()
 	if o.minIndex < s.minIndex || o.maxIndex > s.maxIndex {
 		s.extendRange(o.minIndex, o.maxIndex)
 	}
 	idx := o.minIndex
+	if idx == s.minIndex && o.isCollapsed {
+		// The bins of lowest index of both stores are merged.
+		s.isCollapsed = true
+		s.collapsedCount += o.collapsedCount
+	}
 	for ; idx < s.minIndex && idx <= o.maxIndex; idx++ {
-		s.bins[0] += o.bins[idx-o.offset]
+		s.bins[s.minIndex-s.offset] += o.bins[idx-o.offset]
+		s.collapsedCount += o.bins[idx-o.offset]
 	}
 	for ; idx < o.maxIndex; idx++ {
 		s.bins[idx-s.offset] += o.bins[idx-o.offset]
@@ -165,25 +268,99 @@ func (s *CollapsingLowestDenseStore) MergeWith(other Store) {
 	s.count += o.count
 }
 
+// IsCollapsed returns whether bins have been collapsed since the store was
+// created or last cleared, in which case the bin of lowest index may hold
+// counts of values whose indexes are lower.
+func (s *CollapsingLowestDenseStore) IsCollapsed() bool {
+	return s.isCollapsed
+}
+
+// CollapsedCount returns the part of the count of the bin of lowest index
+// that has been added on behalf of lower indexes because of collapsing,
+// that is, the count of the values that the store does not locate accurately.
+// It is zero if IsCollapsed returns false.
+func (s *CollapsingLowestDenseStore) CollapsedCount() float64 {
+	return s.collapsedCount
+}
+
+func (s *CollapsingLowestDenseStore) MemorySize() int {
+	return int(unsafe.Sizeof(*s)) + s.binsMemorySize()
+}
+
+// memorySizeIncrease returns the lowest increase of the memory size of the
+// store that adding a count at the provided index would lead to, and whether
+// the addition is undoable, which is not the case if it collapses bins (see
+// memoryProjector).
+func (s *CollapsingLowestDenseStore) memorySizeIncrease(index int) (int, bool) {
+	if s.isCollapsed && index < s.minIndex {
+		return 0, false
+	}
+	binsMemorySize, collapses := s.binsMemorySizeAfterExtending(index, s.getNewLength)
+	return binsMemorySize - s.binsMemorySize(), !collapses && !s.shared
+}
+
 func (s *CollapsingLowestDenseStore) Copy() Store {
 	bins := make([]float64, len(s.bins))
 	copy(bins, s.bins)
 	return &CollapsingLowestDenseStore{
 		DenseStore: DenseStore{
-			bins:     bins,
-			count:    s.count,
-			offset:   s.offset,
-			minIndex: s.minIndex,
-			maxIndex: s.maxIndex,
+			denseBins: denseBins[float64]{
+				bins:     bins,
+				offset:   s.offset,
+				minIndex: s.minIndex,
+				maxIndex: s.maxIndex,
+			},
+			count: s.count,
 		},
-		maxNumBins:  s.maxNumBins,
-		isCollapsed: s.isCollapsed,
+		maxNumBins:     s.maxNumBins,
+		isCollapsed:    s.isCollapsed,
+		collapsedCount: s.collapsedCount,
+	}
+}
+
+func (s *CollapsingLowestDenseStore) newEmpty() Store {
+	return NewCollapsingLowestDenseStore(s.maxNumBins)
+}
+
+func (s *CollapsingLowestDenseStore) Downsample(factorLog2 int) Store {
+	return downsample(s, factorLog2, NewCollapsingLowestDenseStore(s.maxNumBins))
+}
+
+// Snapshot returns a copy of the store that shares its bins with the store
+// until either of them is modified (see DenseStore.Snapshot).
+func (s *CollapsingLowestDenseStore) Snapshot() *CollapsingLowestDenseStore {
+	return &CollapsingLowestDenseStore{
+		DenseStore:     *s.DenseStore.Snapshot(),
+		maxNumBins:     s.maxNumBins,
+		isCollapsed:    s.isCollapsed,
+		collapsedCount: s.collapsedCount,
+	}
+}
+
+func (s *CollapsingLowestDenseStore) CopyTo(dst Store) {
+	switch d := dst.(type) {
+	case *CollapsingLowestDenseStore:
+		s.DenseStore.copyTo(&d.DenseStore)
+		d.maxNumBins = s.maxNumBins
+		d.isCollapsed = s.isCollapsed
+		d.collapsedCount = s.collapsedCount
+	case *DenseStore:
+		s.DenseStore.copyTo(d)
+	default:
+		copyTo(s, dst)
 	}
 }
 
 func (s *CollapsingLowestDenseStore) Clear() {
 	s.DenseStore.Clear()
 	s.isCollapsed = false
+	s.collapsedCount = 0
+}
+
+func (s *CollapsingLowestDenseStore) ClearRetainingCapacity() {
+	s.DenseStore.ClearRetainingCapacity()
+	s.isCollapsed = false
+	s.collapsedCount = 0
 }
 
 func (s *CollapsingLowestDenseStore) DecodeAndMergeWith(r *[]byte, encodingMode enc.SubFlag) error {
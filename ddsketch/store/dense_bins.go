@@ -0,0 +1,122 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import "math"
+
+// denseBins holds the contiguous bins of a dense store, whose counts are of
+// type C, and the range of the indexes of the store. It implements the way
+// DenseStore, the collapsing stores and DenseStoreOf grow their bins and clamp
+// indexes, so that they all span at most maxDenseStoreLength bins.
+type denseBins[C Count] struct {
+	bins     []C
+	offset   int
+	minIndex int
+	maxIndex int
+}
+
+// newDenseBins returns bins that hold no index.
+func newDenseBins[C Count]() denseBins[C] {
+	return denseBins[C]{minIndex: math.MaxInt32, maxIndex: math.MinInt32}
+}
+
+// clampIndex returns the index that is the closest to index among the ones
+// that the store can hold without spanning more than maxDenseStoreLength bins.
+func (b *denseBins[C]) clampIndex(index int) int {
+	if b.minIndex > b.maxIndex {
+		return index
+	}
+	if index > b.maxIndex && rangeLength(b.minIndex, index) > maxDenseStoreLength {
+		return b.minIndex + maxDenseStoreLength - 1
+	}
+	if index < b.minIndex && rangeLength(index, b.maxIndex) > maxDenseStoreLength {
+		return b.maxIndex - maxDenseStoreLength + 1
+	}
+	return index
+}
+
+// rangeLength returns the number of indexes from minIndex to maxIndex, or
+// maxInt if it overflows an int.
+func rangeLength(minIndex, maxIndex int) int {
+	if minIndex > maxIndex {
+		return 0
+	}
+	if length := uint(maxIndex) - uint(minIndex) + 1; length != 0 && length <= uint(maxInt) {
+		return int(length)
+	}
+	return maxInt
+}
+
+func (b *denseBins[C]) getNewLength(newMinIndex, newMaxIndex int) int {
+	desiredLength := rangeLength(newMinIndex, newMaxIndex)
+	if desiredLength > maxDenseStoreLength-arrayLengthOverhead {
+		return maxDenseStoreLength
+	}
+	return int((float64(desiredLength+arrayLengthOverhead-1)/arrayLengthGrowthIncrement + 1) * arrayLengthGrowthIncrement)
+}
+
+// extend extends the range of the indexes so that it spans from newMinIndex to
+// newMaxIndex, growing the bins to the length that getNewLength returns if they
+// cannot hold that range, then calling adjust to move the counts within the
+// bins so that they fit the new range. isEmpty tells whether the store holds
+// no count.
+func (b *denseBins[C]) extend(newMinIndex, newMaxIndex int, isEmpty bool, getNewLength func(newMinIndex, newMaxIndex int) int, adjust func(newMinIndex, newMaxIndex int)) {
+	// The range of empty stores is not extended, as their indexes are
+	// sentinel values.
+	if b.minIndex <= b.maxIndex {
+		newMinIndex = min(newMinIndex, b.minIndex)
+		newMaxIndex = max(newMaxIndex, b.maxIndex)
+	}
+
+	if newMinIndex >= b.offset && newMaxIndex < b.offset+len(b.bins) {
+		// This also applies to empty stores whose bins have been retained by
+		// ClearRetainingCapacity, as they are all zero.
+		b.minIndex = newMinIndex
+		b.maxIndex = newMaxIndex
+	} else if isEmpty {
+		initialLength := getNewLength(newMinIndex, newMaxIndex)
+		if initialLength > len(b.bins) {
+			b.bins = append(b.bins, make([]C, initialLength-len(b.bins))...)
+		}
+		b.offset = newMinIndex
+		b.minIndex = newMinIndex
+		b.maxIndex = newMaxIndex
+		adjust(newMinIndex, newMaxIndex)
+	} else {
+		// To avoid shifting too often when nearing the capacity of the array,
+		// we may grow it before we actually reach the capacity.
+		newLength := getNewLength(newMinIndex, newMaxIndex)
+		if newLength > len(b.bins) {
+			b.bins = append(b.bins, make([]C, newLength-len(b.bins))...)
+		}
+		adjust(newMinIndex, newMaxIndex)
+	}
+}
+
+func (b *denseBins[C]) centerCounts(newMinIndex, newMaxIndex int) {
+	midIndex := newMinIndex + (newMaxIndex-newMinIndex+1)/2
+	b.shiftCounts(b.offset + len(b.bins)/2 - midIndex)
+	b.minIndex = newMinIndex
+	b.maxIndex = newMaxIndex
+}
+
+func (b *denseBins[C]) shiftCounts(shift int) {
+	minArrIndex := b.minIndex - b.offset
+	maxArrIndex := b.maxIndex - b.offset
+	copy(b.bins[minArrIndex+shift:], b.bins[minArrIndex:maxArrIndex+1])
+	if shift > 0 {
+		b.resetBins(b.minIndex, b.minIndex+shift-1)
+	} else {
+		b.resetBins(b.maxIndex+shift+1, b.maxIndex)
+	}
+	b.offset -= shift
+}
+
+func (b *denseBins[C]) resetBins(fromIndex, toIndex int) {
+	for i := fromIndex - b.offset; i <= toIndex-b.offset; i++ {
+		b.bins[i] = 0
+	}
+}
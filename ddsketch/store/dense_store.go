@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"unsafe"
 
 	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
 	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
@@ -21,20 +22,57 @@ const (
 
 	// Grow the bins with an extra growthBuffer bins to prevent growing too often
 	growthBuffer = 128
+
+	// maxDenseStoreLength is the maximum number of bins that dense stores
+	// allocate, which bounds their memory size to 128 MiB, whatever the
+	// indexes that are added to them. Logarithmic mappings with a relative
+	// accuracy of 0.1% index the whole range of float64 values with fewer than
+	// 1.5 million bins.
+	maxDenseStoreLength = 1 << 24
 )
 
-// DenseStore is a dynamically growing contiguous (non-sparse) store. The number of bins are
-// bound only by the size of the slice that can be allocated.
+// DenseStore is a dynamically growing contiguous (non-sparse) store. It spans at most
+// maxDenseStoreLength bins: indexes that are too far from the ones of the store to be held
+// without exceeding that number are clamped to the closest index that can be held, i.e., they
+// are collapsed into the extreme bins that the store can span.
 type DenseStore struct {
-	bins     []float64
-	count    float64
-	offset   int
-	minIndex int
-	maxIndex int
+	denseBins[float64]
+	count  float64
+	shared bool // bins may be shared with snapshots and must be copied before being modified
 }
 
 func NewDenseStore() *DenseStore {
-	return &DenseStore{minIndex: math.MaxInt32, maxIndex: math.MinInt32}
+	return &DenseStore{denseBins: newDenseBins[float64]()}
+}
+
+// NewDenseStoreWithRange returns an empty DenseStore whose bins are allocated
+// upfront so that they span the indexes from minIndex to maxIndex (both
+// inclusive). Callers that know the range of the indexes that the store will
+// hold (e.g., the indexes of the latencies between 1µs and 60s for a given
+// index mapping) can therefore avoid the copies that growing the bins
+// requires. The store still grows as usual if indexes are out of that range.
+// Nothing is allocated if the range is empty or spans more indexes than a
+// dense store can hold.
+func NewDenseStoreWithRange(minIndex, maxIndex int) *DenseStore {
+	s := NewDenseStore()
+	if length := rangeLength(minIndex, maxIndex); length > 0 && length <= maxDenseStoreLength {
+		s.bins = make([]float64, length)
+		s.offset = minIndex
+	}
+	return s
+}
+
+// NewDenseStoreWithCapacity returns an empty DenseStore whose bins are
+// allocated upfront so that it can hold any numBins contiguous indexes without
+// growing them, wherever they are.
+func NewDenseStoreWithCapacity(numBins int) *DenseStore {
+	s := NewDenseStore()
+	if numBins > 0 {
+		// The bins are grown ahead of their capacity being reached, so that
+		// they are not shifted too often, which is accounted for upfront.
+		s.bins = make([]float64, s.getNewLength(0, min(numBins, maxDenseStoreLength)-1))
+	}
+	return s
 }
 
 func (s *DenseStore) Add(index int) {
@@ -48,52 +86,115 @@ func (s *DenseStore) AddBin(bin Bin) {
 	s.AddWithCount(bin.index, bin.count)
 }
 
+// AddBins adds the provided bins to the store, extending the range of its
+// bins at most once.
+func (s *DenseStore) AddBins(bins []Bin) {
+	minIndex, maxIndex, ok := binsRange(bins)
+	if !ok {
+		return
+	}
+	if rangeLength(minIndex, maxIndex) > maxDenseStoreLength || s.clampIndex(minIndex) != minIndex || s.clampIndex(maxIndex) != maxIndex {
+		// Some indexes need to be clamped.
+		addBins(s, bins)
+		return
+	}
+	s.own()
+	if minIndex < s.minIndex || maxIndex > s.maxIndex {
+		s.extendRange(minIndex, maxIndex)
+	}
+	for _, bin := range bins {
+		if bin.count != 0 {
+			s.bins[bin.index-s.offset] += bin.count
+			s.count += bin.count
+		}
+	}
+}
+
 func (s *DenseStore) AddWithCount(index int, count float64) {
 	if count == 0 {
 		return
 	}
+	s.own()
 	arrayIndex := s.normalize(index)
 	s.bins[arrayIndex] += count
 	s.count += count
 }
 
+// Snapshot returns a copy of the store that shares its bins with the store.
+// The bins are only copied, as a whole, once either the store or the snapshot
+// is modified, so that the snapshot can be read by another goroutine while the
+// store keeps being modified. Neither of them is otherwise safe for concurrent
+// use.
+func (s *DenseStore) Snapshot() *DenseStore {
+	s.shared = true
+	return &DenseStore{
+		denseBins: denseBins[float64]{
+			bins:     s.bins[:len(s.bins):len(s.bins)],
+			offset:   s.offset,
+			minIndex: s.minIndex,
+			maxIndex: s.maxIndex,
+		},
+		count:  s.count,
+		shared: true,
+	}
+}
+
+// own copies the bins if they may be shared with a snapshot, so that they can
+// be modified.
+func (s *DenseStore) own() {
+	if s.shared {
+		s.bins = append([]float64(nil), s.bins...)
+		s.shared = false
+	}
+}
+
+func (s *DenseStore) SubtractWithCount(index int, count float64) {
+	if !isSubtractableCount(count) || index < s.minIndex || index > s.maxIndex {
+		return
+	}
+	s.subtractAt(index-s.offset, count)
+}
+
+func (s *DenseStore) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
+}
+
+// subtractAt subtracts count from the counter at the specified array index,
+// clamping it at zero, and shrinks the range of indices, if necessary, so that
+// its bounds are non-empty bins.
+func (s *DenseStore) subtractAt(arrayIndex int, count float64) {
+	s.own()
+	removed := math.Min(s.bins[arrayIndex], count)
+	s.bins[arrayIndex] -= removed
+	s.count -= removed
+	s.fitRange()
+}
+
+// fitRange shrinks the range of indices, if necessary, so that its bounds are
+// non-empty bins, and clears the store if all bins are empty.
+func (s *DenseStore) fitRange() {
+	for s.minIndex <= s.maxIndex && s.bins[s.minIndex-s.offset] <= 0 {
+		s.minIndex++
+	}
+	for s.maxIndex >= s.minIndex && s.bins[s.maxIndex-s.offset] <= 0 {
+		s.maxIndex--
+	}
+	if s.minIndex > s.maxIndex {
+		s.Clear()
+	}
+}
+
 // Normalize the store, if necessary, so that the counter of the specified index can be updated.
 func (s *DenseStore) normalize(index int) int {
 	if index < s.minIndex || index > s.maxIndex {
+		index = s.clampIndex(index)
 		s.extendRange(index, index)
 	}
 	return index - s.offset
 }
 
-func (s *DenseStore) getNewLength(newMinIndex, newMaxIndex int) int {
-	desiredLength := newMaxIndex - newMinIndex + 1
-	return int((float64(desiredLength+arrayLengthOverhead-1)/arrayLengthGrowthIncrement + 1) * arrayLengthGrowthIncrement)
-}
-
 func (s *DenseStore) extendRange(newMinIndex, newMaxIndex int) {
-
-	newMinIndex = min(newMinIndex, s.minIndex)
-	newMaxIndex = max(newMaxIndex, s.maxIndex)
-
-	if s.IsEmpty() {
-		initialLength := s.getNewLength(newMinIndex, newMaxIndex)
-		s.bins = append(s.bins, make([]float64, initialLength)...)
-		s.offset = newMinIndex
-		s.minIndex = newMinIndex
-		s.maxIndex = newMaxIndex
-		s.adjust(newMinIndex, newMaxIndex)
-	} else if newMinIndex >= s.offset && newMaxIndex < s.offset+len(s.bins) {
-		s.minIndex = newMinIndex
-		s.maxIndex = newMaxIndex
-	} else {
-		// To avoid shifting too often when nearing the capacity of the array,
-		// we may grow it before we actually reach the capacity.
-		newLength := s.getNewLength(newMinIndex, newMaxIndex)
-		if newLength > len(s.bins) {
-			s.bins = append(s.bins, make([]float64, newLength-len(s.bins))...)
-		}
-		s.adjust(newMinIndex, newMaxIndex)
-	}
+	s.extend(newMinIndex, newMaxIndex, s.IsEmpty(), s.getNewLength, s.adjust)
 }
 
 // Adjust bins, offset, minIndex and maxIndex, without resizing the bins slice in order to make it fit the
@@ -102,28 +203,68 @@ func (s *DenseStore) adjust(newMinIndex, newMaxIndex int) {
 	s.centerCounts(newMinIndex, newMaxIndex)
 }
 
-func (s *DenseStore) centerCounts(newMinIndex, newMaxIndex int) {
-	midIndex := newMinIndex + (newMaxIndex-newMinIndex+1)/2
-	s.shiftCounts(s.offset + len(s.bins)/2 - midIndex)
-	s.minIndex = newMinIndex
-	s.maxIndex = newMaxIndex
+// Shrink reallocates the bins of the store so that they only span the range
+// of its non-empty bins, with some margin. Bins are never reallocated to a
+// smaller size otherwise, so that, after the range of the indexes of the store
+// has shrunk (e.g., after bins have been subtracted or after the store has
+// been cleared and refilled), the store may use much more memory than needed.
+func (s *DenseStore) Shrink() {
+	s.shrink(s.getNewLength)
 }
 
-func (s *DenseStore) shiftCounts(shift int) {
-	minArrIndex := s.minIndex - s.offset
-	maxArrIndex := s.maxIndex - s.offset
-	copy(s.bins[minArrIndex+shift:], s.bins[minArrIndex:maxArrIndex+1])
-	if shift > 0 {
-		s.resetBins(s.minIndex, s.minIndex+shift-1)
-	} else {
-		s.resetBins(s.maxIndex+shift+1, s.maxIndex)
+// shrink reallocates the bins to the length that getNewLength returns for the
+// range of the non-empty bins, if smaller than their current capacity.
+func (s *DenseStore) shrink(getNewLength func(newMinIndex, newMaxIndex int) int) {
+	for s.minIndex <= s.maxIndex && s.bins[s.minIndex-s.offset] <= 0 {
+		s.minIndex++
+	}
+	for s.maxIndex >= s.minIndex && s.bins[s.maxIndex-s.offset] <= 0 {
+		s.maxIndex--
+	}
+	if s.minIndex > s.maxIndex {
+		s.Clear()
+		s.bins = nil
+		return
+	}
+	newLength := getNewLength(s.minIndex, s.maxIndex)
+	if newLength >= cap(s.bins) {
+		return
 	}
-	s.offset -= shift
+	bins := make([]float64, newLength)
+	midIndex := s.minIndex + (s.maxIndex-s.minIndex+1)/2
+	offset := midIndex - newLength/2
+	copy(bins[s.minIndex-offset:], s.bins[s.minIndex-s.offset:s.maxIndex-s.offset+1])
+	s.bins = bins
+	s.offset = offset
+	s.shared = false
 }
 
-func (s *DenseStore) resetBins(fromIndex, toIndex int) {
-	for i := fromIndex - s.offset; i <= toIndex-s.offset; i++ {
-		s.bins[i] = 0
+// Trim removes the bins whose indexes are lower than minIndex or greater than
+// maxIndex, then reallocates the bins of the store, as Shrink does, so that
+// the memory that the removed bins used is released.
+func (s *DenseStore) Trim(minIndex, maxIndex int) {
+	s.trim(minIndex, maxIndex)
+	s.Shrink()
+}
+
+// trim resets the bins whose indexes are lower than minIndex or greater than
+// maxIndex, without reallocating the bins.
+func (s *DenseStore) trim(minIndex, maxIndex int) {
+	if s.IsEmpty() || (minIndex <= s.minIndex && maxIndex >= s.maxIndex) {
+		return
+	}
+	s.own()
+	for index := s.minIndex; index <= s.maxIndex && index < minIndex; index++ {
+		s.bins[index-s.offset] = 0
+	}
+	for index := s.maxIndex; index >= s.minIndex && index > maxIndex; index-- {
+		s.bins[index-s.offset] = 0
+	}
+	// The count is recomputed rather than decremented to avoid accumulating
+	// floating-point errors.
+	s.count = 0
+	for index := max(s.minIndex, minIndex); index <= min(s.maxIndex, maxIndex); index++ {
+		s.count += s.bins[index-s.offset]
 	}
 }
 
@@ -131,6 +272,13 @@ func (s *DenseStore) IsEmpty() bool {
 	return s.count == 0
 }
 
+func (s *DenseStore) GetCountAtIndex(index int) float64 {
+	if index < s.minIndex || index > s.maxIndex {
+		return 0
+	}
+	return s.bins[index-s.offset]
+}
+
 func (s *DenseStore) TotalCount() float64 {
 	return s.count
 }
@@ -149,6 +297,55 @@ func (s *DenseStore) MaxIndex() (int, error) {
 	return s.maxIndex, nil
 }
 
+// MaxCountBin returns the bin with the highest count, the one with the lowest
+// index if there are several.
+func (s *DenseStore) MaxCountBin() (Bin, error) {
+	if s.IsEmpty() {
+		return Bin{}, errUndefinedMaxCount
+	}
+	maxCountBin := Bin{index: s.minIndex, count: s.bins[s.minIndex-s.offset]}
+	for index := s.minIndex + 1; index <= s.maxIndex; index++ {
+		if count := s.bins[index-s.offset]; count > maxCountBin.count {
+			maxCountBin = Bin{index: index, count: count}
+		}
+	}
+	return maxCountBin, nil
+}
+
+func (s *DenseStore) MemorySize() int {
+	return int(unsafe.Sizeof(*s)) + s.binsMemorySize()
+}
+
+func (s *DenseStore) binsMemorySize() int {
+	return cap(s.bins) * int(unsafe.Sizeof(float64(0)))
+}
+
+// memorySizeIncrease returns the lowest increase of the memory size of the
+// store that adding a count at the provided index would lead to (see
+// memoryProjector).
+func (s *DenseStore) memorySizeIncrease(index int) (int, bool) {
+	binsMemorySize, _ := s.binsMemorySizeAfterExtending(s.clampIndex(index), s.getNewLength)
+	// Bins that are shared with a snapshot are copied before being modified.
+	return binsMemorySize - s.binsMemorySize(), !s.shared
+}
+
+// binsMemorySizeAfterExtending returns the lowest memory size of the bins after
+// extending the range of the store to the provided index, given the length
+// that the bins are grown to, and whether the range would then span more bins
+// than that length.
+func (s *DenseStore) binsMemorySizeAfterExtending(index int, getNewLength func(newMinIndex, newMaxIndex int) int) (int, bool) {
+	newMinIndex, newMaxIndex := index, index
+	if !s.IsEmpty() {
+		newMinIndex = min(newMinIndex, s.minIndex)
+		newMaxIndex = max(newMaxIndex, s.maxIndex)
+	}
+	if newMinIndex >= s.offset && newMaxIndex < s.offset+len(s.bins) {
+		return s.binsMemorySize(), false
+	}
+	newLength := max(len(s.bins), getNewLength(newMinIndex, newMaxIndex))
+	return max(cap(s.bins), newLength) * int(unsafe.Sizeof(float64(0))), rangeLength(newMinIndex, newMaxIndex) > newLength
+}
+
 // Return the key for the value at rank
 func (s *DenseStore) KeyAtRank(rank float64) int {
 	if rank < 0 {
@@ -170,12 +367,18 @@ func (s *DenseStore) MergeWith(other Store) {
 	}
 	o, ok := other.(*DenseStore)
 	if !ok {
-		other.ForEach(func(index int, count float64) (stop bool) {
+		s.mergeWithStore(other)
+		return
+	}
+	if s.clampIndex(o.minIndex) != o.minIndex || s.clampIndex(o.maxIndex) != o.maxIndex {
+		// Some indexes need to be clamped.
+		o.ForEach(func(index int, count float64) (stop bool) {
 			s.AddWithCount(index, count)
 			return false
 		})
 		return
 	}
+	s.own()
 	if o.minIndex < s.minIndex || o.maxIndex > s.maxIndex {
 		s.extendRange(o.minIndex, o.maxIndex)
 	}
@@ -185,6 +388,37 @@ func (s *DenseStore) MergeWith(other Store) {
 	s.count += o.count
 }
 
+// mergeWithStore merges a store of another type, extending the range of the
+// bins once so that it covers the indexes of the other store, unless some of
+// them need to be clamped, rather than every time a bin is added.
+func (s *DenseStore) mergeWithStore(other Store) {
+	minIndex, minErr := other.MinIndex()
+	maxIndex, maxErr := other.MaxIndex()
+	if minErr != nil || maxErr != nil || rangeLength(minIndex, maxIndex) > maxDenseStoreLength ||
+		s.clampIndex(minIndex) != minIndex || s.clampIndex(maxIndex) != maxIndex {
+		other.ForEach(func(index int, count float64) (stop bool) {
+			s.AddWithCount(index, count)
+			return false
+		})
+		return
+	}
+	s.own()
+	if minIndex < s.minIndex || maxIndex > s.maxIndex {
+		s.extendRange(minIndex, maxIndex)
+	}
+	other.ForEach(func(index int, count float64) (stop bool) {
+		if index < minIndex || index > maxIndex {
+			s.AddWithCount(index, count)
+		} else {
+			s.bins[index-s.offset] += count
+			s.count += count
+		}
+		return false
+	})
+	// The bins of the other store at both ends of its range may be empty.
+	s.fitRange()
+}
+
 func (s *DenseStore) Bins() <-chan Bin {
 	ch := make(chan Bin)
 	go func() {
@@ -208,25 +442,85 @@ func (s *DenseStore) ForEach(f func(index int, count float64) (stop bool)) {
 	}
 }
 
+func (s *DenseStore) ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool)) {
+	for idx := max(minIndex, s.minIndex); idx <= min(maxIndex, s.maxIndex); idx++ {
+		if s.bins[idx-s.offset] > 0 {
+			if f(idx, s.bins[idx-s.offset]) {
+				return
+			}
+		}
+	}
+}
+
 func (s *DenseStore) Copy() Store {
 	bins := make([]float64, len(s.bins))
 	copy(bins, s.bins)
 	return &DenseStore{
-		bins:     bins,
-		count:    s.count,
-		offset:   s.offset,
-		minIndex: s.minIndex,
-		maxIndex: s.maxIndex,
+		denseBins: denseBins[float64]{
+			bins:     bins,
+			offset:   s.offset,
+			minIndex: s.minIndex,
+			maxIndex: s.maxIndex,
+		},
+		count: s.count,
+	}
+}
+
+func (s *DenseStore) newEmpty() Store {
+	return NewDenseStore()
+}
+
+func (s *DenseStore) Downsample(factorLog2 int) Store {
+	return downsample(s, factorLog2, NewDenseStore())
+}
+
+func (s *DenseStore) CopyTo(dst Store) {
+	if d, ok := dst.(*DenseStore); ok {
+		s.copyTo(d)
+	} else {
+		copyTo(s, dst)
+	}
+}
+
+func (s *DenseStore) copyTo(d *DenseStore) {
+	if d.shared {
+		d.bins = nil
+		d.shared = false
 	}
+	d.bins = append(d.bins[:0], s.bins...)
+	d.count = s.count
+	d.offset = s.offset
+	d.minIndex = s.minIndex
+	d.maxIndex = s.maxIndex
 }
 
 func (s *DenseStore) Clear() {
+	if s.shared {
+		s.bins = nil
+		s.shared = false
+	}
 	s.bins = s.bins[:0]
 	s.count = 0
 	s.minIndex = math.MaxInt32
 	s.maxIndex = math.MinInt32
 }
 
+// ClearRetainingCapacity empties the store while keeping its bins allocated
+// and in place, so that adding indexes within the same range again does not
+// require reallocating or shifting them.
+func (s *DenseStore) ClearRetainingCapacity() {
+	if s.shared {
+		s.bins = make([]float64, len(s.bins))
+		s.shared = false
+	}
+	for i := range s.bins {
+		s.bins[i] = 0
+	}
+	s.count = 0
+	s.minIndex = math.MaxInt32
+	s.maxIndex = math.MinInt32
+}
+
 func (s *DenseStore) string() string {
 	var buffer bytes.Buffer
 	buffer.WriteString("{")
@@ -250,6 +544,28 @@ func (s *DenseStore) ToProto() *sketchpb.Store {
 	}
 }
 
+func (s *DenseStore) ToColumns() ([]int32, []float64) {
+	numBins := 0
+	for index := s.minIndex; index <= s.maxIndex; index++ {
+		if s.bins[index-s.offset] != 0 {
+			numBins++
+		}
+	}
+	indexes := make([]int32, 0, numBins)
+	counts := make([]float64, 0, numBins)
+	for index := s.minIndex; index <= s.maxIndex; index++ {
+		if count := s.bins[index-s.offset]; count != 0 {
+			indexes = append(indexes, int32(index))
+			counts = append(counts, count)
+		}
+	}
+	return indexes, counts
+}
+
+func (s *DenseStore) Stats() Stats {
+	return stats(s)
+}
+
 func (s *DenseStore) Reweight(w float64) error {
 	if w <= 0 {
 		return errors.New("can't reweight by a negative factor")
@@ -257,6 +573,7 @@ func (s *DenseStore) Reweight(w float64) error {
 	if w == 1 {
 		return nil
 	}
+	s.own()
 	s.count *= w
 	for idx := s.minIndex; idx <= s.maxIndex; idx++ {
 		s.bins[idx-s.offset] *= w
@@ -264,47 +581,93 @@ func (s *DenseStore) Reweight(w float64) error {
 	return nil
 }
 
+// Encode encodes the bins of the store either with index deltas, or with
+// contiguous counts, whichever is smaller. In the latter case, the empty bins
+// at both ends are skipped, and the bins are split into several blocks of
+// contiguous counts wherever skipping a run of empty bins takes less space
+// than encoding them, so that stores whose non-empty bins are far apart (e.g.,
+// after merging two distant distributions) are encoded compactly.
 func (s *DenseStore) Encode(b *[]byte, t enc.FlagType) {
 	if s.IsEmpty() {
 		return
 	}
 
-	denseEncodingSize := 0
-	numBins := uint64(s.maxIndex-s.minIndex) + 1
-	denseEncodingSize += enc.Uvarint64Size(numBins)
-	denseEncodingSize += enc.Varint64Size(int64(s.minIndex))
-	denseEncodingSize += enc.Varint64Size(1)
+	blocks := s.contiguousBlocks()
+	// The flag of the first block is not counted, as both encodings need one.
+	denseEncodingSize := len(blocks) - 1
+	for _, block := range blocks {
+		denseEncodingSize += contiguousBlockHeaderSize(block[0], block[1])
+		for index := block[0]; index <= block[1]; index++ {
+			denseEncodingSize += enc.Varfloat64Size(s.bins[index-s.offset])
+		}
+	}
 
 	sparseEncodingSize := 0
 	numNonEmptyBins := uint64(0)
 
-	previousIndex := s.minIndex
+	previousIndex := 0
 	for index := s.minIndex; index <= s.maxIndex; index++ {
 		count := s.bins[index-s.offset]
-		countVarFloat64Size := enc.Varfloat64Size(count)
-		denseEncodingSize += countVarFloat64Size
 		if count != 0 {
 			numNonEmptyBins++
 			sparseEncodingSize += enc.Varint64Size(int64(index - previousIndex))
-			sparseEncodingSize += countVarFloat64Size
+			sparseEncodingSize += enc.Varfloat64Size(count)
 			previousIndex = index
 		}
 	}
 	sparseEncodingSize += enc.Uvarint64Size(numNonEmptyBins)
 
 	if denseEncodingSize <= sparseEncodingSize {
-		s.encodeDensely(b, t, numBins)
+		for _, block := range blocks {
+			s.encodeDensely(b, t, block[0], block[1])
+		}
 	} else {
 		s.encodeSparsely(b, t, numNonEmptyBins)
 	}
 }
 
-func (s *DenseStore) encodeDensely(b *[]byte, t enc.FlagType, numBins uint64) {
+// contiguousBlocks returns the ranges of indexes, both inclusive, of the
+// blocks of contiguous counts that the bins of the store are encoded with. The
+// ranges start and end with non-empty bins, and the runs of empty bins that
+// they skip take more space to encode than the header of a new block.
+func (s *DenseStore) contiguousBlocks() [][2]int {
+	var blocks [][2]int
+	start, end := 0, 0
+	inBlock := false
+	for index := s.minIndex; index <= s.maxIndex; index++ {
+		if s.bins[index-s.offset] == 0 {
+			continue
+		}
+		if inBlock && (index-end-1)*enc.Varfloat64Size(0) <= 1+contiguousBlockHeaderSize(index, s.maxIndex) {
+			// Encoding the empty bins in between takes less space than
+			// starting a new block.
+			end = index
+			continue
+		}
+		if inBlock {
+			blocks = append(blocks, [2]int{start, end})
+		}
+		start, end, inBlock = index, index, true
+	}
+	if inBlock {
+		blocks = append(blocks, [2]int{start, end})
+	}
+	return blocks
+}
+
+// contiguousBlockHeaderSize returns the size of the encoding of the number of
+// bins, the first index and the index delta of a block of contiguous counts,
+// excluding its flag.
+func contiguousBlockHeaderSize(minIndex, maxIndex int) int {
+	return enc.Uvarint64Size(uint64(maxIndex-minIndex)+1) + enc.Varint64Size(int64(minIndex)) + enc.Varint64Size(1)
+}
+
+func (s *DenseStore) encodeDensely(b *[]byte, t enc.FlagType, minIndex, maxIndex int) {
 	enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingContiguousCounts))
-	enc.EncodeUvarint64(b, numBins)
-	enc.EncodeVarint64(b, int64(s.minIndex))
+	enc.EncodeUvarint64(b, uint64(maxIndex-minIndex)+1)
+	enc.EncodeVarint64(b, int64(minIndex))
 	enc.EncodeVarint64(b, 1)
-	for index := s.minIndex; index <= s.maxIndex; index++ {
+	for index := minIndex; index <= maxIndex; index++ {
 		enc.EncodeVarfloat64(b, s.bins[index-s.offset])
 	}
 }
@@ -324,7 +687,64 @@ func (s *DenseStore) encodeSparsely(b *[]byte, t enc.FlagType, numNonEmptyBins u
 }
 
 func (s *DenseStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.SubFlag) error {
+	if encodingMode == enc.BinEncodingContiguousCounts {
+		if ok, err := s.decodeContiguousCountsAndMergeWith(b); ok {
+			return err
+		}
+	}
 	return DecodeAndMergeWith(s, b, encodingMode)
 }
 
+// decodeContiguousCountsAndMergeWith decodes bins that have been encoded with
+// contiguous counts of consecutive indexes, which is how dense stores encode
+// their bins, extending the range of the bins of the store at most once and
+// adding the counts directly to them. It returns false, leaving b unchanged,
+// if the bins need to be decoded one by one, for instance, if their indexes
+// are not consecutive or if some of them need to be clamped.
+func (s *DenseStore) decodeContiguousCountsAndMergeWith(b *[]byte) (bool, error) {
+	data := *b
+	numBins, err := enc.DecodeUvarint64(&data)
+	if err != nil {
+		return false, nil
+	}
+	index, err := enc.DecodeVarint64(&data)
+	if err != nil {
+		return false, nil
+	}
+	indexDelta, err := enc.DecodeVarint64(&data)
+	if err != nil {
+		return false, nil
+	}
+	// Each count takes at least one byte, which bounds the range to extend
+	// the bins to if numBins is corrupt.
+	if indexDelta != 1 || numBins == 0 || numBins > uint64(len(data)) || numBins > maxDenseStoreLength ||
+		index < int64(minInt) || index > int64(maxInt)-int64(numBins)+1 {
+		return false, nil
+	}
+	minIndex := int(index)
+	maxIndex := minIndex + int(numBins) - 1
+	if s.clampIndex(minIndex) != minIndex || s.clampIndex(maxIndex) != maxIndex {
+		return false, nil
+	}
+
+	*b = data
+	s.own()
+	if minIndex < s.minIndex || maxIndex > s.maxIndex {
+		s.extendRange(minIndex, maxIndex)
+	}
+	bins := s.bins[minIndex-s.offset : maxIndex-s.offset+1]
+	for i := range bins {
+		count, err := enc.DecodeVarfloat64(b)
+		if err != nil {
+			s.fitRange()
+			return true, err
+		}
+		bins[i] += count
+		s.count += count
+	}
+	// The counts at both ends of the range may be zero.
+	s.fitRange()
+	return true, nil
+}
+
 var _ Store = (*DenseStore)(nil)
@@ -0,0 +1,22 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+// DenseStoreF32 is a dynamically growing contiguous store, similar to
+// DenseStore, that stores counts as float32 rather than float64, which halves
+// the memory size of its bins.
+//
+// Bin counts are rounded to float32 precision (about 7 significant digits)
+// each time they are updated. In particular, adding a count of one to a bin
+// whose count is at least 2^24 may have no effect. Bin counts saturate at
+// math.MaxFloat32 instead of overflowing to infinity. The total count is
+// tracked as a float64 and is kept consistent with the counts that are
+// actually stored in the bins.
+type DenseStoreF32 = DenseStoreOf[float32]
+
+func NewDenseStoreF32() *DenseStoreF32 {
+	return NewDenseStoreOf[float32]()
+}
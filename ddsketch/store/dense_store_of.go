@@ -0,0 +1,529 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import (
+	"errors"
+	"math"
+	"unsafe"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+// Count is the constraint on the types of the counts of DenseStoreOf, that is,
+// floating-point numbers and integers.
+type Count interface {
+	~float32 | ~float64 |
+		~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64
+}
+
+// DenseStoreOf is a dynamically growing contiguous store, similar to
+// DenseStore, whose bin counts are of type C. Smaller count types make the
+// bins take less memory, at the expense of range and precision.
+//
+// Counts are converted to C each time they are updated. If C is an integer
+// type, counts are rounded to the nearest integer and bins whose rounded count
+// is not positive are ignored. Counts saturate at the greatest value of C
+// instead of overflowing. The total count is kept consistent with the counts
+// that are actually stored in the bins. If C is an integer type, it is tracked
+// exactly, saturating at math.MaxUint64, and counts are added to the bins with
+// integer arithmetic, so that they remain exact beyond 2^53.
+//
+// DenseStore is not an alias of DenseStoreOf[float64], as the collapsing
+// stores embed it and override the way it extends its range, and as it
+// supports snapshots. Both grow their bins and clamp indexes the same way
+// (see denseBins).
+type DenseStoreOf[C Count] struct {
+	denseBins[C]
+	count        float64
+	integerCount uint64 // the exact total count if C is an integer type
+
+	isInteger  bool
+	maxCount   C       // the greatest value of C
+	countBound float64 // counts that are greater than or equal to it (greater than it for floating-point types) saturate
+}
+
+// NewDenseStoreOf returns an empty DenseStoreOf whose counts are of type C.
+func NewDenseStoreOf[C Count]() *DenseStoreOf[C] {
+	s := &DenseStoreOf[C]{denseBins: newDenseBins[C]()}
+	var zero C
+	half, maxFloat32, maxFloat64 := 0.5, float64(math.MaxFloat32), math.MaxFloat64
+	numBits := 8 * int(unsafe.Sizeof(zero))
+	switch {
+	case C(half) != 0 && numBits == 32:
+		s.maxCount, s.countBound = C(maxFloat32), maxFloat32
+	case C(half) != 0:
+		s.maxCount, s.countBound = C(maxFloat64), maxFloat64
+	case zero-1 < zero:
+		// Signed integers: the lowest value is exactly representable as a
+		// float64, and the greatest value is the opposite of its successor.
+		s.isInteger = true
+		s.countBound = math.Ldexp(1, numBits-1)
+		s.maxCount = -(C(-s.countBound) + 1)
+	default:
+		s.isInteger = true
+		s.countBound = math.Ldexp(1, numBits)
+		s.maxCount = zero - 1
+	}
+	return s
+}
+
+// toCount converts count to C, rounding it if C is an integer type and
+// saturating it.
+func (s *DenseStoreOf[C]) toCount(count float64) C {
+	if s.isInteger {
+		count = math.Round(count)
+		if !(count > 0) {
+			return 0
+		}
+		if count >= s.countBound {
+			return s.maxCount
+		}
+		return C(count)
+	}
+	if count > s.countBound {
+		return s.maxCount
+	}
+	if count < -s.countBound {
+		return -s.maxCount
+	}
+	return C(count)
+}
+
+func (s *DenseStoreOf[C]) Add(index int) {
+	s.AddWithCount(index, float64(1))
+}
+
+func (s *DenseStoreOf[C]) AddBin(bin Bin) {
+	s.AddWithCount(bin.index, bin.count)
+}
+
+// AddBins adds the provided bins to the store, extending the range of its
+// bins at most once.
+func (s *DenseStoreOf[C]) AddBins(bins []Bin) {
+	minIndex, maxIndex := maxInt, minInt
+	for _, bin := range bins {
+		if s.toCount(bin.count) != 0 {
+			minIndex = min(minIndex, bin.index)
+			maxIndex = max(maxIndex, bin.index)
+		}
+	}
+	if minIndex > maxIndex {
+		return
+	}
+	if rangeLength(minIndex, maxIndex) > maxDenseStoreLength || s.clampIndex(minIndex) != minIndex || s.clampIndex(maxIndex) != maxIndex {
+		// Some indexes need to be clamped.
+		for _, bin := range bins {
+			s.AddWithCount(bin.index, bin.count)
+		}
+		return
+	}
+	if minIndex < s.minIndex || maxIndex > s.maxIndex {
+		s.extendRange(minIndex, maxIndex)
+	}
+	for _, bin := range bins {
+		if s.toCount(bin.count) != 0 {
+			s.addAt(bin.index-s.offset, bin.count)
+		}
+	}
+}
+
+func (s *DenseStoreOf[C]) AddWithCount(index int, count float64) {
+	if s.toCount(count) == 0 {
+		return
+	}
+	s.addAt(s.normalize(index), count)
+}
+
+// AddWithIntegerCount adds count to the count of the bin of the provided
+// index. Unlike with AddWithCount, counts beyond 2^53 are exactly added if C
+// is an integer type.
+func (s *DenseStoreOf[C]) AddWithIntegerCount(index int, count uint64) {
+	if count == 0 {
+		return
+	}
+	if !s.isInteger {
+		s.AddWithCount(index, float64(count))
+		return
+	}
+	c := s.maxCount
+	if count < uint64(s.maxCount) {
+		c = C(count)
+	}
+	s.addIntegerAt(s.normalize(index), c)
+}
+
+// addAt adds count to the counter at the specified array index and updates
+// the total count with the change of the stored counter.
+func (s *DenseStoreOf[C]) addAt(arrayIndex int, count float64) {
+	if s.isInteger {
+		s.addIntegerAt(arrayIndex, s.toCount(count))
+		return
+	}
+	previous := s.bins[arrayIndex]
+	s.bins[arrayIndex] = s.toCount(float64(previous) + count)
+	s.count += float64(s.bins[arrayIndex]) - float64(previous)
+}
+
+// addIntegerAt adds count to the counter at the specified array index,
+// saturating it, if C is an integer type.
+func (s *DenseStoreOf[C]) addIntegerAt(arrayIndex int, count C) {
+	previous := s.bins[arrayIndex]
+	if count > s.maxCount-previous {
+		count = s.maxCount - previous
+	}
+	s.bins[arrayIndex] = previous + count
+	s.integerCount = saturatingAdd(s.integerCount, uint64(count))
+	s.count = float64(s.integerCount)
+}
+
+// subtractIntegerAt subtracts count, which is at most the count of the
+// counter, from the counter at the specified array index, if C is an integer
+// type.
+func (s *DenseStoreOf[C]) subtractIntegerAt(arrayIndex int, count C) {
+	s.bins[arrayIndex] -= count
+	s.integerCount -= uint64(count)
+	s.count = float64(s.integerCount)
+}
+
+func (s *DenseStoreOf[C]) SubtractWithCount(index int, count float64) {
+	if s.isInteger {
+		count = math.Round(count)
+	}
+	if !isSubtractableCount(count) || index < s.minIndex || index > s.maxIndex {
+		return
+	}
+	arrayIndex := index - s.offset
+	if s.isInteger {
+		// Counts are compared as integers, as they may not be exactly
+		// representable as float64s.
+		removed := s.toCount(count)
+		if removed > s.bins[arrayIndex] {
+			removed = s.bins[arrayIndex]
+		}
+		s.subtractIntegerAt(arrayIndex, removed)
+	} else {
+		s.addAt(arrayIndex, -math.Min(float64(s.bins[arrayIndex]), count))
+	}
+	s.trim()
+}
+
+func (s *DenseStoreOf[C]) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
+}
+
+// trim shrinks the range of indices so that its bounds are non-empty bins,
+// clearing the store if all bins are empty.
+func (s *DenseStoreOf[C]) trim() {
+	for s.minIndex <= s.maxIndex && s.bins[s.minIndex-s.offset] <= 0 {
+		s.minIndex++
+	}
+	for s.maxIndex >= s.minIndex && s.bins[s.maxIndex-s.offset] <= 0 {
+		s.maxIndex--
+	}
+	if s.minIndex > s.maxIndex {
+		s.Clear()
+	}
+}
+
+// Normalize the store, if necessary, so that the counter of the specified index can be updated.
+func (s *DenseStoreOf[C]) normalize(index int) int {
+	if index < s.minIndex || index > s.maxIndex {
+		index = s.clampIndex(index)
+		s.extendRange(index, index)
+	}
+	return index - s.offset
+}
+
+func (s *DenseStoreOf[C]) extendRange(newMinIndex, newMaxIndex int) {
+	s.extend(newMinIndex, newMaxIndex, s.IsEmpty(), s.getNewLength, s.centerCounts)
+}
+
+func (s *DenseStoreOf[C]) IsEmpty() bool {
+	return s.count == 0
+}
+
+func (s *DenseStoreOf[C]) GetCountAtIndex(index int) float64 {
+	if index < s.minIndex || index > s.maxIndex {
+		return 0
+	}
+	return float64(s.bins[index-s.offset])
+}
+
+func (s *DenseStoreOf[C]) TotalCount() float64 {
+	return s.count
+}
+
+// TotalIntegerCount returns the total count, which is exact, saturating at
+// math.MaxUint64, if C is an integer type, and otherwise rounded to the nearest
+// integer.
+func (s *DenseStoreOf[C]) TotalIntegerCount() uint64 {
+	if s.isInteger {
+		return s.integerCount
+	}
+	return toIntegerCount(s.count)
+}
+
+func (s *DenseStoreOf[C]) MinIndex() (int, error) {
+	if s.IsEmpty() {
+		return 0, errUndefinedMinIndex
+	}
+	return s.minIndex, nil
+}
+
+func (s *DenseStoreOf[C]) MaxIndex() (int, error) {
+	if s.IsEmpty() {
+		return 0, errUndefinedMaxIndex
+	}
+	return s.maxIndex, nil
+}
+
+func (s *DenseStoreOf[C]) MaxCountBin() (Bin, error) {
+	if s.IsEmpty() {
+		return Bin{}, errUndefinedMaxCount
+	}
+	maxCountBin := Bin{index: s.minIndex, count: float64(s.bins[s.minIndex-s.offset])}
+	for index := s.minIndex + 1; index <= s.maxIndex; index++ {
+		if count := float64(s.bins[index-s.offset]); count > maxCountBin.count {
+			maxCountBin = Bin{index: index, count: count}
+		}
+	}
+	return maxCountBin, nil
+}
+
+func (s *DenseStoreOf[C]) MemorySize() int {
+	var zero C
+	return int(unsafe.Sizeof(*s)) + cap(s.bins)*int(unsafe.Sizeof(zero))
+}
+
+func (s *DenseStoreOf[C]) KeyAtRank(rank float64) int {
+	if rank < 0 {
+		rank = 0
+	}
+	var n float64
+	for idx := s.minIndex; idx <= s.maxIndex; idx++ {
+		n += float64(s.bins[idx-s.offset])
+		if n > rank {
+			return idx
+		}
+	}
+	return s.maxIndex
+}
+
+func (s *DenseStoreOf[C]) MergeWith(other Store) {
+	if other.IsEmpty() {
+		return
+	}
+	o, ok := other.(*DenseStoreOf[C])
+	if !ok || s.clampIndex(o.minIndex) != o.minIndex || s.clampIndex(o.maxIndex) != o.maxIndex {
+		// The bins of stores of other types, or whose indexes need to be
+		// clamped, are added one by one.
+		other.ForEach(func(index int, count float64) (stop bool) {
+			s.AddWithCount(index, count)
+			return false
+		})
+		return
+	}
+	if o.minIndex < s.minIndex || o.maxIndex > s.maxIndex {
+		s.extendRange(o.minIndex, o.maxIndex)
+	}
+	for idx := o.minIndex; idx <= o.maxIndex; idx++ {
+		if count := o.bins[idx-o.offset]; count == 0 {
+			continue
+		} else if s.isInteger {
+			s.addIntegerAt(idx-s.offset, count)
+		} else {
+			s.addAt(idx-s.offset, float64(count))
+		}
+	}
+}
+
+func (s *DenseStoreOf[C]) Bins() <-chan Bin {
+	ch := make(chan Bin)
+	go func() {
+		defer close(ch)
+		for idx := s.minIndex; idx <= s.maxIndex; idx++ {
+			if s.bins[idx-s.offset] > 0 {
+				ch <- Bin{index: idx, count: float64(s.bins[idx-s.offset])}
+			}
+		}
+	}()
+	return ch
+}
+
+func (s *DenseStoreOf[C]) ForEach(f func(index int, count float64) (stop bool)) {
+	for idx := s.minIndex; idx <= s.maxIndex; idx++ {
+		if s.bins[idx-s.offset] > 0 {
+			if f(idx, float64(s.bins[idx-s.offset])) {
+				return
+			}
+		}
+	}
+}
+
+func (s *DenseStoreOf[C]) ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool)) {
+	for idx := max(minIndex, s.minIndex); idx <= min(maxIndex, s.maxIndex); idx++ {
+		if s.bins[idx-s.offset] > 0 {
+			if f(idx, float64(s.bins[idx-s.offset])) {
+				return
+			}
+		}
+	}
+}
+
+func (s *DenseStoreOf[C]) Copy() Store {
+	c := *s
+	c.bins = make([]C, len(s.bins))
+	copy(c.bins, s.bins)
+	return &c
+}
+
+func (s *DenseStoreOf[C]) newEmpty() Store {
+	return NewDenseStoreOf[C]()
+}
+
+func (s *DenseStoreOf[C]) Downsample(factorLog2 int) Store {
+	return downsample(s, factorLog2, NewDenseStoreOf[C]())
+}
+
+// Trim removes the bins whose indexes are lower than minIndex or greater than
+// maxIndex. The remaining bins are moved to newly allocated memory, so that
+// the memory that the removed bins used is released.
+func (s *DenseStoreOf[C]) Trim(minIndex, maxIndex int) {
+	trimmed := NewDenseStoreOf[C]()
+	addBinsInRange(s, minIndex, maxIndex, trimmed)
+	*s = *trimmed
+}
+
+func (s *DenseStoreOf[C]) CopyTo(dst Store) {
+	if d, ok := dst.(*DenseStoreOf[C]); ok {
+		d.bins = append(d.bins[:0], s.bins...)
+		d.count = s.count
+		d.integerCount = s.integerCount
+		d.offset = s.offset
+		d.minIndex = s.minIndex
+		d.maxIndex = s.maxIndex
+	} else {
+		copyTo(s, dst)
+	}
+}
+
+func (s *DenseStoreOf[C]) Clear() {
+	s.bins = s.bins[:0]
+	s.count = 0
+	s.integerCount = 0
+	s.minIndex = math.MaxInt32
+	s.maxIndex = math.MinInt32
+}
+
+// ClearRetainingCapacity empties the store while keeping its bins allocated
+// and in place.
+func (s *DenseStoreOf[C]) ClearRetainingCapacity() {
+	for i := range s.bins {
+		s.bins[i] = 0
+	}
+	s.count = 0
+	s.integerCount = 0
+	s.minIndex = math.MaxInt32
+	s.maxIndex = math.MinInt32
+}
+
+func (s *DenseStoreOf[C]) ToProto() *sketchpb.Store {
+	if s.IsEmpty() {
+		return &sketchpb.Store{ContiguousBinCounts: nil}
+	}
+	bins := make([]float64, s.maxIndex-s.minIndex+1)
+	for i := range bins {
+		bins[i] = float64(s.bins[s.minIndex-s.offset+i])
+	}
+	return &sketchpb.Store{
+		ContiguousBinCounts:      bins,
+		ContiguousBinIndexOffset: int32(s.minIndex),
+	}
+}
+
+func (s *DenseStoreOf[C]) ToColumns() ([]int32, []float64) {
+	return toColumns(s)
+}
+
+func (s *DenseStoreOf[C]) Stats() Stats {
+	return stats(s)
+}
+
+func (s *DenseStoreOf[C]) Reweight(w float64) error {
+	if w <= 0 {
+		return errors.New("can't reweight by a negative factor")
+	}
+	if w == 1 {
+		return nil
+	}
+	s.count = 0
+	s.integerCount = 0
+	for idx := s.minIndex; idx <= s.maxIndex; idx++ {
+		s.bins[idx-s.offset] = s.toCount(float64(s.bins[idx-s.offset]) * w)
+		if s.isInteger {
+			s.integerCount = saturatingAdd(s.integerCount, uint64(s.bins[idx-s.offset]))
+			s.count = float64(s.integerCount)
+		} else {
+			s.count += float64(s.bins[idx-s.offset])
+		}
+	}
+	s.trim()
+	return nil
+}
+
+func (s *DenseStoreOf[C]) Encode(b *[]byte, t enc.FlagType) {
+	if s.IsEmpty() {
+		return
+	}
+
+	numBins := uint64(s.maxIndex-s.minIndex) + 1
+	denseEncodingSize := enc.Uvarint64Size(numBins) + enc.Varint64Size(int64(s.minIndex)) + enc.Varint64Size(1)
+	sparseEncodingSize := 0
+	numNonEmptyBins := uint64(0)
+	previousIndex := s.minIndex
+	for index := s.minIndex; index <= s.maxIndex; index++ {
+		count := float64(s.bins[index-s.offset])
+		countVarFloat64Size := enc.Varfloat64Size(count)
+		denseEncodingSize += countVarFloat64Size
+		if count != 0 {
+			numNonEmptyBins++
+			sparseEncodingSize += enc.Varint64Size(int64(index - previousIndex))
+			sparseEncodingSize += countVarFloat64Size
+			previousIndex = index
+		}
+	}
+	sparseEncodingSize += enc.Uvarint64Size(numNonEmptyBins)
+
+	if denseEncodingSize <= sparseEncodingSize {
+		enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingContiguousCounts))
+		enc.EncodeUvarint64(b, numBins)
+		enc.EncodeVarint64(b, int64(s.minIndex))
+		enc.EncodeVarint64(b, 1)
+		for index := s.minIndex; index <= s.maxIndex; index++ {
+			enc.EncodeVarfloat64(b, float64(s.bins[index-s.offset]))
+		}
+	} else {
+		enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingIndexDeltasAndCounts))
+		enc.EncodeUvarint64(b, numNonEmptyBins)
+		previousIndex := 0
+		for index := s.minIndex; index <= s.maxIndex; index++ {
+			if count := s.bins[index-s.offset]; count != 0 {
+				enc.EncodeVarint64(b, int64(index-previousIndex))
+				enc.EncodeVarfloat64(b, float64(count))
+				previousIndex = index
+			}
+		}
+	}
+}
+
+func (s *DenseStoreOf[C]) DecodeAndMergeWith(b *[]byte, encodingMode enc.SubFlag) error {
+	return DecodeAndMergeWith(s, b, encodingMode)
+}
+
+var _ Store = (*DenseStoreOf[float64])(nil)
@@ -0,0 +1,48 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import "math"
+
+// IntegerDenseStore is a dynamically growing contiguous store whose counts are
+// unsigned integers rather than floating-point numbers. It is meant for
+// workloads that only ever add values with integer counts (typically one) and
+// that need the counts and the total count to remain exact, whereas float64
+// counts stop being able to represent increments of one beyond 2^53.
+//
+// Counts that are not integers, including those of the bins of stores that
+// are merged into it, are rounded to the nearest integer, and bins whose
+// rounded count is not positive are ignored. Therefore, merging a store with
+// fractional counts into an IntegerDenseStore is lossy: the rounding error is
+// up to 0.5 per bin and per merge. Counts saturate at math.MaxUint64 instead
+// of overflowing. Methods of the Store interface that return counts convert
+// them to float64; TotalIntegerCount returns the exact total count.
+type IntegerDenseStore = DenseStoreOf[uint64]
+
+func NewIntegerDenseStore() *IntegerDenseStore {
+	return NewDenseStoreOf[uint64]()
+}
+
+// toIntegerCount rounds count to the nearest integer, returning zero if it is
+// not positive and saturating at math.MaxUint64.
+func toIntegerCount(count float64) uint64 {
+	rounded := math.Round(count)
+	if !(rounded > 0) {
+		return 0
+	}
+	if rounded >= math.MaxUint64 {
+		return math.MaxUint64
+	}
+	return uint64(rounded)
+}
+
+// saturatingAdd returns a+b, or math.MaxUint64 if the sum overflows.
+func saturatingAdd(a, b uint64) uint64 {
+	if sum := a + b; sum >= a {
+		return sum
+	}
+	return math.MaxUint64
+}
@@ -0,0 +1,179 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// PagePool provides BufferedPaginatedStores with pages and gets them back
+// when the stores no longer need them, so that pages can be reused across
+// stores. It is implemented by MemoryPool and SyncMemoryPool.
+type PagePool interface {
+	// pageLen returns the number of counts of the pages of the pool.
+	pageLen() int
+	// canAllocate returns whether a store may create a page that it does not
+	// strictly need.
+	canAllocate() bool
+	// allocate returns a zeroed page.
+	allocate() []float64
+	// release gives back to the pool a page that has been obtained from
+	// allocate.
+	release(page []float64)
+}
+
+// PoolPolicy defines how a MemoryPool behaves once its byte budget is reached.
+type PoolPolicy int
+
+const (
+	// PoolPolicyEvict lets stores allocate pages beyond the budget of the
+	// pool. The budget then only bounds the memory of the pages that the pool
+	// keeps for reuse: pages that are released while the pool is over budget
+	// are evicted from the pool and left to the garbage collector.
+	PoolPolicyEvict PoolPolicy = iota
+	// PoolPolicyDeny additionally prevents stores from creating pages that
+	// they do not strictly need once the budget is reached: indexes that are
+	// added with a count of 1 are then kept in the buffer of the store rather
+	// than compacted into new pages. Pages that are required to hold other
+	// counts are still allocated, so that no count is ever dropped.
+	PoolPolicyDeny
+)
+
+// MemoryPool hands out pages to BufferedPaginatedStores and keeps track of
+// the memory that they take. It can be shared by many stores so as to bound
+// their total page memory and to reuse the pages that some of them free for
+// the others. A store that uses a pool returns its pages to the pool when it
+// is cleared; the pages of a store that is discarded without being cleared
+// remain accounted for as used.
+// MemoryPool is not safe for concurrent use.
+type MemoryPool struct {
+	pageLenLog2 int
+	maxBytes    int
+	policy      PoolPolicy
+	numUsed     int         // number of pages held by stores
+	free        [][]float64 // zeroed pages kept for reuse
+}
+
+// NewMemoryPool returns a pool of pages of 2^pageLenLog2 counts (pageLenLog2
+// being capped at 16) that aims at keeping the memory size of the pages held
+// by stores and kept for reuse no greater than maxBytes.
+func NewMemoryPool(pageLenLog2 uint8, maxBytes int, policy PoolPolicy) *MemoryPool {
+	if pageLenLog2 > maxPageLenLog2 {
+		pageLenLog2 = maxPageLenLog2
+	}
+	return &MemoryPool{
+		pageLenLog2: int(pageLenLog2),
+		maxBytes:    maxBytes,
+		policy:      policy,
+	}
+}
+
+func (p *MemoryPool) pageLen() int {
+	return 1 << p.pageLenLog2
+}
+
+func (p *MemoryPool) pageBytes() int {
+	return p.pageLen() * countSize / 8
+}
+
+// MaxBytes returns the byte budget of the pool.
+func (p *MemoryPool) MaxBytes() int {
+	return p.maxBytes
+}
+
+// UsedBytes returns the memory size of the pages that are held by stores.
+func (p *MemoryPool) UsedBytes() int {
+	return p.numUsed * p.pageBytes()
+}
+
+// FreeBytes returns the memory size of the pages that the pool keeps for
+// reuse.
+func (p *MemoryPool) FreeBytes() int {
+	return len(p.free) * p.pageBytes()
+}
+
+func (p *MemoryPool) canAllocate() bool {
+	return p.policy != PoolPolicyDeny || p.UsedBytes()+p.pageBytes() <= p.maxBytes
+}
+
+func (p *MemoryPool) allocate() []float64 {
+	p.numUsed++
+	if n := len(p.free); n > 0 {
+		page := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		return page
+	}
+	return make([]float64, p.pageLen())
+}
+
+func (p *MemoryPool) release(page []float64) {
+	p.numUsed--
+	if p.UsedBytes()+p.FreeBytes()+p.pageBytes() > p.maxBytes {
+		// Evict the page.
+		return
+	}
+	page = page[:p.pageLen()]
+	for i := range page {
+		page[i] = 0
+	}
+	p.free = append(p.free, page)
+}
+
+// SyncMemoryPool is a pool of pages backed by a sync.Pool. Unlike MemoryPool,
+// it is safe for concurrent use, so that stores that are used by different
+// goroutines can share it. It has no byte budget: the pages that it keeps for
+// reuse may be freed by the garbage collector at any time.
+type SyncMemoryPool struct {
+	pageLenLog2 int
+	numUsed     int64 // accessed atomically
+	pool        sync.Pool
+}
+
+// NewSyncMemoryPool returns a pool of pages of 2^pageLenLog2 counts,
+// pageLenLog2 being capped at 16.
+func NewSyncMemoryPool(pageLenLog2 uint8) *SyncMemoryPool {
+	if pageLenLog2 > maxPageLenLog2 {
+		pageLenLog2 = maxPageLenLog2
+	}
+	return &SyncMemoryPool{pageLenLog2: int(pageLenLog2)}
+}
+
+func (p *SyncMemoryPool) pageLen() int {
+	return 1 << p.pageLenLog2
+}
+
+// UsedBytes returns the memory size of the pages that are held by stores.
+func (p *SyncMemoryPool) UsedBytes() int {
+	return int(atomic.LoadInt64(&p.numUsed)) * p.pageLen() * countSize / 8
+}
+
+func (p *SyncMemoryPool) canAllocate() bool {
+	return true
+}
+
+func (p *SyncMemoryPool) allocate() []float64 {
+	atomic.AddInt64(&p.numUsed, 1)
+	if page, ok := p.pool.Get().(*[]float64); ok {
+		return *page
+	}
+	return make([]float64, p.pageLen())
+}
+
+func (p *SyncMemoryPool) release(page []float64) {
+	atomic.AddInt64(&p.numUsed, -1)
+	page = page[:p.pageLen()]
+	for i := range page {
+		page[i] = 0
+	}
+	p.pool.Put(&page)
+}
+
+var (
+	_ PagePool = (*MemoryPool)(nil)
+	_ PagePool = (*SyncMemoryPool)(nil)
+)
@@ -0,0 +1,122 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ProviderFactory returns the Provider of a store type given the parameter
+// that follows the colon in the name of the store type (e.g., "2048" in
+// "collapsing_lowest:2048"), or an empty string if there is none. Return a
+// non-nil error if the parameter is invalid.
+type ProviderFactory func(param string) (Provider, error)
+
+var (
+	providerFactoriesMutex sync.RWMutex
+	providerFactories      = map[string]ProviderFactory{
+		"dense":                withoutParam(DenseStoreConstructor),
+		"sparse":               withoutParam(SparseStoreConstructor),
+		"unbuffered_paginated": withoutParam(UnbufferedPaginatedStoreConstructor),
+		"integer_dense":        withoutParam(IntegerDenseStoreConstructor),
+		"dense_f32":            withoutParam(DenseStoreF32Constructor),
+		"adaptive":             withoutParam(AdaptiveStoreConstructor),
+		"buffered_paginated": func(param string) (Provider, error) {
+			if param == "" {
+				return BufferedPaginatedStoreConstructor, nil
+			}
+			pageLenLog2, err := strconv.ParseUint(param, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid page size: %w", err)
+			}
+			return func() Store { return NewBufferedPaginatedStoreWithPageSize(uint8(pageLenLog2)) }, nil
+		},
+		"collapsing_lowest": func(param string) (Provider, error) {
+			maxNumBins, err := parseMaxNumBins(param)
+			if err != nil {
+				return nil, err
+			}
+			return func() Store { return NewCollapsingLowestDenseStore(maxNumBins) }, nil
+		},
+		"collapsing_highest": func(param string) (Provider, error) {
+			maxNumBins, err := parseMaxNumBins(param)
+			if err != nil {
+				return nil, err
+			}
+			return func() Store { return NewCollapsingHighestDenseStore(maxNumBins) }, nil
+		},
+	}
+)
+
+func withoutParam(provider Provider) ProviderFactory {
+	return func(param string) (Provider, error) {
+		if param != "" {
+			return nil, fmt.Errorf("unexpected parameter %q", param)
+		}
+		return provider, nil
+	}
+}
+
+func parseMaxNumBins(param string) (int, error) {
+	maxNumBins, err := strconv.Atoi(param)
+	if err != nil || maxNumBins <= 0 {
+		return 0, fmt.Errorf("the maximum number of bins must be a positive integer, got %q", param)
+	}
+	return maxNumBins, nil
+}
+
+// RegisterProvider registers the factory that ProviderByName uses to get the
+// providers of the store type of the provided name, which allows choosing
+// store types that are defined outside of this package by name. The name must
+// not contain a colon. Return a non-nil error if a factory is already
+// registered for the name.
+func RegisterProvider(name string, factory ProviderFactory) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("invalid store type name %q", name)
+	}
+	providerFactoriesMutex.Lock()
+	defer providerFactoriesMutex.Unlock()
+	if _, ok := providerFactories[name]; ok {
+		return fmt.Errorf("a provider is already registered for store type %q", name)
+	}
+	providerFactories[name] = factory
+	return nil
+}
+
+// unregisterProvider removes the factory that is registered for the name, so
+// that tests do not leave providers registered.
+func unregisterProvider(name string) {
+	providerFactoriesMutex.Lock()
+	defer providerFactoriesMutex.Unlock()
+	delete(providerFactories, name)
+}
+
+// ProviderByName returns the Provider of the store type of the provided name,
+// optionally followed by a colon and a parameter, so that the store type can
+// be chosen in configuration files. The built-in names are "dense", "sparse",
+// "buffered_paginated" (optionally followed by the base-2 logarithm of the
+// page size, e.g., "buffered_paginated:5"), "unbuffered_paginated",
+// "integer_dense", "dense_f32", "adaptive", and "collapsing_lowest" and
+// "collapsing_highest", which must be followed by the maximum number of bins
+// (e.g., "collapsing_lowest:2048"). Return a non-nil error if no provider is
+// registered for the name or if the parameter is invalid.
+func ProviderByName(name string) (Provider, error) {
+	typeName, param, _ := strings.Cut(name, ":")
+	providerFactoriesMutex.RLock()
+	factory, ok := providerFactories[typeName]
+	providerFactoriesMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no provider is registered for store type %q", typeName)
+	}
+	provider, err := factory(param)
+	if err != nil {
+		return nil, fmt.Errorf("store type %q: %w", name, err)
+	}
+	return provider, nil
+}
@@ -7,7 +7,9 @@ package store
 
 import (
 	"errors"
+	"math"
 	"sort"
+	"unsafe"
 
 	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
 	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
@@ -29,6 +31,14 @@ func (s *SparseStore) AddBin(bin Bin) {
 	s.AddWithCount(bin.index, bin.count)
 }
 
+func (s *SparseStore) AddBins(bins []Bin) {
+	for _, bin := range bins {
+		if bin.count != 0 {
+			s.counts[bin.index] += bin.count
+		}
+	}
+}
+
 func (s *SparseStore) AddWithCount(index int, count float64) {
 	if count == 0 {
 		return
@@ -36,6 +46,23 @@ func (s *SparseStore) AddWithCount(index int, count float64) {
 	s.counts[index] += count
 }
 
+func (s *SparseStore) SubtractWithCount(index int, count float64) {
+	if !isSubtractableCount(count) {
+		return
+	}
+	if binCount, ok := s.counts[index]; ok {
+		if binCount <= count {
+			delete(s.counts, index)
+		} else {
+			s.counts[index] = binCount - count
+		}
+	}
+}
+
+func (s *SparseStore) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
+}
+
 func (s *SparseStore) Bins() <-chan Bin {
 	orderedBins := s.orderedBins()
 	ch := make(chan Bin)
@@ -65,6 +92,16 @@ func (s *SparseStore) ForEach(f func(index int, count float64) (stop bool)) {
 	}
 }
 
+func (s *SparseStore) ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool)) {
+	for index, count := range s.counts {
+		if index >= minIndex && index <= maxIndex {
+			if f(index, count) {
+				return
+			}
+		}
+	}
+}
+
 func (s *SparseStore) Copy() Store {
 	countsCopy := make(map[int]float64)
 	for index, count := range s.counts {
@@ -73,12 +110,54 @@ func (s *SparseStore) Copy() Store {
 	return &SparseStore{counts: countsCopy}
 }
 
+func (s *SparseStore) newEmpty() Store {
+	return NewSparseStore()
+}
+
+func (s *SparseStore) Downsample(factorLog2 int) Store {
+	return downsample(s, factorLog2, NewSparseStore())
+}
+
+// Trim removes the bins whose indexes are lower than minIndex or greater than
+// maxIndex. The remaining bins are moved to a new map, as deleting entries
+// from a map does not release its memory.
+func (s *SparseStore) Trim(minIndex, maxIndex int) {
+	counts := make(map[int]float64)
+	for index, count := range s.counts {
+		if index >= minIndex && index <= maxIndex {
+			counts[index] = count
+		}
+	}
+	s.counts = counts
+}
+
+func (s *SparseStore) CopyTo(dst Store) {
+	d, ok := dst.(*SparseStore)
+	if !ok {
+		copyTo(s, dst)
+		return
+	}
+	if s == d {
+		return
+	}
+	d.Clear()
+	for index, count := range s.counts {
+		d.counts[index] = count
+	}
+}
+
 func (s *SparseStore) Clear() {
 	for index := range s.counts {
 		delete(s.counts, index)
 	}
 }
 
+// ClearRetainingCapacity empties the store. It is equivalent to Clear, as
+// deleting entries from a map does not release its memory.
+func (s *SparseStore) ClearRetainingCapacity() {
+	s.Clear()
+}
+
 func (s *SparseStore) IsEmpty() bool {
 	return len(s.counts) == 0
 }
@@ -109,6 +188,32 @@ func (s *SparseStore) MinIndex() (int, error) {
 	return minIndex, nil
 }
 
+func (s *SparseStore) MaxCountBin() (Bin, error) {
+	if s.IsEmpty() {
+		return Bin{}, errUndefinedMaxCount
+	}
+	maxCountBin := Bin{index: maxInt, count: math.Inf(-1)}
+	for index, count := range s.counts {
+		if count > maxCountBin.count || (count == maxCountBin.count && index < maxCountBin.index) {
+			maxCountBin = Bin{index: index, count: count}
+		}
+	}
+	return maxCountBin, nil
+}
+
+// sparseStoreEntrySize is an approximation of the memory size of an entry of
+// the map of a SparseStore, accounting for the key, the value, the hash byte
+// and the maximum load factor of Go maps (6.5 entries per bucket of 8).
+const sparseStoreEntrySize = (int(unsafe.Sizeof(int(0))) + int(unsafe.Sizeof(float64(0))) + 1) * 16 / 13
+
+func (s *SparseStore) MemorySize() int {
+	return int(unsafe.Sizeof(*s)) + len(s.counts)*sparseStoreEntrySize
+}
+
+func (s *SparseStore) GetCountAtIndex(index int) float64 {
+	return s.counts[index]
+}
+
 func (s *SparseStore) TotalCount() float64 {
 	totalCount := float64(0)
 	for _, count := range s.counts {
@@ -150,6 +255,14 @@ func (s *SparseStore) ToProto() *sketchpb.Store {
 	return &sketchpb.Store{BinCounts: binCounts}
 }
 
+func (s *SparseStore) ToColumns() ([]int32, []float64) {
+	return toColumns(s)
+}
+
+func (s *SparseStore) Stats() Stats {
+	return stats(s)
+}
+
 func (s *SparseStore) Reweight(w float64) error {
 	if w <= 0 {
 		return errors.New("can't reweight by a negative factor")
@@ -163,22 +276,77 @@ func (s *SparseStore) Reweight(w float64) error {
 	return nil
 }
 
+// Encode encodes the bins of the store in ascending order of their indexes, so
+// that the index deltas are small. If all the counts are equal to 1, which is
+// common when the store is fed one value at a time, they are omitted.
 func (s *SparseStore) Encode(b *[]byte, t enc.FlagType) {
 	if s.IsEmpty() {
 		return
 	}
-	enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingIndexDeltasAndCounts))
-	enc.EncodeUvarint64(b, uint64(len(s.counts)))
+	orderedBins := s.orderedBins()
+	unitCounts := true
+	for _, bin := range orderedBins {
+		if bin.count != 1 {
+			unitCounts = false
+			break
+		}
+	}
+	if unitCounts {
+		enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingIndexDeltas))
+	} else {
+		enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingIndexDeltasAndCounts))
+	}
+	enc.EncodeUvarint64(b, uint64(len(orderedBins)))
 	previousIndex := 0
-	for index, count := range s.counts {
-		enc.EncodeVarint64(b, int64(index-previousIndex))
-		enc.EncodeVarfloat64(b, count)
-		previousIndex = index
+	for _, bin := range orderedBins {
+		enc.EncodeVarint64(b, int64(bin.index-previousIndex))
+		if !unitCounts {
+			enc.EncodeVarfloat64(b, bin.count)
+		}
+		previousIndex = bin.index
 	}
 }
 
 func (s *SparseStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.SubFlag) error {
-	return DecodeAndMergeWith(s, b, encodingMode)
+	switch encodingMode {
+
+	case enc.BinEncodingIndexDeltasAndCounts, enc.BinEncodingIndexDeltas:
+		numBins, err := enc.DecodeUvarint64(b)
+		if err != nil {
+			return err
+		}
+		withCounts := encodingMode == enc.BinEncodingIndexDeltasAndCounts
+		if len(s.counts) == 0 {
+			// Each bin takes at least one byte, which bounds the preallocation
+			// if numBins is corrupt.
+			capacity := len(*b)
+			if numBins < uint64(capacity) {
+				capacity = int(numBins)
+			}
+			s.counts = make(map[int]float64, capacity)
+		}
+		index := int64(0)
+		for i := uint64(0); i < numBins; i++ {
+			indexDelta, err := enc.DecodeVarint64(b)
+			if err != nil {
+				return err
+			}
+			index += indexDelta
+			if !withCounts {
+				s.counts[int(index)]++
+				continue
+			}
+			count, err := enc.DecodeVarfloat64(b)
+			if err != nil {
+				return err
+			}
+			s.AddWithCount(int(index), count)
+		}
+		return nil
+
+	default:
+		return DecodeAndMergeWith(s, b, encodingMode)
+	}
 }
 
 var _ Store = (*SparseStore)(nil)
@@ -7,8 +7,12 @@ package store
 
 import (
 	"errors"
+	"io"
+	"math"
+	"sort"
 
 	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/internal/emptystore"
 	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
 )
 
@@ -19,8 +23,44 @@ var (
 	DenseStoreConstructor             = Provider(func() Store { return NewDenseStore() })
 	BufferedPaginatedStoreConstructor = Provider(func() Store { return NewBufferedPaginatedStore() })
 	SparseStoreConstructor            = Provider(func() Store { return NewSparseStore() })
+
+	UnbufferedPaginatedStoreConstructor = Provider(func() Store { return NewUnbufferedPaginatedStore() })
+	IntegerDenseStoreConstructor        = Provider(func() Store { return NewIntegerDenseStore() })
+	DenseStoreF32Constructor            = Provider(func() Store { return NewDenseStoreF32() })
+	AdaptiveStoreConstructor            = Provider(func() Store { return NewAdaptiveStore() })
 )
 
+// PoolProvider returns a Provider of BufferedPaginatedStores that allocate
+// their pages from pool (see NewBufferedPaginatedStoreWithPool), so that the
+// stores of many sketches can share the same pool, for instance, an ArenaPool
+// that is reset at the end of an aggregation window.
+func PoolProvider(pool PagePool) Provider {
+	return func() Store { return NewBufferedPaginatedStoreWithPool(pool) }
+}
+
+// emptyLiker is implemented by the stores of this package, which can build
+// empty stores of their own types and with their own settings (e.g., the same
+// maximum number of bins, page size, page pool or memory limit).
+type emptyLiker interface {
+	newEmpty() Store
+}
+
+// newEmptyLike returns an empty store of the same type as s, with the same
+// settings, without copying the bins of s. Stores of types that are defined
+// outside of this package are copied, then cleared.
+func newEmptyLike(s Store) Store {
+	if e, ok := s.(emptyLiker); ok {
+		return e.newEmpty()
+	}
+	empty := s.Copy()
+	empty.Clear()
+	return empty
+}
+
+func init() {
+	emptystore.NewLike = func(s interface{}) interface{} { return newEmptyLike(s.(Store)) }
+}
+
 const (
 	maxInt = int(^uint(0) >> 1)
 	minInt = ^maxInt
@@ -29,31 +69,88 @@ const (
 var (
 	errUndefinedMinIndex = errors.New("MinIndex of empty store is undefined")
 	errUndefinedMaxIndex = errors.New("MaxIndex of empty store is undefined")
+	errUndefinedMaxCount = errors.New("MaxCountBin of empty store is undefined")
 )
 
 type Store interface {
 	Add(index int)
 	AddBin(bin Bin)
+	// AddBins adds the provided bins to the store. It is equivalent to
+	// calling AddBin on each of them, but stores may add them more
+	// efficiently, e.g., by growing only once.
+	AddBins(bins []Bin)
 	AddWithCount(index int, count float64)
+	// SubtractWithCount subtracts count from the count of the bin of the
+	// provided index, clamping it at zero. It has no effect if count is not
+	// positive or is infinite.
+	SubtractWithCount(index int, count float64)
+	// SubtractBin subtracts the count of bin from the count of the bin of the
+	// same index, as SubtractWithCount does.
+	SubtractBin(bin Bin)
 	// Bins returns a channel that emits the bins that are encoded in the store.
 	// Note that this leaks a channel and a goroutine if it is not iterated to completion.
 	Bins() <-chan Bin
 	// ForEach applies f to all elements of the store or until f returns true.
 	ForEach(f func(index int, count float64) (stop bool))
+	// ForEachInRange applies f to the elements of the store whose indexes are
+	// between minIndex and maxIndex (both inclusive), in the same order as
+	// ForEach, or until f returns true. It only goes through the part of the
+	// store that may hold such indexes.
+	ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool))
 	Copy() Store
+	// Downsample returns a new store, of the same type and configuration as
+	// this one, whose bins are the bins of this store merged by groups of
+	// 2^factorLog2 adjacent indexes: the count of the bin of index i is added
+	// to the bin of index i >> factorLog2, that is, floor(i / 2^factorLog2).
+	// This store is not modified. A factorLog2 lower than or equal to 0 makes
+	// Downsample return a copy of this store.
+	Downsample(factorLog2 int) Store
+	// Trim removes the bins whose indexes are lower than minIndex or greater
+	// than maxIndex, and releases the memory that they used, as far as the
+	// store allows it.
+	Trim(minIndex, maxIndex int)
+	// CopyTo overwrites the content of dst with the content of the store. If
+	// dst is of the same type as the store, it is made identical to the store
+	// while reusing the memory that it has allocated. Otherwise, dst keeps its
+	// type and its configuration, and the bins of the store are merged into
+	// it once cleared.
+	CopyTo(dst Store)
 	// Clear empties the store while allowing reusing already allocated memory.
 	// In some situations, it may be advantageous to clear and reuse a store
 	// rather than instantiating a new one. Keeping reusing the same store again
 	// and again on varying input data distributions may however ultimately make
 	// the store overly large and may waste memory space.
 	Clear()
+	// ClearRetainingCapacity empties the store while keeping the memory that
+	// it has allocated, as well as how this memory is laid out, so that the
+	// store can be efficiently reused to track similarly distributed data.
+	ClearRetainingCapacity()
 	IsEmpty() bool
 	MaxIndex() (int, error)
 	MinIndex() (int, error)
+	// MaxCountBin returns the bin with the highest count. If several bins have
+	// the highest count, the one with the lowest index is returned. Return a
+	// non-nil error if the store is empty.
+	MaxCountBin() (Bin, error)
 	TotalCount() float64
+	// GetCountAtIndex returns the count of the bin of the provided index, or
+	// zero if the store holds no such bin.
+	GetCountAtIndex(index int) float64
+	// MemorySize returns an approximation of the memory size in bytes that the
+	// store uses, including the memory space that is allocated but unused.
+	MemorySize() int
 	KeyAtRank(rank float64) int
 	MergeWith(store Store)
 	ToProto() *sketchpb.Store
+	// ToColumns returns the indexes and the counts of the non-empty bins of
+	// the store, in ascending order of their indexes, as two slices of the
+	// same length that the store does not retain, e.g., to write them to a
+	// columnar format. The store can be rebuilt with FromColumns.
+	ToColumns() (indexes []int32, counts []float64)
+	// Stats describes how the store holds its bins, for diagnostic purposes,
+	// e.g., to understand why some stores grow large. It goes through the
+	// bins of the store.
+	Stats() Stats
 	// Reweight multiplies all values from the store by w, but keeps the same global distribution.
 	Reweight(w float64) error
 	// Encode encodes the bins of the store and appends its content to the
@@ -68,86 +165,477 @@ type Store interface {
 	DecodeAndMergeWith(b *[]byte, binEncodingMode enc.SubFlag) error
 }
 
+// copyTo clears dst and merges s into it, which is how stores copy themselves
+// to stores of different types.
+func copyTo(s, dst Store) {
+	if s == dst {
+		return
+	}
+	dst.Clear()
+	dst.MergeWith(s)
+}
+
+// Equivalent returns whether the two stores have the same non-empty bins with
+// the same counts, regardless of their types and of how they represent their
+// bins internally.
+func Equivalent(s1, s2 Store) bool {
+	return ApproxEquivalent(s1, s2, 0)
+}
+
+// ApproxEquivalent returns whether the absolute differences between the counts
+// of the bins of the two stores are at most tolerance, regardless of their
+// types and of how they represent their bins internally.
+func ApproxEquivalent(s1, s2 Store, tolerance float64) bool {
+	if s1 == s2 {
+		return true
+	}
+	// Some stores may report an index more than once, so counts are summed
+	// before being compared.
+	counts := make(map[int][2]float64)
+	s1.ForEach(func(index int, count float64) (stop bool) {
+		c := counts[index]
+		c[0] += count
+		counts[index] = c
+		return false
+	})
+	s2.ForEach(func(index int, count float64) (stop bool) {
+		c := counts[index]
+		c[1] += count
+		counts[index] = c
+		return false
+	})
+	for _, c := range counts {
+		if c[0] != c[1] && !(math.Abs(c[0]-c[1]) <= tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// addBins adds bins to s one at a time, which is how stores that do not
+// benefit from adding them at once implement AddBins.
+func addBins(s Store, bins []Bin) {
+	for _, bin := range bins {
+		s.AddBin(bin)
+	}
+}
+
+// binsRange returns the lowest and the highest indexes of the bins with
+// non-zero counts, and false if there is no such bin.
+func binsRange(bins []Bin) (minIndex, maxIndex int, ok bool) {
+	minIndex, maxIndex = maxInt, minInt
+	for _, bin := range bins {
+		if bin.count == 0 {
+			continue
+		}
+		minIndex = min(minIndex, bin.index)
+		maxIndex = max(maxIndex, bin.index)
+	}
+	return minIndex, maxIndex, minIndex <= maxIndex
+}
+
+// downsample adds the counts of the bins of s to the downsampled bins of dst,
+// which is expected to be empty, and returns dst (see Store.Downsample).
+func downsample(s Store, factorLog2 int, dst Store) Store {
+	if factorLog2 <= 0 {
+		s.CopyTo(dst)
+		return dst
+	}
+	s.ForEach(func(index int, count float64) (stop bool) {
+		dst.AddWithCount(index>>uint(factorLog2), count)
+		return false
+	})
+	return dst
+}
+
+// addBinsInRange adds to dst the bins of s whose indexes are greater than or
+// equal to minIndex and lower than or equal to maxIndex.
+func addBinsInRange(s Store, minIndex, maxIndex int, dst Store) {
+	s.ForEachInRange(minIndex, maxIndex, func(index int, count float64) (stop bool) {
+		dst.AddWithCount(index, count)
+		return false
+	})
+}
+
+var (
+	ErrInvalidProtoCount = errors.New("bin counts must be finite and non-negative")
+	ErrInvalidProtoIndex = errors.New("bin indexes must be 32-bit integers")
+)
+
 // FromProto returns an instance of DenseStore that contains the data in the provided protobuf representation.
-func FromProto(pb *sketchpb.Store) *DenseStore {
+// Return a non-nil error if the protobuf representation is invalid (see ValidateProto).
+func FromProto(pb *sketchpb.Store) (*DenseStore, error) {
 	store := NewDenseStore()
-	MergeWithProto(store, pb)
-	return store
+	if err := MergeWithProto(store, pb); err != nil {
+		return nil, err
+	}
+	return store, nil
 }
 
 // MergeWithProto merges the distribution in a protobuf Store to an existing store.
 // - if called with an empty store, this simply populates the store with the distribution in the protobuf Store.
 // - if called with a non-empty store, this has the same outcome as deserializing the protobuf Store, then merging.
-func MergeWithProto(store Store, pb *sketchpb.Store) {
+// The protobuf Store is validated first (see ValidateProto), and the store is left unchanged if it is invalid.
+func MergeWithProto(store Store, pb *sketchpb.Store) error {
+	if err := ValidateProto(pb); err != nil {
+		return err
+	}
+	bins := make([]Bin, 0, len(pb.BinCounts)+len(pb.ContiguousBinCounts))
 	for idx, count := range pb.BinCounts {
-		store.AddWithCount(int(idx), count)
+		bins = append(bins, Bin{index: int(idx), count: count})
 	}
 	for idx, count := range pb.ContiguousBinCounts {
-		store.AddWithCount(idx+int(pb.ContiguousBinIndexOffset), count)
+		bins = append(bins, Bin{index: idx + int(pb.ContiguousBinIndexOffset), count: count})
+	}
+	store.AddBins(bins)
+	return nil
+}
+
+// FromColumns returns an instance of DenseStore that holds the bins whose
+// indexes and counts are provided as two slices of the same length, as
+// ToColumns returns them. It returns a non-nil error if the slices have
+// different lengths or if some counts are NaN, infinite or negative.
+func FromColumns(indexes []int32, counts []float64) (*DenseStore, error) {
+	store := NewDenseStore()
+	if err := MergeWithColumns(store, indexes, counts); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// MergeWithColumns adds to the store the bins whose indexes and counts are
+// provided as two slices of the same length, which do not need to be sorted.
+// The columns are validated first, and the store is left unchanged if they
+// are invalid (see FromColumns).
+func MergeWithColumns(store Store, indexes []int32, counts []float64) error {
+	if len(indexes) != len(counts) {
+		return errors.New("index and count columns must have the same length")
+	}
+	for _, count := range counts {
+		if !isValidCount(count) {
+			return ErrInvalidProtoCount
+		}
+	}
+	bins := make([]Bin, len(indexes))
+	for i, index := range indexes {
+		bins[i] = Bin{index: int(index), count: counts[i]}
+	}
+	store.AddBins(bins)
+	return nil
+}
+
+// Stats describes how a store holds its bins (see Store.Stats). The fields
+// that do not apply to the type of the store are zero.
+type Stats struct {
+	// NumBins is the number of non-empty bins.
+	NumBins int
+	// MemorySize is the memory size of the store, as MemorySize returns it,
+	// which includes the memory that is allocated but unused.
+	MemorySize int
+	// NumPages is the number of pages that paginated stores have allocated.
+	NumPages int
+	// NumBufferedIndexes is the number of indexes that the buffer of a
+	// BufferedPaginatedStore holds and that have not been compacted into
+	// pages.
+	NumBufferedIndexes int
+	// NumCompactions is the number of times the buffer of a
+	// BufferedPaginatedStore has been compacted into pages since the store
+	// has been created.
+	NumCompactions int
+}
+
+// stats returns the Stats of s that apply to any store.
+func stats(s Store) Stats {
+	numBins := 0
+	s.ForEach(func(index int, count float64) (stop bool) {
+		if count != 0 {
+			numBins++
+		}
+		return false
+	})
+	return Stats{NumBins: numBins, MemorySize: s.MemorySize()}
+}
+
+// toColumns returns the columns of the non-empty bins of s (see
+// Store.ToColumns).
+func toColumns(s Store) ([]int32, []float64) {
+	c := columns{}
+	s.ForEach(func(index int, count float64) (stop bool) {
+		if count != 0 {
+			c.indexes = append(c.indexes, int32(index))
+			c.counts = append(c.counts, count)
+		}
+		return false
+	})
+	if !sort.IsSorted(c) {
+		sort.Sort(c)
+	}
+	return c.indexes, c.counts
+}
+
+// columns sorts bins that are held as two columns by index.
+type columns struct {
+	indexes []int32
+	counts  []float64
+}
+
+func (c columns) Len() int           { return len(c.indexes) }
+func (c columns) Less(i, j int) bool { return c.indexes[i] < c.indexes[j] }
+func (c columns) Swap(i, j int) {
+	c.indexes[i], c.indexes[j] = c.indexes[j], c.indexes[i]
+	c.counts[i], c.counts[j] = c.counts[j], c.counts[i]
+}
+
+// ValidateProto returns a non-nil error if the protobuf Store has counts that
+// are NaN, infinite or negative, or if its contiguous bins span indexes that
+// cannot be represented as 32-bit integers, which may be the case if it has
+// been decoded from a corrupt or malicious payload.
+func ValidateProto(pb *sketchpb.Store) error {
+	for _, count := range pb.BinCounts {
+		if !isValidCount(count) {
+			return ErrInvalidProtoCount
+		}
+	}
+	for _, count := range pb.ContiguousBinCounts {
+		if !isValidCount(count) {
+			return ErrInvalidProtoCount
+		}
+	}
+	if int64(pb.ContiguousBinIndexOffset)+int64(len(pb.ContiguousBinCounts))-1 > math.MaxInt32 {
+		return ErrInvalidProtoIndex
+	}
+	return nil
+}
+
+func isValidCount(count float64) bool {
+	return count >= 0 && !math.IsInf(count, 1)
+}
+
+// isSubtractableCount returns whether count can be subtracted from the counts
+// of bins, which is the case if it is positive and finite, as subtracting NaN
+// would corrupt them.
+func isSubtractableCount(count float64) bool {
+	return count > 0 && !math.IsInf(count, 1)
+}
+
+// EncodeTo writes the content of the store to w, so that it can be decoded
+// with DecodeAndMergeWith, without building an intermediate []byte. The bytes
+// that it writes may differ from those that Encode appends, as bins are always
+// encoded as index deltas and counts. As many small writes are performed, w
+// should generally be buffered.
+func EncodeTo(w io.Writer, s Store, t enc.FlagType) error {
+	numBins := uint64(0)
+	s.ForEach(func(index int, count float64) (stop bool) {
+		numBins++
+		return false
+	})
+	if numBins == 0 {
+		return nil
+	}
+	if err := enc.WriteFlag(w, enc.NewFlag(t, enc.BinEncodingIndexDeltasAndCounts)); err != nil {
+		return err
+	}
+	if err := enc.WriteUvarint64(w, numBins); err != nil {
+		return err
 	}
+	var err error
+	previousIndex := 0
+	s.ForEach(func(index int, count float64) (stop bool) {
+		if err = enc.WriteVarint64(w, int64(index-previousIndex)); err != nil {
+			return true
+		}
+		if err = enc.WriteVarfloat64(w, count); err != nil {
+			return true
+		}
+		previousIndex = index
+		return false
+	})
+	return err
+}
+
+var (
+	ErrInvalidEncodedCount   = errors.New("encoded bin counts must be finite and non-negative")
+	ErrDecodingLimitExceeded = errors.New("encoded bins exceed the decoding limits")
+)
+
+// DecodingOptions limits what can be decoded, so that a corrupt or malicious
+// payload cannot make stores allocate unbounded memory. Its zero value does
+// not set any limit.
+type DecodingOptions struct {
+	// MaxNumBins is the maximum number of encoded bins, including the empty ones
+	// that contiguous encodings may have, or 0 for no limit.
+	MaxNumBins int
+	// MaxIndexMagnitude is the maximum absolute value of the indexes of the
+	// encoded bins, or 0 for no limit. As dense stores allocate memory for the
+	// whole range of the indexes of their bins, it bounds their memory size.
+	MaxIndexMagnitude int
+}
+
+// DecodeAndMergeWithOptions checks that the bins encoded at the start of b
+// are within the limits of options and have finite and non-negative counts
+// (see ValidateEncodedBins), then decodes them and merges them into s. The
+// store is left unchanged if they are invalid.
+func DecodeAndMergeWithOptions(s Store, b *[]byte, binEncodingMode enc.SubFlag, options DecodingOptions) error {
+	if _, err := ValidateEncodedBins(*b, binEncodingMode, options); err != nil {
+		return err
+	}
+	return s.DecodeAndMergeWith(b, binEncodingMode)
+}
+
+// ValidateEncodedBins returns the number of bins that are encoded with
+// binEncodingMode at the start of b, without decoding them into a store, or a
+// non-nil error if they cannot be decoded, if some of them have counts that
+// are NaN, infinite or negative, or if they are not within the limits of
+// options.
+func ValidateEncodedBins(b []byte, binEncodingMode enc.SubFlag, options DecodingOptions) (int, error) {
+	numBins, err := enc.DecodeUvarint64(&b)
+	if err != nil {
+		return 0, err
+	}
+	if options.MaxNumBins > 0 && numBins > uint64(options.MaxNumBins) {
+		return 0, ErrDecodingLimitExceeded
+	}
+	isValidIndex := func(index int64) bool {
+		return options.MaxIndexMagnitude <= 0 || (index <= int64(options.MaxIndexMagnitude) && index >= -int64(options.MaxIndexMagnitude))
+	}
+	switch binEncodingMode {
+
+	case enc.BinEncodingIndexDeltasAndCounts, enc.BinEncodingIndexDeltas:
+		withCounts := binEncodingMode == enc.BinEncodingIndexDeltasAndCounts
+		index := int64(0)
+		for i := uint64(0); i < numBins; i++ {
+			indexDelta, err := enc.DecodeVarint64(&b)
+			if err != nil {
+				return 0, err
+			}
+			index += indexDelta
+			if !isValidIndex(index) {
+				return 0, ErrDecodingLimitExceeded
+			}
+			if withCounts {
+				count, err := enc.DecodeVarfloat64(&b)
+				if err != nil {
+					return 0, err
+				}
+				if !isValidCount(count) {
+					return 0, ErrInvalidEncodedCount
+				}
+			}
+		}
+
+	case enc.BinEncodingContiguousCounts:
+		index, err := enc.DecodeVarint64(&b)
+		if err != nil {
+			return 0, err
+		}
+		indexDelta, err := enc.DecodeVarint64(&b)
+		if err != nil {
+			return 0, err
+		}
+		for i := uint64(0); i < numBins; i++ {
+			if !isValidIndex(index) {
+				return 0, ErrDecodingLimitExceeded
+			}
+			count, err := enc.DecodeVarfloat64(&b)
+			if err != nil {
+				return 0, err
+			}
+			if !isValidCount(count) {
+				return 0, ErrInvalidEncodedCount
+			}
+			index += indexDelta
+		}
+
+	default:
+		return 0, errors.New("unknown bin encoding")
+	}
+	return int(numBins), nil
 }
 
 func DecodeAndMergeWith(s Store, b *[]byte, binEncodingMode enc.SubFlag) error {
+	bins, err := decodeEncodedBins(b, binEncodingMode)
+	s.AddBins(bins)
+	return err
+}
+
+// decodeEncodedBins decodes bins that have been encoded in the format of the
+// provided binEncodingMode. If decoding fails, it returns the bins that have
+// been decoded so far along with the error.
+func decodeEncodedBins(b *[]byte, binEncodingMode enc.SubFlag) ([]Bin, error) {
+	var bins []Bin
 	switch binEncodingMode {
 
 	case enc.BinEncodingIndexDeltasAndCounts:
 		numBins, err := enc.DecodeUvarint64(b)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		bins = make([]Bin, 0, numBinsCapacity(numBins, *b))
 		index := int64(0)
 		for i := uint64(0); i < numBins; i++ {
 			indexDelta, err := enc.DecodeVarint64(b)
 			if err != nil {
-				return err
+				return bins, err
 			}
 			count, err := enc.DecodeVarfloat64(b)
 			if err != nil {
-				return err
+				return bins, err
 			}
 			index += indexDelta
-			s.AddWithCount(int(index), count)
+			bins = append(bins, Bin{index: int(index), count: count})
 		}
 
 	case enc.BinEncodingIndexDeltas:
 		numBins, err := enc.DecodeUvarint64(b)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		bins = make([]Bin, 0, numBinsCapacity(numBins, *b))
 		index := int64(0)
 		for i := uint64(0); i < numBins; i++ {
 			indexDelta, err := enc.DecodeVarint64(b)
 			if err != nil {
-				return err
+				return bins, err
 			}
 			index += indexDelta
-			s.Add(int(index))
+			bins = append(bins, Bin{index: int(index), count: 1})
 		}
 
 	case enc.BinEncodingContiguousCounts:
 		numBins, err := enc.DecodeUvarint64(b)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		bins = make([]Bin, 0, numBinsCapacity(numBins, *b))
 		index, err := enc.DecodeVarint64(b)
 		if err != nil {
-			return err
+			return bins, err
 		}
 		indexDelta, err := enc.DecodeVarint64(b)
 		if err != nil {
-			return err
+			return bins, err
 		}
 		for i := uint64(0); i < numBins; i++ {
 			count, err := enc.DecodeVarfloat64(b)
 			if err != nil {
-				return err
+				return bins, err
 			}
-			s.AddWithCount(int(index), count)
+			bins = append(bins, Bin{index: int(index), count: count})
 			index += indexDelta
 		}
 
 	default:
-		return errors.New("unknown bin encoding")
+		return nil, errors.New("unknown bin encoding")
 	}
-	return nil
+	return bins, nil
+}
+
+// numBinsCapacity bounds the number of bins to preallocate with the length of
+// the encoded bins, in which each bin takes at least one byte, in case the
+// encoded number of bins is corrupt.
+func numBinsCapacity(numBins uint64, b []byte) int {
+	if numBins < uint64(len(b)) {
+		return int(numBins)
+	}
+	return len(b)
 }
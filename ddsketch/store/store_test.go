@@ -6,15 +6,21 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
 	"reflect"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"unsafe"
 
 	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
 	fuzz "github.com/google/gofuzz"
 	"github.com/stretchr/testify/assert"
 )
@@ -40,6 +46,7 @@ var (
 		{name: "collapsing_highest_1024", newStore: func() Store { return NewCollapsingHighestDenseStore(1024) }, transformBins: collapsingHighest(1024)},
 		{name: "sparse", newStore: func() Store { return NewSparseStore() }, transformBins: identity},
 		{name: "buffered_paginated", newStore: func() Store { return NewBufferedPaginatedStore() }, transformBins: identity},
+		{name: "unbuffered_paginated", newStore: func() Store { return NewUnbufferedPaginatedStore() }, transformBins: identity},
 	}
 )
 
@@ -300,6 +307,371 @@ func TestMergeFuzzy(t *testing.T) {
 	}
 }
 
+func TestSubtractWithCountFuzzy(t *testing.T) {
+	maxNumValues := 1000
+
+	random := rand.New(rand.NewSource(seed))
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := testCase.newStore()
+				numValues := random.Intn(maxNumValues)
+				for j := 0; j < numValues; j++ {
+					bin := Bin{index: randomIndex(random), count: 1}
+					if random.Intn(2) == 0 {
+						bin.count = randomCount(random)
+					}
+					bins = append(bins, bin)
+					store.AddWithCount(bin.index, bin.count)
+				}
+				counts := make(map[int]float64)
+				for _, bin := range normalize(testCase.transformBins(bins)) {
+					counts[bin.index] = bin.count
+				}
+
+				// Subtract from bins that exist in the store, sometimes more
+				// than their counts.
+				numSubtractions := random.Intn(len(counts) + 1)
+				for index := range counts {
+					if numSubtractions == 0 {
+						break
+					}
+					numSubtractions--
+					count := float64(random.Intn(3))
+					if random.Intn(2) == 0 {
+						count = 2 * randomCount(random)
+					}
+					store.SubtractWithCount(index, count)
+					counts[index] -= count
+				}
+
+				expectedBins := make([]Bin, 0, len(counts))
+				for index, count := range counts {
+					expectedBins = append(expectedBins, Bin{index: index, count: count})
+				}
+				testStore(t, store, normalize(expectedBins))
+			}
+		})
+	}
+}
+
+func TestSubtractWithCount(t *testing.T) {
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore()
+			store.SubtractWithCount(0, 1)
+			assertEncodeBins(t, store, nil)
+
+			store.Add(-2)
+			store.Add(3)
+			store.AddWithCount(3, 1.5)
+			store.SubtractWithCount(3, -1)
+			store.SubtractWithCount(3, 0.5)
+			assertEncodeBins(t, store, []Bin{{index: -2, count: 1}, {index: 3, count: 2}})
+			// NaN and infinite counts have no effect.
+			for _, index := range []int{-2, 3, 4} {
+				store.SubtractWithCount(index, math.NaN())
+				store.SubtractWithCount(index, math.Inf(1))
+				store.SubtractBin(Bin{index: index, count: math.NaN()})
+			}
+			assertEncodeBins(t, store, []Bin{{index: -2, count: 1}, {index: 3, count: 2}})
+			assert.Equal(t, float64(3), store.TotalCount())
+			store.SubtractWithCount(-2, 1)
+			assertEncodeBins(t, store, []Bin{{index: 3, count: 2}})
+			store.SubtractWithCount(3, 10)
+			assertEncodeBins(t, store, nil)
+
+			store.Add(5)
+			assertEncodeBins(t, store, []Bin{{index: 5, count: 1}})
+		})
+	}
+}
+
+func TestSubtractBin(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore()
+			store.AddWithCount(0, 2)
+			store.AddWithCount(3, 2)
+			store.AddWithCount(5, 2)
+			store.SubtractBin(Bin{index: 5, count: 5})
+			store.SubtractBin(Bin{index: 3, count: 1})
+			store.SubtractBin(Bin{index: 10, count: 1})
+			assertEncodeBins(t, store, []Bin{{index: 0, count: 2}, {index: 3, count: 1}})
+			maxIndex, err := store.MaxIndex()
+			assert.Nil(t, err)
+			assert.Equal(t, 3, maxIndex)
+			store.SubtractBin(Bin{index: 0, count: 2})
+			minIndex, err := store.MinIndex()
+			assert.Nil(t, err)
+			assert.Equal(t, 3, minIndex)
+
+			// Retracting the bins that have been added empties the store.
+			for i := 0; i < numTests; i++ {
+				store := testCase.newStore()
+				bins := make([]Bin, 0)
+				for j := random.Intn(100); j > 0; j-- {
+					bin := Bin{index: randomIndex(random) / 100, count: float64(1 + random.Intn(5))}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				for _, bin := range normalize(testCase.transformBins(bins)) {
+					store.SubtractBin(bin)
+				}
+				assertEncodeBins(t, store, nil)
+			}
+		})
+	}
+}
+
+func TestNewBin(t *testing.T) {
+	bin, err := NewBin(-3, 2.5)
+	assert.Nil(t, err)
+	assert.Equal(t, -3, bin.Index())
+	assert.Equal(t, 2.5, bin.Count())
+
+	for _, count := range []float64{-1, math.NaN(), math.Inf(1)} {
+		_, err := NewBin(0, count)
+		assert.Equal(t, ErrInvalidBinCount, err)
+		_, err = bin.WithCount(count)
+		assert.Equal(t, ErrInvalidBinCount, err)
+	}
+
+	moved := bin.WithIndex(7)
+	assert.Equal(t, Bin{index: 7, count: 2.5}, moved)
+	assert.Equal(t, -3, bin.Index())
+	updated, err := moved.WithCount(0)
+	assert.Nil(t, err)
+	assert.Equal(t, Bin{index: 7, count: 0}, updated)
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore()
+			store.AddBin(updated.WithIndex(1))
+			store.AddBin(moved)
+			testStore(t, store, testCase.transformBins([]Bin{moved}))
+		})
+	}
+}
+
+func TestMaxCountBin(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore()
+			_, err := store.MaxCountBin()
+			assert.Error(t, err)
+
+			// Ties are broken in favor of the lowest index.
+			store.Add(7)
+			store.Add(3)
+			store.Add(5)
+			store.Add(5)
+			store.Add(3)
+			bin, err := store.MaxCountBin()
+			assert.NoError(t, err)
+			assert.Equal(t, Bin{index: 3, count: 2}, bin)
+
+			for i := 0; i < numTests; i++ {
+				store := testCase.newStore()
+				bins := make([]Bin, 0)
+				for j := 0; j < 100; j++ {
+					bin := Bin{index: randomIndex(random) / 10, count: float64(1 + random.Intn(5))}
+					bins = append(bins, bin)
+					store.AddWithCount(bin.index, bin.count)
+				}
+				expected := Bin{}
+				for _, bin := range normalize(testCase.transformBins(bins)) {
+					if bin.count > expected.count {
+						expected = bin
+					}
+				}
+				actual, err := store.MaxCountBin()
+				assert.NoError(t, err)
+				assert.Equal(t, expected, actual)
+			}
+		})
+	}
+}
+
+func TestMemorySize(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore()
+			emptySize := store.MemorySize()
+			assert.Greater(t, emptySize, 0)
+			for i := 0; i < 1000; i++ {
+				store.Add(randomIndex(random))
+			}
+			assert.Greater(t, store.MemorySize(), emptySize)
+			if _, ok := store.(*SparseStore); !ok {
+				assert.Equal(t, int(size(t, store)), store.MemorySize())
+			}
+		})
+	}
+}
+
+func TestClearRetainingCapacity(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore()
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				numValues := random.Intn(1000)
+				for j := 0; j < numValues; j++ {
+					bin := Bin{index: randomIndex(random) / (i + 1), count: randomCount(random)}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				normalizedBins := normalize(testCase.transformBins(bins))
+				assertEncodeBins(t, store, normalizedBins)
+
+				// The memory size of sparse stores is estimated from their
+				// number of bins, which does not reflect retained capacity.
+				_, isSparse := store.(*SparseStore)
+				memorySize := store.MemorySize()
+				store.ClearRetainingCapacity()
+				assertEncodeBins(t, store, nil)
+				if !isSparse {
+					assert.Equal(t, memorySize, store.MemorySize())
+				}
+
+				// Adding the same bins again does not require more memory.
+				for _, bin := range bins {
+					store.AddBin(bin)
+				}
+				assertEncodeBins(t, store, normalizedBins)
+				assert.Equal(t, memorySize, store.MemorySize())
+
+				other := testCase.newStore()
+				other.MergeWith(store)
+				store.ClearRetainingCapacity()
+				store.MergeWith(other)
+				assertEncodeBins(t, store, normalizedBins)
+				store.ClearRetainingCapacity()
+			}
+		})
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for _, dstTestCase := range testCases {
+				store := testCase.newStore()
+				dst := dstTestCase.newStore()
+				for i := 0; i < 100; i++ {
+					dst.AddWithCount(randomIndex(random), randomCount(random))
+				}
+				bins := make([]Bin, 0)
+				for i := 0; i < 1000; i++ {
+					bin := Bin{index: randomIndex(random), count: randomCount(random)}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				normalizedBins := normalize(testCase.transformBins(bins))
+
+				// A store of the same type is made identical, while a store of
+				// another type keeps its configuration.
+				sameType := reflect.TypeOf(store) == reflect.TypeOf(dst)
+				expectedBins := normalizedBins
+				if !sameType {
+					expectedBins = normalize(dstTestCase.transformBins(normalizedBins))
+				}
+				store.CopyTo(dst)
+				assertEncodeBins(t, dst, expectedBins)
+				dst.Add(0)
+				assertEncodeBins(t, store, normalizedBins)
+
+				if sameType {
+					// Copying again does not require more memory.
+					memorySize := dst.MemorySize()
+					store.CopyTo(dst)
+					assertEncodeBins(t, dst, normalizedBins)
+					if _, isSparse := store.(*SparseStore); !isSparse {
+						assert.Equal(t, memorySize, dst.MemorySize())
+					}
+				}
+
+				store.CopyTo(store)
+				assertEncodeBins(t, store, normalizedBins)
+				testCase.newStore().CopyTo(dst)
+				assertEncodeBins(t, dst, nil)
+			}
+		})
+	}
+}
+
+func TestNewEmptyLike(t *testing.T) {
+	pool := NewSyncMemoryPool(4)
+	unbuffered := NewUnbufferedPaginatedStore()
+	unbuffered.pageLenLog2, unbuffered.pageLenMask = 3, 7
+	stores := []Store{
+		NewDenseStore(),
+		NewCollapsingLowestDenseStore(8),
+		NewCollapsingHighestDenseStore(8),
+		NewIntegerDenseStore(),
+		NewDenseStoreF32(),
+		NewDenseStoreOf[uint32](),
+		NewSparseStore(),
+		NewBufferedPaginatedStoreWithPageSize(3),
+		NewBufferedPaginatedStoreWithPool(pool),
+		unbuffered,
+		NewAdaptiveStore(),
+		NewBoundedStore(NewCollapsingLowestDenseStore(8), 1<<20),
+		NewAccountedStore(NewBufferedPaginatedStoreWithPageSize(3), &testAccountant{}),
+	}
+	for _, store := range stores {
+		t.Run(reflect.TypeOf(store).String(), func(t *testing.T) {
+			bins := make([]Bin, 0)
+			for index := -20; index < 20; index++ {
+				bin := Bin{index: index, count: 1}
+				bins = append(bins, bin)
+				store.AddBin(bin)
+			}
+			expectedBins := make([]Bin, 0)
+			store.ForEach(func(index int, count float64) bool {
+				expectedBins = append(expectedBins, Bin{index: index, count: count})
+				return false
+			})
+			expectedBins = normalize(expectedBins)
+
+			// Stores of this package do not need to be copied.
+			assert.Implements(t, (*emptyLiker)(nil), store)
+			empty := newEmptyLike(store)
+			assert.IsType(t, store, empty)
+			assert.True(t, empty.IsEmpty())
+			assertEncodeBins(t, store, expectedBins)
+
+			// The empty store has the same settings as store.
+			reference := newEmptyLike(store)
+			for _, bin := range bins {
+				reference.AddBin(bin)
+			}
+			assertEncodeBins(t, reference, expectedBins)
+			switch st := store.(type) {
+			case *BufferedPaginatedStore:
+				assert.Equal(t, st.pageLenLog2, empty.(*BufferedPaginatedStore).pageLenLog2)
+				assert.Equal(t, st.pool, empty.(*BufferedPaginatedStore).pool)
+			case *UnbufferedPaginatedStore:
+				assert.Equal(t, st.pageLenLog2, empty.(*UnbufferedPaginatedStore).pageLenLog2)
+			case *BoundedStore:
+				assert.Equal(t, st.maxBytes, empty.(*BoundedStore).maxBytes)
+				assert.IsType(t, st.inner, empty.(*BoundedStore).inner)
+			case *AccountedStore:
+				assert.Same(t, st.accountant, empty.(*AccountedStore).accountant)
+				assert.Equal(t, st.inner.(*BufferedPaginatedStore).pageLenLog2, empty.(*AccountedStore).inner.(*BufferedPaginatedStore).pageLenLog2)
+			}
+		})
+	}
+}
+
 func TestMergeAfterClear(t *testing.T) {
 	for _, testCase := range testCases {
 		t.Run(testCase.name, func(t *testing.T) {
@@ -317,6 +689,108 @@ func TestMergeAfterClear(t *testing.T) {
 	}
 }
 
+func TestMergeWithItself(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := testCase.newStore()
+				numValues := random.Intn(1000)
+				for j := 0; j < numValues; j++ {
+					index := 10 * randomIndex(random)
+					bins = append(bins, Bin{index: index, count: 2})
+					store.Add(index)
+				}
+				store.MergeWith(store)
+				assertEncodeBins(t, store, normalize(testCase.transformBins(bins)))
+			}
+		})
+	}
+}
+
+func TestGetCountAtIndex(t *testing.T) {
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			random := rand.New(rand.NewSource(seed))
+			for i := 0; i < numTests; i++ {
+				store := testCase.newStore()
+				bins := make([]Bin, 0)
+				numBins := random.Intn(1000)
+				for j := 0; j < numBins; j++ {
+					bin := Bin{index: randomIndex(random) * (i%3 + 1), count: 1}
+					if j%2 == 0 {
+						bin.count = randomCount(random)
+					}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				counts := make(map[int]float64)
+				for _, bin := range normalize(testCase.transformBins(bins)) {
+					counts[bin.index] = bin.count
+				}
+				for index := -3100; index <= 3100; index++ {
+					assert.InDelta(t, counts[index], store.GetCountAtIndex(index), epsilon*counts[index], "index: %d", index)
+				}
+				assert.Zero(t, store.GetCountAtIndex(minInt))
+				assert.Zero(t, store.GetCountAtIndex(maxInt))
+			}
+		})
+	}
+}
+
+func TestForEachInRange(t *testing.T) {
+	allTestCases := append([]TestCase{
+		{name: "integer_dense", newStore: func() Store { return NewIntegerDenseStore() }, transformBins: identity},
+		{name: "dense_f32", newStore: func() Store { return NewDenseStoreF32() }, transformBins: identity},
+		{name: "dense_of_uint32", newStore: func() Store { return NewDenseStoreOf[uint32]() }, transformBins: identity},
+	}, testCases...)
+	for _, testCase := range allTestCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			random := rand.New(rand.NewSource(seed))
+			for i := 0; i < numTests; i++ {
+				store := testCase.newStore()
+				bins := make([]Bin, 0)
+				numBins := random.Intn(1000)
+				for j := 0; j < numBins; j++ {
+					// Integer counts so that all stores represent them exactly.
+					bin := Bin{index: randomIndex(random) * (i%3 + 1), count: float64(random.Intn(3) + 1)}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				normalizedBins := normalize(testCase.transformBins(bins))
+				ranges := [][2]int{{minInt, maxInt}, {0, 0}, {1, -1}, {minInt, 0}, {0, maxInt}}
+				for j := 0; j < 10; j++ {
+					from := randomIndex(random) * 3
+					ranges = append(ranges, [2]int{from, from + random.Intn(500)})
+				}
+				for _, r := range ranges {
+					expectedBins := make([]Bin, 0)
+					for _, bin := range normalizedBins {
+						if bin.index >= r[0] && bin.index <= r[1] {
+							expectedBins = append(expectedBins, bin)
+						}
+					}
+					actualBins := make([]Bin, 0)
+					store.ForEachInRange(r[0], r[1], func(index int, count float64) bool {
+						actualBins = append(actualBins, Bin{index: index, count: count})
+						return false
+					})
+					sort.Slice(actualBins, func(i, j int) bool { return actualBins[i].index < actualBins[j].index })
+					assert.Equal(t, expectedBins, actualBins, "range [%d, %d]", r[0], r[1])
+
+					numVisited := 0
+					store.ForEachInRange(r[0], r[1], func(index int, count float64) bool {
+						numVisited++
+						return true
+					})
+					assert.Equal(t, min(1, len(expectedBins)), numVisited)
+				}
+			}
+		})
+	}
+}
+
 func testStore(t *testing.T, store Store, normalizedBins []Bin) {
 	assertEncodeBins(t, store, normalizedBins)
 	testCopy(t, store, normalizedBins)
@@ -382,7 +856,13 @@ func assertEncodeBins(t *testing.T, store Store, normalizedBins []Bin) {
 		assert.Equal(t, errUndefinedMinIndex, minErr, "min index err")
 		assert.Equal(t, errUndefinedMaxIndex, maxErr, "max index err")
 
-		assert.Zero(t, len(store.Bins()))
+		// Bins is drained, as its goroutine would otherwise leak, along with
+		// the store.
+		numBins := 0
+		for range store.Bins() {
+			numBins++
+		}
+		assert.Zero(t, numBins)
 	} else {
 		assert.False(t, store.IsEmpty(), "empty")
 		assert.InEpsilon(t, expectedTotalCount, store.TotalCount(), epsilon, "total count")
@@ -598,9 +1078,14 @@ func TestCollapsingLowest(t *testing.T) {
 	var store *CollapsingLowestDenseStore
 	for _, maxNumBins := range testMaxNumBins {
 		store = NewCollapsingLowestDenseStore(maxNumBins)
-		for i := 0; i < 2*maxNumBins; i++ {
+		for i := 0; i < maxNumBins; i++ {
+			store.Add(i)
+		}
+		assert.False(t, store.IsCollapsed())
+		for i := maxNumBins; i < 2*maxNumBins; i++ {
 			store.Add(i)
 		}
+		assert.True(t, store.IsCollapsed())
 		assert.Equal(t, len(store.bins), maxNumBins)
 		minIndex, _ := store.MinIndex()
 		assert.Equal(t, minIndex, maxNumBins)
@@ -613,9 +1098,14 @@ func TestCollapsingHighest(t *testing.T) {
 	var store *CollapsingHighestDenseStore
 	for _, maxNumBins := range testMaxNumBins {
 		store = NewCollapsingHighestDenseStore(maxNumBins)
-		for i := 0; i < 2*maxNumBins; i++ {
+		for i := 0; i < maxNumBins; i++ {
+			store.Add(i)
+		}
+		assert.False(t, store.IsCollapsed())
+		for i := maxNumBins; i < 2*maxNumBins; i++ {
 			store.Add(i)
 		}
+		assert.True(t, store.IsCollapsed())
 		assert.Equal(t, len(store.bins), maxNumBins)
 		minIndex, _ := store.MinIndex()
 		assert.Equal(t, minIndex, 0)
@@ -624,6 +1114,89 @@ func TestCollapsingHighest(t *testing.T) {
 	}
 }
 
+func TestCollapsedCount(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		if !strings.HasPrefix(testCase.name, "collapsing") {
+			continue
+		}
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				store := testCase.newStore()
+				other := testCase.newStore()
+				bins := make([]Bin, 0)
+				for j := random.Intn(1000); j > 0; j-- {
+					bin := Bin{index: randomIndex(random) / (i + 1), count: randomCount(random)}
+					bins = append(bins, bin)
+					if j%2 == 0 {
+						store.AddBin(bin)
+					} else {
+						other.AddBin(bin)
+					}
+				}
+				store.MergeWith(other)
+				expected := float64(0)
+				for k, bin := range testCase.transformBins(bins) {
+					if bin.index != bins[k].index {
+						expected += bin.count
+					}
+				}
+				c := store.(interface {
+					IsCollapsed() bool
+					CollapsedCount() float64
+				})
+				assert.InDelta(t, expected, c.CollapsedCount(), epsilon*expected)
+				if expected > 0 {
+					assert.True(t, c.IsCollapsed())
+				}
+				assert.Equal(t, c.CollapsedCount(), store.Copy().(interface{ CollapsedCount() float64 }).CollapsedCount())
+
+				// Removing the collapsed counts leaves the bin holding its own ones.
+				if expected > 0 {
+					minIndex, _ := store.MinIndex()
+					maxIndex, _ := store.MaxIndex()
+					edgeIndex := minIndex
+					if strings.HasPrefix(testCase.name, "collapsing_highest") {
+						edgeIndex = maxIndex
+					}
+					ownCount := store.GetCountAtIndex(edgeIndex) - c.CollapsedCount()
+					if ownCount > 0 {
+						store.SubtractWithCount(edgeIndex, ownCount/2)
+						assert.InDelta(t, expected, c.CollapsedCount(), epsilon*expected)
+					}
+					store.SubtractWithCount(edgeIndex, store.GetCountAtIndex(edgeIndex)-expected/2)
+					assert.InDelta(t, expected/2, c.CollapsedCount(), epsilon*expected)
+				}
+				store.Clear()
+				assert.Zero(t, c.CollapsedCount())
+			}
+		})
+	}
+}
+
+func TestCollapsingAddWithCount(t *testing.T) {
+	for _, maxNumBins := range testMaxNumBins {
+		for _, newStore := range []func() Store{
+			func() Store { return NewCollapsingLowestDenseStore(maxNumBins) },
+			func() Store { return NewCollapsingHighestDenseStore(maxNumBins) },
+		} {
+			// Weighted additions collapse bins as unit additions do.
+			weighted, unit := newStore(), newStore()
+			for i := 0; i < 2*maxNumBins; i++ {
+				weighted.AddWithCount(i, 3)
+				for j := 0; j < 3; j++ {
+					unit.Add(i)
+				}
+			}
+			assert.Equal(t, unit.ToProto(), weighted.ToProto())
+			minIndex, _ := weighted.MinIndex()
+			maxIndex, _ := weighted.MaxIndex()
+			assert.Equal(t, maxNumBins, maxIndex-minIndex+1)
+			assert.Equal(t, float64(6*maxNumBins), weighted.TotalCount())
+		}
+	}
+}
+
 func EvaluateCollapsingBins(t *testing.T, bins []Bin, values []int32, lowest bool) {
 	var binValues []int
 	for _, b := range bins {
@@ -710,6 +1283,47 @@ func TestCollapsingLowestMerge(t *testing.T) {
 	}
 }
 
+// Subtracting counts may shrink the range of the indexes of collapsing stores
+// so that it no longer starts, or ends, at the bounds of their arrays. The
+// counts of the indexes that are then collapsed, be they added or merged, must
+// go to the bins at the bounds of the range, where they are accounted for.
+func TestCollapsingAfterSubtract(t *testing.T) {
+	for _, collapsingLowest := range []bool{true, false} {
+		for _, merge := range []bool{false, true} {
+			sign := 1
+			var store Store
+			if collapsingLowest {
+				store = NewCollapsingLowestDenseStore(4)
+			} else {
+				sign = -1
+				store = NewCollapsingHighestDenseStore(4)
+			}
+			for index := 0; index < 4; index++ {
+				store.Add(sign * index)
+			}
+			// The lowest (resp. highest) indexes are collapsed, then removed.
+			store.Add(sign * 10)
+			collapsedIndex := sign * 7
+			assert.Equal(t, float64(4), store.GetCountAtIndex(collapsedIndex))
+			store.SubtractWithCount(collapsedIndex, 4)
+			assertEncodeBins(t, store, []Bin{{index: sign * 10, count: 1}})
+
+			if merge {
+				other := NewDenseStore()
+				other.AddWithCount(sign*-5, 2)
+				other.AddWithCount(sign*9, 3)
+				store.MergeWith(other)
+			} else {
+				store.AddWithCount(sign*-5, 2)
+				store.AddWithCount(sign*9, 3)
+			}
+			// As the store is collapsed, both counts go to the bin of the
+			// lowest (resp. highest) index.
+			assertEncodeBins(t, store, []Bin{{index: sign * 10, count: 6}})
+		}
+	}
+}
+
 func TestCollapsingHighestMerge(t *testing.T) {
 	nTests := 100
 	// Store indices are limited to the int32 range
@@ -814,6 +1428,39 @@ func TestDenseMixedMerge2(t *testing.T) {
 	}
 }
 
+func TestMergeWithOtherTypes(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	dstProviders := map[string]Provider{
+		"dense":              DenseStoreConstructor,
+		"buffered_paginated": BufferedPaginatedStoreConstructor,
+	}
+	srcProviders := map[string]Provider{
+		"sparse":               SparseStoreConstructor,
+		"unbuffered_paginated": UnbufferedPaginatedStoreConstructor,
+	}
+	for dstName, newDst := range dstProviders {
+		for srcName, newSrc := range srcProviders {
+			t.Run(dstName+"_"+srcName, func(t *testing.T) {
+				for i := 0; i < numTests; i++ {
+					var bins []Bin
+					dst := newDst()
+					for _, offset := range []int{0, random.Intn(1000) - 500} {
+						src := newSrc()
+						for k := random.Intn(100); k > 0; k-- {
+							bin := Bin{index: offset + random.Intn(200), count: randomCount(random)}
+							bins = append(bins, bin)
+							src.AddBin(bin)
+						}
+						dst.MergeWith(src)
+					}
+					testStore(t, dst, normalize(bins))
+				}
+			})
+		}
+	}
+
+}
+
 func AssertDenseStoresEqual(t *testing.T, store DenseStore, other DenseStore) {
 	assert.Equal(t, store.count, other.count)
 	assert.Equal(t, store.minIndex, other.minIndex)
@@ -825,6 +1472,143 @@ func AssertDenseStoresEqual(t *testing.T, store DenseStore, other DenseStore) {
 	)
 }
 
+func TestDenseShrink(t *testing.T) {
+	shrinkTestCases := []struct {
+		name          string
+		newStore      func() Store
+		shrink        func(Store)
+		transformBins func([]Bin) []Bin
+	}{
+		{"dense", func() Store { return NewDenseStore() }, func(s Store) { s.(*DenseStore).Shrink() }, identity},
+		{"collapsing_lowest_1024", func() Store { return NewCollapsingLowestDenseStore(1024) }, func(s Store) { s.(*CollapsingLowestDenseStore).Shrink() }, collapsingLowest(1024)},
+		{"collapsing_highest_1024", func() Store { return NewCollapsingHighestDenseStore(1024) }, func(s Store) { s.(*CollapsingHighestDenseStore).Shrink() }, collapsingHighest(1024)},
+	}
+	for _, testCase := range shrinkTestCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			random := rand.New(rand.NewSource(seed))
+			store := testCase.newStore()
+			bins := make([]Bin, 0)
+			for index := -512; index < 512; index++ {
+				bin := Bin{index: index, count: randomCount(random)}
+				store.AddBin(bin)
+				if index < -20 || index > 20 {
+					store.SubtractWithCount(bin.index, bin.count)
+				} else {
+					bins = append(bins, bin)
+				}
+			}
+			// Bins with zero counts at the edges are trimmed.
+			store.AddWithCount(200, 1)
+			store.AddWithCount(200, -1)
+
+			sizeBefore := store.MemorySize()
+			testCase.shrink(store)
+			assert.Less(t, store.MemorySize(), sizeBefore/4)
+			assertEncodeBins(t, store, normalize(testCase.transformBins(bins)))
+
+			// Shrinking again is a no-op.
+			sizeBefore = store.MemorySize()
+			testCase.shrink(store)
+			assert.Equal(t, sizeBefore, store.MemorySize())
+
+			for i := 0; i < 1000; i++ {
+				bin := Bin{index: randomIndex(random), count: randomCount(random)}
+				bins = append(bins, bin)
+				store.AddBin(bin)
+			}
+			testStore(t, store, normalize(testCase.transformBins(bins)))
+
+			store.Clear()
+			testCase.shrink(store)
+			assert.Zero(t, store.MemorySize()-int(reflect.TypeOf(store).Elem().Size()))
+			assertEncodeBins(t, store, nil)
+		})
+	}
+}
+
+func TestDenseExtremeIndexes(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		newStore func() Store
+	}{
+		{name: "dense", newStore: func() Store { return NewDenseStore() }},
+		{name: "integer_dense", newStore: func() Store { return NewIntegerDenseStore() }},
+		{name: "dense_f32", newStore: func() Store { return NewDenseStoreF32() }},
+		{name: "dense_of_uint32", newStore: func() Store { return NewDenseStoreOf[uint32]() }},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore()
+			store.Add(maxInt)
+			store.Add(minInt)
+			store.AddWithCount(1<<40, 2)
+			assert.Equal(t, 4.0, store.TotalCount())
+			assert.LessOrEqual(t, numAllocatedBins(store), maxDenseStoreLength)
+			minIndex, _ := store.MinIndex()
+			maxIndex, _ := store.MaxIndex()
+			assert.Equal(t, maxInt-maxDenseStoreLength+1, minIndex)
+			assert.Equal(t, maxInt, maxIndex)
+			assert.Equal(t, 3.0, store.GetCountAtIndex(minIndex))
+
+			// Merging stores that are too far apart clamps the indexes of the bins.
+			other := testCase.newStore()
+			other.Add(0)
+			other.Add(1)
+			store.MergeWith(other)
+			assert.Equal(t, 6.0, store.TotalCount())
+			assert.Equal(t, 5.0, store.GetCountAtIndex(minIndex))
+
+			// Adding bins that are too far apart clamps their indexes.
+			store = testCase.newStore()
+			store.AddBins([]Bin{{index: -(1 << 62), count: 1}, {index: 1 << 62, count: 1}})
+			store.Add(-(1 << 62))
+			store.Add(1 << 62)
+			assert.Equal(t, 4.0, store.TotalCount())
+			assert.LessOrEqual(t, numAllocatedBins(store), maxDenseStoreLength)
+			minIndex, _ = store.MinIndex()
+			maxIndex, _ = store.MaxIndex()
+			assert.Equal(t, maxDenseStoreLength, maxIndex-minIndex+1)
+
+			// Empty stores hold any index.
+			store = testCase.newStore()
+			store.Add(1 << 40)
+			minIndex, _ = store.MinIndex()
+			assert.Equal(t, 1<<40, minIndex)
+			assert.Less(t, numAllocatedBins(store), 1000)
+		})
+	}
+
+	for _, store := range []interface {
+		Store
+		IsCollapsed() bool
+	}{NewCollapsingLowestDenseStore(1 << 30), NewCollapsingHighestDenseStore(1 << 30)} {
+		store.Add(1 << 40)
+		assert.False(t, store.IsCollapsed())
+		store.Add(maxInt)
+		store.Add(minInt)
+		assert.True(t, store.IsCollapsed())
+		assert.Equal(t, 3.0, store.TotalCount())
+		minIndex, _ := store.MinIndex()
+		maxIndex, _ := store.MaxIndex()
+		assert.Equal(t, maxDenseStoreLength, maxIndex-minIndex+1)
+	}
+}
+
+// numAllocatedBins returns the number of bins that a dense store allocates.
+func numAllocatedBins(store Store) int {
+	switch s := store.(type) {
+	case *DenseStore:
+		return len(s.bins)
+	case *IntegerDenseStore:
+		return len(s.bins)
+	case *DenseStoreF32:
+		return len(s.bins)
+	case *DenseStoreOf[uint32]:
+		return len(s.bins)
+	default:
+		panic("not a dense store")
+	}
+}
+
 func TestDenseStoreSerialization(t *testing.T) {
 	nTests := 100
 	// Store indices are limited to the int32 range
@@ -839,12 +1623,14 @@ func TestDenseStoreSerialization(t *testing.T) {
 				storeLow.Add(int(v))
 				storeHigh.Add(int(v))
 			}
-			deserializedStoreLow := FromProto(storeLow.ToProto())
+			deserializedStoreLow, err := FromProto(storeLow.ToProto())
+			assert.Nil(t, err)
 			AssertDenseStoresEqual(t, storeLow.DenseStore, *deserializedStoreLow)
 			//			EvaluateCollapsingLowestStore(t, deserializedStoreLow, values)
 			// Store does not change after serializing
 			assert.Equal(t, storeLow.maxNumBins, maxNumBins)
-			deserializedStoreHigh := FromProto(storeHigh.ToProto())
+			deserializedStoreHigh, err := FromProto(storeHigh.ToProto())
+			assert.Nil(t, err)
 			AssertDenseStoresEqual(t, storeHigh.DenseStore, *deserializedStoreHigh)
 			//EvaluateCollapsingHighestStore(t, deserializedStoreHigh, values)
 			// Store does not change after serializing
@@ -865,11 +1651,560 @@ func TestSparseStoreSerialization(t *testing.T) {
 			store.Add(int(v))
 		}
 		deserializedStore := NewSparseStore()
-		MergeWithProto(deserializedStore, store.ToProto())
+		assert.Nil(t, MergeWithProto(deserializedStore, store.ToProto()))
 		assert.Equal(t, store, deserializedStore)
 	}
 }
 
+func TestSparseStoreEncoding(t *testing.T) {
+	decode := func(b []byte) (*SparseStore, enc.SubFlag) {
+		decoded := NewSparseStore()
+		flag, err := enc.DecodeFlag(&b)
+		assert.Nil(t, err)
+		assert.Nil(t, decoded.DecodeAndMergeWith(&b, flag.SubFlag()))
+		assert.Empty(t, b)
+		return decoded, flag.SubFlag()
+	}
+
+	unit := NewSparseStore()
+	for _, index := range []int{-1000, -3, 0, 2, 1000} {
+		unit.Add(index)
+	}
+	var b []byte
+	unit.Encode(&b, enc.FlagTypePositiveStore)
+	decoded, subFlag := decode(b)
+	assert.Equal(t, enc.BinEncodingIndexDeltas, subFlag)
+	assert.Equal(t, unit, decoded)
+
+	weighted := unit.Copy().(*SparseStore)
+	weighted.AddWithCount(5, 0.5)
+	var weightedB []byte
+	weighted.Encode(&weightedB, enc.FlagTypePositiveStore)
+	decoded, subFlag = decode(weightedB)
+	assert.Equal(t, enc.BinEncodingIndexDeltasAndCounts, subFlag)
+	assert.Equal(t, weighted, decoded)
+
+	// Decoding merges with the existing bins.
+	b = b[1:]
+	assert.Nil(t, decoded.DecodeAndMergeWith(&b, enc.BinEncodingIndexDeltas))
+	assert.Equal(t, float64(2), decoded.GetCountAtIndex(-1000))
+	assert.Equal(t, 0.5, decoded.GetCountAtIndex(5))
+}
+
+func TestDenseStoreDecodeContiguousCounts(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	encode := func(minIndex int, indexDelta int, counts []float64) []byte {
+		var b []byte
+		enc.EncodeUvarint64(&b, uint64(len(counts)))
+		enc.EncodeVarint64(&b, int64(minIndex))
+		enc.EncodeVarint64(&b, int64(indexDelta))
+		for _, count := range counts {
+			enc.EncodeVarfloat64(&b, count)
+		}
+		return b
+	}
+	for i := 0; i < numTests; i++ {
+		store := NewDenseStore()
+		reference := NewSparseStore()
+		for j := random.Intn(5); j >= 0; j-- {
+			counts := make([]float64, random.Intn(100))
+			for k := range counts {
+				if random.Intn(3) > 0 {
+					counts[k] = randomCount(random)
+				}
+			}
+			b := encode(randomIndex(random)/10, 1+random.Intn(2), counts)
+			rb := append([]byte(nil), b...)
+			assert.Nil(t, store.DecodeAndMergeWith(&b, enc.BinEncodingContiguousCounts))
+			assert.Nil(t, reference.DecodeAndMergeWith(&rb, enc.BinEncodingContiguousCounts))
+			assert.Empty(t, b)
+		}
+		assertEncodeBins(t, store, normalize(reference.orderedBins()))
+	}
+
+	// Empty bins at both ends are not part of the range of the store.
+	store := NewDenseStore()
+	b := encode(-3, 1, []float64{0, 0, 2, 0, 3, 0})
+	assert.Nil(t, store.DecodeAndMergeWith(&b, enc.BinEncodingContiguousCounts))
+	assertEncodeBins(t, store, []Bin{{index: -1, count: 2}, {index: 1, count: 3}})
+	b = encode(10, 1, []float64{0, 0})
+	assert.Nil(t, store.DecodeAndMergeWith(&b, enc.BinEncodingContiguousCounts))
+	maxIndex, _ := store.MaxIndex()
+	assert.Equal(t, 1, maxIndex)
+
+	// Truncated payloads are partially merged.
+	b = encode(0, 1, []float64{1, 1, 1})
+	b = b[:len(b)-1]
+	assert.NotNil(t, store.DecodeAndMergeWith(&b, enc.BinEncodingContiguousCounts))
+	assertEncodeBins(t, store, []Bin{{index: -1, count: 2}, {index: 0, count: 1}, {index: 1, count: 4}})
+
+	// A corrupt number of bins does not make the store allocate them.
+	b = encode(0, 1, []float64{1})
+	b[0] = 0xff
+	b = append(b[:1], append([]byte{0xff, 0xff, 0x7f}, b[1:]...)...)
+	assert.NotNil(t, NewDenseStore().DecodeAndMergeWith(&b, enc.BinEncodingContiguousCounts))
+}
+
+func TestNewDenseStoreWithRange(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, store := range []*DenseStore{NewDenseStoreWithRange(-500, 1000), NewDenseStoreWithCapacity(1501)} {
+		bins := make([]Bin, 0)
+		numAllocatedBins := len(store.bins)
+		assert.GreaterOrEqual(t, numAllocatedBins, 1501)
+		firstBin := &store.bins[0]
+		for i := 0; i < 1000; i++ {
+			bin := Bin{index: random.Intn(1501) - 500, count: randomCount(random)}
+			bins = append(bins, bin)
+			store.AddBin(bin)
+		}
+		assertEncodeBins(t, store, normalize(bins))
+		// The bins have not been reallocated.
+		assert.Same(t, firstBin, &store.bins[0])
+		assert.Equal(t, numAllocatedBins, len(store.bins))
+
+		// Out-of-range indexes are still accepted.
+		store.Add(5000)
+		assert.Equal(t, 5000, store.maxIndex)
+	}
+
+	for _, store := range []*DenseStore{NewDenseStoreWithRange(1, 0), NewDenseStoreWithRange(minInt, maxInt), NewDenseStoreWithCapacity(0)} {
+		assert.Empty(t, store.bins)
+		store.Add(3)
+		assertEncodeBins(t, store, []Bin{{index: 3, count: 1}})
+	}
+}
+
+func TestDenseStoreEncodingZeroRuns(t *testing.T) {
+	encodingModes := func(b []byte) []enc.SubFlag {
+		decoded := NewDenseStore()
+		var subFlags []enc.SubFlag
+		for len(b) > 0 {
+			flag, err := enc.DecodeFlag(&b)
+			assert.Nil(t, err)
+			assert.Nil(t, decoded.DecodeAndMergeWith(&b, flag.SubFlag()))
+			subFlags = append(subFlags, flag.SubFlag())
+		}
+		return subFlags
+	}
+
+	// Two distant groups of contiguous bins are encoded as two blocks.
+	store := NewDenseStore()
+	for i := 0; i < 100; i++ {
+		store.AddWithCount(i, 1.5)
+		store.AddWithCount(1000000+i, 2.5)
+	}
+	var b []byte
+	store.Encode(&b, enc.FlagTypePositiveStore)
+	assert.Less(t, len(b), 500)
+	assert.Equal(t, []enc.SubFlag{enc.BinEncodingContiguousCounts, enc.BinEncodingContiguousCounts}, encodingModes(b))
+	decoded := NewDenseStore()
+	decodeBins(t, decoded, b)
+	assert.True(t, Equivalent(store, decoded))
+
+	// Short runs of empty bins are encoded within blocks.
+	store = NewDenseStore()
+	for i := 0; i < 100; i++ {
+		if i < 50 || i > 52 {
+			store.AddWithCount(i, 1.5)
+		}
+	}
+	b = b[:0]
+	store.Encode(&b, enc.FlagTypePositiveStore)
+	assert.Equal(t, []enc.SubFlag{enc.BinEncodingContiguousCounts}, encodingModes(b))
+
+	// The empty bins at both ends are skipped.
+	store.AddWithCount(-10, 1)
+	store.AddWithCount(200, 1)
+	store.SubtractWithCount(-10, 1)
+	store.SubtractWithCount(200, 1)
+	store.minIndex, store.maxIndex = -10, 200
+	b = b[:0]
+	store.Encode(&b, enc.FlagTypePositiveStore)
+	flag, err := enc.DecodeFlag(&b)
+	assert.Nil(t, err)
+	assert.Equal(t, enc.BinEncodingContiguousCounts, flag.SubFlag())
+	numBins, err := enc.DecodeUvarint64(&b)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), numBins)
+	minIndex, err := enc.DecodeVarint64(&b)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), minIndex)
+}
+
+func TestAddBins(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := testCase.newStore()
+				store.AddBins(nil)
+				for k := random.Intn(4); k >= 0; k-- {
+					batch := make([]Bin, 0)
+					for j := random.Intn(1000); j > 0; j-- {
+						bin := Bin{index: randomIndex(random) * (i + 1), count: randomCount(random)}
+						switch j % 3 {
+						case 0:
+							bin.count = 1
+						case 1:
+							// Bins with zero counts are ignored.
+							bin.count = 0
+						}
+						batch = append(batch, bin)
+						if bin.count != 0 {
+							bins = append(bins, bin)
+						}
+					}
+					store.AddBins(batch)
+				}
+				testStore(t, store, normalize(testCase.transformBins(bins)))
+			}
+		})
+	}
+}
+
+func TestReweight(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := testCase.newStore()
+				for j := random.Intn(1000); j > 0; j-- {
+					bin := Bin{index: randomIndex(random), count: randomCount(random)}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				normalizedBins := normalize(testCase.transformBins(bins))
+				assert.NotNil(t, store.Reweight(0))
+				assert.NotNil(t, store.Reweight(-1))
+				assert.Nil(t, store.Reweight(1))
+				assertEncodeBins(t, store, normalizedBins)
+				for _, w := range []float64{0.5, 3} {
+					reweighted := store.Copy()
+					assert.Nil(t, reweighted.Reweight(w))
+					reweightedBins := make([]Bin, 0, len(normalizedBins))
+					for _, bin := range normalizedBins {
+						reweightedBins = append(reweightedBins, Bin{index: bin.index, count: w * bin.count})
+					}
+					assertEncodeBins(t, reweighted, reweightedBins)
+				}
+			}
+		})
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := testCase.newStore()
+				for j := random.Intn(1000); j > 0; j-- {
+					bin := Bin{index: randomIndex(random), count: randomCount(random)}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				storedBins := normalize(testCase.transformBins(bins))
+				for _, factorLog2 := range []int{0, 1, 3, 10} {
+					downsampledBins := make([]Bin, 0, len(storedBins))
+					for _, bin := range storedBins {
+						downsampledBins = append(downsampledBins, Bin{index: bin.index >> factorLog2, count: bin.count})
+					}
+					downsampled := store.Downsample(factorLog2)
+					assert.IsType(t, store, downsampled)
+					assertEncodeBins(t, downsampled, normalize(downsampledBins))
+				}
+				// The store is not modified.
+				assertEncodeBins(t, store, storedBins)
+			}
+		})
+	}
+}
+
+func TestTrim(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := testCase.newStore()
+				for j := random.Intn(1000); j > 0; j-- {
+					bin := Bin{index: randomIndex(random), count: randomCount(random)}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				storedBins := normalize(testCase.transformBins(bins))
+				for _, window := range [][2]int{{minInt, maxInt}, {randomIndex(random), randomIndex(random)}, {0, 0}, {1, -1}} {
+					trimmed := store.Copy()
+					trimmed.Trim(window[0], window[1])
+					trimmedBins := make([]Bin, 0, len(storedBins))
+					for _, bin := range storedBins {
+						if bin.index >= window[0] && bin.index <= window[1] {
+							trimmedBins = append(trimmedBins, bin)
+						}
+					}
+					assertEncodeBins(t, trimmed, trimmedBins)
+					// The trimmed store can keep being updated.
+					trimmed.AddWithCount(randomIndex(random), 1)
+				}
+			}
+		})
+	}
+
+	// The memory that the removed bins used is released.
+	for _, testCase := range testCases {
+		store := testCase.newStore()
+		for index := -10000; index <= 10000; index++ {
+			store.Add(index)
+		}
+		memorySize := store.MemorySize()
+		store.Trim(0, 10)
+		if memorySize > 10000 {
+			// Stores that hold few bins are already small.
+			assert.Less(t, store.MemorySize(), memorySize/10, testCase.name)
+		}
+	}
+}
+
+func TestColumns(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := testCase.newStore()
+				for j := random.Intn(1000); j > 0; j-- {
+					bin := Bin{index: randomIndex(random), count: randomCount(random)}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				normalizedBins := normalize(testCase.transformBins(bins))
+				indexes, counts := store.ToColumns()
+				assert.Len(t, indexes, len(normalizedBins))
+				assert.Len(t, counts, len(normalizedBins))
+				for k, bin := range normalizedBins {
+					assert.Equal(t, int32(bin.index), indexes[k])
+					assert.InEpsilon(t, bin.count, counts[k], epsilon)
+				}
+				fromColumns, err := FromColumns(indexes, counts)
+				assert.Nil(t, err)
+				assertEncodeBins(t, fromColumns, normalizedBins)
+			}
+		})
+	}
+
+	store := NewSparseStore()
+	assert.Nil(t, MergeWithColumns(store, []int32{3, -2, 3}, []float64{1, 2, 0.5}))
+	indexes, counts := store.ToColumns()
+	assert.Equal(t, []int32{-2, 3}, indexes)
+	assert.Equal(t, []float64{2, 1.5}, counts)
+	assert.NotNil(t, MergeWithColumns(store, []int32{1, 2}, []float64{1}))
+	assert.Equal(t, ErrInvalidProtoCount, MergeWithColumns(store, []int32{1, 2}, []float64{1, math.NaN()}))
+	assert.Equal(t, float64(3.5), store.TotalCount())
+	_, err := FromColumns([]int32{1}, []float64{-1})
+	assert.NotNil(t, err)
+}
+
+func TestStats(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		store := testCase.newStore()
+		assert.Equal(t, Stats{MemorySize: store.MemorySize()}, store.Stats(), testCase.name)
+		bins := make([]Bin, 0)
+		for i := 0; i < 1000; i++ {
+			bin := Bin{index: randomIndex(random), count: 1}
+			bins = append(bins, bin)
+			store.AddBin(bin)
+		}
+		stats := store.Stats()
+		assert.Equal(t, len(normalize(testCase.transformBins(bins))), stats.NumBins, testCase.name)
+		assert.Equal(t, store.MemorySize(), stats.MemorySize, testCase.name)
+	}
+
+	store := NewBufferedPaginatedStoreWithPageSize(2)
+	store.Add(0)
+	store.Add(1)
+	assert.Equal(t, Stats{NumBins: 2, MemorySize: store.MemorySize(), NumBufferedIndexes: 2}, store.Stats())
+	for index := 0; index < 100; index++ {
+		store.Add(index)
+	}
+	stats := store.Stats()
+	assert.Equal(t, 100, stats.NumBins)
+	assert.Greater(t, stats.NumCompactions, 0)
+	assert.Greater(t, stats.NumPages, 0)
+	assert.LessOrEqual(t, stats.NumPages, 25)
+	assert.Equal(t, len(store.buffer), stats.NumBufferedIndexes)
+}
+
+func TestProviderByName(t *testing.T) {
+	for name, expected := range map[string]Store{
+		"dense":                  NewDenseStore(),
+		"sparse":                 NewSparseStore(),
+		"buffered_paginated":     NewBufferedPaginatedStore(),
+		"buffered_paginated:3":   NewBufferedPaginatedStoreWithPageSize(3),
+		"unbuffered_paginated":   NewUnbufferedPaginatedStore(),
+		"integer_dense":          NewIntegerDenseStore(),
+		"dense_f32":              NewDenseStoreF32(),
+		"adaptive":               NewAdaptiveStore(),
+		"collapsing_lowest:2048": NewCollapsingLowestDenseStore(2048),
+		"collapsing_highest:16":  NewCollapsingHighestDenseStore(16),
+	} {
+		provider, err := ProviderByName(name)
+		assert.Nil(t, err, name)
+		assert.IsType(t, expected, provider(), name)
+	}
+	provider, err := ProviderByName("buffered_paginated:3")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, provider().(*BufferedPaginatedStore).pageLenLog2)
+	provider, err = ProviderByName("collapsing_lowest:2048")
+	assert.Nil(t, err)
+	assert.Equal(t, 2048, provider().(*CollapsingLowestDenseStore).maxNumBins)
+	for _, name := range []string{"", "unknown", "dense:1", "buffered_paginated:x", "collapsing_lowest", "collapsing_highest:0", "collapsing_lowest:-1"} {
+		_, err := ProviderByName(name)
+		assert.NotNil(t, err, name)
+	}
+
+	assert.Nil(t, RegisterProvider("test_bounded", func(param string) (Provider, error) {
+		maxBytes, err := strconv.Atoi(param)
+		if err != nil {
+			return nil, err
+		}
+		return func() Store { return NewBoundedStore(NewDenseStore(), maxBytes) }, nil
+	}))
+	provider, err = ProviderByName("test_bounded:1000")
+	assert.Nil(t, err)
+	assert.Equal(t, NewBoundedStore(NewDenseStore(), 1000), provider())
+	t.Cleanup(func() { unregisterProvider("test_bounded") })
+	assert.NotNil(t, RegisterProvider("test_bounded", nil))
+	assert.NotNil(t, RegisterProvider("dense", nil))
+	assert.NotNil(t, RegisterProvider("test:bounded", nil))
+}
+
+func TestEquivalent(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	newStores := []func() Store{
+		func() Store { return NewDenseStore() },
+		func() Store { return NewSparseStore() },
+		func() Store { return NewBufferedPaginatedStore() },
+		func() Store { return NewUnbufferedPaginatedStore() },
+		func() Store { return NewAdaptiveStore() },
+	}
+	for i := 0; i < numTests; i++ {
+		bins := make([]Bin, 0)
+		for j := random.Intn(1000); j > 0; j-- {
+			bins = append(bins, Bin{index: randomIndex(random), count: float64(1 + random.Intn(10))})
+		}
+		stores := make([]Store, 0, len(newStores))
+		for _, newStore := range newStores {
+			store := newStore()
+			for _, bin := range bins {
+				store.AddBin(bin)
+			}
+			stores = append(stores, store)
+		}
+		for _, s1 := range stores {
+			for _, s2 := range stores {
+				assert.True(t, Equivalent(s1, s2), "%T, %T", s1, s2)
+				different := s2.Copy()
+				different.Add(randomIndex(random))
+				assert.False(t, Equivalent(s1, different), "%T, %T", s1, different)
+				assert.False(t, Equivalent(different, s1), "%T, %T", different, s1)
+			}
+		}
+	}
+
+	s1, s2 := NewDenseStore(), NewSparseStore()
+	assert.True(t, Equivalent(s1, s2))
+	s1.AddWithCount(3, 1)
+	s2.AddWithCount(3, 1.25)
+	assert.False(t, Equivalent(s1, s2))
+	assert.True(t, ApproxEquivalent(s1, s2, 0.25))
+	assert.False(t, ApproxEquivalent(s1, s2, 0.2))
+	// Empty bins are ignored.
+	s1.AddWithCount(4, 1)
+	s1.SubtractWithCount(4, 1)
+	assert.True(t, ApproxEquivalent(s1, s2, 0.25))
+}
+
+func TestValidateEncodedBins(t *testing.T) {
+	var indexDeltas, indexDeltasAndCounts, contiguousCounts []byte
+	enc.EncodeUvarint64(&indexDeltas, 3)
+	for _, indexDelta := range []int64{-5, 3, 10} {
+		enc.EncodeVarint64(&indexDeltas, indexDelta)
+	}
+	enc.EncodeUvarint64(&indexDeltasAndCounts, 2)
+	enc.EncodeVarint64(&indexDeltasAndCounts, 4)
+	enc.EncodeVarfloat64(&indexDeltasAndCounts, 1.5)
+	enc.EncodeVarint64(&indexDeltasAndCounts, -12)
+	enc.EncodeVarfloat64(&indexDeltasAndCounts, 2)
+	enc.EncodeUvarint64(&contiguousCounts, 3)
+	enc.EncodeVarint64(&contiguousCounts, 6)
+	enc.EncodeVarint64(&contiguousCounts, -1)
+	for _, count := range []float64{1, 0, 3} {
+		enc.EncodeVarfloat64(&contiguousCounts, count)
+	}
+	for _, testCase := range []struct {
+		b            []byte
+		encodingMode enc.SubFlag
+		numBins      int
+		maxIndex     int
+	}{
+		{b: indexDeltas, encodingMode: enc.BinEncodingIndexDeltas, numBins: 3, maxIndex: 8},
+		{b: indexDeltasAndCounts, encodingMode: enc.BinEncodingIndexDeltasAndCounts, numBins: 2, maxIndex: 8},
+		{b: contiguousCounts, encodingMode: enc.BinEncodingContiguousCounts, numBins: 3, maxIndex: 6},
+	} {
+		numBins, err := ValidateEncodedBins(testCase.b, testCase.encodingMode, DecodingOptions{})
+		assert.Nil(t, err)
+		assert.Equal(t, testCase.numBins, numBins)
+		_, err = ValidateEncodedBins(testCase.b, testCase.encodingMode, DecodingOptions{MaxNumBins: testCase.numBins, MaxIndexMagnitude: testCase.maxIndex})
+		assert.Nil(t, err)
+		_, err = ValidateEncodedBins(testCase.b, testCase.encodingMode, DecodingOptions{MaxNumBins: testCase.numBins - 1})
+		assert.Equal(t, ErrDecodingLimitExceeded, err)
+		_, err = ValidateEncodedBins(testCase.b, testCase.encodingMode, DecodingOptions{MaxIndexMagnitude: testCase.maxIndex - 1})
+		assert.Equal(t, ErrDecodingLimitExceeded, err)
+		_, err = ValidateEncodedBins(testCase.b[:len(testCase.b)-1], testCase.encodingMode, DecodingOptions{})
+		assert.NotNil(t, err)
+
+		store := NewDenseStore()
+		b := testCase.b
+		assert.Nil(t, DecodeAndMergeWithOptions(store, &b, testCase.encodingMode, DecodingOptions{}))
+		assert.Empty(t, b)
+		assert.False(t, store.IsEmpty())
+	}
+
+	for _, count := range []float64{-1, math.NaN(), math.Inf(1)} {
+		var b []byte
+		enc.EncodeUvarint64(&b, 1)
+		enc.EncodeVarint64(&b, 0)
+		enc.EncodeVarfloat64(&b, count)
+		store := NewDenseStore()
+		assert.Equal(t, ErrInvalidEncodedCount, DecodeAndMergeWithOptions(store, &b, enc.BinEncodingIndexDeltasAndCounts, DecodingOptions{}))
+		assert.True(t, store.IsEmpty())
+	}
+}
+
+func TestMergeWithInvalidProto(t *testing.T) {
+	for _, pb := range []*sketchpb.Store{
+		{BinCounts: map[int32]float64{1: 1, 2: -1}},
+		{BinCounts: map[int32]float64{1: math.NaN()}},
+		{BinCounts: map[int32]float64{1: math.Inf(1)}},
+		{ContiguousBinCounts: []float64{1, -1}},
+		{ContiguousBinCounts: []float64{math.NaN()}},
+		{ContiguousBinCounts: []float64{1, 2, 3}, ContiguousBinIndexOffset: math.MaxInt32 - 1},
+	} {
+		for _, testCase := range testCases {
+			store := testCase.newStore()
+			store.Add(5)
+			assert.NotNil(t, MergeWithProto(store, pb))
+			assertEncodeBins(t, store, []Bin{{index: 5, count: 1}})
+		}
+		_, err := FromProto(pb)
+		assert.NotNil(t, err)
+	}
+}
+
 func assertStoreBinsLogicallyEquivalent(t *testing.T, store1 Store, store2 Store) {
 	store1Bins := make([]Bin, 0)
 	store1.ForEach(func(index int, count float64) bool {
@@ -880,81 +2215,1147 @@ func assertStoreBinsLogicallyEquivalent(t *testing.T, store1 Store, store2 Store
 	assertEncodeBins(t, store2, store1Bins)
 }
 
-func TestBufferPaginatedStoreSerialization(t *testing.T) {
-	nTests := 100
-	// Store indices are limited to the int32 range
-	var values []int32
-	f := fuzz.New().NilChance(0).NumElements(10, 1000)
-	for i := 0; i < nTests; i++ {
-		f.Fuzz(&values)
+func TestBufferPaginatedStoreSerialization(t *testing.T) {
+	nTests := 100
+	// Store indices are limited to the int32 range
+	var values []int32
+	f := fuzz.New().NilChance(0).NumElements(10, 1000)
+	for i := 0; i < nTests; i++ {
+		f.Fuzz(&values)
+		store := NewBufferedPaginatedStore()
+		for _, v := range values {
+			store.Add(int(v))
+		}
+		deserializedStore := NewBufferedPaginatedStore()
+		assert.Nil(t, MergeWithProto(deserializedStore, store.ToProto()))
+
+		// when serializing / deserializing, the "before" and "after" stores may not be exactly equal because some
+		// points may be stored in the buffer in one version, but stored in a page in the other. So to compare them to
+		// see if they are logically equivalent, check that their logical bins are equivalent, then compare other fields
+		assertStoreBinsLogicallyEquivalent(t, store, deserializedStore)
+
+		// clear fields that are allowed to differ and assert all other fields are equal
+		store.buffer = []int{}
+		deserializedStore.buffer = []int{}
+		store.pages = [][]float64{}
+		deserializedStore.pages = [][]float64{}
+		store.minPageIndex = 0
+		deserializedStore.minPageIndex = 0
+		// Deserializing adds all the bins at once, which compacts the buffer less often.
+		store.bufferCompactionTriggerLen = 0
+		deserializedStore.bufferCompactionTriggerLen = 0
+		store.numCompactions = 0
+		deserializedStore.numCompactions = 0
+
+		assert.Equal(t, store, deserializedStore)
+	}
+}
+
+func TestBufferedPaginatedCompactionDensity(t *testing.T) {
+	{
+		store := NewBufferedPaginatedStore()
+		for index := 0; index < 4*(1<<store.pageLenLog2); index += 2 {
+			store.Add(index)
+		}
+		store.compact()
+		assert.Zero(t, len(store.pages))
+	}
+	{
+		store := NewBufferedPaginatedStore()
+		for index := 0; index < 4*(1<<store.pageLenLog2); index += 2 {
+			for i := 0; i < 8; i++ {
+				store.Add(index)
+			}
+		}
+		store.compact()
+		assert.Zero(t, len(store.buffer))
+	}
+}
+
+func TestBufferedPaginatedCompactionFew(t *testing.T) {
+	store := NewBufferedPaginatedStore()
+	store.Add(2)
+	store.Add(-7432)
+	store.Add(977)
+	store.compact()
+	assert.Zero(t, len(store.pages))
+}
+
+func TestBufferedPaginatedCompactionOutliers(t *testing.T) {
+	store := NewBufferedPaginatedStore()
+	for index := 0; index < 1<<store.pageLenLog2; index += 1 {
+		for i := 0; i < 2; i++ {
+			store.Add(index)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		store.Add(6377)
+	}
+	assert.Equal(t, 4, len(store.buffer))
+}
+
+func TestBufferedPaginatedMergeWithProtoFuzzy(t *testing.T) {
+	numMerges := 3
+	maxNumAdds := 1000
+
+	random := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < numTests; i++ {
+		bins := make([]Bin, 0)
+		store := NewBufferedPaginatedStore()
+		for j := 0; j < numMerges; j++ {
+			numValues := random.Intn(maxNumAdds)
+			tmpStore := NewBufferedPaginatedStore()
+			for k := 0; k < numValues; k++ {
+				bin := Bin{index: randomIndex(random), count: randomCount(random)}
+				bins = append(bins, bin)
+				tmpStore.AddBin(bin)
+			}
+			assert.Nil(t, store.MergeWithProto(tmpStore.ToProto()))
+		}
+		normalizedBins := normalize(bins)
+		testStore(t, store, normalizedBins)
+	}
+}
+
+func TestMergeWithProtoValidation(t *testing.T) {
+	invalidProtos := map[string]*sketchpb.Store{
+		"nan_count":                 {BinCounts: map[int32]float64{1: 1, 2: math.NaN()}},
+		"infinite_count":            {BinCounts: map[int32]float64{1: math.Inf(1)}},
+		"negative_count":            {BinCounts: map[int32]float64{1: 1}, ContiguousBinCounts: []float64{1, -1}},
+		"contiguous_nan_count":      {ContiguousBinCounts: []float64{1, math.NaN()}, ContiguousBinIndexOffset: 3},
+		"contiguous_index_overflow": {ContiguousBinCounts: []float64{1, 1}, ContiguousBinIndexOffset: math.MaxInt32},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for name, pb := range invalidProtos {
+				store := testCase.newStore()
+				store.AddWithCount(5, 2)
+				assert.NotNil(t, MergeWithProto(store, pb), name)
+				assertEncodeBins(t, store, []Bin{{index: 5, count: 2}})
+			}
+		})
+	}
+	for name, pb := range invalidProtos {
+		store := NewBufferedPaginatedStore()
+		store.AddWithCount(5, 2)
+		assert.NotNil(t, store.MergeWithProto(pb), name)
+		assertEncodeBins(t, store, []Bin{{index: 5, count: 2}})
+	}
+}
+
+func TestBufferedPaginatedBufferEncoding(t *testing.T) {
+	encode := func(store *BufferedPaginatedStore) ([]byte, enc.SubFlag) {
+		var b []byte
+		store.Encode(&b, enc.FlagTypePositiveStore)
+		flag, err := enc.DecodeFlag(&[]byte{b[0]})
+		assert.Nil(t, err)
+		decoded := NewBufferedPaginatedStore()
+		decodeBins(t, decoded, b)
+		assert.True(t, Equivalent(store, decoded))
+		return b, flag.SubFlag()
+	}
+
+	// The pool denies pages, so that indexes stay in the buffer.
+	pool := NewMemoryPool(defaultPageLenLog2, 0, PoolPolicyDeny)
+	hotSpot := NewBufferedPaginatedStoreWithPool(pool)
+	for i := 0; i < 500; i++ {
+		hotSpot.Add(1000)
+		hotSpot.Add(-1000)
+	}
+	hotSpot.Add(3)
+	b, subFlag := encode(hotSpot)
+	assert.Equal(t, 1001, len(hotSpot.buffer))
+	assert.Equal(t, enc.BinEncodingIndexDeltasAndCounts, subFlag)
+	assert.Less(t, len(b), 20)
+
+	distinct := NewBufferedPaginatedStoreWithPool(pool)
+	for i := 0; i < 10; i++ {
+		distinct.Add(100 * i)
+	}
+	distinct.Add(0)
+	_, subFlag = encode(distinct)
+	assert.Equal(t, enc.BinEncodingIndexDeltas, subFlag)
+}
+
+func TestBufferedPaginatedToProtoEncoding(t *testing.T) {
+	dense := NewBufferedPaginatedStore()
+	for index := -10; index <= 10; index += 2 {
+		dense.AddWithCount(index, float64(index+20))
+	}
+	pb := dense.ToProto()
+	assert.Empty(t, pb.BinCounts)
+	assert.Equal(t, int32(-10), pb.ContiguousBinIndexOffset)
+	assert.Len(t, pb.ContiguousBinCounts, 21)
+	assert.Equal(t, float64(10), pb.ContiguousBinCounts[0])
+	assert.Equal(t, float64(0), pb.ContiguousBinCounts[1])
+	assert.Equal(t, float64(30), pb.ContiguousBinCounts[20])
+
+	sparse := NewBufferedPaginatedStore()
+	sparse.Add(-1000)
+	sparse.Add(3)
+	sparse.AddWithCount(1000, 2)
+	pb = sparse.ToProto()
+	assert.Empty(t, pb.ContiguousBinCounts)
+	assert.Equal(t, map[int32]float64{-1000: 1, 3: 1, 1000: 2}, pb.BinCounts)
+
+	for _, store := range []*BufferedPaginatedStore{dense, sparse} {
+		bins := make([]Bin, 0)
+		store.ForEach(func(index int, count float64) (stop bool) {
+			bins = append(bins, Bin{index: index, count: count})
+			return false
+		})
+		deserialized, err := FromProto(store.ToProto())
+		assert.Nil(t, err)
+		assertEncodeBins(t, deserialized, bins)
+	}
+}
+
+func TestBufferedPaginatedTotalCount(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	sumOfCounts := func(store Store) float64 {
+		sum := float64(0)
+		store.ForEach(func(index int, count float64) (stop bool) {
+			sum += count
+			return false
+		})
+		return sum
+	}
+	store := NewBufferedPaginatedStore()
+	for i := 0; i < numTests; i++ {
+		other := NewBufferedPaginatedStore()
+		for j := 0; j < 1000; j++ {
+			other.Add(randomIndex(random))
+			other.AddWithCount(randomIndex(random), float64(random.Intn(5)))
+		}
+		store.MergeWith(other)
+		assert.InEpsilon(t, sumOfCounts(store), store.TotalCount(), epsilon)
+		for j := 0; j < 100; j++ {
+			store.SubtractWithCount(randomIndex(random), randomCount(random))
+		}
+		assert.InEpsilon(t, sumOfCounts(store), store.TotalCount(), epsilon)
+		snapshot := store.Snapshot()
+		assert.Nil(t, store.Reweight(0.5))
+		assert.InEpsilon(t, sumOfCounts(store), store.TotalCount(), epsilon)
+		assert.InEpsilon(t, 2*store.TotalCount(), snapshot.TotalCount(), epsilon)
+		snapshot.CopyTo(store)
+		assert.Equal(t, snapshot.TotalCount(), store.TotalCount())
+	}
+	store.ClearRetainingCapacity()
+	assert.Equal(t, float64(0), store.TotalCount())
+	store.Add(1)
+	store.Clear()
+	assert.Equal(t, float64(0), store.TotalCount())
+}
+
+func TestBufferedPaginatedKeyAtRankAfterUpdates(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	store, reference := NewBufferedPaginatedStore(), NewDenseStore()
+	assertKeysAtRanks := func() {
+		totalCount := reference.TotalCount()
+		for _, rank := range []float64{0, 0.01, 0.5, 0.99, 1} {
+			assert.Equal(t, reference.KeyAtRank(rank*totalCount), store.KeyAtRank(rank*totalCount))
+		}
+	}
+	for i := 0; i < numTests; i++ {
+		// Queries are interleaved with updates, which invalidate the
+		// cumulative counts of the pages.
+		for j := 0; j < 100; j++ {
+			index, count := randomIndex(random), float64(random.Intn(3))
+			store.AddWithCount(index, count)
+			reference.AddWithCount(index, count)
+			index = randomIndex(random)
+			store.Add(index)
+			reference.Add(index)
+		}
+		assertKeysAtRanks()
+		index := randomIndex(random)
+		store.SubtractWithCount(index, 1)
+		reference.SubtractWithCount(index, 1)
+		assertKeysAtRanks()
+		other := NewBufferedPaginatedStore()
+		other.AddWithCount(randomIndex(random), 100)
+		store.MergeWith(other)
+		reference.MergeWith(other)
+		assertKeysAtRanks()
+	}
+	store.Clear()
+	store.Add(3)
+	assert.Equal(t, 3, store.KeyAtRank(0))
+
+	// Buffered indexes may be lower than the ones of the pages.
+	store.AddWithCount(100, 5)
+	store.Add(-1000)
+	assert.Equal(t, -1000, store.KeyAtRank(0))
+	assert.Equal(t, 3, store.KeyAtRank(1))
+	assert.Equal(t, 100, store.KeyAtRank(2))
+}
+
+func TestBufferedPaginatedIndexRangeAfterUpdates(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	store, reference := NewBufferedPaginatedStore(), NewDenseStore()
+	assertIndexRange := func() {
+		expectedMinIndex, expectedMinErr := reference.MinIndex()
+		minIndex, minErr := store.MinIndex()
+		assert.Equal(t, expectedMinErr == nil, minErr == nil)
+		assert.Equal(t, expectedMinIndex, minIndex)
+		expectedMaxIndex, expectedMaxErr := reference.MaxIndex()
+		maxIndex, maxErr := store.MaxIndex()
+		assert.Equal(t, expectedMaxErr == nil, maxErr == nil)
+		assert.Equal(t, expectedMaxIndex, maxIndex)
+	}
+	assertIndexRange()
+	for i := 0; i < numTests; i++ {
+		for j := 0; j < 20; j++ {
+			index, count := randomIndex(random), float64(random.Intn(3))
+			store.AddWithCount(index, count)
+			reference.AddWithCount(index, count)
+			index = randomIndex(random)
+			store.Add(index)
+			reference.Add(index)
+		}
+		assertIndexRange()
+		// Emptying the extreme bins requires the range to be recomputed.
+		minIndex, _ := reference.MinIndex()
+		maxIndex, _ := reference.MaxIndex()
+		store.SubtractWithCount(minIndex, reference.GetCountAtIndex(minIndex))
+		reference.SubtractWithCount(minIndex, reference.GetCountAtIndex(minIndex))
+		store.SubtractWithCount(maxIndex, reference.GetCountAtIndex(maxIndex))
+		reference.SubtractWithCount(maxIndex, reference.GetCountAtIndex(maxIndex))
+		assertIndexRange()
+		other := NewBufferedPaginatedStore()
+		other.AddWithCount(randomIndex(random), 100)
+		store.MergeWith(other)
+		reference.MergeWith(other)
+		assertIndexRange()
+		copiedMinIndex, _ := store.Copy().MinIndex()
+		expectedMinIndex, _ := reference.MinIndex()
+		assert.Equal(t, expectedMinIndex, copiedMinIndex)
+		if i%10 == 9 {
+			store.ClearRetainingCapacity()
+			reference.Clear()
+			assertIndexRange()
+		}
+	}
+	store.Clear()
+	reference.Clear()
+	assertIndexRange()
+}
+
+func TestBufferedPaginatedPageSizes(t *testing.T) {
+	pageLenLog2s := []uint8{0, 2, 5, 10, 255}
+	random := rand.New(rand.NewSource(seed))
+
+	for _, pageLenLog2 := range pageLenLog2s {
+		t.Run(fmt.Sprintf("page_len_log2_%d", pageLenLog2), func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := NewBufferedPaginatedStoreWithPageSize(pageLenLog2)
+				for _, otherPageLenLog2 := range pageLenLog2s {
+					other := NewBufferedPaginatedStoreWithPageSize(otherPageLenLog2)
+					numValues := random.Intn(200)
+					for k := 0; k < numValues; k++ {
+						bin := Bin{index: randomIndex(random) * (i + 1), count: 1}
+						if k%2 == 0 {
+							bin.count = randomCount(random)
+						}
+						bins = append(bins, bin)
+						other.AddBin(bin)
+					}
+					store.MergeWith(other)
+				}
+				assert.Equal(t, min(int(pageLenLog2), maxPageLenLog2), store.pageLenLog2)
+				testStore(t, store, normalize(bins))
+			}
+		})
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	snapshotTestCases := []struct {
+		name          string
+		newStore      func() Store
+		snapshot      func(Store) Store
+		transformBins func([]Bin) []Bin
+	}{
+		{
+			name:          "dense",
+			newStore:      func() Store { return NewDenseStore() },
+			snapshot:      func(s Store) Store { return s.(*DenseStore).Snapshot() },
+			transformBins: identity,
+		},
+		{
+			name:          "collapsing_lowest_1024",
+			newStore:      func() Store { return NewCollapsingLowestDenseStore(1024) },
+			snapshot:      func(s Store) Store { return s.(*CollapsingLowestDenseStore).Snapshot() },
+			transformBins: collapsingLowest(1024),
+		},
+		{
+			name:          "collapsing_highest_1024",
+			newStore:      func() Store { return NewCollapsingHighestDenseStore(1024) },
+			snapshot:      func(s Store) Store { return s.(*CollapsingHighestDenseStore).Snapshot() },
+			transformBins: collapsingHighest(1024),
+		},
+		{
+			name:          "buffered_paginated",
+			newStore:      func() Store { return NewBufferedPaginatedStore() },
+			snapshot:      func(s Store) Store { return s.(*BufferedPaginatedStore).Snapshot() },
+			transformBins: identity,
+		},
+	}
+	random := rand.New(rand.NewSource(seed))
+	randomBins := func(n int) []Bin {
+		bins := make([]Bin, n)
+		for i := range bins {
+			bins[i] = Bin{index: randomIndex(random), count: 1}
+			if i%2 == 0 {
+				bins[i].count = randomCount(random)
+			}
+		}
+		return bins
+	}
+	addBins := func(store Store, bins []Bin) {
+		for _, bin := range bins {
+			store.AddBin(bin)
+		}
+	}
+
+	for _, testCase := range snapshotTestCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins1, bins2, bins3 := randomBins(random.Intn(1000)), randomBins(random.Intn(1000)), randomBins(random.Intn(1000))
+				store := testCase.newStore()
+				addBins(store, bins1)
+
+				// Modifying the store does not affect the snapshot.
+				snapshot := testCase.snapshot(store)
+				addBins(store, bins2)
+				store.MergeWith(store.Copy())
+				assertEncodeBins(t, snapshot, normalize(testCase.transformBins(bins1)))
+				bins12 := append(append(append([]Bin{}, bins1...), bins2...), append(bins1, bins2...)...)
+				assertEncodeBins(t, store, normalize(testCase.transformBins(bins12)))
+
+				// Modifying the snapshot does not affect the store.
+				addBins(snapshot, bins3)
+				bins13 := append(append([]Bin{}, bins1...), bins3...)
+				assertEncodeBins(t, snapshot, normalize(testCase.transformBins(bins13)))
+				assertEncodeBins(t, store, normalize(testCase.transformBins(bins12)))
+
+				// Clearing or overwriting the store does not affect the snapshots.
+				snapshot1 := testCase.snapshot(store)
+				snapshot2 := testCase.snapshot(snapshot1)
+				for _, bin := range normalize(testCase.transformBins(bins12)) {
+					store.SubtractWithCount(bin.index, bin.count/2)
+				}
+				assert.Nil(t, store.Reweight(2))
+				store.ClearRetainingCapacity()
+				addBins(store, bins3)
+				snapshot.CopyTo(snapshot1)
+				store.Clear()
+				assertEncodeBins(t, snapshot1, normalize(testCase.transformBins(bins13)))
+				assertEncodeBins(t, snapshot2, normalize(testCase.transformBins(bins12)))
+				assertEncodeBins(t, store, nil)
+			}
+		})
+	}
+}
+
+func TestCollapsingSnapshotAddBins(t *testing.T) {
+	for _, testCase := range []struct {
+		name     string
+		newStore func() Store
+		snapshot func(Store) Store
+	}{
+		{
+			name:     "collapsing_lowest",
+			newStore: func() Store { return NewCollapsingLowestDenseStore(100000) },
+			snapshot: func(s Store) Store { return s.(*CollapsingLowestDenseStore).Snapshot() },
+		},
+		{
+			name:     "collapsing_highest",
+			newStore: func() Store { return NewCollapsingHighestDenseStore(100000) },
+			snapshot: func(s Store) Store { return s.(*CollapsingHighestDenseStore).Snapshot() },
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			store := testCase.newStore()
+			// Leave spare capacity, so that the counts are shifted in place when the
+			// range is extended.
+			store.Add(0)
+			store.Add(5000)
+			store.Clear()
+			var bins []Bin
+			for index := 0; index < 5; index++ {
+				store.Add(index)
+				bins = append(bins, Bin{index: index, count: 1})
+			}
+			snapshot := testCase.snapshot(store)
+			store.AddBins([]Bin{{index: -1000, count: 1}})
+			assertEncodeBins(t, snapshot, bins)
+			assertEncodeBins(t, store, normalize(append([]Bin{{index: -1000, count: 1}}, bins...)))
+		})
+	}
+}
+
+func TestBufferedPaginatedSnapshotSharesPages(t *testing.T) {
+	store := NewBufferedPaginatedStore()
+	store.AddWithCount(0, 2)
+	store.AddWithCount(1000, 2)
+	snapshot := store.Snapshot()
+	pagePos := func(s *BufferedPaginatedStore, index int) int { return s.pageIndex(index) - s.minPageIndex }
+	assert.Same(t, &store.pages[pagePos(store, 0)][0], &snapshot.pages[pagePos(snapshot, 0)][0])
+	assert.Same(t, &store.pages[pagePos(store, 1000)][0], &snapshot.pages[pagePos(snapshot, 1000)][0])
+
+	store.Add(1000)
+	assert.Same(t, &store.pages[pagePos(store, 0)][0], &snapshot.pages[pagePos(snapshot, 0)][0])
+	assert.NotSame(t, &store.pages[pagePos(store, 1000)][0], &snapshot.pages[pagePos(snapshot, 1000)][0])
+
+	// Reading the snapshot while the store is being modified is safe.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assertEncodeBins(t, snapshot, []Bin{{index: 0, count: 2}, {index: 1000, count: 2}})
+		}
+	}()
+	for i := 0; i < 10000; i++ {
+		store.AddWithCount(i%2000-1000, 2)
+	}
+	<-done
+}
+
+func TestBufferedPaginatedSpillPage(t *testing.T) {
+	store := NewBufferedPaginatedStore()
+	pageLen := 1 << store.pageLenLog2
+	var bins []Bin
+	for i := 0; i < pageLen; i++ {
+		store.AddWithCount(i, 2)
+		bins = append(bins, Bin{index: i, count: 2})
+	}
+	store.AddWithCount(pageLen, 0.5)
+	snapshot := store.Snapshot()
+	memorySize := store.MemorySize()
+
+	// The page is kept until its counts fit in half its memory size.
+	for i := 0; i < 3*pageLen/4; i++ {
+		assert.NotEmpty(t, store.pages[store.pageIndex(0)-store.minPageIndex])
+		store.SubtractWithCount(i, 2)
+		bins[i].count = 0
+	}
+	assert.Empty(t, store.pages[store.pageIndex(0)-store.minPageIndex])
+	assert.Len(t, store.buffer, pageLen/2)
+	assert.Less(t, store.MemorySize(), memorySize)
+	assertEncodeBins(t, store, append(normalize(bins), Bin{index: pageLen, count: 0.5}))
+	assert.Equal(t, float64(pageLen/2)+0.5, store.TotalCount())
+
+	// Pages with non-integer counts are kept.
+	store.SubtractWithCount(pageLen+1, 1)
+	assert.NotEmpty(t, store.pages[store.pageIndex(pageLen)-store.minPageIndex])
+
+	// The snapshot is unaffected.
+	assert.Equal(t, float64(2*pageLen)+0.5, snapshot.TotalCount())
+	assert.Equal(t, float64(2), snapshot.GetCountAtIndex(0))
+}
+
+func TestBufferedPaginatedDiffWith(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for i := 0; i < numTests; i++ {
 		store := NewBufferedPaginatedStore()
-		for _, v := range values {
-			store.Add(int(v))
+		other := NewSparseStore()
+		for j := 0; j < 2000; j++ {
+			index := random.Intn(1000) - 500
+			if random.Intn(4) == 0 {
+				store.AddWithCount(index, randomCount(random))
+			} else {
+				store.Add(index)
+			}
+			if random.Intn(2) == 0 {
+				other.AddWithCount(index, 2*randomCount(random))
+			} else if random.Intn(2) == 0 {
+				other.Add(index)
+			}
 		}
-		deserializedStore := NewBufferedPaginatedStore()
-		MergeWithProto(deserializedStore, store.ToProto())
+		other.Add(1000)
+		expected := store.Copy()
+		other.ForEach(func(index int, count float64) (stop bool) {
+			expected.SubtractWithCount(index, count)
+			return false
+		})
+		store.DiffWith(other)
+		var expectedBins []Bin
+		expected.ForEach(func(index int, count float64) (stop bool) {
+			expectedBins = append(expectedBins, Bin{index: index, count: count})
+			return false
+		})
+		assertEncodeBins(t, store, normalize(expectedBins))
+		assert.InDelta(t, expected.TotalCount(), store.TotalCount(), 1e-9)
+	}
 
-		// when serializing / deserializing, the "before" and "after" stores may not be exactly equal because some
-		// points may be stored in the buffer in one version, but stored in a page in the other. So to compare them to
-		// see if they are logically equivalent, check that their logical bins are equivalent, then compare other fields
-		assertStoreBinsLogicallyEquivalent(t, store, deserializedStore)
+	store := NewBufferedPaginatedStore()
+	store.Add(0)
+	store.DiffWith(store)
+	assert.True(t, store.IsEmpty())
+}
 
-		// clear fields that are allowed to differ and assert all other fields are equal
-		store.buffer = []int{}
-		deserializedStore.buffer = []int{}
-		store.pages = [][]float64{}
-		deserializedStore.pages = [][]float64{}
-		store.minPageIndex = 0
-		deserializedStore.minPageIndex = 0
+func TestBufferedPaginatedClearRetainingPages(t *testing.T) {
+	store := NewBufferedPaginatedStore()
+	store.AddWithCount(0, 2)
+	store.AddWithCount(1000, 2)
+	pagePos := func(s *BufferedPaginatedStore, index int) int { return s.pageIndex(index) - s.minPageIndex }
+	page := &store.pages[pagePos(store, 0)][0]
+	snapshot := store.Snapshot()
+	store.Add(1000)
+	memorySize := store.MemorySize()
+
+	store.ClearRetainingPages()
+	assertEncodeBins(t, store, nil)
+	assertEncodeBins(t, snapshot, []Bin{{index: 0, count: 2}, {index: 1000, count: 2}})
+	assert.Equal(t, memorySize, store.MemorySize())
+	// The page that was shared with the snapshot has been replaced.
+	assert.NotSame(t, page, &store.pages[pagePos(store, 0)][0])
+	assert.NotSame(t, &snapshot.pages[pagePos(snapshot, 1000)][0], &store.pages[pagePos(store, 1000)][0])
+
+	// Counts are added to the retained pages rather than to the buffer.
+	page = &store.pages[pagePos(store, 0)][0]
+	store.Add(0)
+	store.Add(1000)
+	assert.Empty(t, store.buffer)
+	assert.Equal(t, memorySize, store.MemorySize())
+	assertEncodeBins(t, store, []Bin{{index: 0, count: 1}, {index: 1000, count: 1}})
+
+	store.ClearRetainingPages()
+	assertEncodeBins(t, store, nil)
+	assert.Same(t, page, &store.pages[pagePos(store, 0)][0])
+	assertEncodeBins(t, snapshot, []Bin{{index: 0, count: 2}, {index: 1000, count: 2}})
+}
 
-		assert.Equal(t, store, deserializedStore)
+func TestBufferedPaginatedMergeAndClear(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	pool := NewMemoryPool(defaultPageLenLog2, 1<<20, PoolPolicyEvict)
+	newStores := map[string]func() (*BufferedPaginatedStore, *BufferedPaginatedStore){
+		"same_page_size": func() (*BufferedPaginatedStore, *BufferedPaginatedStore) {
+			return NewBufferedPaginatedStore(), NewBufferedPaginatedStore()
+		},
+		"different_page_sizes": func() (*BufferedPaginatedStore, *BufferedPaginatedStore) {
+			return NewBufferedPaginatedStore(), NewBufferedPaginatedStoreWithPageSize(2)
+		},
+		"same_pool": func() (*BufferedPaginatedStore, *BufferedPaginatedStore) {
+			return NewBufferedPaginatedStoreWithPool(pool), NewBufferedPaginatedStoreWithPool(pool)
+		},
+		"snapshot": func() (*BufferedPaginatedStore, *BufferedPaginatedStore) {
+			other := NewBufferedPaginatedStore()
+			other.Snapshot()
+			return NewBufferedPaginatedStore(), other
+		},
+	}
+	for name, newStore := range newStores {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				store, other := newStore()
+				bins := make([]Bin, 0)
+				for j := 0; j < 1000; j++ {
+					bin := Bin{index: randomIndex(random), count: randomCount(random)}
+					bins = append(bins, bin)
+					if j%2 == 0 {
+						store.AddBin(bin)
+					} else {
+						other.AddBin(bin)
+					}
+				}
+				store.MergeAndClear(other)
+				assertEncodeBins(t, store, normalize(bins))
+				assertEncodeBins(t, other, nil)
+				store.Clear()
+			}
+		})
 	}
+	assert.Zero(t, pool.UsedBytes())
+
+	// Pages that do not overlap with the ones of the store are moved.
+	store := NewBufferedPaginatedStore()
+	other := NewBufferedPaginatedStore()
+	store.AddWithCount(0, 2)
+	other.AddWithCount(1, 2)
+	other.AddWithCount(1000, 3)
+	pagePos := func(s *BufferedPaginatedStore, index int) int { return s.pageIndex(index) - s.minPageIndex }
+	storePage := &store.pages[pagePos(store, 0)][0]
+	otherPage := &other.pages[pagePos(other, 1000)][0]
+	store.MergeAndClear(other)
+	assertEncodeBins(t, store, []Bin{{index: 0, count: 2}, {index: 1, count: 2}, {index: 1000, count: 3}})
+	assert.Same(t, storePage, &store.pages[pagePos(store, 0)][0])
+	assert.Same(t, otherPage, &store.pages[pagePos(store, 1000)][0])
+	assert.True(t, other.IsEmpty())
+
+	// Merging a store with itself doubles its counts.
+	store.MergeAndClear(store)
+	assertEncodeBins(t, store, []Bin{{index: 0, count: 4}, {index: 1, count: 4}, {index: 1000, count: 6}})
 }
 
-func TestBufferedPaginatedCompactionDensity(t *testing.T) {
-	{
-		store := NewBufferedPaginatedStore()
-		for index := 0; index < 4*(1<<store.pageLenLog2); index += 2 {
-			store.Add(index)
+func TestBufferedPaginatedMergeAndClearStaleIndexRange(t *testing.T) {
+	store := NewBufferedPaginatedStore()
+	other := NewBufferedPaginatedStore()
+	for _, index := range []int{0, 1, 5000} {
+		other.AddWithCount(index, 2)
+	}
+	// Makes the index range of other stale.
+	other.SubtractWithCount(0, 2)
+	store.MergeAndClear(other)
+	assertEncodeBins(t, store, []Bin{{index: 1, count: 2}, {index: 5000, count: 2}})
+	minIndex, _ := store.MinIndex()
+	maxIndex, _ := store.MaxIndex()
+	assert.Equal(t, 1, minIndex)
+	assert.Equal(t, 5000, maxIndex)
+	assert.True(t, other.IsEmpty())
+}
+
+func TestMemoryPool(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	pool := NewMemoryPool(defaultPageLenLog2, 1<<20, PoolPolicyEvict)
+	pageBytes := 8 << defaultPageLenLog2
+
+	stores := make([]*BufferedPaginatedStore, 4)
+	storeBins := make([][]Bin, len(stores))
+	for i := range stores {
+		stores[i] = NewBufferedPaginatedStoreWithPool(pool)
+		for j := 0; j < 1000; j++ {
+			bin := Bin{index: randomIndex(random), count: randomCount(random)}
+			storeBins[i] = append(storeBins[i], bin)
+			stores[i].AddBin(bin)
 		}
-		store.compact()
-		assert.Zero(t, len(store.pages))
 	}
-	{
-		store := NewBufferedPaginatedStore()
-		for index := 0; index < 4*(1<<store.pageLenLog2); index += 2 {
-			for i := 0; i < 8; i++ {
-				store.Add(index)
+	used := pool.UsedBytes()
+	assert.Greater(t, used, 0)
+	assert.Zero(t, pool.FreeBytes())
+
+	// Copies allocate from the same pool.
+	storeCopy := stores[0].Copy()
+	assert.Greater(t, pool.UsedBytes(), used)
+	total := pool.UsedBytes()
+	storeCopy.Clear()
+	assert.Equal(t, used, pool.UsedBytes())
+	assert.Equal(t, total, pool.UsedBytes()+pool.FreeBytes())
+
+	// Pages that are freed by a store are reused by the others.
+	stores[0].Clear()
+	stores[0].CopyTo(stores[1])
+	stores[2].CopyTo(stores[0])
+	assert.Equal(t, total, pool.UsedBytes()+pool.FreeBytes())
+	assertEncodeBins(t, stores[0], normalize(storeBins[2]))
+	assertEncodeBins(t, stores[1], nil)
+	for i := 2; i < len(stores); i++ {
+		testStore(t, stores[i], normalize(storeBins[i]))
+	}
+	assert.Zero(t, pool.UsedBytes()%pageBytes)
+	assert.LessOrEqual(t, pool.UsedBytes()+pool.FreeBytes(), pool.MaxBytes())
+}
+
+func TestMemoryPoolBudget(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	pageBytes := 8 << defaultPageLenLog2
+
+	t.Run("evict", func(t *testing.T) {
+		pool := NewMemoryPool(defaultPageLenLog2, 4*pageBytes, PoolPolicyEvict)
+		store := NewBufferedPaginatedStoreWithPool(pool)
+		for i := 0; i < 1000; i++ {
+			store.AddWithCount(randomIndex(random), randomCount(random))
+		}
+		assert.Greater(t, pool.UsedBytes(), pool.MaxBytes())
+		store.Clear()
+		assert.Zero(t, pool.UsedBytes())
+		assert.Equal(t, pool.MaxBytes(), pool.FreeBytes())
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		pool := NewMemoryPool(defaultPageLenLog2, pageBytes, PoolPolicyDeny)
+		store := NewBufferedPaginatedStoreWithPool(pool)
+		bins := make([]Bin, 0)
+		for i := 0; i < 10000; i++ {
+			bin := Bin{index: randomIndex(random), count: 1}
+			bins = append(bins, bin)
+			store.AddBin(bin)
+		}
+		assert.Equal(t, pool.MaxBytes(), pool.UsedBytes())
+		assertEncodeBins(t, store, normalize(bins))
+
+		// Counts other than 1 require pages.
+		for i := 0; i < 100; i++ {
+			bin := Bin{index: randomIndex(random), count: randomCount(random)}
+			bins = append(bins, bin)
+			store.AddBin(bin)
+		}
+		assert.Greater(t, pool.UsedBytes(), pool.MaxBytes())
+		assertEncodeBins(t, store, normalize(bins))
+	})
+}
+
+func TestSyncMemoryPool(t *testing.T) {
+	pool := NewSyncMemoryPool(defaultPageLenLog2)
+	numGoroutines := 8
+	var wg sync.WaitGroup
+	for g := 0; g < numGoroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed + int64(g)))
+			store := NewBufferedPaginatedStoreWithPool(pool)
+			for i := 0; i < 10; i++ {
+				bins := make([]Bin, 0)
+				for j := 0; j < 1000; j++ {
+					bin := Bin{index: randomIndex(random), count: randomCount(random)}
+					bins = append(bins, bin)
+					store.AddBin(bin)
+				}
+				assertEncodeBins(t, store, normalize(bins))
+				store.Clear()
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Zero(t, pool.UsedBytes())
+}
+
+func TestArenaPool(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	pageBytes := 8 << defaultPageLenLog2
+	// The arena is misaligned on purpose and filled with garbage.
+	arena := make([]byte, 8*pageBytes+3)[3:]
+	for i := range arena {
+		arena[i] = 0xff
+	}
+	pool := NewArenaPool(arena, defaultPageLenLog2)
+	assert.Equal(t, 7*pageBytes, pool.ArenaBytes())
+
+	stores := make([]*BufferedPaginatedStore, 2)
+	storeBins := make([][]Bin, len(stores))
+	for i := range stores {
+		stores[i] = NewBufferedPaginatedStoreWithPool(pool)
+		for j := 0; j < 1000; j++ {
+			bin := Bin{index: randomIndex(random), count: randomCount(random)}
+			storeBins[i] = append(storeBins[i], bin)
+			stores[i].AddBin(bin)
+		}
+		assertEncodeBins(t, stores[i], normalize(storeBins[i]))
+	}
+	// Once the arena is exhausted, pages are allocated on the heap.
+	assert.Equal(t, pool.ArenaBytes(), pool.UsedBytes()-pool.HeapBytes())
+	assert.Greater(t, pool.HeapBytes(), 0)
+	numArenaPages := 0
+	for _, store := range stores {
+		for _, page := range store.pages {
+			if len(page) > 0 && pool.inArena(page) {
+				numArenaPages++
 			}
 		}
-		store.compact()
-		assert.Zero(t, len(store.buffer))
 	}
+	assert.Equal(t, 7, numArenaPages)
+
+	// Pages that live in the arena are reused, while the others are left to
+	// the garbage collector.
+	stores[0].Clear()
+	assert.Equal(t, pool.UsedBytes(), pool.HeapBytes()+pool.ArenaBytes()-len(pool.free)*pageBytes)
+	assert.Greater(t, len(pool.free), 0)
+	stores[1].CopyTo(stores[0])
+	assertEncodeBins(t, stores[0], normalize(storeBins[1]))
+	stores[0].Clear()
+	stores[1].Clear()
+	assert.Zero(t, pool.UsedBytes())
+	assert.Zero(t, pool.HeapBytes())
+	assert.Equal(t, pool.ArenaBytes(), len(pool.free)*pageBytes)
+
+	// Stores that are denied pages keep indexes in their buffer.
+	store := NewBufferedPaginatedStoreWithPool(NewArenaPool(nil, defaultPageLenLog2))
+	bins := make([]Bin, 0)
+	for i := 0; i < 1000; i++ {
+		bin := Bin{index: randomIndex(random), count: 1}
+		bins = append(bins, bin)
+		store.AddBin(bin)
+	}
+	assert.Empty(t, store.pages)
+	testStore(t, store, normalize(bins))
+
+	// Resetting the pool makes the whole arena available again.
+	for _, store := range stores {
+		for i := 0; i < 1000; i++ {
+			store.AddWithCount(randomIndex(random), randomCount(random))
+		}
+	}
+	assert.Greater(t, pool.HeapBytes(), 0)
+	pool.Reset()
+	assert.Zero(t, pool.UsedBytes())
+	assert.Zero(t, pool.HeapBytes())
+	store = NewBufferedPaginatedStoreWithPool(pool)
+	store.AddWithCount(0, 2)
+	assert.Equal(t, pageBytes, pool.UsedBytes())
+	for _, page := range store.pages {
+		if len(page) > 0 {
+			assert.Same(t, &pool.arena[0], &page[0])
+		}
+	}
+	assertEncodeBins(t, store, []Bin{{index: 0, count: 2}})
 }
 
-func TestBufferedPaginatedCompactionFew(t *testing.T) {
-	store := NewBufferedPaginatedStore()
-	store.Add(2)
-	store.Add(-7432)
-	store.Add(977)
-	store.compact()
-	assert.Zero(t, len(store.pages))
+func TestArenaPoolPersist(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	pageBytes := 8 << defaultPageLenLog2
+	arena := make([]byte, 64*pageBytes)
+	pool := NewArenaPool(arena, defaultPageLenLog2)
+
+	stores := make([]*BufferedPaginatedStore, 3)
+	storeBins := make([][]Bin, len(stores))
+	for i := range stores {
+		stores[i] = NewBufferedPaginatedStoreWithPool(pool)
+		for j := 0; j < 100; j++ {
+			bin := Bin{index: randomIndex(random) % 500, count: 1}
+			if random.Intn(2) == 0 {
+				bin.count = randomCount(random)
+			}
+			storeBins[i] = append(storeBins[i], bin)
+			stores[i].AddBin(bin)
+		}
+		assert.Nil(t, pool.Persist(uint64(i+1), stores[i]))
+		assert.Empty(t, stores[i].buffer)
+		assertEncodeBins(t, stores[i], normalize(storeBins[i]))
+	}
+	// Persisting again replaces what has been recorded.
+	stores[0].AddWithCount(1000, 3)
+	storeBins[0] = append(storeBins[0], Bin{index: 1000, count: 3})
+	assert.Nil(t, pool.Persist(1, stores[0]))
+	// Released pages are no longer persisted.
+	stores[2].Clear()
+
+	assert.NotNil(t, pool.Persist(0, stores[0]))
+	assert.NotNil(t, pool.Persist(4, NewBufferedPaginatedStore()))
+	_, err := OpenArenaPool(arena, defaultPageLenLog2+1)
+	assert.NotNil(t, err)
+	_, err = OpenArenaPool(make([]byte, 64*pageBytes), defaultPageLenLog2)
+	assert.NotNil(t, err)
+
+	// The arena is opened again, as if it had been mapped by another process.
+	reopened, err := OpenArenaPool(arena, defaultPageLenLog2)
+	assert.Nil(t, err)
+	restored := make([]*BufferedPaginatedStore, 2)
+	for i := range restored {
+		restored[i] = reopened.Restore(uint64(i + 1))
+		assertEncodeBins(t, restored[i], normalize(storeBins[i]))
+		assert.Equal(t, normalize(storeBins[i])[0].index, restored[i].KeyAtRank(0))
+	}
+	assert.True(t, reopened.Restore(3).IsEmpty())
+	assert.Equal(t, pool.UsedBytes(), reopened.UsedBytes())
+
+	// The pages that have been persisted are not handed out to other stores.
+	store := NewBufferedPaginatedStoreWithPool(reopened)
+	for i := 0; reopened.canAllocate(); i++ {
+		store.AddWithCount(i*(1<<defaultPageLenLog2), 2)
+	}
+	for i := range restored {
+		assertEncodeBins(t, restored[i], normalize(storeBins[i]))
+	}
+
+	// Persisting fails once the arena is exhausted.
+	store.AddWithCount(-1000, 2)
+	assert.Greater(t, reopened.HeapBytes(), 0)
+	assert.NotNil(t, reopened.Persist(5, store))
+
+	// Resetting the pool forgets the persisted stores.
+	reopened.Reset()
+	assert.True(t, reopened.Restore(1).IsEmpty())
 }
 
-func TestBufferedPaginatedCompactionOutliers(t *testing.T) {
-	store := NewBufferedPaginatedStore()
-	for index := 0; index < 1<<store.pageLenLog2; index += 1 {
-		for i := 0; i < 2; i++ {
-			store.Add(index)
+func TestIntegerDenseStoreFuzzy(t *testing.T) {
+	numMerges := 3
+	maxNumAdds := 1000
+
+	random := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < numTests; i++ {
+		bins := make([]Bin, 0)
+		store := NewIntegerDenseStore()
+		for j := 0; j < numMerges; j++ {
+			numValues := random.Intn(maxNumAdds)
+			tmpStore := NewIntegerDenseStore()
+			for k := 0; k < numValues; k++ {
+				bin := Bin{index: randomIndex(random), count: float64(random.Intn(5))}
+				bins = append(bins, bin)
+				tmpStore.AddBin(bin)
+			}
+			store.MergeWith(tmpStore)
 		}
+		normalizedBins := normalize(bins)
+		testStore(t, store, normalizedBins)
+		for _, bin := range normalizedBins {
+			store.SubtractWithCount(bin.index, bin.count)
+		}
+		assertEncodeBins(t, store, nil)
 	}
-	for i := 0; i < 4; i++ {
-		store.Add(6377)
+}
+
+func TestIntegerDenseStoreRounding(t *testing.T) {
+	store := NewIntegerDenseStore()
+	store.AddWithCount(1, 0.4)
+	store.AddWithCount(2, 0.6)
+	store.AddWithCount(3, 2.5)
+	store.AddWithCount(4, -1)
+	assertEncodeBins(t, store, []Bin{{index: 2, count: 1}, {index: 3, count: 3}})
+
+	fractional := NewDenseStore()
+	fractional.AddWithCount(2, 0.3)
+	fractional.AddWithCount(2, 0.3)
+	fractional.AddWithCount(5, 1.2)
+	store.MergeWith(fractional)
+	assertEncodeBins(t, store, []Bin{{index: 2, count: 2}, {index: 3, count: 3}, {index: 5, count: 1}})
+
+	store.SubtractWithCount(3, 0.4)
+	assertEncodeBins(t, store, []Bin{{index: 2, count: 2}, {index: 3, count: 3}, {index: 5, count: 1}})
+	store.SubtractWithCount(3, 1.6)
+	assertEncodeBins(t, store, []Bin{{index: 2, count: 2}, {index: 3, count: 1}, {index: 5, count: 1}})
+
+	assert.Nil(t, store.Reweight(0.4))
+	assertEncodeBins(t, store, []Bin{{index: 2, count: 1}})
+}
+
+func TestIntegerDenseStoreExactTotalCount(t *testing.T) {
+	store := NewIntegerDenseStore()
+	store.AddWithIntegerCount(0, 1<<53)
+	store.Add(0)
+	store.Add(1)
+	assert.Equal(t, uint64(1<<53+2), store.TotalIntegerCount())
+	assert.Equal(t, float64(1<<53+2), store.TotalCount())
+	store.SubtractWithCount(0, 1)
+	assert.Equal(t, uint64(1<<53+1), store.TotalIntegerCount())
+	merged := NewIntegerDenseStore()
+	merged.MergeWith(store)
+	assert.Equal(t, uint64(1<<53+1), merged.TotalIntegerCount())
+
+	store.AddWithIntegerCount(0, math.MaxUint64)
+	assert.Equal(t, uint64(math.MaxUint64), store.TotalIntegerCount())
+	bin, err := store.MaxCountBin()
+	assert.Nil(t, err)
+	assert.Equal(t, Bin{index: 0, count: math.MaxUint64}, bin)
+}
+
+func TestDenseStoreF32Fuzzy(t *testing.T) {
+	numMerges := 3
+	maxNumAdds := 1000
+
+	random := rand.New(rand.NewSource(seed))
+
+	for i := 0; i < numTests; i++ {
+		bins := make([]Bin, 0)
+		store := NewDenseStoreF32()
+		for j := 0; j < numMerges; j++ {
+			numValues := random.Intn(maxNumAdds)
+			tmpStore := NewDenseStoreF32()
+			for k := 0; k < numValues; k++ {
+				// Counts that are exactly representable as float32.
+				bin := Bin{index: randomIndex(random), count: float64(random.Intn(40)) / 4}
+				bins = append(bins, bin)
+				tmpStore.AddBin(bin)
+			}
+			store.MergeWith(tmpStore)
+		}
+		normalizedBins := normalize(bins)
+		testStore(t, store, normalizedBins)
+		for _, bin := range normalizedBins {
+			store.SubtractWithCount(bin.index, bin.count)
+		}
+		assertEncodeBins(t, store, nil)
 	}
-	assert.Equal(t, 4, len(store.buffer))
 }
 
-func TestBufferedPaginatedMergeWithProtoFuzzy(t *testing.T) {
+func TestDenseStoreF32Precision(t *testing.T) {
+	store := NewDenseStoreF32()
+	store.AddWithCount(0, 1<<24)
+	store.Add(0)
+	store.Add(1)
+	assertEncodeBins(t, store, []Bin{{index: 0, count: 1 << 24}, {index: 1, count: 1}})
+
+	store.AddWithCount(2, 0.1)
+	assert.Equal(t, float64(float32(0.1)), store.TotalCount()-(1<<24+1))
+
+	saturated := NewDenseStoreF32()
+	saturated.AddWithCount(1, 1e300)
+	saturated.AddWithCount(1, 1e300)
+	assertEncodeBins(t, saturated, []Bin{{index: 1, count: math.MaxFloat32}})
+	saturated.SubtractWithCount(1, math.Inf(1))
+	assertEncodeBins(t, saturated, []Bin{{index: 1, count: math.MaxFloat32}})
+	saturated.SubtractWithCount(1, 1e300)
+	assertEncodeBins(t, saturated, nil)
+}
+
+func TestDenseStoreF32MemorySize(t *testing.T) {
+	store, store32 := NewDenseStore(), NewDenseStoreF32()
+	for i := -500; i < 500; i++ {
+		store.Add(i)
+		store32.Add(i)
+	}
+	assert.Equal(t, len(store.bins), len(store32.bins))
+	assert.Equal(t, 4*cap(store32.bins), store32.MemorySize()-int(unsafe.Sizeof(*store32)))
+	assert.Less(t, store32.MemorySize(), store.MemorySize()*3/5)
+}
+
+func TestDenseStoreOfFuzzy(t *testing.T) {
+	newStores := map[string]func() Store{
+		"float64": func() Store { return NewDenseStoreOf[float64]() },
+		"float32": func() Store { return NewDenseStoreOf[float32]() },
+		"uint64":  func() Store { return NewDenseStoreOf[uint64]() },
+		"int32":   func() Store { return NewDenseStoreOf[int32]() },
+		"uint16":  func() Store { return NewDenseStoreOf[uint16]() },
+	}
+	random := rand.New(rand.NewSource(seed))
+	for name, newStore := range newStores {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < numTests; i++ {
+				bins := make([]Bin, 0)
+				store := newStore()
+				for j := 0; j < 3; j++ {
+					tmpStore := newStore()
+					for k := random.Intn(1000); k > 0; k-- {
+						// Counts that all count types represent exactly.
+						bin := Bin{index: randomIndex(random), count: float64(random.Intn(10) + 1)}
+						bins = append(bins, bin)
+						tmpStore.AddBin(bin)
+					}
+					store.MergeWith(tmpStore)
+				}
+				normalizedBins := normalize(bins)
+				testStore(t, store, normalizedBins)
+				for _, bin := range normalizedBins {
+					store.SubtractBin(bin)
+				}
+				assertEncodeBins(t, store, nil)
+			}
+		})
+	}
+}
+
+func TestDenseStoreOfIntegerCounts(t *testing.T) {
+	store := NewDenseStoreOf[uint64]()
+	store.AddWithCount(0, 2.4)
+	store.AddWithCount(0, 0.4)
+	store.AddWithCount(1, 0.5)
+	store.AddWithCount(2, -3)
+	assertEncodeBins(t, store, []Bin{{index: 0, count: 2}, {index: 1, count: 1}})
+	store.SubtractWithCount(0, 1.6)
+	assertEncodeBins(t, store, []Bin{{index: 1, count: 1}})
+
+	unsigned := NewDenseStoreOf[uint8]()
+	unsigned.AddWithCount(0, 200)
+	unsigned.AddWithCount(0, 200)
+	unsigned.AddWithCount(1, 1e300)
+	assertEncodeBins(t, unsigned, []Bin{{index: 0, count: math.MaxUint8}, {index: 1, count: math.MaxUint8}})
+	assert.Equal(t, float64(2*math.MaxUint8), unsigned.TotalCount())
+
+	signed := NewDenseStoreOf[int8]()
+	signed.AddWithCount(0, 100)
+	signed.AddWithCount(0, 100)
+	assertEncodeBins(t, signed, []Bin{{index: 0, count: math.MaxInt8}})
+	signed.SubtractWithCount(0, math.Inf(1))
+	assertEncodeBins(t, signed, []Bin{{index: 0, count: math.MaxInt8}})
+	signed.SubtractWithCount(0, 1e300)
+	assertEncodeBins(t, signed, nil)
+}
+
+func TestAdaptiveStoreFuzzy(t *testing.T) {
 	numMerges := 3
 	maxNumAdds := 1000
 
@@ -962,20 +3363,184 @@ func TestBufferedPaginatedMergeWithProtoFuzzy(t *testing.T) {
 
 	for i := 0; i < numTests; i++ {
 		bins := make([]Bin, 0)
-		store := NewBufferedPaginatedStore()
+		store := NewAdaptiveStore()
 		for j := 0; j < numMerges; j++ {
 			numValues := random.Intn(maxNumAdds)
-			tmpStore := NewBufferedPaginatedStore()
+			var tmpStore Store
+			switch j {
+			case 0:
+				tmpStore = NewAdaptiveStore()
+			case 1:
+				tmpStore = NewSparseStore()
+			default:
+				tmpStore = NewDenseStore()
+			}
 			for k := 0; k < numValues; k++ {
-				bin := Bin{index: randomIndex(random), count: randomCount(random)}
+				bin := Bin{index: randomIndex(random) / (i + 1), count: randomCount(random)}
 				bins = append(bins, bin)
 				tmpStore.AddBin(bin)
 			}
-			store.MergeWithProto(tmpStore.ToProto())
+			store.MergeWith(tmpStore)
 		}
 		normalizedBins := normalize(bins)
 		testStore(t, store, normalizedBins)
+		copied := NewAdaptiveStore()
+		store.CopyTo(copied)
+		assertEncodeBins(t, copied, normalizedBins)
+		assert.Equal(t, store.IsSparse(), copied.IsSparse())
+	}
+}
+
+func TestAdaptiveStoreConversion(t *testing.T) {
+	store := NewAdaptiveStore()
+	// Bins spread far apart remain sparse.
+	for i := 0; i < 100; i++ {
+		store.Add(i * 1000)
+	}
+	assert.True(t, store.IsSparse())
+
+	// Filling the gaps makes the bins dense enough.
+	for i := 0; i < 100000; i += 2 {
+		store.Add(i)
+	}
+	assert.False(t, store.IsSparse())
+	assert.IsType(t, &DenseStore{}, store.store)
+	assert.Equal(t, 50100.0, store.TotalCount())
+	assert.Equal(t, 2.0, store.GetCountAtIndex(1000))
+	assert.Equal(t, 1.0, store.GetCountAtIndex(2))
+
+	// Clearing retaining capacity keeps the dense representation.
+	store.ClearRetainingCapacity()
+	assert.False(t, store.IsSparse())
+	assertEncodeBins(t, store, nil)
+
+	// Clearing makes the store sparse again.
+	store.Add(0)
+	store.Clear()
+	assert.True(t, store.IsSparse())
+	assertEncodeBins(t, store, nil)
+
+	// The store converts to the provided representation.
+	paginated := NewAdaptiveStoreWithThreshold(BufferedPaginatedStoreConstructor, 0.5)
+	bins := make([]Bin, 0, 32)
+	for i := 0; i < 32; i++ {
+		paginated.Add(i)
+		bins = append(bins, Bin{index: i, count: 1})
+	}
+	assert.IsType(t, &BufferedPaginatedStore{}, paginated.store)
+	assertEncodeBins(t, paginated, bins)
+}
+
+func TestBoundedStore(t *testing.T) {
+	maxBytes := 4096
+	random := rand.New(rand.NewSource(seed))
+	// Collapsing stores with few bins never reach the limit.
+	boundedTestCases := []TestCase{
+		{name: "dense", newStore: func() Store { return NewDenseStore() }, transformBins: identity},
+		{name: "collapsing_lowest_1024", newStore: func() Store { return NewCollapsingLowestDenseStore(1024) }, transformBins: collapsingLowest(1024)},
+		{name: "collapsing_highest_1024", newStore: func() Store { return NewCollapsingHighestDenseStore(1024) }, transformBins: collapsingHighest(1024)},
+		{name: "sparse", newStore: func() Store { return NewSparseStore() }, transformBins: identity},
+		{name: "buffered_paginated", newStore: func() Store { return NewBufferedPaginatedStore() }, transformBins: identity},
+		{name: "unbuffered_paginated", newStore: func() Store { return NewUnbufferedPaginatedStore() }, transformBins: identity},
+	}
+	for _, testCase := range boundedTestCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			inner := testCase.newStore()
+			store := NewBoundedStore(inner, maxBytes)
+			bins := make([]Bin, 0)
+			numRejected := 0
+			for i := 0; i < 1000; i++ {
+				bin := Bin{index: randomIndex(random), count: randomCount(random)}
+				store.AddBin(bin)
+				if err := store.TakeError(); err != nil {
+					var memoryLimitErr *MemoryLimitError
+					assert.True(t, errors.As(err, &memoryLimitErr))
+					assert.Equal(t, bin.count, memoryLimitErr.RejectedCount)
+					numRejected++
+				} else {
+					bins = append(bins, bin)
+				}
+			}
+			assert.Greater(t, numRejected, 0)
+			// Rejected additions are undone in place.
+			assert.Same(t, inner, store.inner)
+			assertEncodeBins(t, store, normalize(testCase.transformBins(bins)))
+			if _, ok := store.inner.(*BufferedPaginatedStore); !ok {
+				assert.LessOrEqual(t, store.inner.MemorySize(), maxBytes)
+			}
+		})
+	}
+
+	// Merging rejects the bins that do not fit, but not the others.
+	store := NewBoundedStore(NewDenseStore(), maxBytes)
+	for i := 0; i < 100; i++ {
+		store.Add(i)
+	}
+	other := NewDenseStore()
+	other.Add(50)
+	other.AddWithCount(1<<20, 2)
+	store.MergeWith(other)
+	var memoryLimitErr *MemoryLimitError
+	assert.True(t, errors.As(store.TakeError(), &memoryLimitErr))
+	assert.Equal(t, 2.0, memoryLimitErr.RejectedCount)
+	assert.Nil(t, store.TakeError())
+	assert.Equal(t, 101.0, store.TotalCount())
+	assert.Equal(t, 2.0, store.GetCountAtIndex(50))
+}
+
+type testAccountant struct {
+	allocated int
+}
+
+func (a *testAccountant) OnAlloc(bytes int) {
+	a.allocated += bytes
+}
+
+func (a *testAccountant) OnFree(bytes int) {
+	a.allocated -= bytes
+}
+
+func TestAccountedStore(t *testing.T) {
+	random := rand.New(rand.NewSource(seed))
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			accountant := &testAccountant{}
+			store := NewAccountedStore(testCase.newStore(), accountant)
+			assert.Equal(t, store.inner.MemorySize(), accountant.allocated)
+			bins := make([]Bin, 0)
+			for i := 0; i < 1000; i++ {
+				bin := Bin{index: randomIndex(random), count: randomCount(random)}
+				bins = append(bins, bin)
+				store.AddBin(bin)
+				assert.Equal(t, store.inner.MemorySize(), accountant.allocated)
+			}
+			assertEncodeBins(t, store, normalize(testCase.transformBins(bins)))
+
+			other := NewAccountedStore(testCase.newStore(), accountant)
+			other.MergeWith(store)
+			assert.Equal(t, store.inner.MemorySize()+other.inner.MemorySize(), accountant.allocated)
+			copied := store.Copy().(*AccountedStore)
+			assert.Equal(t, store.inner.MemorySize()+other.inner.MemorySize()+copied.inner.MemorySize(), accountant.allocated)
+			copied.Release()
+			other.Release()
+
+			store.Trim(0, maxInt)
+			assert.Equal(t, store.inner.MemorySize(), accountant.allocated)
+			store.Clear()
+			assert.Equal(t, store.inner.MemorySize(), accountant.allocated)
+			store.Release()
+			assert.Zero(t, accountant.allocated)
+		})
 	}
+
+	// Bins that are shared with a snapshot are copied when modified.
+	accountant := &testAccountant{}
+	dense := NewDenseStoreWithRange(0, 1000)
+	store := NewAccountedStore(dense, accountant)
+	store.Add(0)
+	dense.Snapshot()
+	store.Add(1)
+	assert.Equal(t, dense.MemorySize(), accountant.allocated)
 }
 
 func TestDecode(t *testing.T) {
@@ -1156,6 +3721,13 @@ func size(t *testing.T, store Store) uintptr {
 			size += uintptr(cap(page)) * reflect.TypeOf(page).Elem().Size()
 		}
 		return size
+	} else if s, ok := store.(*UnbufferedPaginatedStore); ok {
+		size := reflect.TypeOf(s).Elem().Size()
+		size += uintptr(cap(s.pages)) * reflect.TypeOf(s.pages).Elem().Size()
+		for _, page := range s.pages {
+			size += uintptr(cap(page)) * reflect.TypeOf(page).Elem().Size()
+		}
+		return size
 	}
 	return 0
 }
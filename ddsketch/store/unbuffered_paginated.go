@@ -0,0 +1,536 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package store
+
+import (
+	"errors"
+	"math"
+	"unsafe"
+
+	enc "github.com/DataDog/sketches-go/ddsketch/encoding"
+	"github.com/DataDog/sketches-go/ddsketch/pb/sketchpb"
+)
+
+// UnbufferedPaginatedStore allocates storage for counts in aligned fixed-size
+// pages, themselves stored in a dynamically-sized slice, like
+// BufferedPaginatedStore does, but it always writes counts directly into pages.
+// Without the buffer and its compaction, adding an index is always done in
+// constant time (once its page has been allocated), the layout of the store
+// only depends on the indexes that have been added to it, and merging and
+// encoding stores only involve pages. In return, the store may need more
+// memory space than BufferedPaginatedStore when only few indexes are added or
+// when they are scattered, as a full page is allocated for any added index.
+// This store never collapses or merges bins, therefore, it does not introduce
+// any error in itself.
+type UnbufferedPaginatedStore struct {
+	pages        [][]float64 // len == cap, the slice is always used to its maximum capacity
+	minPageIndex int         // minPageIndex == maxInt iff pages are unused (they may still be allocated)
+	pageLenLog2  int
+	pageLenMask  int
+}
+
+func NewUnbufferedPaginatedStore() *UnbufferedPaginatedStore {
+	pageLenLog2 := defaultPageLenLog2
+	return &UnbufferedPaginatedStore{
+		pages:        nil,
+		minPageIndex: maxInt,
+		pageLenLog2:  pageLenLog2,
+		pageLenMask:  1<<pageLenLog2 - 1,
+	}
+}
+
+// pageIndex returns the page number the given index falls on.
+func (s *UnbufferedPaginatedStore) pageIndex(index int) int {
+	return index >> s.pageLenLog2
+}
+
+// lineIndex returns the line number within a page that the given index falls on.
+func (s *UnbufferedPaginatedStore) lineIndex(index int) int {
+	return index & s.pageLenMask
+}
+
+// index returns the store-level index for a given page number and a line within that page.
+func (s *UnbufferedPaginatedStore) index(pageIndex, lineIndex int) int {
+	return pageIndex<<s.pageLenLog2 + lineIndex
+}
+
+// page returns the page for the provided pageIndex, or nil. When unexisting,
+// the page is created if and only if ensureExists is true.
+func (s *UnbufferedPaginatedStore) page(pageIndex int, ensureExists bool) []float64 {
+	pageLen := 1 << s.pageLenLog2
+
+	if pageIndex >= s.minPageIndex && pageIndex < s.minPageIndex+len(s.pages) {
+		// No need to extend s.pages.
+		page := &s.pages[pageIndex-s.minPageIndex]
+		if ensureExists && len(*page) == 0 {
+			*page = append(*page, make([]float64, pageLen)...)
+		}
+		return *page
+	}
+
+	if !ensureExists {
+		return nil
+	}
+
+	if pageIndex < s.minPageIndex {
+		if s.minPageIndex == maxInt {
+			if len(s.pages) == 0 {
+				s.pages = append(s.pages, make([][]float64, s.newPagesLen(1))...)
+			}
+			s.minPageIndex = pageIndex - len(s.pages)/2
+		} else {
+			// Extends s.pages left.
+			newLen := s.newPagesLen(s.minPageIndex - pageIndex + 1 + len(s.pages))
+			addedLen := newLen - len(s.pages)
+			s.pages = append(s.pages, make([][]float64, addedLen)...)
+			copy(s.pages[addedLen:], s.pages)
+			for i := 0; i < addedLen; i++ {
+				s.pages[i] = nil
+			}
+			s.minPageIndex -= addedLen
+		}
+	} else {
+		// Extends s.pages right.
+		s.pages = append(s.pages, make([][]float64, s.newPagesLen(pageIndex-s.minPageIndex+1)-len(s.pages))...)
+	}
+
+	page := &s.pages[pageIndex-s.minPageIndex]
+	if len(*page) == 0 {
+		*page = append(*page, make([]float64, pageLen)...)
+	}
+	return *page
+}
+
+func (s *UnbufferedPaginatedStore) newPagesLen(required int) int {
+	// Grow in size by multiples of 64 bytes
+	pageGrowthIncrement := 64 * 8 / ptrSize
+	return (required + pageGrowthIncrement - 1) & -pageGrowthIncrement
+}
+
+func (s *UnbufferedPaginatedStore) Add(index int) {
+	s.page(s.pageIndex(index), true)[s.lineIndex(index)]++
+}
+
+func (s *UnbufferedPaginatedStore) AddBin(bin Bin) {
+	s.AddWithCount(bin.Index(), bin.Count())
+}
+
+// AddBins adds the provided bins to the store, extending the slice of its
+// pages at most once on each side.
+func (s *UnbufferedPaginatedStore) AddBins(bins []Bin) {
+	minIndex, maxIndex, ok := binsRange(bins)
+	if !ok {
+		return
+	}
+	s.page(s.pageIndex(minIndex), true)
+	s.page(s.pageIndex(maxIndex), true)
+	for _, bin := range bins {
+		s.AddWithCount(bin.index, bin.count)
+	}
+}
+
+func (s *UnbufferedPaginatedStore) AddWithCount(index int, count float64) {
+	if count == 0 {
+		return
+	}
+	s.page(s.pageIndex(index), true)[s.lineIndex(index)] += count
+}
+
+func (s *UnbufferedPaginatedStore) SubtractWithCount(index int, count float64) {
+	if !isSubtractableCount(count) {
+		return
+	}
+	if page := s.page(s.pageIndex(index), false); len(page) > 0 {
+		lineIndex := s.lineIndex(index)
+		page[lineIndex] = math.Max(page[lineIndex]-count, 0)
+	}
+}
+
+func (s *UnbufferedPaginatedStore) SubtractBin(bin Bin) {
+	s.SubtractWithCount(bin.index, bin.count)
+}
+
+func (s *UnbufferedPaginatedStore) IsEmpty() bool {
+	for _, page := range s.pages {
+		for _, count := range page {
+			if count > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *UnbufferedPaginatedStore) GetCountAtIndex(index int) float64 {
+	if page := s.page(s.pageIndex(index), false); len(page) > 0 {
+		return page[s.lineIndex(index)]
+	}
+	return 0
+}
+
+func (s *UnbufferedPaginatedStore) TotalCount() float64 {
+	totalCount := float64(0)
+	for _, page := range s.pages {
+		for _, count := range page {
+			totalCount += count
+		}
+	}
+	return totalCount
+}
+
+func (s *UnbufferedPaginatedStore) MinIndex() (int, error) {
+	for pageOffset, page := range s.pages {
+		for lineIndex, count := range page {
+			if count > 0 {
+				return s.index(s.minPageIndex+pageOffset, lineIndex), nil
+			}
+		}
+	}
+	return 0, errUndefinedMinIndex
+}
+
+func (s *UnbufferedPaginatedStore) MaxIndex() (int, error) {
+	for pageOffset := len(s.pages) - 1; pageOffset >= 0; pageOffset-- {
+		page := s.pages[pageOffset]
+		for lineIndex := len(page) - 1; lineIndex >= 0; lineIndex-- {
+			if page[lineIndex] > 0 {
+				return s.index(s.minPageIndex+pageOffset, lineIndex), nil
+			}
+		}
+	}
+	return 0, errUndefinedMaxIndex
+}
+
+func (s *UnbufferedPaginatedStore) MaxCountBin() (Bin, error) {
+	if s.IsEmpty() {
+		return Bin{}, errUndefinedMaxCount
+	}
+	// ForEach iterates over bins by increasing indexes, so the first bin with
+	// the highest count is kept in case of ties.
+	maxCountBin := Bin{count: math.Inf(-1)}
+	s.ForEach(func(index int, count float64) (stop bool) {
+		if count > maxCountBin.count {
+			maxCountBin = Bin{index: index, count: count}
+		}
+		return false
+	})
+	return maxCountBin, nil
+}
+
+func (s *UnbufferedPaginatedStore) MemorySize() int {
+	size := int(unsafe.Sizeof(*s))
+	size += cap(s.pages) * int(unsafe.Sizeof([]float64(nil)))
+	for _, page := range s.pages {
+		size += cap(page) * int(unsafe.Sizeof(float64(0)))
+	}
+	return size
+}
+
+// memorySizeIncrease returns the lowest increase of the memory size of the
+// store that adding a count at the provided index would lead to (see
+// memoryProjector).
+func (s *UnbufferedPaginatedStore) memorySizeIncrease(index int) (int, bool) {
+	pageIndex := s.pageIndex(index)
+	pageSize := (1 << s.pageLenLog2) * int(unsafe.Sizeof(float64(0)))
+	if pageIndex >= s.minPageIndex && pageIndex < s.minPageIndex+len(s.pages) {
+		if len(s.pages[pageIndex-s.minPageIndex]) == 0 {
+			return pageSize, true
+		}
+		return 0, true
+	}
+	if s.minPageIndex == maxInt {
+		if len(s.pages) == 0 {
+			return s.newPagesLen(1)*int(unsafe.Sizeof([]float64(nil))) + pageSize, true
+		}
+		// The pages are recentered on pageIndex, and the page may have been
+		// retained.
+		if len(s.pages[len(s.pages)/2]) == 0 {
+			return pageSize, true
+		}
+		return 0, true
+	}
+	newPagesLen := s.newPagesLen(max(s.minPageIndex+len(s.pages), pageIndex+1) - min(s.minPageIndex, pageIndex))
+	return max(0, newPagesLen-cap(s.pages))*int(unsafe.Sizeof([]float64(nil))) + pageSize, true
+}
+
+func (s *UnbufferedPaginatedStore) KeyAtRank(rank float64) int {
+	if rank < 0 {
+		rank = 0
+	}
+	cumulCount := float64(0)
+	for pageOffset, page := range s.pages {
+		for lineIndex, count := range page {
+			cumulCount += count
+			if cumulCount > rank {
+				return s.index(s.minPageIndex+pageOffset, lineIndex)
+			}
+		}
+	}
+	maxIndex, err := s.MaxIndex()
+	if err == nil {
+		return maxIndex
+	} else {
+		// FIXME: make Store's KeyAtRank consistent with MinIndex and MaxIndex
+		return 0
+	}
+}
+
+func (s *UnbufferedPaginatedStore) MergeWith(other Store) {
+	o, ok := other.(*UnbufferedPaginatedStore)
+	if ok && s.pageLenLog2 == o.pageLenLog2 {
+		// Merging a store with itself does not extend its pages.
+		for oPageOffset, oPage := range o.pages {
+			if len(oPage) == 0 {
+				continue
+			}
+			page := s.page(o.minPageIndex+oPageOffset, true)
+			for i, oCount := range oPage {
+				page[i] += oCount
+			}
+		}
+	} else {
+		// Fallback merging.
+		other.ForEach(func(index int, count float64) (stop bool) {
+			s.AddWithCount(index, count)
+			return false
+		})
+	}
+}
+
+func (s *UnbufferedPaginatedStore) Bins() <-chan Bin {
+	ch := make(chan Bin)
+	go func() {
+		defer close(ch)
+		s.ForEach(func(index int, count float64) (stop bool) {
+			ch <- Bin{index: index, count: count}
+			return false
+		})
+	}()
+	return ch
+}
+
+func (s *UnbufferedPaginatedStore) ForEach(f func(index int, count float64) (stop bool)) {
+	for pageOffset, page := range s.pages {
+		for lineIndex, count := range page {
+			if count == 0 {
+				continue
+			}
+			if f(s.index(s.minPageIndex+pageOffset, lineIndex), count) {
+				return
+			}
+		}
+	}
+}
+
+func (s *UnbufferedPaginatedStore) ForEachInRange(minIndex, maxIndex int, f func(index int, count float64) (stop bool)) {
+	if minIndex > maxIndex || s.minPageIndex == maxInt {
+		return
+	}
+	// Only go through the pages that overlap the range.
+	fromPageOffset := max(s.pageIndex(minIndex), s.minPageIndex) - s.minPageIndex
+	toPageOffset := min(s.pageIndex(maxIndex), s.minPageIndex+len(s.pages)-1) - s.minPageIndex
+	for pageOffset := fromPageOffset; pageOffset <= toPageOffset; pageOffset++ {
+		for lineIndex, count := range s.pages[pageOffset] {
+			index := s.index(s.minPageIndex+pageOffset, lineIndex)
+			if count == 0 || index < minIndex || index > maxIndex {
+				continue
+			}
+			if f(index, count) {
+				return
+			}
+		}
+	}
+}
+
+func (s *UnbufferedPaginatedStore) Copy() Store {
+	pagesCopy := make([][]float64, len(s.pages))
+	for i, page := range s.pages {
+		if len(page) > 0 {
+			pageCopy := make([]float64, len(page))
+			copy(pageCopy, page)
+			pagesCopy[i] = pageCopy
+		}
+	}
+	return &UnbufferedPaginatedStore{
+		pages:        pagesCopy,
+		minPageIndex: s.minPageIndex,
+		pageLenLog2:  s.pageLenLog2,
+		pageLenMask:  s.pageLenMask,
+	}
+}
+
+func (s *UnbufferedPaginatedStore) newEmpty() Store {
+	empty := NewUnbufferedPaginatedStore()
+	empty.pageLenLog2 = s.pageLenLog2
+	empty.pageLenMask = s.pageLenMask
+	return empty
+}
+
+func (s *UnbufferedPaginatedStore) Downsample(factorLog2 int) Store {
+	return downsample(s, factorLog2, NewUnbufferedPaginatedStore())
+}
+
+// Trim removes the bins whose indexes are lower than minIndex or greater than
+// maxIndex. The remaining bins are moved to newly allocated memory, so that
+// the memory that the removed bins used is released.
+func (s *UnbufferedPaginatedStore) Trim(minIndex, maxIndex int) {
+	trimmed := NewUnbufferedPaginatedStore()
+	addBinsInRange(s, minIndex, maxIndex, trimmed)
+	*s = *trimmed
+}
+
+// CopyTo overwrites the content of dst with the content of the store (see
+// Store.CopyTo). If dst is an UnbufferedPaginatedStore, its pages are reused.
+func (s *UnbufferedPaginatedStore) CopyTo(dst Store) {
+	d, ok := dst.(*UnbufferedPaginatedStore)
+	if !ok {
+		copyTo(s, dst)
+		return
+	}
+	if s == d {
+		return
+	}
+	if len(d.pages) < len(s.pages) {
+		d.pages = append(d.pages, make([][]float64, len(s.pages)-len(d.pages))...)
+	}
+	// Move the allocated pages of dst to where the pages of the store are, as
+	// their positions may differ.
+	spare := 0
+	for i, page := range s.pages {
+		if len(page) == 0 || cap(d.pages[i]) > 0 {
+			continue
+		}
+		for spare < len(d.pages) && (cap(d.pages[spare]) == 0 || spare < len(s.pages) && len(s.pages[spare]) > 0) {
+			spare++
+		}
+		if spare == len(d.pages) {
+			break
+		}
+		d.pages[i], d.pages[spare] = d.pages[spare], d.pages[i]
+	}
+	for i := range d.pages {
+		if i < len(s.pages) {
+			d.pages[i] = append(d.pages[i][:0], s.pages[i]...)
+		} else {
+			// Extra pages are kept allocated to the right of the copied ones.
+			d.pages[i] = d.pages[i][:0]
+		}
+	}
+	d.minPageIndex = s.minPageIndex
+	d.pageLenLog2 = s.pageLenLog2
+	d.pageLenMask = s.pageLenMask
+}
+
+func (s *UnbufferedPaginatedStore) Clear() {
+	for i := range s.pages {
+		s.pages[i] = s.pages[i][:0]
+	}
+	s.minPageIndex = maxInt
+}
+
+// ClearRetainingCapacity empties the store while keeping its pages allocated
+// and in place, so that adding indexes within the same range again does not
+// require reallocating them.
+func (s *UnbufferedPaginatedStore) ClearRetainingCapacity() {
+	for _, page := range s.pages {
+		for i := range page {
+			page[i] = 0
+		}
+	}
+}
+
+func (s *UnbufferedPaginatedStore) ToProto() *sketchpb.Store {
+	if s.IsEmpty() {
+		return &sketchpb.Store{}
+	}
+	binCounts := make(map[int32]float64)
+	s.ForEach(func(index int, count float64) (stop bool) {
+		binCounts[int32(index)] = count
+		return false
+	})
+	return &sketchpb.Store{
+		BinCounts: binCounts,
+	}
+}
+
+func (s *UnbufferedPaginatedStore) ToColumns() ([]int32, []float64) {
+	return toColumns(s)
+}
+
+func (s *UnbufferedPaginatedStore) Stats() Stats {
+	st := stats(s)
+	for _, page := range s.pages {
+		if len(page) > 0 {
+			st.NumPages++
+		}
+	}
+	return st
+}
+
+func (s *UnbufferedPaginatedStore) Reweight(w float64) error {
+	if w <= 0 {
+		return errors.New("can't reweight by a negative factor")
+	}
+	if w == 1 {
+		return nil
+	}
+	for _, page := range s.pages {
+		for i := range page {
+			page[i] *= w
+		}
+	}
+	return nil
+}
+
+func (s *UnbufferedPaginatedStore) Encode(b *[]byte, t enc.FlagType) {
+	for pageOffset, page := range s.pages {
+		if len(page) > 0 {
+			enc.EncodeFlag(b, enc.NewFlag(t, enc.BinEncodingContiguousCounts))
+			enc.EncodeUvarint64(b, uint64(len(page)))
+			enc.EncodeVarint64(b, int64(s.index(s.minPageIndex+pageOffset, 0)))
+			enc.EncodeVarint64(b, 1)
+			for _, count := range page {
+				enc.EncodeVarfloat64(b, count)
+			}
+		}
+	}
+}
+
+func (s *UnbufferedPaginatedStore) DecodeAndMergeWith(b *[]byte, encodingMode enc.SubFlag) error {
+	if encodingMode != enc.BinEncodingContiguousCounts {
+		return DecodeAndMergeWith(s, b, encodingMode)
+	}
+	numBins, err := enc.DecodeUvarint64(b)
+	if err != nil {
+		return err
+	}
+	indexOffset, err := enc.DecodeVarint64(b)
+	if err != nil {
+		return err
+	}
+	indexDelta, err := enc.DecodeVarint64(b)
+	if err != nil {
+		return err
+	}
+	pageLen := 1 << s.pageLenLog2
+	for i := uint64(0); i < numBins; {
+		page := s.page(s.pageIndex(int(indexOffset)), true)
+		lineIndex := s.lineIndex(int(indexOffset))
+		for lineIndex >= 0 && lineIndex < pageLen && i < numBins {
+			count, err := enc.DecodeVarfloat64(b)
+			if err != nil {
+				return err
+			}
+			page[lineIndex] += count
+			lineIndex += int(indexDelta)
+			indexOffset += indexDelta
+			i++
+		}
+	}
+	return nil
+}
+
+var _ Store = (*UnbufferedPaginatedStore)(nil)
@@ -0,0 +1,87 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package ddsketch
+
+import (
+	"sort"
+)
+
+// Centroid is a centroid of a t-digest: Weight values whose mean is Mean.
+type Centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+// NewDDSketchFromCentroids returns a sketch with the provided relative accuracy
+// that approximates the distribution of a t-digest given its centroids (see
+// AddCentroids).
+func NewDDSketchFromCentroids(relativeAccuracy float64, centroids []Centroid) (*DDSketch, error) {
+	sketch, err := NewDefaultDDSketch(relativeAccuracy)
+	if err != nil {
+		return nil, err
+	}
+	if err := sketch.AddCentroids(centroids); err != nil {
+		return nil, err
+	}
+	return sketch, nil
+}
+
+// AddCentroids adds the centroids of a t-digest to the sketch, the weight of
+// each centroid being added at its mean. The total weight of the t-digest is
+// preserved, but the values within a centroid are assumed to be equal to its
+// mean, which is how t-digests themselves approximate the values of their
+// centroids. The relative accuracy guarantee of the sketch therefore only
+// holds with respect to the centroids and not to the original values.
+// If any of the centroids cannot be tracked or has a negative weight, none of
+// the centroids are added to the sketch and a non-nil error is returned.
+func (s *DDSketch) AddCentroids(centroids []Centroid) error {
+	means, weights := centroidMeansAndWeights(centroids)
+	return s.AddWithCounts(means, weights)
+}
+
+// AddCentroids adds the centroids of a t-digest to the sketch (see
+// DDSketch.AddCentroids). The exact summary statistics are updated as if the
+// values of each centroid were equal to its mean.
+func (s *DDSketchWithExactSummaryStatistics) AddCentroids(centroids []Centroid) error {
+	means, weights := centroidMeansAndWeights(centroids)
+	return s.AddWithCounts(means, weights)
+}
+
+func centroidMeansAndWeights(centroids []Centroid) ([]float64, []float64) {
+	means := make([]float64, len(centroids))
+	weights := make([]float64, len(centroids))
+	for i, centroid := range centroids {
+		means[i] = centroid.Mean
+		weights[i] = centroid.Weight
+	}
+	return means, weights
+}
+
+// ToCentroids returns one centroid per non-empty bin of the sketch, sorted by
+// increasing mean, so that the sketch can be fed to a t-digest. The mean of
+// each centroid is the midpoint of the range of values that its bin covers,
+// and its weight is the count of the bin. Values that fall in the zero bin are
+// emitted as a centroid whose mean is 0.
+func (s *DDSketch) ToCentroids() []Centroid {
+	centroids := make([]Centroid, 0)
+	if s.zeroCount > 0 {
+		centroids = append(centroids, Centroid{Mean: 0, Weight: s.zeroCount})
+	}
+	s.positiveValueStore.ForEach(func(index int, count float64) (stop bool) {
+		centroids = append(centroids, Centroid{Mean: s.binMidpoint(index), Weight: count})
+		return false
+	})
+	s.negativeValueStore.ForEach(func(index int, count float64) (stop bool) {
+		centroids = append(centroids, Centroid{Mean: -s.binMidpoint(index), Weight: count})
+		return false
+	})
+	sort.Slice(centroids, func(i, j int) bool { return centroids[i].Mean < centroids[j].Mean })
+	return centroids
+}
+
+func (s *DDSketch) binMidpoint(index int) float64 {
+	return (s.LowerBound(index) + s.UpperBound(index)) / 2
+}
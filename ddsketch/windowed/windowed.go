@@ -0,0 +1,159 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package windowed
+
+import (
+	"errors"
+	"time"
+
+	"github.com/DataDog/sketches-go/ddsketch"
+)
+
+var (
+	ErrTooOld = errors.New("time is older than the oldest tracked interval")
+)
+
+// Provider returns a new empty sketch. All the sketches it returns must use the
+// same index mapping.
+type Provider func() *ddsketch.DDSketch
+
+// Sketch tracks values over a sliding time window. It maintains a ring of
+// sketches, one per time interval, for a fixed number of consecutive
+// intervals. Values are added to the sketch of the interval they fall in, and
+// sketches of intervals that are older than the window are recycled as time
+// advances.
+// Sketch is not thread-safe.
+type Sketch struct {
+	interval        time.Duration
+	sketches        []*ddsketch.DDSketch
+	sketchProvider  Provider
+	currentInterval int64 // the number of the most recent interval, valid iff started is true
+	started         bool
+}
+
+// NewSketch returns a Sketch that tracks values over numIntervals consecutive
+// intervals of the provided duration. Interval sketches are built using
+// sketchProvider.
+func NewSketch(interval time.Duration, numIntervals int, sketchProvider Provider) (*Sketch, error) {
+	if interval <= 0 {
+		return nil, errors.New("the interval must be positive")
+	}
+	if numIntervals <= 0 {
+		return nil, errors.New("the number of intervals must be positive")
+	}
+	sketches := make([]*ddsketch.DDSketch, numIntervals)
+	for i := range sketches {
+		sketches[i] = sketchProvider()
+	}
+	return &Sketch{
+		interval:       interval,
+		sketches:       sketches,
+		sketchProvider: sketchProvider,
+	}, nil
+}
+
+// Add adds a value that has been observed at time t.
+func (s *Sketch) Add(value float64, t time.Time) error {
+	return s.AddWithCount(value, 1, t)
+}
+
+// AddWithCount adds a value with a float64 count that has been observed at
+// time t. If t is more recent than the most recent interval, the window is
+// advanced so that its most recent interval contains t. Return ErrTooOld if t
+// is older than the oldest interval of the window.
+func (s *Sketch) AddWithCount(value, count float64, t time.Time) error {
+	intervalNumber := s.intervalNumber(t)
+	s.advance(intervalNumber)
+	if intervalNumber <= s.currentInterval-int64(len(s.sketches)) {
+		return ErrTooOld
+	}
+	return s.sketches[s.slot(intervalNumber)].AddWithCount(value, count)
+}
+
+// Advance moves the window forward so that its most recent interval contains
+// t, and clears the intervals that fall out of the window. It has no effect if
+// t is not more recent than the most recent interval.
+func (s *Sketch) Advance(t time.Time) {
+	s.advance(s.intervalNumber(t))
+}
+
+// Query returns a newly created sketch that encodes the values of the
+// numIntervals most recent intervals, including the current one. If
+// numIntervals is greater than the number of intervals of the window, all the
+// intervals are merged.
+func (s *Sketch) Query(numIntervals int) (*ddsketch.DDSketch, error) {
+	if numIntervals <= 0 {
+		return nil, errors.New("the number of intervals must be positive")
+	}
+	if numIntervals > len(s.sketches) {
+		numIntervals = len(s.sketches)
+	}
+	merged := s.sketchProvider()
+	if !s.started {
+		return merged, nil
+	}
+	for i := 0; i < numIntervals; i++ {
+		if err := merged.MergeWith(s.sketches[s.slot(s.currentInterval-int64(i))]); err != nil {
+			return nil, err
+		}
+	}
+	return merged, nil
+}
+
+// Interval returns the duration of each interval of the window.
+func (s *Sketch) Interval() time.Duration {
+	return s.interval
+}
+
+// NumIntervals returns the number of intervals of the window.
+func (s *Sketch) NumIntervals() int {
+	return len(s.sketches)
+}
+
+// Clear empties all the intervals of the window.
+func (s *Sketch) Clear() {
+	for _, sketch := range s.sketches {
+		sketch.Clear()
+	}
+	s.started = false
+}
+
+func (s *Sketch) intervalNumber(t time.Time) int64 {
+	nanos := t.UnixNano()
+	intervalNanos := s.interval.Nanoseconds()
+	intervalNumber := nanos / intervalNanos
+	if nanos%intervalNanos < 0 {
+		intervalNumber--
+	}
+	return intervalNumber
+}
+
+func (s *Sketch) slot(intervalNumber int64) int {
+	slot := int(intervalNumber % int64(len(s.sketches)))
+	if slot < 0 {
+		slot += len(s.sketches)
+	}
+	return slot
+}
+
+func (s *Sketch) advance(intervalNumber int64) {
+	if !s.started {
+		s.currentInterval = intervalNumber
+		s.started = true
+		return
+	}
+	if intervalNumber <= s.currentInterval {
+		return
+	}
+	numExpired := intervalNumber - s.currentInterval
+	if numExpired > int64(len(s.sketches)) {
+		numExpired = int64(len(s.sketches))
+	}
+	for i := int64(1); i <= numExpired; i++ {
+		s.sketches[s.slot(s.currentInterval+i)].Clear()
+	}
+	s.currentInterval = intervalNumber
+}
@@ -0,0 +1,82 @@
+// Unless explicitly stated otherwise all files in this repository are licensed
+// under the Apache License 2.0.
+// This product includes software developed at Datadog (https://www.datadoghq.com/).
+// Copyright 2021 Datadog, Inc.
+
+package windowed
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DataDog/sketches-go/ddsketch"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSketchProvider() Provider {
+	return func() *ddsketch.DDSketch {
+		sketch, _ := ddsketch.LogUnboundedDenseDDSketch(0.01)
+		return sketch
+	}
+}
+
+func TestNewSketchErrors(t *testing.T) {
+	_, err := NewSketch(0, 10, newSketchProvider())
+	assert.Error(t, err)
+	_, err = NewSketch(time.Minute, 0, newSketchProvider())
+	assert.Error(t, err)
+}
+
+func TestQuery(t *testing.T) {
+	sketch, err := NewSketch(time.Minute, 5, newSketchProvider())
+	assert.NoError(t, err)
+
+	empty, err := sketch.Query(5)
+	assert.NoError(t, err)
+	assert.True(t, empty.IsEmpty())
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		// i+1 values in the i-th interval.
+		for j := 0; j <= i; j++ {
+			assert.NoError(t, sketch.Add(float64(i+1), start.Add(time.Duration(i)*time.Minute+time.Second)))
+		}
+	}
+	for numIntervals, expectedCount := range map[int]float64{1: 5, 2: 9, 5: 15, 10: 15} {
+		merged, err := sketch.Query(numIntervals)
+		assert.NoError(t, err)
+		assert.Equal(t, expectedCount, merged.GetCount())
+	}
+	_, err = sketch.Query(0)
+	assert.Error(t, err)
+
+	// Values that fall before the window cannot be added.
+	assert.Equal(t, ErrTooOld, sketch.Add(1, start.Add(-time.Second)))
+	assert.NoError(t, sketch.Add(1, start))
+
+	// Advancing the window expires the oldest intervals.
+	sketch.Advance(start.Add(6 * time.Minute))
+	merged, _ := sketch.Query(5)
+	assert.Equal(t, float64(3+4+5), merged.GetCount())
+	merged, _ = sketch.Query(1)
+	assert.True(t, merged.IsEmpty())
+
+	assert.NoError(t, sketch.AddWithCount(1, 2, start.Add(100*time.Minute)))
+	merged, _ = sketch.Query(5)
+	assert.Equal(t, float64(2), merged.GetCount())
+
+	sketch.Clear()
+	merged, _ = sketch.Query(5)
+	assert.True(t, merged.IsEmpty())
+}
+
+func TestNegativeTimes(t *testing.T) {
+	sketch, _ := NewSketch(time.Minute, 3, newSketchProvider())
+	start := time.Unix(-3600, 0)
+	assert.NoError(t, sketch.Add(1, start.Add(-time.Second)))
+	assert.NoError(t, sketch.Add(1, start))
+	merged, _ := sketch.Query(1)
+	assert.Equal(t, float64(1), merged.GetCount())
+	merged, _ = sketch.Query(2)
+	assert.Equal(t, float64(2), merged.GetCount())
+}